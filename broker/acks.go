@@ -0,0 +1,136 @@
+package broker
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// AckModeSync acknowledges a delivery with the 2xx response, it is the default
+	AckModeSync = "sync"
+	// AckModeAsync lets the subscriber answer 202 Accepted and ack or nack later
+	AckModeAsync = "async"
+
+	// DefaultAckDeadlineSeconds is used for async subscriptions without a deadline
+	DefaultAckDeadlineSeconds = 60
+)
+
+// inflightDelivery is an accepted async delivery waiting for its ack.
+type inflightDelivery[T any] struct {
+	pending  pendingDelivery[T]
+	deadline time.Time
+	// consumer is set for stream subscriptions, it counts the deliveries in flight
+	consumer *consumer[T]
+}
+
+// ackDeadline returns how long an async subscriber has to ack a delivery.
+func (s Subscription) ackDeadline() time.Duration {
+	if s.AckDeadlineSeconds <= 0 {
+		return DefaultAckDeadlineSeconds * time.Second
+	}
+	return time.Duration(s.AckDeadlineSeconds) * time.Second
+}
+
+// setAckHeaders tells async subscribers where to ack or nack the delivery and until when.
+func (vq *VortexQ[T]) setAckHeaders(header http.Header, sub Subscription, token string) {
+	if token == "" {
+		return
+	}
+	base := strings.TrimSuffix(vq.PublicURL, "/")
+	header.Set("X-VortexQ-Ack-URL", base+"/acks/"+token)
+	header.Set("X-VortexQ-Nack-URL", base+"/nacks/"+token)
+	header.Set("X-VortexQ-Ack-Deadline", strconv.Itoa(int(sub.ackDeadline()/time.Second)))
+}
+
+// awaitAck keeps the accepted delivery until it is acked, nacked or its deadline passes.
+func (vq *VortexQ[T]) awaitAck(p pendingDelivery[T], now time.Time) {
+	d := &inflightDelivery[T]{pending: p, deadline: now.Add(p.sub.ackDeadline())}
+	if c, ok := vq.consumer(p.sub.ID); ok {
+		d.consumer = c
+		c.inFlight.Add(1)
+	}
+	vq.inflight.Store(p.ackToken, d)
+}
+
+// settle stops waiting for the ack of a delivery, it reports false when the
+// delivery was settled already.
+func (vq *VortexQ[T]) settle(token string) (*inflightDelivery[T], bool) {
+	value, ok := vq.inflight.LoadAndDelete(token)
+	if !ok {
+		return nil, false
+	}
+	d := value.(*inflightDelivery[T])
+	if d.consumer != nil {
+		d.consumer.inFlight.Add(-1)
+	}
+	return d, true
+}
+
+// Ack confirms that an async subscriber processed the delivery.
+func (vq *VortexQ[T]) Ack(token string) error {
+	const op = "broker.VortexQ.Ack"
+	d, ok := vq.settle(token)
+	if !ok {
+		return fmt.Errorf("%s: delivery %q: %w", op, token, ErrNotFound)
+	}
+	p := d.pending
+	if p.sub.streamed() {
+		// the consumer has room for another delivery
+		vq.signalWake()
+	}
+	vq.recordReceipt(p.msg, DeliveryReceipt{
+		MessageID:      p.msg.ID,
+		SubscriptionID: p.sub.ID,
+		Status:         ReceiptDelivered,
+		StatusCode:     http.StatusAccepted,
+		Attempts:       p.attempt,
+		Timestamp:      time.Now().UTC(),
+	}, true)
+	return nil
+}
+
+// Nack tells that an async subscriber failed to process the delivery, it is retried
+// like a failed delivery.
+func (vq *VortexQ[T]) Nack(token string) error {
+	const op = "broker.VortexQ.Nack"
+	d, ok := vq.settle(token)
+	if !ok {
+		return fmt.Errorf("%s: delivery %q: %w", op, token, ErrNotFound)
+	}
+	vq.abandonAck(d.pending, "subscriber nacked the delivery")
+	return nil
+}
+
+// expireAcks redelivers the async deliveries whose ack deadline passed.
+func (vq *VortexQ[T]) expireAcks(now time.Time) {
+	const op = "broker.VortexQ.expireAcks"
+	vq.inflight.Range(func(key, value any) bool {
+		d := value.(*inflightDelivery[T])
+		if now.Before(d.deadline) {
+			return true
+		}
+		if _, ok := vq.settle(key.(string)); ok {
+			vq.Logger.With(slog.String("op", op)).Warn("ack deadline exceeded", slog.String("subscription", d.pending.sub.ID),
+				slog.String("message", d.pending.msg.ID), slog.Int("attempt", d.pending.attempt))
+			vq.abandonAck(d.pending, "ack deadline exceeded")
+		}
+		return true
+	})
+}
+
+func (vq *VortexQ[T]) abandonAck(p pendingDelivery[T], reason string) {
+	receipt := DeliveryReceipt{
+		MessageID:      p.msg.ID,
+		SubscriptionID: p.sub.ID,
+		Status:         ReceiptFailed,
+		StatusCode:     http.StatusAccepted,
+		Attempts:       p.attempt,
+		Error:          reason,
+		Timestamp:      time.Now().UTC(),
+	}
+	vq.retryLater(p, receipt, 0)
+}
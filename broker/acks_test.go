@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test async subscriptions are settled by ack, nack or the ack deadline
+func TestAsyncAcks(t *testing.T) {
+	tokens := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ackURL := r.Header.Get("X-VortexQ-Ack-URL")
+		if !strings.HasPrefix(ackURL, "https://vq.example.com/acks/") || r.Header.Get("X-VortexQ-Ack-Deadline") != "30" {
+			t.Errorf("unexpected ack headers: %v", r.Header)
+		}
+		tokens <- strings.TrimPrefix(ackURL, "https://vq.example.com/acks/")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	v := NewVortexQ[string]()
+	v.PublicURL = "https://vq.example.com/"
+	v.Retry.BaseDelay = time.Millisecond
+	if err := v.Subscribe(Subscription{ID: "s1", SubscriberAddress: server.URL, TopicName: "t",
+		AckMode: AckModeAsync, AckDeadlineSeconds: 30}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	next := func() string {
+		t.Helper()
+		for i := 0; i < 100; i++ {
+			_ = v.Swirl()
+			select {
+			case token := <-tokens:
+				return token
+			default:
+				time.Sleep(5 * time.Millisecond)
+			}
+		}
+		t.Fatal("no delivery")
+		return ""
+	}
+
+	v.Publish(Message[string]{ID: "m1", Pattern: "t"})
+	first := next()
+
+	// nack redelivers with a new token, the old one is settled
+	if err := v.Nack(first); err != nil {
+		t.Fatalf("Nack error: %v", err)
+	}
+	second := next()
+	if second == first {
+		t.Error("redelivery reused the ack token")
+	}
+	if err := v.Ack(first); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Ack of a nacked token error = %v; want ErrNotFound", err)
+	}
+
+	// the deadline passing redelivers as well
+	v.expireAcks(time.Now().Add(31 * time.Second))
+	third := next()
+	if err := v.Ack(second); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Ack of an expired token error = %v; want ErrNotFound", err)
+	}
+
+	if err := v.Ack(third); err != nil {
+		t.Fatalf("Ack error: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	_ = v.Swirl()
+	select {
+	case token := <-tokens:
+		t.Errorf("acked message delivered again with token %s", token)
+	default:
+	}
+
+	var attempts []int
+	for _, r := range v.SubscriptionDeliveries("s1") {
+		attempts = append(attempts, r.Attempt)
+	}
+	if len(attempts) != 3 || attempts[2] != 3 {
+		t.Errorf("delivery attempts = %v; want [1 2 3]", attempts)
+	}
+}
+
+// Test Subscribe validates the ack mode and defaults the deadline
+func TestSubscribeAckMode(t *testing.T) {
+	v := NewVortexQ[string]()
+	if err := v.Subscribe(Subscription{ID: "s1", SubscriberAddress: "http://localhost", TopicName: "t", AckMode: "later"}); !errors.Is(err, ErrInvalidSubscription) {
+		t.Errorf("unknown ack mode error = %v; want ErrInvalidSubscription", err)
+	}
+	// without a public URL the subscriber has nowhere to ack
+	if err := v.Subscribe(Subscription{ID: "s2", SubscriberAddress: "http://localhost", TopicName: "t", AckMode: AckModeAsync}); !errors.Is(err, ErrInvalidSubscription) {
+		t.Errorf("async ack mode without public URL error = %v; want ErrInvalidSubscription", err)
+	}
+	v.PublicURL = "https://vq.example.com"
+	if err := v.Subscribe(Subscription{ID: "s2", SubscriberAddress: "http://localhost", TopicName: "t", AckMode: AckModeAsync}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	if sub, _ := v.FindSubscription("s2"); sub.AckDeadlineSeconds != DefaultAckDeadlineSeconds {
+		t.Errorf("AckDeadlineSeconds = %d; want %d", sub.AckDeadlineSeconds, DefaultAckDeadlineSeconds)
+	}
+}
@@ -2,11 +2,16 @@ package broker
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ivanbulyk/vortexq/internal/logging"
+	"github.com/ivanbulyk/vortexq/internal/urlpolicy"
+	"io"
 	"log/slog"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,6 +20,33 @@ type VortexQ[T any] struct {
 	Subscriptions sync.Map     `json:"subscriptions"`
 	Topics        sync.Map     `json:"topics"`
 	Logger        *slog.Logger `json:"-"`
+	// URLPolicy restricts subscriber addresses, nil allows any address
+	URLPolicy *urlpolicy.Policy `json:"-"`
+	// Deliveries records every webhook delivery attempt
+	Deliveries *DeliveryLog `json:"-"`
+	// Retry decides how failed deliveries are retried
+	Retry RetryPolicy `json:"-"`
+	// Retention bounds the messages topics keep for replay
+	Retention Retention `json:"-"`
+	// PublicURL is the base URL subscribers reach the API on, used in ack links
+	PublicURL string `json:"-"`
+
+	// cursors holds the next offset of every subscription
+	cursors sync.Map
+	// waiters holds the reply channels of pending requests by correlation ID
+	waiters sync.Map
+	// receipts holds the trackers of messages published with PublishAndWait
+	receipts sync.Map
+	// inflight holds the async deliveries waiting for an ack by token
+	inflight sync.Map
+	// consumers holds the attached stream consumers by subscription ID
+	consumers sync.Map
+	subsMu    sync.Mutex
+	retryMu   sync.Mutex
+	retries   []pendingDelivery[T]
+
+	// wake holds one signal at most, see Wake
+	wake chan struct{}
 }
 
 func NewVortexQ[T any]() *VortexQ[T] {
@@ -22,14 +54,39 @@ func NewVortexQ[T any]() *VortexQ[T] {
 		Subscriptions: sync.Map{},
 		Topics:        sync.Map{},
 		Logger:        slog.Default(),
+		Deliveries:    NewDeliveryLog(DefaultDeliveryLogMaxRecords, DefaultDeliveryLogRetention),
+		Retry:         DefaultRetryPolicy(),
+		Retention:     DefaultRetention(),
+		wake:          make(chan struct{}, 1),
 	}
 }
 
+// ErrInvalidSubscription is returned when a subscription request can't be accepted.
+var ErrInvalidSubscription = errors.New("invalid subscription")
+
+// ErrSubscriptionExists is returned when a subscription ID is taken already.
+var ErrSubscriptionExists = errors.New("subscription already exists")
+
 type VortexQFuncs interface {
-	Publish(message Message[any])
+	Publish(message Message[any]) (int64, error)
+	ValidateMessage(message Message[any]) error
 	Subscribe(subscription Subscription) error
+	Seek(subscriptionID string, position StartPosition) error
+	ReadTopic(topic string, offset int64, limit int) ([]Message[any], int64, error)
+	ListTopics() []TopicInfo
+	TopicOffset(topic string, position StartPosition) (int64, error)
+	Request(ctx context.Context, message Message[any]) (Message[any], error)
+	PublishAndWait(ctx context.Context, message Message[any], quorum int) (int64, []DeliveryReceipt, error)
+	Ack(token string) error
+	Nack(token string) error
+	Consume(ctx context.Context, subscription Subscription, opts ConsumeOptions) (<-chan Delivery[any], error)
+	Unsubscribe(subscriptionID string) error
 	sendWebhook(message Message[any], subscriberAddress string) error
 	Swirl() error
+	SubscriptionDeliveries(subscriptionID string) []DeliveryRecord
+	MessageDeliveries(messageID string) []DeliveryRecord
+	FindSubscription(id string) (Subscription, bool)
+	ListSubscriptions() []Subscription
 }
 
 type WebhookRequest[T any] struct {
@@ -42,59 +99,309 @@ type Message[T any] struct {
 	ID      string `json:"id"`
 	Pattern string `json:"pattern"`
 	Data    T      `json:"data"`
+	// Source, Type and Time map onto the CloudEvents attributes of the same name
+	Source      string            `json:"source,omitempty"`
+	Type        string            `json:"type,omitempty"`
+	Time        time.Time         `json:"time,omitzero"`
+	ContentType string            `json:"content_type,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	// Offset is the position in the topic, assigned on publish
+	Offset int64 `json:"offset"`
+	// CorrelationID links a reply to the message it answers, by its correlation ID or else its ID
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// ReplyTo is the topic a reply is expected on
+	ReplyTo string `json:"reply_to,omitempty"`
+	// ReceiptURL receives a DeliveryReceipt for every subscription once its outcome is final
+	ReceiptURL string `json:"receipt_url,omitempty"`
 }
 
 type Subscription struct {
 	ID                string `json:"id"`
 	SubscriberAddress string `json:"subscriber_address"`
 	TopicName         string `json:"topic_name"`
+	// Format selects the delivery payload, see FormatLegacy, FormatRaw and the CloudEvents formats
+	Format string `json:"format,omitempty"`
+	// Template rewrites method, headers and body of the delivery, it takes precedence over Format
+	Template *DeliveryTemplate `json:"template,omitempty"`
+	// Start is where a new subscription begins reading, the latest message by default
+	Start *StartPosition `json:"start,omitempty"`
+	// ReplyTopic receives the subscriber response of every successful delivery
+	ReplyTopic string `json:"reply_topic,omitempty"`
+	// AckMode async lets the subscriber answer 202 Accepted and ack within AckDeadlineSeconds
+	AckMode            string `json:"ack_mode,omitempty"`
+	AckDeadlineSeconds int    `json:"ack_deadline_seconds,omitempty"`
+	// Protocol names the stream a consumer reads the subscription from, empty for webhooks
+	Protocol string `json:"protocol,omitempty"`
+	// State is managed by the broker, a subscription is created active
+	State       string `json:"state,omitempty"`
+	StateReason string `json:"state_reason,omitempty"`
 }
 
 func (vq *VortexQ[T]) Swirl() error {
 	const op = "broker.VortexQ.Swirl"
 	var wg sync.WaitGroup
 
+	send := func(p pendingDelivery[T]) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			vq.Logger.With(slog.String("op", op)).
+				Info("sending message", logging.Attr("message", p.msg),
+					"to subscriber", logging.Attr("subscriber", p.sub.SubscriberAddress),
+					slog.Int("attempt", p.attempt))
+			vq.attempt(p)
+		}()
+	}
+
+	vq.expireAcks(time.Now())
+	for _, p := range vq.dueRetries(time.Now()) {
+		// the subscription may have been disabled while the retry was waiting
+		sub, ok := vq.FindSubscription(p.sub.ID)
+		if !ok || !sub.Active() {
+			continue
+		}
+		if _, attached := vq.consumer(sub.ID); sub.streamed() && !attached {
+			// keep it for the next consumer of the stream
+			vq.scheduleRetry(p)
+			continue
+		}
+		p.sub = sub
+		send(p)
+	}
+
 	vq.Subscriptions.Range(func(key, value interface{}) bool {
-		topicKey := key
+		topicKey := key.(string)
 		subs := value.([]Subscription)
 
-		topicVal, ok := vq.Topics.Load(topicKey)
-		if !ok {
+		// a pattern reads every matching topic
+		topics := vq.topicsMatching(topicKey)
+		if len(topics) == 0 {
 			vq.Logger.With(slog.String("op", op)).
 				Info("topic can't be found", logging.Attr("topic", topicKey))
 			return true
 		}
+		for _, tl := range topics {
+			tl.mu.Lock()
+			tl.trim(time.Now(), vq.Retention)
+			tl.mu.Unlock()
+		}
 
-		messages := topicVal.([]Message[T])
-
-		for _, msg := range messages {
-			msgCopy := msg // capture by value
-			for _, sub := range subs {
-				subCopy := sub // capture by value
+		for _, sub := range subs {
+			if !sub.Active() {
+				continue
+			}
+			limit := 0
+			if sub.streamed() {
+				// streams wait for a consumer and respect its flow control
+				c, ok := vq.consumer(sub.ID)
+				if !ok || c.credit() <= 0 {
+					continue
+				}
+				limit = c.credit()
+			}
+			for name, tl := range topics {
+				// messages stay retained, each subscription moves its own cursor
+				cursor := vq.cursor(name, sub)
+				messages, next := tl.from(cursor, limit)
+				vq.advanceCursor(name, sub, cursor, next)
+				if !sub.streamed() {
+					for _, msg := range messages {
+						send(pendingDelivery[T]{msg: msg, sub: sub, attempt: 1})
+					}
+					continue
+				}
+				// a consumer receives the messages of a topic in order
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					vq.Logger.With(slog.String("op", op)).
-						Info("sending message", logging.Attr("message", msgCopy),
-							"to subscriber", logging.Attr("subscriber", subCopy.SubscriberAddress))
-					err := vq.sendWebhook(msgCopy, subCopy.SubscriberAddress)
-					if err != nil {
-						vq.Logger.With(slog.String("op", op)).Error("error sending webhook to",
-							subCopy.SubscriberAddress, logging.Err(err))
+					for _, msg := range messages {
+						vq.attempt(pendingDelivery[T]{msg: msg, sub: sub, attempt: 1})
 					}
 				}()
+				if limit -= len(messages); limit <= 0 {
+					break
+				}
 			}
 		}
-		// clear messages so we don't redeliver next time
-		vq.Topics.Store(topicKey, []Message[T]{})
 		return true
 	})
 	wg.Wait()
+	vq.dropConsumedInboxes()
 	return nil
 }
 
+// attempt delivers once and decides what happens to a failed delivery.
+func (vq *VortexQ[T]) attempt(p pendingDelivery[T]) {
+	const op = "broker.VortexQ.attempt"
+	log := vq.Logger.With(slog.String("op", op))
+
+	if p.sub.AckMode == AckModeAsync {
+		p.ackToken = NewID()
+		// registered up front, the subscriber may ack before it responded
+		vq.awaitAck(p, time.Now())
+	}
+	resp, err := vq.deliver(p)
+	if p.ackToken != "" {
+		if err == nil && resp.StatusCode == http.StatusAccepted {
+			return
+		}
+		if _, ok := vq.settle(p.ackToken); !ok {
+			// acked or nacked while the request was running
+			return
+		}
+	}
+	if errors.Is(err, errConsumerBusy) {
+		// not an attempt, the consumer takes it once it read the deliveries it has
+		p.ackToken = ""
+		vq.scheduleRetry(p)
+		return
+	}
+	receipt := DeliveryReceipt{
+		MessageID:      p.msg.ID,
+		SubscriptionID: p.sub.ID,
+		Status:         ReceiptDelivered,
+		StatusCode:     resp.StatusCode,
+		Attempts:       p.attempt,
+		Timestamp:      time.Now().UTC(),
+	}
+	if err == nil {
+		// async subscribers publish their reply with the correlation ID themselves
+		if p.ackToken == "" && !p.sub.streamed() {
+			vq.publishReplies(p.msg, p.sub, resp)
+		}
+		vq.recordReceipt(p.msg, receipt, true)
+		return
+	}
+	log.Error("error sending webhook to", p.sub.SubscriberAddress, logging.Err(err))
+	receipt.Status, receipt.Error = ReceiptFailed, err.Error()
+
+	switch {
+	case resp.StatusCode == http.StatusGone:
+		vq.setSubscriptionState(p.sub.ID, SubscriptionDisabled, "subscriber responded 410 Gone")
+		log.Warn("subscription disabled", slog.String("subscription", p.sub.ID))
+	case vq.Retry.PermanentFailureCodes[resp.StatusCode]:
+		log.Warn("permanent delivery failure, not retrying", slog.String("subscription", p.sub.ID),
+			slog.String("message", p.msg.ID), slog.Int("status", resp.StatusCode))
+	default:
+		vq.retryLater(p, receipt, resp.RetryAfter)
+		return
+	}
+	vq.recordReceipt(p.msg, receipt, true)
+}
+
+// retryLater schedules the next attempt of a failed delivery, after the backoff
+// unless delay is given, or gives up when the attempts are exhausted.
+func (vq *VortexQ[T]) retryLater(p pendingDelivery[T], receipt DeliveryReceipt, delay time.Duration) {
+	const op = "broker.VortexQ.retryLater"
+	if p.attempt >= vq.Retry.MaxAttempts {
+		vq.Logger.With(slog.String("op", op)).Warn("delivery attempts exhausted", slog.String("subscription", p.sub.ID),
+			slog.String("message", p.msg.ID), slog.Int("attempts", p.attempt))
+		vq.recordReceipt(p.msg, receipt, true)
+		return
+	}
+	if delay == 0 {
+		delay = vq.Retry.backoff(p.attempt + 1)
+	}
+	p.attempt++
+	p.ackToken = ""
+	p.notBefore = time.Now().Add(delay)
+	vq.scheduleRetry(p)
+
+	receipt.Status = ReceiptPending
+	vq.recordReceipt(p.msg, receipt, false)
+}
+
+func (vq *VortexQ[T]) scheduleRetry(p pendingDelivery[T]) {
+	vq.retryMu.Lock()
+	defer vq.retryMu.Unlock()
+	vq.retries = append(vq.retries, p)
+}
+
+// dueRetries removes and returns the retries whose time has come.
+func (vq *VortexQ[T]) dueRetries(now time.Time) []pendingDelivery[T] {
+	vq.retryMu.Lock()
+	defer vq.retryMu.Unlock()
+
+	var due []pendingDelivery[T]
+	waiting := vq.retries[:0]
+	for _, p := range vq.retries {
+		if now.Before(p.notBefore) {
+			waiting = append(waiting, p)
+		} else {
+			due = append(due, p)
+		}
+	}
+	vq.retries = waiting
+	return due
+}
+
+// Subscribe adds the subscription to its topic, an empty ID gets a generated one.
 func (vq *VortexQ[T]) Subscribe(subscription Subscription) error {
 	const op = "broker.VortexQ.Subscribe"
+	if !subscription.streamed() {
+		if err := vq.URLPolicy.Validate(context.Background(), subscription.SubscriberAddress); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	switch subscription.Format {
+	case "", FormatLegacy, FormatCloudEventsStructured, FormatCloudEventsBinary, FormatRaw:
+	default:
+		return fmt.Errorf("%s: %w: unknown format %q", op, ErrInvalidSubscription, subscription.Format)
+	}
+	if subscription.Template != nil {
+		if err := subscription.Template.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	if subscription.ReplyTopic != "" && subscription.ReplyTopic == subscription.TopicName {
+		return fmt.Errorf("%s: %w: reply topic must differ from the subscribed topic", op, ErrInvalidSubscription)
+	}
+	switch subscription.AckMode {
+	case "", AckModeSync:
+	case AckModeAsync:
+		// webhook subscribers are sent links to ack on, stream consumers ack on their stream
+		if vq.PublicURL == "" && !subscription.streamed() {
+			return fmt.Errorf("%s: %w: async acks need the public URL of the API", op, ErrInvalidSubscription)
+		}
+		if subscription.AckDeadlineSeconds <= 0 {
+			subscription.AckDeadlineSeconds = DefaultAckDeadlineSeconds
+		}
+	default:
+		return fmt.Errorf("%s: %w: unknown ack mode %q", op, ErrInvalidSubscription, subscription.AckMode)
+	}
+	if IsTopicPattern(subscription.TopicName) {
+		if err := ValidateTopicPattern(subscription.TopicName); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	start := StartPosition{From: StartLatest}
+	if subscription.Start != nil {
+		if err := subscription.Start.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		start = *subscription.Start
+	}
+	if subscription.ID == "" {
+		subscription.ID = NewID()
+	}
+	subscription.State = SubscriptionActive
+	subscription.StateReason = ""
+
+	vq.subsMu.Lock()
+	defer vq.subsMu.Unlock()
+
+	// cursors, receipts and deliveries are keyed by the ID
+	if _, ok := vq.FindSubscription(subscription.ID); ok {
+		return fmt.Errorf("%s: subscription %q: %w", op, subscription.ID, ErrSubscriptionExists)
+	}
+	if !IsTopicPattern(subscription.TopicName) {
+		vq.topic(subscription.TopicName)
+	}
+	// topics a pattern matches later start at their first message
+	for name, tl := range vq.topicsMatching(subscription.TopicName) {
+		vq.setCursor(name, subscription, tl.resolve(start))
+	}
+
 	// if the topic exists, add the subscription to the topic
 	if topicName, ok := vq.Subscriptions.Load(subscription.TopicName); !ok {
 		subs := make([]Subscription, 0)
@@ -110,48 +417,182 @@ func (vq *VortexQ[T]) Subscribe(subscription Subscription) error {
 	return nil
 }
 
-func (vq *VortexQ[T]) Publish(msg Message[T]) {
+// ValidateMessage checks the message can be published, the topic must be a
+// name and the URL policy must allow its receipt URL.
+func (vq *VortexQ[T]) ValidateMessage(msg Message[T]) error {
+	if err := ValidateTopicName(msg.Pattern); err != nil {
+		return err
+	}
+	if msg.ReceiptURL != "" {
+		return vq.URLPolicy.Validate(context.Background(), msg.ReceiptURL)
+	}
+	return nil
+}
+
+// Publish appends the message to its topic and returns the assigned offset,
+// the message must pass ValidateMessage. A reply to an inbox nobody
+// subscribed to is only handed to the request waiting for it and gets no offset.
+func (vq *VortexQ[T]) Publish(msg Message[T]) (int64, error) {
 	const op = "broker.VortexQ.Publish"
-	if topicRaw, ok := vq.Topics.Load(msg.Pattern); ok {
-		msgs := topicRaw.([]Message[T])
-		msgs = append(msgs, msg)
-		vq.Topics.Store(msg.Pattern, msgs)
+	if err := vq.ValidateMessage(msg); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	if isInbox(msg.Pattern) && len(vq.subscriptionsFor(msg.Pattern)) == 0 {
+		vq.completeRequest(msg)
+		return 0, nil
+	}
+	for {
+		tl, created := vq.topic(msg.Pattern)
+		if created {
+			vq.Logger.With(slog.String("op", op)).
+				Info("new topic created", logging.Attr("topic", msg.Pattern))
+		}
+		// an inbox may be dropped meanwhile, it is created again
+		if offset, ok := tl.append(msg, time.Now(), vq.Retention); ok {
+			vq.completeRequest(msg)
+			vq.wakeConsumers(msg.Pattern)
+			return offset, nil
+		}
+	}
+}
+
+// SubscriptionDeliveries returns the recorded delivery attempts of a subscription.
+func (vq *VortexQ[T]) SubscriptionDeliveries(subscriptionID string) []DeliveryRecord {
+	return vq.Deliveries.BySubscription(subscriptionID)
+}
+
+// MessageDeliveries returns the recorded delivery attempts of a message.
+func (vq *VortexQ[T]) MessageDeliveries(messageID string) []DeliveryRecord {
+	return vq.Deliveries.ByMessage(messageID)
+}
+
+// deliver sends the message to the subscriber and records the attempt.
+func (vq *VortexQ[T]) deliver(p pendingDelivery[T]) (webhookResponse, error) {
+	msg, sub := p.msg, p.sub
+	start := time.Now()
+	var resp webhookResponse
+	var err error
+	if sub.streamed() {
+		resp, err = vq.push(p)
 	} else {
-		newTopic := []Message[T]{msg}
-		vq.Topics.Store(msg.Pattern, newTopic)
-		vq.Logger.With(slog.String("op", op)).
-			Info("new topic created", logging.Attr("topic", msg.Pattern))
+		resp, err = vq.postWebhook(msg, sub, p.ackToken)
+	}
+
+	record := DeliveryRecord{
+		MessageID:         msg.ID,
+		SubscriptionID:    sub.ID,
+		TopicName:         sub.TopicName,
+		SubscriberAddress: sub.SubscriberAddress,
+		Attempt:           p.attempt,
+		StatusCode:        resp.StatusCode,
+		LatencyMs:         time.Since(start).Milliseconds(),
+		ResponseBody:      string(resp.Body[:min(len(resp.Body), maxRecordedResponseBody)]),
+		Timestamp:         start.UTC(),
 	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	vq.Deliveries.Record(record)
 
+	return resp, err
 }
 
 func (vq *VortexQ[T]) sendWebhook(msg Message[T], SubscriberAddr string) error {
-	const op = "broker.VortexQ.SendWebhook"
-	// create a Webhook payload
-	wreq := WebhookRequest[T]{
-		EventType: msg.Pattern,
-		EventData: msg,
-		Timestamp: time.Now().UTC(),
+	_, err := vq.postWebhook(msg, Subscription{SubscriberAddress: SubscriberAddr}, "")
+	return err
+}
+
+// newWebhookRequest renders the message in the format chosen by the subscription.
+// A non-empty ackToken adds the ack headers of an async subscription.
+func (vq *VortexQ[T]) newWebhookRequest(msg Message[T], sub Subscription, ackToken string) (*http.Request, error) {
+	if sub.Template != nil {
+		rendered, err := RenderTemplate(*sub.Template, msg)
+		if err != nil {
+			return nil, fmt.Errorf("error rendering webhook template: %w", err)
+		}
+		req, err := http.NewRequest(rendered.Method, sub.SubscriberAddress, strings.NewReader(rendered.Body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to prepare the webhook request: %w", err)
+		}
+		for name, value := range rendered.Headers {
+			req.Header.Set(name, value)
+		}
+		setReplyHeaders(req.Header, msg)
+		vq.setAckHeaders(req.Header, sub, ackToken)
+		return req, nil
 	}
 
-	// Marshal the WebhookRequest to JSON
-	jsonBytes, err := json.Marshal(wreq)
+	var body []byte
+	header := make(http.Header)
+	var err error
+
+	switch sub.Format {
+	case FormatRaw:
+		header, body, err = msg.rawPayload()
+	case FormatCloudEventsStructured:
+		body, err = msg.structuredCloudEvent()
+		header.Set("Content-Type", CloudEventsContentType+"; charset=utf-8")
+	case FormatCloudEventsBinary:
+		header, body, err = msg.binaryCloudEvent()
+	default:
+		// create a Webhook payload
+		wreq := WebhookRequest[T]{
+			EventType: msg.Pattern,
+			EventData: msg,
+			Timestamp: time.Now().UTC(),
+		}
+		// Marshal the WebhookRequest to JSON
+		body, err = json.Marshal(wreq)
+		header.Set("Content-Type", "application/json")
+	}
 	if err != nil {
-		return fmt.Errorf("error creating webhook payload: %w", err)
+		return nil, fmt.Errorf("error creating webhook payload: %w", err)
 	}
 
 	// Prepare the webhook request
-	req, err := http.NewRequest("POST", SubscriberAddr, bytes.NewBuffer(jsonBytes))
+	req, err := http.NewRequest("POST", sub.SubscriberAddress, bytes.NewBuffer(body))
 	if err != nil {
-		return fmt.Errorf("failed to prepare the webhook request: %w", err)
+		return nil, fmt.Errorf("failed to prepare the webhook request: %w", err)
+	}
+	req.Header = header
+	setReplyHeaders(req.Header, msg)
+	vq.setAckHeaders(req.Header, sub, ackToken)
+	return req, nil
+}
+
+// setReplyHeaders tells subscribers where and how to reply to a request.
+func setReplyHeaders[T any](header http.Header, msg Message[T]) {
+	if msg.ReplyTo != "" {
+		header.Set("X-VortexQ-Reply-To", msg.ReplyTo)
+	}
+	if msg.CorrelationID != "" {
+		header.Set("X-VortexQ-Correlation-ID", msg.CorrelationID)
+	}
+}
+
+// webhookResponse is what is kept of a subscriber response.
+type webhookResponse struct {
+	StatusCode  int
+	ContentType string
+	Body        []byte
+	RetryAfter  time.Duration
+	// CorrelationID is echoed by subscribers answering a request without a body
+	CorrelationID string
+}
+
+func (vq *VortexQ[T]) postWebhook(msg Message[T], sub Subscription, ackToken string) (webhookResponse, error) {
+	const op = "broker.VortexQ.SendWebhook"
+
+	req, err := vq.newWebhookRequest(msg, sub, ackToken)
+	if err != nil {
+		return webhookResponse{}, err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
 	// Send the webhook to the callback URL
-	client := http.Client{Timeout: 5 * time.Second}
+	client := http.Client{Timeout: 5 * time.Second, Transport: vq.URLPolicy.Transport()}
 	resp, err := client.Do(req)
 	if err != nil {
-		return fmt.Errorf("error sending webhook to %s: %w", SubscriberAddr, err)
+		return webhookResponse{}, fmt.Errorf("error sending webhook to %s: %w", sub.SubscriberAddress, err)
 	}
 	defer func() {
 		if err := resp.Body.Close(); err != nil {
@@ -159,12 +600,24 @@ func (vq *VortexQ[T]) sendWebhook(msg Message[T], SubscriberAddr string) error {
 		}
 	}()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("webhook delivery failed: status %s", resp.Status)
+	// keep the head of the body for the delivery log, or all of it for the reply topic
+	limit := int64(maxRecordedResponseBody)
+	if sub.ReplyTopic != "" || msg.ReplyTo != "" {
+		limit = maxReplyBody
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, limit))
+	result := webhookResponse{StatusCode: resp.StatusCode, ContentType: resp.Header.Get("Content-Type"), Body: body,
+		CorrelationID: resp.Header.Get("X-VortexQ-Correlation-ID")}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			result.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		}
+		return result, fmt.Errorf("webhook delivery failed: status %s", resp.Status)
 	}
 
 	vq.Logger.With(slog.String("op", op)).
-		Info("webhook delivered to", logging.Attr("subscriber address", SubscriberAddr),
+		Info("webhook delivered to", logging.Attr("subscriber address", sub.SubscriberAddress),
 			logging.Attr("with status", resp.Status))
-	return nil
+	return result, nil
 }
@@ -3,6 +3,7 @@ package broker
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -18,30 +19,29 @@ func TestPublishTopics(t *testing.T) {
 	msg := Message[string]{ID: "1", Pattern: "topic1", Data: "hello"}
 
 	// Publish first message
-	v.Publish(msg)
-	val, ok := v.Topics.Load("topic1")
-	if !ok {
-		t.Fatalf("expected topic1 in Topics map")
+	if offset, err := v.Publish(msg); err != nil || offset != 0 {
+		t.Errorf("first offset = %d, %v; want 0", offset, err)
 	}
-	msgs, ok := val.([]Message[string])
-	if !ok {
-		t.Fatalf("invalid type for messages: %T", val)
+	if _, ok := v.Topics.Load("topic1"); !ok {
+		t.Fatalf("expected topic1 in Topics map")
 	}
+	msgs := v.Messages("topic1")
 	if got, want := len(msgs), 1; got != want {
 		t.Fatalf("got %d messages, want %d", got, want)
 	}
 
 	// Publish second message to same topic
 	msg2 := Message[string]{ID: "2", Pattern: "topic1", Data: "world"}
-	v.Publish(msg2)
-	val2, ok := v.Topics.Load("topic1")
-	if !ok {
-		t.Fatalf("expected topic1 in Topics map after second publish")
+	if offset, err := v.Publish(msg2); err != nil || offset != 1 {
+		t.Errorf("second offset = %d, %v; want 1", offset, err)
 	}
-	msgs2 := val2.([]Message[string])
+	msgs2 := v.Messages("topic1")
 	if got, want := len(msgs2), 2; got != want {
 		t.Fatalf("got %d messages, want %d", got, want)
 	}
+	if msgs2[1].ID != "2" || msgs2[1].Offset != 1 {
+		t.Errorf("second message = %+v; want ID 2 at offset 1", msgs2[1])
+	}
 }
 
 // Test Subscribe and Subscriptions map behavior
@@ -163,7 +163,7 @@ func TestSwirlDelivery(t *testing.T) {
 
 	// Publish messages
 	msg1 := Message[string]{ID: "1", Pattern: "topic", Data: "a"}
-	msg2 := Message[string]{ID: "2", Pattern: "topic", Data: "b"}
+	msg2 := Message[string]{ID: "2", Pattern: "topic", Data: "b", Offset: 1}
 	v.Publish(msg1)
 	v.Publish(msg2)
 
@@ -190,18 +190,230 @@ func TestSwirlDelivery(t *testing.T) {
 	for _, w := range want {
 		if gm, ok := gotMap[w.ID]; !ok {
 			t.Errorf("missing message with ID %q", w.ID)
-		} else if gm != w {
+		} else if !reflect.DeepEqual(gm, w) {
 			t.Errorf("message mismatch for ID %q: got %v, want %v", w.ID, gm, w)
 		}
 	}
 
-	// Topics should be cleared
-	val, ok := v.Topics.Load("topic")
-	if !ok {
-		t.Fatalf("expected topic key after Swirl")
+	// Messages are retained, but a second Swirl must not redeliver them
+	if retained := v.Messages("topic"); len(retained) != 2 {
+		t.Fatalf("expected 2 retained messages, got %v", retained)
+	}
+	if err := v.Swirl(); err != nil {
+		t.Fatalf("Swirl error: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(received) != 2 {
+		t.Fatalf("received %d messages after second Swirl, want 2", len(received))
+	}
+}
+
+// Test Swirl records every delivery attempt in the delivery log
+func TestSwirlRecordsDeliveries(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 2*maxRecordedResponseBody))
+	}))
+	defer server.Close()
+
+	v := NewVortexQ[string]()
+	sub := Subscription{ID: "sub", SubscriberAddress: server.URL, TopicName: "topic"}
+	if err := v.Subscribe(sub); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	v.Publish(Message[string]{ID: "m1", Pattern: "topic", Data: "a"})
+	if err := v.Swirl(); err != nil {
+		t.Fatalf("Swirl error: %v", err)
+	}
+
+	records := v.MessageDeliveries("m1")
+	if len(records) != 1 {
+		t.Fatalf("got %d records, want 1", len(records))
+	}
+	r := records[0]
+	if r.SubscriptionID != "sub" || r.Attempt != 1 || r.StatusCode != http.StatusInternalServerError {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if r.Error == "" {
+		t.Error("expected recorded error")
+	}
+	if len(r.ResponseBody) != maxRecordedResponseBody {
+		t.Errorf("response body length = %d; want %d", len(r.ResponseBody), maxRecordedResponseBody)
+	}
+	if got := v.SubscriptionDeliveries("sub"); !reflect.DeepEqual(got, records) {
+		t.Errorf("SubscriptionDeliveries = %v; want %v", got, records)
+	}
+}
+
+// Test DeliveryLog evicts by count and by age
+func TestDeliveryLogRetention(t *testing.T) {
+	l := NewDeliveryLog(2, time.Hour)
+	now := time.Now()
+	l.Record(DeliveryRecord{MessageID: "old", Timestamp: now.Add(-2 * time.Hour)})
+	l.Record(DeliveryRecord{MessageID: "a", Timestamp: now})
+	if got := l.ByMessage("old"); len(got) != 0 {
+		t.Errorf("expired record kept: %v", got)
+	}
+	l.Record(DeliveryRecord{MessageID: "b", Timestamp: now})
+	l.Record(DeliveryRecord{MessageID: "c", Timestamp: now})
+	if got := l.ByMessage("a"); len(got) != 0 {
+		t.Errorf("record beyond max count kept: %v", got)
+	}
+	if got := l.ByMessage("c"); len(got) != 1 {
+		t.Errorf("got %d records for c, want 1", len(got))
+	}
+}
+
+// Test delivery outcomes per response code: 2xx, 410, permanent failures and retries
+func TestSwirlResponseCodes(t *testing.T) {
+	var mu sync.Mutex
+	hits := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		n := hits[r.URL.Path]
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		case "/bad":
+			w.WriteHeader(http.StatusBadRequest)
+		case "/busy":
+			if n == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer server.Close()
+
+	v := NewVortexQ[string]()
+	v.Retry.BaseDelay = time.Millisecond
+	for _, path := range []string{"/created", "/gone", "/bad", "/busy"} {
+		sub := Subscription{ID: path, SubscriberAddress: server.URL + path, TopicName: "topic"}
+		if err := v.Subscribe(sub); err != nil {
+			t.Fatalf("subscribe error: %v", err)
+		}
+	}
+
+	v.Publish(Message[string]{ID: "1", Pattern: "topic", Data: "a"})
+	if err := v.Swirl(); err != nil {
+		t.Fatalf("Swirl error: %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	v.Publish(Message[string]{ID: "2", Pattern: "topic", Data: "b"})
+	if err := v.Swirl(); err != nil {
+		t.Fatalf("Swirl error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := map[string]int{"/created": 2, "/gone": 1, "/bad": 2, "/busy": 3}
+	if !reflect.DeepEqual(hits, want) {
+		t.Errorf("hits = %v; want %v", hits, want)
+	}
+	if sub, _ := v.FindSubscription("/gone"); sub.State != SubscriptionDisabled {
+		t.Errorf("410 subscription state = %q; want %q", sub.State, SubscriptionDisabled)
+	}
+	if sub, _ := v.FindSubscription("/bad"); sub.State != SubscriptionActive {
+		t.Errorf("400 subscription state = %q; want %q", sub.State, SubscriptionActive)
+	}
+	retried := v.MessageDeliveries("1")
+	var busyAttempts []int
+	for _, r := range retried {
+		if r.SubscriptionID == "/busy" {
+			busyAttempts = append(busyAttempts, r.Attempt)
+		}
+	}
+	if !reflect.DeepEqual(busyAttempts, []int{1, 2}) {
+		t.Errorf("busy attempts for message 1 = %v; want [1 2]", busyAttempts)
+	}
+}
+
+// Test Retry-After parsing and the exponential backoff
+func TestRetryTiming(t *testing.T) {
+	now := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	if got := parseRetryAfter("120", now); got != 2*time.Minute {
+		t.Errorf("parseRetryAfter(seconds) = %v; want 2m", got)
+	}
+	if got := parseRetryAfter(now.Add(time.Hour).Format(http.TimeFormat), now); got != time.Hour {
+		t.Errorf("parseRetryAfter(date) = %v; want 1h", got)
+	}
+	if got := parseRetryAfter("soon", now); got != 0 {
+		t.Errorf("parseRetryAfter(garbage) = %v; want 0", got)
+	}
+
+	p := RetryPolicy{BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for attempt, want := range map[int]time.Duration{2: time.Second, 3: 2 * time.Second, 4: 4 * time.Second, 10: 5 * time.Second} {
+		if got := p.backoff(attempt); got != want {
+			t.Errorf("backoff(%d) = %v; want %v", attempt, got, want)
+		}
+	}
+}
+
+// Test successful responses are published to the reply topic, correlated to the original message
+func TestReplyTopic(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"result":42}`))
+	}))
+	defer server.Close()
+
+	v := NewVortexQ[any]()
+	sub := Subscription{ID: "worker", SubscriberAddress: server.URL, TopicName: "jobs", ReplyTopic: "results"}
+	if err := v.Subscribe(sub); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	v.Publish(Message[any]{ID: "job-1", Pattern: "jobs", Data: "work"})
+	if err := v.Swirl(); err != nil {
+		t.Fatalf("Swirl error: %v", err)
+	}
+
+	replies := v.Messages("results")
+	if len(replies) != 1 {
+		t.Fatalf("got %d replies, want 1", len(replies))
+	}
+	reply := replies[0]
+	if reply.CorrelationID != "job-1" || reply.ID == "" || reply.ID == "job-1" {
+		t.Errorf("reply IDs = %q correlated to %q", reply.ID, reply.CorrelationID)
+	}
+	if reply.Headers["status_code"] != "201" || reply.ContentType != "application/json" {
+		t.Errorf("reply metadata = %v, %q", reply.Headers, reply.ContentType)
+	}
+	if !reflect.DeepEqual(reply.Data, map[string]any{"result": float64(42)}) {
+		t.Errorf("reply data = %v", reply.Data)
+	}
+
+	sub.ReplyTopic = sub.TopicName
+	if err := v.Subscribe(sub); !errors.Is(err, ErrInvalidSubscription) {
+		t.Errorf("reply topic looping back error = %v; want ErrInvalidSubscription", err)
+	}
+}
+
+// Test subscriptions without an ID get one and IDs can't be taken twice
+func TestSubscribeIDs(t *testing.T) {
+	v := NewVortexQ[string]()
+	if err := v.Subscribe(Subscription{SubscriberAddress: "http://a", TopicName: "t"}); err != nil {
+		t.Fatalf("Subscribe without ID error: %v", err)
+	}
+	if err := v.Subscribe(Subscription{SubscriberAddress: "http://b", TopicName: "t"}); err != nil {
+		t.Fatalf("second Subscribe without ID error: %v", err)
+	}
+	subs := v.ListSubscriptions()
+	if len(subs) != 2 || subs[0].ID == "" || subs[1].ID == "" || subs[0].ID == subs[1].ID {
+		t.Fatalf("subscriptions = %+v; want two distinct IDs", subs)
+	}
+
+	if err := v.Subscribe(Subscription{ID: subs[0].ID, SubscriberAddress: "http://c", TopicName: "other"}); !errors.Is(err, ErrSubscriptionExists) {
+		t.Errorf("duplicate ID error = %v; want ErrSubscriptionExists", err)
 	}
-	cleared, _ := val.([]Message[string])
-	if len(cleared) != 0 {
-		t.Fatalf("expected cleared messages, got %v", cleared)
+	if _, ok := v.Subscriptions.Load("other"); ok {
+		t.Error("duplicate subscription stored")
 	}
 }
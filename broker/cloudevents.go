@@ -0,0 +1,298 @@
+package broker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// FormatLegacy delivers the WebhookRequest envelope, it is the default
+	FormatLegacy = "legacy"
+	// FormatCloudEventsStructured delivers an application/cloudevents+json document
+	FormatCloudEventsStructured = "cloudevents-structured"
+	// FormatCloudEventsBinary delivers the data as body and attributes as ce-* headers
+	FormatCloudEventsBinary = "cloudevents-binary"
+	// FormatRaw delivers the data unchanged with its content type and the attributes as headers
+	FormatRaw = "raw"
+
+	// CloudEventsSpecVersion is the only supported CloudEvents version
+	CloudEventsSpecVersion = "1.0"
+	// CloudEventsContentType marks a structured mode CloudEvent
+	CloudEventsContentType = "application/cloudevents+json"
+
+	ceHeaderPrefix = "Ce-"
+)
+
+// ErrInvalidCloudEvent is returned for requests that are not valid CloudEvents.
+var ErrInvalidCloudEvent = errors.New("invalid cloudevent")
+
+// reservedAttributes are CloudEvents attributes mapped onto Message fields.
+var reservedAttributes = map[string]bool{
+	"specversion": true, "id": true, "source": true, "type": true, "time": true,
+	"datacontenttype": true, "data": true, "data_base64": true,
+}
+
+// IsCloudEvent reports whether the request carries a CloudEvent in structured or binary mode.
+func IsCloudEvent(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == CloudEventsContentType || header.Get(ceHeaderPrefix+"Specversion") != ""
+}
+
+// ParseCloudEvent maps a CloudEvent onto a Message. The message pattern defaults
+// to the event type.
+func ParseCloudEvent[T any](header http.Header, body []byte) (Message[T], error) {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	if mediaType == CloudEventsContentType {
+		return parseStructuredCloudEvent[T](body)
+	}
+	return parseBinaryCloudEvent[T](header, body)
+}
+
+func parseStructuredCloudEvent[T any](body []byte) (Message[T], error) {
+	var msg Message[T]
+	var attrs map[string]json.RawMessage
+	if err := json.Unmarshal(body, &attrs); err != nil {
+		return msg, fmt.Errorf("%w: %v", ErrInvalidCloudEvent, err)
+	}
+
+	str := func(name string) string {
+		var v string
+		if raw, ok := attrs[name]; ok && json.Unmarshal(raw, &v) != nil {
+			// extension values may be numbers or booleans
+			v = string(raw)
+		}
+		return v
+	}
+
+	for name := range attrs {
+		if !reservedAttributes[name] {
+			msg.setHeader(name, str(name))
+		}
+	}
+	if err := msg.setCloudEventAttributes(str("specversion"), str("id"), str("source"), str("type"),
+		str("time"), str("datacontenttype")); err != nil {
+		return msg, err
+	}
+
+	switch {
+	case attrs["data_base64"] != nil:
+		raw, err := base64.StdEncoding.DecodeString(str("data_base64"))
+		if err != nil {
+			return msg, fmt.Errorf("%w: data_base64: %v", ErrInvalidCloudEvent, err)
+		}
+		return msg, wrapDataErr(msg.setData(raw, false))
+	case attrs["data"] != nil:
+		if isJSONContentType(msg.ContentType) {
+			return msg, wrapDataErr(msg.setData(attrs["data"], true))
+		}
+		var text string
+		if err := json.Unmarshal(attrs["data"], &text); err != nil {
+			return msg, wrapDataErr(msg.setData(attrs["data"], true))
+		}
+		return msg, wrapDataErr(msg.setData([]byte(text), false))
+	}
+	return msg, nil
+}
+
+func wrapDataErr(err error) error {
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidCloudEvent, err)
+	}
+	return nil
+}
+
+func parseBinaryCloudEvent[T any](header http.Header, body []byte) (Message[T], error) {
+	var msg Message[T]
+	for key, values := range header {
+		name := strings.ToLower(strings.TrimPrefix(key, ceHeaderPrefix))
+		if !strings.HasPrefix(key, ceHeaderPrefix) || reservedAttributes[name] || len(values) == 0 {
+			continue
+		}
+		msg.setHeader(name, values[0])
+	}
+	get := func(name string) string { return header.Get(ceHeaderPrefix + name) }
+	if err := msg.setCloudEventAttributes(get("Specversion"), get("Id"), get("Source"), get("Type"),
+		get("Time"), header.Get("Content-Type")); err != nil {
+		return msg, err
+	}
+	if len(body) == 0 {
+		return msg, nil
+	}
+	return msg, wrapDataErr(msg.setData(body, isJSONContentType(msg.ContentType)))
+}
+
+func (msg *Message[T]) setCloudEventAttributes(specVersion, id, source, eventType, eventTime, contentType string) error {
+	if specVersion != CloudEventsSpecVersion {
+		return fmt.Errorf("%w: unsupported specversion %q", ErrInvalidCloudEvent, specVersion)
+	}
+	if id == "" || source == "" || eventType == "" {
+		return fmt.Errorf("%w: id, source and type are required", ErrInvalidCloudEvent)
+	}
+	msg.ID, msg.Source, msg.Type, msg.Pattern = id, source, eventType, eventType
+	msg.ContentType = contentType
+	if eventTime != "" {
+		t, err := time.Parse(time.RFC3339Nano, eventTime)
+		if err != nil {
+			return fmt.Errorf("%w: time: %v", ErrInvalidCloudEvent, err)
+		}
+		msg.Time = t
+	}
+	return nil
+}
+
+// setData stores the payload, decoding JSON payloads into T.
+func (msg *Message[T]) setData(raw []byte, isJSON bool) error {
+	if isJSON {
+		if err := json.Unmarshal(raw, &msg.Data); err != nil {
+			return fmt.Errorf("data: %w", err)
+		}
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(msg.ContentType)
+	if strings.HasPrefix(mediaType, "text/") && utf8.Valid(raw) {
+		if data, ok := any(string(raw)).(T); ok {
+			msg.Data = data
+			return nil
+		}
+	}
+	if data, ok := any(raw).(T); ok {
+		msg.Data = data
+		return nil
+	}
+	if data, ok := any(string(raw)).(T); ok {
+		msg.Data = data
+		return nil
+	}
+	return fmt.Errorf("can't store %q payload as %T", msg.ContentType, msg.Data)
+}
+
+func (msg *Message[T]) setHeader(name, value string) {
+	if msg.Headers == nil {
+		msg.Headers = make(map[string]string)
+	}
+	msg.Headers[name] = value
+}
+
+// encodeData returns the payload bytes, its content type and whether it is JSON.
+func (msg Message[T]) encodeData() ([]byte, string, bool, error) {
+	switch data := any(msg.Data).(type) {
+	case []byte:
+		if msg.ContentType == "" {
+			return data, "application/octet-stream", false, nil
+		}
+		return data, msg.ContentType, isJSONContentType(msg.ContentType), nil
+	case string:
+		if msg.ContentType != "" && !isJSONContentType(msg.ContentType) {
+			return []byte(data), msg.ContentType, false, nil
+		}
+	}
+	raw, err := json.Marshal(msg.Data)
+	if err != nil {
+		return nil, "", false, err
+	}
+	contentType := msg.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	return raw, contentType, true, nil
+}
+
+// cloudEventAttributes returns the context attributes of the message, defaulting
+// the required ones that were not published as a CloudEvent.
+func (msg Message[T]) cloudEventAttributes() map[string]string {
+	attrs := map[string]string{
+		"specversion": CloudEventsSpecVersion,
+		"id":          msg.ID,
+		"source":      msg.Source,
+		"type":        msg.Type,
+		"time":        msg.Time.UTC().Format(time.RFC3339Nano),
+	}
+	if msg.ID == "" {
+		attrs["id"] = NewID()
+	}
+	if msg.Source == "" {
+		attrs["source"] = "/vortexq/" + msg.Pattern
+	}
+	if msg.Type == "" {
+		attrs["type"] = msg.Pattern
+	}
+	if msg.Time.IsZero() {
+		attrs["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	}
+	for name, value := range msg.Headers {
+		if validExtensionName(name) && !reservedAttributes[name] {
+			attrs[name] = value
+		}
+	}
+	if _, ok := attrs["subject"]; !ok && msg.Pattern != "" {
+		attrs["subject"] = msg.Pattern
+	}
+	return attrs
+}
+
+// structuredCloudEvent renders the message as an application/cloudevents+json document.
+func (msg Message[T]) structuredCloudEvent() ([]byte, error) {
+	data, contentType, isJSON, err := msg.encodeData()
+	if err != nil {
+		return nil, err
+	}
+	doc := make(map[string]any)
+	for name, value := range msg.cloudEventAttributes() {
+		doc[name] = value
+	}
+	doc["datacontenttype"] = contentType
+	switch mediaType, _, _ := mime.ParseMediaType(contentType); {
+	case isJSON:
+		doc["data"] = json.RawMessage(data)
+	case strings.HasPrefix(mediaType, "text/") && utf8.Valid(data):
+		doc["data"] = string(data)
+	default:
+		doc["data_base64"] = base64.StdEncoding.EncodeToString(data)
+	}
+	return json.Marshal(doc)
+}
+
+// binaryCloudEvent renders the message for the binary HTTP binding.
+func (msg Message[T]) binaryCloudEvent() (http.Header, []byte, error) {
+	data, contentType, _, err := msg.encodeData()
+	if err != nil {
+		return nil, nil, err
+	}
+	header := make(http.Header)
+	for name, value := range msg.cloudEventAttributes() {
+		header.Set(ceHeaderPrefix+name, value)
+	}
+	header.Set("Content-Type", contentType)
+	return header, data, nil
+}
+
+func isJSONContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || mediaType == "text/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// validExtensionName follows the CloudEvents attribute naming rules.
+func validExtensionName(name string) bool {
+	if name == "" || len(name) > 20 {
+		return false
+	}
+	for _, r := range name {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') {
+			return false
+		}
+	}
+	return true
+}
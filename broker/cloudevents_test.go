@@ -0,0 +1,198 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Test structured mode CloudEvents map onto Message fields
+func TestParseStructuredCloudEvent(t *testing.T) {
+	header := http.Header{"Content-Type": {CloudEventsContentType}}
+	body := []byte(`{"specversion":"1.0","id":"e1","source":"/orders","type":"order.created",
+		"time":"2025-01-02T03:04:05Z","datacontenttype":"application/json","traceid":"abc",
+		"data":{"total":10}}`)
+
+	msg, err := ParseCloudEvent[any](header, body)
+	if err != nil {
+		t.Fatalf("ParseCloudEvent error: %v", err)
+	}
+	want := Message[any]{
+		ID: "e1", Pattern: "order.created", Data: map[string]any{"total": float64(10)},
+		Source: "/orders", Type: "order.created", Time: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC),
+		ContentType: "application/json", Headers: map[string]string{"traceid": "abc"},
+	}
+	if !reflect.DeepEqual(msg, want) {
+		t.Errorf("got %+v; want %+v", msg, want)
+	}
+
+	// base64 data keeps the raw bytes
+	body = []byte(`{"specversion":"1.0","id":"e2","source":"s","type":"t","datacontenttype":"application/octet-stream","data_base64":"AAEC"}`)
+	raw, err := ParseCloudEvent[any](header, body)
+	if err != nil {
+		t.Fatalf("ParseCloudEvent base64 error: %v", err)
+	}
+	if !reflect.DeepEqual(raw.Data, []byte{0, 1, 2}) {
+		t.Errorf("base64 data = %v; want [0 1 2]", raw.Data)
+	}
+}
+
+// Test binary mode CloudEvents map headers and body onto Message fields
+func TestParseBinaryCloudEvent(t *testing.T) {
+	header := http.Header{}
+	header.Set("Ce-Specversion", "1.0")
+	header.Set("Ce-Id", "e1")
+	header.Set("Ce-Source", "/sensors")
+	header.Set("Ce-Type", "reading")
+	header.Set("Ce-Partitionkey", "p1")
+	header.Set("Content-Type", "text/plain")
+	if !IsCloudEvent(header) {
+		t.Fatal("IsCloudEvent = false; want true")
+	}
+
+	msg, err := ParseCloudEvent[string](header, []byte("21.5"))
+	if err != nil {
+		t.Fatalf("ParseCloudEvent error: %v", err)
+	}
+	if msg.ID != "e1" || msg.Source != "/sensors" || msg.Type != "reading" || msg.Data != "21.5" ||
+		msg.Headers["partitionkey"] != "p1" {
+		t.Errorf("unexpected message %+v", msg)
+	}
+}
+
+// Test invalid CloudEvents are rejected
+func TestParseCloudEventInvalid(t *testing.T) {
+	header := http.Header{"Content-Type": {CloudEventsContentType}}
+	for _, body := range []string{
+		`not json`,
+		`{"specversion":"0.3","id":"1","source":"s","type":"t"}`,
+		`{"specversion":"1.0","source":"s","type":"t"}`,
+		`{"specversion":"1.0","id":"1","source":"s","type":"t","time":"yesterday"}`,
+	} {
+		if _, err := ParseCloudEvent[any](header, []byte(body)); !errors.Is(err, ErrInvalidCloudEvent) {
+			t.Errorf("ParseCloudEvent(%s) error = %v; want ErrInvalidCloudEvent", body, err)
+		}
+	}
+}
+
+// Test subscriptions receive CloudEvents in the format they chose
+func TestDeliverCloudEvents(t *testing.T) {
+	type captured struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan captured, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- captured{r.Header, body}
+	}))
+	defer server.Close()
+
+	v := NewVortexQ[any]()
+	msg := Message[any]{ID: "m1", Pattern: "orders", Data: map[string]any{"n": float64(1)}, Source: "/shop",
+		Headers: map[string]string{"traceid": "abc", "not_valid": "x"}}
+
+	// structured mode
+	sub := Subscription{ID: "s", SubscriberAddress: server.URL, TopicName: "orders", Format: FormatCloudEventsStructured}
+	if _, err := v.postWebhook(msg, sub, ""); err != nil {
+		t.Fatalf("structured delivery error: %v", err)
+	}
+	c := <-got
+	if ct := c.header.Get("Content-Type"); ct != CloudEventsContentType+"; charset=utf-8" {
+		t.Errorf("structured Content-Type = %q", ct)
+	}
+	var doc map[string]any
+	if err := json.Unmarshal(c.body, &doc); err != nil {
+		t.Fatalf("structured body is not JSON: %v", err)
+	}
+	for name, want := range map[string]any{"specversion": "1.0", "id": "m1", "source": "/shop", "type": "orders",
+		"subject": "orders", "traceid": "abc", "data": map[string]any{"n": float64(1)}} {
+		if !reflect.DeepEqual(doc[name], want) {
+			t.Errorf("structured %s = %v; want %v", name, doc[name], want)
+		}
+	}
+	if _, ok := doc["not_valid"]; ok {
+		t.Error("invalid extension name must not be delivered")
+	}
+
+	// binary mode
+	sub.Format = FormatCloudEventsBinary
+	if _, err := v.postWebhook(msg, sub, ""); err != nil {
+		t.Fatalf("binary delivery error: %v", err)
+	}
+	c = <-got
+	if c.header.Get("Ce-Id") != "m1" || c.header.Get("Ce-Source") != "/shop" || c.header.Get("Ce-Traceid") != "abc" {
+		t.Errorf("binary headers = %v", c.header)
+	}
+	if c.header.Get("Content-Type") != "application/json" || string(c.body) != `{"n":1}` {
+		t.Errorf("binary body = %s (%s)", c.body, c.header.Get("Content-Type"))
+	}
+
+	// round trip through the binary parser
+	back, err := ParseCloudEvent[any](c.header, c.body)
+	if err != nil {
+		t.Fatalf("ParseCloudEvent error: %v", err)
+	}
+	if back.ID != msg.ID || !reflect.DeepEqual(back.Data, msg.Data) {
+		t.Errorf("round trip = %+v; want %+v", back, msg)
+	}
+}
+
+// Test the raw format delivers the data unchanged with its content type, without format it keeps the envelope
+func TestRawDelivery(t *testing.T) {
+	type captured struct {
+		header http.Header
+		body   []byte
+	}
+	got := make(chan captured, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- captured{r.Header, body}
+	}))
+	defer server.Close()
+
+	v := NewVortexQ[any]()
+	png := []byte{0x89, 'P', 'N', 'G', 0}
+	msg := Message[any]{ID: "m1", Pattern: "images", Data: png, ContentType: "image/png", CorrelationID: "r1", ReplyTo: "_inbox.r1",
+		Headers: map[string]string{"Content-Disposition": "inline", "title": "logo"}}
+	sub := Subscription{ID: "s", SubscriberAddress: server.URL, TopicName: "images", Format: FormatRaw}
+	if _, err := v.postWebhook(msg, sub, ""); err != nil {
+		t.Fatalf("raw delivery error: %v", err)
+	}
+	c := <-got
+	if !bytes.Equal(c.body, png) || c.header.Get("Content-Type") != "image/png" {
+		t.Errorf("raw body = %q (%s); want the PNG bytes", c.body, c.header.Get("Content-Type"))
+	}
+	if c.header.Get("X-VortexQ-Message-ID") != "m1" || c.header.Get("X-VortexQ-Topic") != "images" ||
+		c.header.Get("Content-Disposition") != "inline" || c.header.Get("X-Meta-Title") != "logo" {
+		t.Errorf("raw headers = %v", c.header)
+	}
+	header, _, err := msg.rawPayload()
+	if err != nil || header.Get("X-VortexQ-Correlation-ID") != "r1" || header.Get("X-VortexQ-Reply-To") != "_inbox.r1" {
+		t.Errorf("raw reply headers = %v, %v", header, err)
+	}
+
+	// without format binary data keeps the legacy envelope
+	sub.Format = ""
+	if _, err := v.postWebhook(msg, sub, ""); err != nil {
+		t.Fatalf("legacy delivery error: %v", err)
+	}
+	if c = <-got; c.header.Get("Content-Type") != "application/json" || !bytes.Contains(c.body, []byte(`"event_data"`)) {
+		t.Errorf("legacy delivery = %s (%s); want the envelope", c.body, c.header.Get("Content-Type"))
+	}
+}
+
+// Test unknown delivery formats are rejected at subscribe time
+func TestSubscribeInvalidFormat(t *testing.T) {
+	v := NewVortexQ[any]()
+	err := v.Subscribe(Subscription{ID: "s", SubscriberAddress: "http://example.com", TopicName: "t", Format: "xml"})
+	if !errors.Is(err, ErrInvalidSubscription) {
+		t.Errorf("Subscribe error = %v; want ErrInvalidSubscription", err)
+	}
+}
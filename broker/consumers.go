@@ -0,0 +1,206 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// ProtocolStream marks a subscription consumed in-process through Consume
+	ProtocolStream = "stream"
+
+	// DefaultMaxInFlight bounds the unsettled deliveries of a consumer
+	DefaultMaxInFlight = 100
+)
+
+// ErrConsumerAttached is returned when a subscription already streams to another consumer.
+var ErrConsumerAttached = errors.New("subscription already has a consumer")
+
+var (
+	errNoConsumer   = errors.New("no consumer attached")
+	errConsumerBusy = errors.New("consumer is busy")
+)
+
+// ConsumeOptions configures a stream consumer.
+type ConsumeOptions struct {
+	// MaxInFlight bounds the deliveries handed out and not yet acked, DefaultMaxInFlight if zero
+	MaxInFlight int
+	// AutoAck settles deliveries once they are handed to the consumer
+	AutoAck bool
+	// Ephemeral removes the subscription when ctx is done, implied without subscription ID
+	Ephemeral bool
+}
+
+// Delivery is a message handed to a stream consumer.
+type Delivery[T any] struct {
+	Message        Message[T] `json:"message"`
+	SubscriptionID string     `json:"subscription_id"`
+	Attempt        int        `json:"attempt"`
+	// AckToken settles the delivery with Ack or Nack, it is empty when auto acked
+	AckToken string `json:"ack_token,omitempty"`
+}
+
+// consumer is the receiving end of a stream subscription.
+type consumer[T any] struct {
+	mu          sync.RWMutex
+	closed      bool
+	ch          chan Delivery[T]
+	done        <-chan struct{}
+	maxInFlight int
+	autoAck     bool
+	// inFlight counts the deliveries awaiting an ack
+	inFlight atomic.Int64
+}
+
+// streamed reports whether the subscription is delivered to a consumer instead of a webhook.
+func (s Subscription) streamed() bool {
+	return s.Protocol != ""
+}
+
+// Consume attaches a consumer to the subscription, creating it when it doesn't exist,
+// and streams its deliveries until ctx is done. A subscription without ID lives as
+// long as the consumer, a named one keeps its cursor for the next consumer.
+func (vq *VortexQ[T]) Consume(ctx context.Context, sub Subscription, opts ConsumeOptions) (<-chan Delivery[T], error) {
+	const op = "broker.VortexQ.Consume"
+	if sub.Protocol == "" {
+		sub.Protocol = ProtocolStream
+	}
+	if opts.MaxInFlight <= 0 {
+		opts.MaxInFlight = DefaultMaxInFlight
+	}
+	sub.AckMode = AckModeAsync
+	if opts.AutoAck {
+		sub.AckMode = AckModeSync
+	}
+	ephemeral := sub.ID == "" || opts.Ephemeral
+	if sub.ID == "" {
+		sub.ID = NewID()
+	}
+
+	c := &consumer[T]{
+		ch:          make(chan Delivery[T], opts.MaxInFlight),
+		done:        ctx.Done(),
+		maxInFlight: opts.MaxInFlight,
+		autoAck:     opts.AutoAck,
+	}
+	if _, loaded := vq.consumers.LoadOrStore(sub.ID, c); loaded {
+		return nil, fmt.Errorf("%s: subscription %q: %w", op, sub.ID, ErrConsumerAttached)
+	}
+
+	existing, ok := vq.FindSubscription(sub.ID)
+	switch {
+	case !ok:
+		if err := vq.Subscribe(sub); err != nil {
+			vq.consumers.Delete(sub.ID)
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	case !existing.streamed() || existing.TopicName != sub.TopicName:
+		vq.consumers.Delete(sub.ID)
+		return nil, fmt.Errorf("%s: %w: subscription %q is not a stream of topic %q",
+			op, ErrInvalidSubscription, sub.ID, sub.TopicName)
+	default:
+		vq.updateSubscription(sub.ID, func(s *Subscription) {
+			s.AckMode = sub.AckMode
+			if sub.AckDeadlineSeconds > 0 {
+				s.AckDeadlineSeconds = sub.AckDeadlineSeconds
+			}
+		})
+	}
+
+	go func() {
+		<-ctx.Done()
+		vq.consumers.CompareAndDelete(sub.ID, c)
+		c.close()
+		if ephemeral {
+			_ = vq.Unsubscribe(sub.ID)
+		}
+	}()
+	return c.ch, nil
+}
+
+// push hands the delivery to the consumer of the subscription, it answers like a
+// subscriber would: 202 when an ack is expected, 200 otherwise.
+func (vq *VortexQ[T]) push(p pendingDelivery[T]) (webhookResponse, error) {
+	c, ok := vq.consumer(p.sub.ID)
+	if !ok {
+		return webhookResponse{}, errNoConsumer
+	}
+	d := Delivery[T]{Message: p.msg, SubscriptionID: p.sub.ID, Attempt: p.attempt, AckToken: p.ackToken}
+	if err := c.send(d); err != nil {
+		return webhookResponse{}, err
+	}
+	if p.ackToken != "" {
+		return webhookResponse{StatusCode: http.StatusAccepted}, nil
+	}
+	return webhookResponse{StatusCode: http.StatusOK}, nil
+}
+
+func (vq *VortexQ[T]) consumer(subscriptionID string) (*consumer[T], bool) {
+	value, ok := vq.consumers.Load(subscriptionID)
+	if !ok {
+		return nil, false
+	}
+	return value.(*consumer[T]), true
+}
+
+// credit returns how many more deliveries the consumer takes right now.
+func (c *consumer[T]) credit() int {
+	if c.autoAck {
+		return cap(c.ch) - len(c.ch)
+	}
+	return c.maxInFlight - int(c.inFlight.Load())
+}
+
+// send doesn't wait for a consumer that has no room, Swirl would wait with it.
+func (c *consumer[T]) send(d Delivery[T]) error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	select {
+	case <-c.done:
+		return errNoConsumer
+	default:
+	}
+	if c.closed {
+		return errNoConsumer
+	}
+	select {
+	case c.ch <- d:
+		return nil
+	default:
+		return errConsumerBusy
+	}
+}
+
+// Wake is signaled when messages wait for an attached consumer or it got
+// credit back, so that the caller swirls before its next tick.
+func (vq *VortexQ[T]) Wake() <-chan struct{} {
+	return vq.wake
+}
+
+// wakeConsumers signals Wake when a consumer reads the topic.
+func (vq *VortexQ[T]) wakeConsumers(topic string) {
+	for _, sub := range vq.subscriptionsFor(topic) {
+		if _, ok := vq.consumer(sub.ID); ok {
+			vq.signalWake()
+			return
+		}
+	}
+}
+
+func (vq *VortexQ[T]) signalWake() {
+	select {
+	case vq.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *consumer[T]) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	close(c.ch)
+}
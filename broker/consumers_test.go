@@ -0,0 +1,143 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// Test a consumer gets at most MaxInFlight unacked deliveries and a durable
+// subscription keeps its cursor between consumers
+func TestConsume(t *testing.T) {
+	v := NewVortexQ[string]()
+	ctx, cancel := context.WithCancel(context.Background())
+	deliveries, err := v.Consume(ctx, Subscription{ID: "c1", TopicName: "t"}, ConsumeOptions{MaxInFlight: 2})
+	if err != nil {
+		t.Fatalf("Consume error: %v", err)
+	}
+	if _, err := v.Consume(ctx, Subscription{ID: "c1", TopicName: "t"}, ConsumeOptions{}); !errors.Is(err, ErrConsumerAttached) {
+		t.Errorf("second consumer error = %v; want ErrConsumerAttached", err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		v.Publish(Message[string]{ID: id, Pattern: "t"})
+	}
+
+	_ = v.Swirl()
+	first, second := <-deliveries, <-deliveries
+	if first.Message.ID != "a" || second.Message.ID != "b" {
+		t.Fatalf("deliveries = %s, %s; want a, b", first.Message.ID, second.Message.ID)
+	}
+	_ = v.Swirl()
+	select {
+	case d := <-deliveries:
+		t.Fatalf("delivered %s beyond MaxInFlight", d.Message.ID)
+	default:
+	}
+	if err := v.Ack(first.AckToken); err != nil {
+		t.Fatalf("Ack error: %v", err)
+	}
+	_ = v.Swirl()
+	if d := <-deliveries; d.Message.ID != "c" {
+		t.Errorf("delivery after ack = %s; want c", d.Message.ID)
+	}
+
+	// detached, the subscription stays and the next consumer continues at d
+	cancel()
+	for range deliveries {
+	}
+	v.Publish(Message[string]{ID: "d", Pattern: "t"})
+	_ = v.Swirl()
+	if _, ok := v.FindSubscription("c1"); !ok {
+		t.Fatal("durable subscription removed with its consumer")
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+	deliveries, err = v.Consume(ctx, Subscription{ID: "c1", TopicName: "t"}, ConsumeOptions{AutoAck: true})
+	if err != nil {
+		t.Fatalf("Consume error: %v", err)
+	}
+	_ = v.Swirl()
+	if d := <-deliveries; d.Message.ID != "d" || d.AckToken != "" {
+		t.Errorf("delivery after reattach = %+v; want d without ack token", d)
+	}
+}
+
+// Test a consumer without subscription ID is removed with its stream
+func TestConsumeEphemeral(t *testing.T) {
+	v := NewVortexQ[string]()
+	ctx, cancel := context.WithCancel(context.Background())
+	deliveries, err := v.Consume(ctx, Subscription{TopicName: "t"}, ConsumeOptions{AutoAck: true})
+	if err != nil {
+		t.Fatalf("Consume error: %v", err)
+	}
+	if subs := v.ListSubscriptions(); len(subs) != 1 || subs[0].Protocol != ProtocolStream {
+		t.Fatalf("subscriptions = %+v; want one stream", subs)
+	}
+	cancel()
+	for range deliveries {
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(v.ListSubscriptions()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if subs := v.ListSubscriptions(); len(subs) != 0 {
+		t.Errorf("subscriptions after the stream ended = %+v", subs)
+	}
+}
+
+// Test a consumer without room doesn't hold up Swirl, the delivery waits for it
+func TestConsumeBusy(t *testing.T) {
+	v := NewVortexQ[string]()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	deliveries, err := v.Consume(ctx, Subscription{ID: "c1", TopicName: "t"}, ConsumeOptions{MaxInFlight: 1, AutoAck: true})
+	if err != nil {
+		t.Fatalf("Consume error: %v", err)
+	}
+	v.Publish(Message[string]{ID: "a", Pattern: "t"})
+	_ = v.Swirl()
+
+	sub, _ := v.FindSubscription("c1")
+	attempted := make(chan struct{})
+	go func() {
+		defer close(attempted)
+		v.attempt(pendingDelivery[string]{msg: Message[string]{ID: "b", Pattern: "t"}, sub: sub, attempt: 1})
+	}()
+	select {
+	case <-attempted:
+	case <-time.After(time.Second):
+		t.Fatal("push waited for the busy consumer")
+	}
+
+	if d := <-deliveries; d.Message.ID != "a" {
+		t.Fatalf("delivery = %s; want a", d.Message.ID)
+	}
+	_ = v.Swirl()
+	if d := <-deliveries; d.Message.ID != "b" || d.Attempt != 1 {
+		t.Errorf("delivery = %s attempt %d; want b attempt 1", d.Message.ID, d.Attempt)
+	}
+}
+
+// Test Publish wakes the caller of Swirl when a consumer reads the topic
+func TestConsumeWake(t *testing.T) {
+	v := NewVortexQ[string]()
+	v.Publish(Message[string]{ID: "a", Pattern: "t"})
+	select {
+	case <-v.Wake():
+		t.Error("woken up without consumer")
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if _, err := v.Consume(ctx, Subscription{TopicName: "t"}, ConsumeOptions{}); err != nil {
+		t.Fatalf("Consume error: %v", err)
+	}
+	v.Publish(Message[string]{ID: "b", Pattern: "t"})
+	select {
+	case <-v.Wake():
+	default:
+		t.Error("not woken up for the consumer")
+	}
+}
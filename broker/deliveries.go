@@ -0,0 +1,99 @@
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultDeliveryLogMaxRecords bounds the number of kept delivery records
+	DefaultDeliveryLogMaxRecords = 10000
+	// DefaultDeliveryLogRetention bounds the age of kept delivery records
+	DefaultDeliveryLogRetention = 24 * time.Hour
+
+	// maxRecordedResponseBody is how much of a subscriber response is kept
+	maxRecordedResponseBody = 1024
+)
+
+// DeliveryRecord describes a single webhook delivery attempt.
+type DeliveryRecord struct {
+	MessageID         string    `json:"message_id"`
+	SubscriptionID    string    `json:"subscription_id"`
+	TopicName         string    `json:"topic_name"`
+	SubscriberAddress string    `json:"subscriber_address"`
+	Attempt           int       `json:"attempt"`
+	StatusCode        int       `json:"status_code,omitempty"`
+	LatencyMs         int64     `json:"latency_ms"`
+	ResponseBody      string    `json:"response_body,omitempty"`
+	Error             string    `json:"error,omitempty"`
+	Timestamp         time.Time `json:"timestamp"`
+}
+
+// DeliveryLog keeps delivery records bounded by count and age.
+type DeliveryLog struct {
+	mu         sync.RWMutex
+	records    []DeliveryRecord
+	maxRecords int
+	maxAge     time.Duration
+}
+
+// NewDeliveryLog creates a DeliveryLog, non-positive limits fall back to the defaults.
+func NewDeliveryLog(maxRecords int, maxAge time.Duration) *DeliveryLog {
+	if maxRecords <= 0 {
+		maxRecords = DefaultDeliveryLogMaxRecords
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultDeliveryLogRetention
+	}
+	return &DeliveryLog{
+		maxRecords: maxRecords,
+		maxAge:     maxAge,
+	}
+}
+
+// Record appends a delivery record and evicts the ones past retention.
+func (l *DeliveryLog) Record(record DeliveryRecord) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.records = append(l.records, record)
+	l.evict(time.Now())
+}
+
+// BySubscription returns the records of the given subscription, oldest first.
+func (l *DeliveryLog) BySubscription(id string) []DeliveryRecord {
+	return l.filter(func(r DeliveryRecord) bool { return r.SubscriptionID == id })
+}
+
+// ByMessage returns the records of the given message, oldest first.
+func (l *DeliveryLog) ByMessage(id string) []DeliveryRecord {
+	return l.filter(func(r DeliveryRecord) bool { return r.MessageID == id })
+}
+
+func (l *DeliveryLog) filter(keep func(DeliveryRecord) bool) []DeliveryRecord {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	cutoff := time.Now().Add(-l.maxAge)
+	found := make([]DeliveryRecord, 0)
+	for _, r := range l.records {
+		if r.Timestamp.After(cutoff) && keep(r) {
+			found = append(found, r)
+		}
+	}
+	return found
+}
+
+// evict must be called with the lock held.
+func (l *DeliveryLog) evict(now time.Time) {
+	drop := len(l.records) - l.maxRecords
+	if drop < 0 {
+		drop = 0
+	}
+	cutoff := now.Add(-l.maxAge)
+	for drop < len(l.records) && !l.records[drop].Timestamp.After(cutoff) {
+		drop++
+	}
+	// re-slicing is enough, append moves live records once capacity runs out
+	l.records = l.records[drop:]
+}
@@ -0,0 +1,106 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// TopicSeparator splits topic names into levels, e.g. orders.eu.created
+	TopicSeparator = "."
+	// WildcardOne matches exactly one level of a topic name
+	WildcardOne = "*"
+	// WildcardRest matches one or more trailing levels, it must be the last level
+	WildcardRest = ">"
+)
+
+// ErrInvalidTopic is returned when a message is published to something else than a topic name.
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// IsTopicPattern reports whether the name contains wildcards.
+func IsTopicPattern(name string) bool {
+	for _, level := range strings.Split(name, TopicSeparator) {
+		if level == WildcardOne || level == WildcardRest {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidateTopicPattern checks levels are not empty and WildcardRest comes last.
+func ValidateTopicPattern(pattern string) error {
+	levels := strings.Split(pattern, TopicSeparator)
+	for i, level := range levels {
+		switch {
+		case level == "" && len(levels) > 1:
+			return fmt.Errorf("%w: empty level in topic %q", ErrInvalidSubscription, pattern)
+		case level == WildcardRest && i != len(levels)-1:
+			return fmt.Errorf("%w: %q must be the last level of topic %q", ErrInvalidSubscription, WildcardRest, pattern)
+		}
+	}
+	return nil
+}
+
+// ValidateTopicName checks messages can be published to the name, patterns
+// only select topics.
+func ValidateTopicName(name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%w: topic name is required", ErrInvalidTopic)
+	case IsTopicPattern(name):
+		return fmt.Errorf("%w: %q is a pattern, not a topic name", ErrInvalidTopic, name)
+	}
+	return nil
+}
+
+// MatchTopic reports whether the topic matches the pattern, a name without
+// wildcards only matches itself.
+func MatchTopic(pattern, topic string) bool {
+	if pattern == topic {
+		return true
+	}
+	pl := strings.Split(pattern, TopicSeparator)
+	tl := strings.Split(topic, TopicSeparator)
+	for i, level := range pl {
+		switch {
+		case level == WildcardRest:
+			return i < len(tl)
+		case i >= len(tl):
+			return false
+		case level != WildcardOne && level != tl[i]:
+			return false
+		}
+	}
+	return len(pl) == len(tl)
+}
+
+// subscriptionsFor returns the subscriptions of the topic, including those of matching patterns.
+func (vq *VortexQ[T]) subscriptionsFor(topic string) []Subscription {
+	var subs []Subscription
+	vq.Subscriptions.Range(func(key, value interface{}) bool {
+		if MatchTopic(key.(string), topic) {
+			subs = append(subs, value.([]Subscription)...)
+		}
+		return true
+	})
+	return subs
+}
+
+// topicsMatching returns the logs of all topics matching the pattern by name.
+func (vq *VortexQ[T]) topicsMatching(pattern string) map[string]*topicLog[T] {
+	topics := make(map[string]*topicLog[T])
+	if !IsTopicPattern(pattern) {
+		if tl, ok := vq.Topics.Load(pattern); ok {
+			topics[pattern] = tl.(*topicLog[T])
+		}
+		return topics
+	}
+	vq.Topics.Range(func(key, value any) bool {
+		if name := key.(string); MatchTopic(pattern, name) {
+			topics[name] = value.(*topicLog[T])
+		}
+		return true
+	})
+	return topics
+}
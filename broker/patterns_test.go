@@ -0,0 +1,84 @@
+package broker
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern, topic string
+		want           bool
+	}{
+		{"orders", "orders", true},
+		{"orders", "orders.eu", false},
+		{"orders.*", "orders.eu", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.eu.created", false},
+		{"orders.*.created", "orders.eu.created", true},
+		{"orders.>", "orders.eu.created", true},
+		{"orders.>", "orders", false},
+		{">", "orders", true},
+		{"*", "orders.eu", false},
+	}
+	for _, tt := range tests {
+		if got := MatchTopic(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("MatchTopic(%q, %q) = %v; want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTopicPattern(t *testing.T) {
+	for _, pattern := range []string{"orders.*", "orders.>", "*.created", ">"} {
+		if err := ValidateTopicPattern(pattern); err != nil {
+			t.Errorf("ValidateTopicPattern(%q) error: %v", pattern, err)
+		}
+	}
+	for _, pattern := range []string{"orders.>.created", "orders..*"} {
+		if err := ValidateTopicPattern(pattern); !errors.Is(err, ErrInvalidSubscription) {
+			t.Errorf("ValidateTopicPattern(%q) error = %v; want ErrInvalidSubscription", pattern, err)
+		}
+	}
+}
+
+// Test messages can't be published to patterns or without a topic
+func TestPublishInvalidTopic(t *testing.T) {
+	v := NewVortexQ[string]()
+	for _, topic := range []string{"", "orders.*", "orders.>"} {
+		if _, err := v.Publish(Message[string]{ID: "m", Pattern: topic}); !errors.Is(err, ErrInvalidTopic) {
+			t.Errorf("Publish to %q error = %v; want ErrInvalidTopic", topic, err)
+		}
+		if _, ok := v.Topics.Load(topic); ok {
+			t.Errorf("topic %q created", topic)
+		}
+	}
+}
+
+// Test a pattern subscription receives new messages of existing and later topics
+func TestPatternSubscription(t *testing.T) {
+	rec := newRecorder(t)
+	v := NewVortexQ[string]()
+	v.Publish(Message[string]{ID: "old", Pattern: "orders.eu"})
+	if err := v.Subscribe(Subscription{ID: "s1", SubscriberAddress: rec.URL, TopicName: "orders.*"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	v.Publish(Message[string]{ID: "eu", Pattern: "orders.eu"})
+	v.Publish(Message[string]{ID: "us", Pattern: "orders.us"})
+	v.Publish(Message[string]{ID: "deep", Pattern: "orders.us.created"})
+	v.Publish(Message[string]{ID: "other", Pattern: "users.eu"})
+	_ = v.Swirl()
+
+	got := rec.take()
+	if len(got) != 2 || !got["eu"] || !got["us"] {
+		t.Errorf("delivered %v; want eu and us", got)
+	}
+
+	if err := v.Unsubscribe("s1"); err != nil {
+		t.Fatalf("Unsubscribe error: %v", err)
+	}
+	v.Publish(Message[string]{ID: "late", Pattern: "orders.eu"})
+	_ = v.Swirl()
+	if got := rec.take(); len(got) != 0 {
+		t.Errorf("delivered %v after unsubscribe", got)
+	}
+}
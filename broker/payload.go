@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+)
+
+// SetPayload stores raw bytes received over a binary protocol as the message data.
+// JSON content types, or a valid JSON payload without content type, are decoded into T.
+func (msg *Message[T]) SetPayload(raw []byte) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	isJSON := isJSONContentType(msg.ContentType) && (msg.ContentType != "" || json.Valid(raw))
+	return msg.setData(raw, isJSON)
+}
+
+// Payload returns the message data as bytes together with its content type.
+func (msg Message[T]) Payload() ([]byte, string, error) {
+	data, contentType, _, err := msg.encodeData()
+	return data, contentType, err
+}
+
+// MetaHeaderPrefix carries the message headers of raw deliveries, the standard
+// content headers go by their own name.
+const MetaHeaderPrefix = "X-Meta-"
+
+// contentHeaders are the message headers raw deliveries send as they are.
+var contentHeaders = []string{"Content-Disposition", "Content-Encoding", "Content-Language"}
+
+// rawPayload returns the data as body and the message attributes as headers.
+func (msg Message[T]) rawPayload() (http.Header, []byte, error) {
+	data, contentType, _, err := msg.encodeData()
+	if err != nil {
+		return nil, nil, err
+	}
+	header := make(http.Header)
+	header.Set("Content-Type", contentType)
+	header.Set("X-VortexQ-Message-ID", msg.ID)
+	header.Set("X-VortexQ-Topic", msg.Pattern)
+	setReplyHeaders(header, msg)
+	for name, value := range msg.Headers {
+		if IsContentHeader(name) {
+			header.Set(name, value)
+		} else {
+			header.Set(MetaHeaderPrefix+name, value)
+		}
+	}
+	return header, data, nil
+}
+
+// IsContentHeader reports whether the header describes the data of a raw
+// payload, such as its encoding.
+func IsContentHeader(name string) bool {
+	return slices.Contains(contentHeaders, http.CanonicalHeaderKey(name))
+}
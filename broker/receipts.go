@@ -0,0 +1,157 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// ReceiptPending means the subscriber hasn't acknowledged the message yet
+	ReceiptPending = "pending"
+	// ReceiptDelivered means the subscriber acknowledged the message
+	ReceiptDelivered = "delivered"
+	// ReceiptFailed means the message won't be delivered to the subscriber
+	ReceiptFailed = "failed"
+)
+
+// DeliveryReceipt is the delivery outcome of a message for one subscription.
+type DeliveryReceipt struct {
+	MessageID      string    `json:"message_id"`
+	SubscriptionID string    `json:"subscription_id"`
+	Status         string    `json:"status"`
+	StatusCode     int       `json:"status_code,omitempty"`
+	Attempts       int       `json:"attempts,omitempty"`
+	Error          string    `json:"error,omitempty"`
+	Timestamp      time.Time `json:"timestamp,omitzero"`
+}
+
+// receiptTracker collects the receipts of a message published with PublishAndWait.
+type receiptTracker struct {
+	mu       sync.Mutex
+	receipts map[string]DeliveryReceipt
+	quorum   int
+	done     chan struct{}
+	closed   bool
+}
+
+// PublishAndWait publishes the message and waits until quorum of the subscriptions
+// active at publish time acknowledged it, or all of them reached a final outcome.
+// A quorum <= 0 waits for all. The receipts are returned even when ctx is done first.
+func (vq *VortexQ[T]) PublishAndWait(ctx context.Context, msg Message[T], quorum int) (int64, []DeliveryReceipt, error) {
+	const op = "broker.VortexQ.PublishAndWait"
+	if msg.ID == "" {
+		msg.ID = NewID()
+	}
+
+	tracker := &receiptTracker{receipts: make(map[string]DeliveryReceipt), done: make(chan struct{})}
+	for _, sub := range vq.subscriptionsFor(msg.Pattern) {
+		if sub.Active() {
+			tracker.receipts[sub.ID] = DeliveryReceipt{MessageID: msg.ID, SubscriptionID: sub.ID, Status: ReceiptPending}
+		}
+	}
+	if quorum <= 0 || quorum > len(tracker.receipts) {
+		quorum = len(tracker.receipts)
+	}
+	tracker.quorum = quorum
+
+	vq.receipts.Store(msg.ID, tracker)
+	defer vq.receipts.Delete(msg.ID)
+	offset, err := vq.Publish(msg)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if quorum == 0 {
+		return offset, tracker.snapshot(), nil
+	}
+
+	select {
+	case <-tracker.done:
+		return offset, tracker.snapshot(), nil
+	case <-ctx.Done():
+		return offset, tracker.snapshot(), fmt.Errorf("%s: %w", op, ctx.Err())
+	}
+}
+
+// recordReceipt updates waiting publishers and the receipt callback of the message.
+func (vq *VortexQ[T]) recordReceipt(msg Message[T], receipt DeliveryReceipt, final bool) {
+	if value, ok := vq.receipts.Load(msg.ID); ok {
+		value.(*receiptTracker).update(receipt)
+	}
+	if final && msg.ReceiptURL != "" {
+		go vq.sendReceipt(msg.ReceiptURL, receipt)
+	}
+}
+
+// sendReceipt posts the receipt to the publisher callback URL.
+func (vq *VortexQ[T]) sendReceipt(receiptURL string, receipt DeliveryReceipt) {
+	const op = "broker.VortexQ.sendReceipt"
+	log := vq.Logger.With(slog.String("op", op))
+
+	body, err := json.Marshal(receipt)
+	if err != nil {
+		log.Error("error creating receipt payload", logging.Err(err))
+		return
+	}
+	req, err := http.NewRequest(http.MethodPost, receiptURL, bytes.NewReader(body))
+	if err != nil {
+		log.Error("failed to prepare the receipt request", logging.Err(err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{Timeout: 5 * time.Second, Transport: vq.URLPolicy.Transport()}
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Error("error sending receipt", slog.String("url", receiptURL), logging.Err(err))
+		return
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Warn("receipt rejected", slog.String("url", receiptURL), slog.String("status", resp.Status))
+	}
+}
+
+func (rt *receiptTracker) update(receipt DeliveryReceipt) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if _, ok := rt.receipts[receipt.SubscriptionID]; !ok || rt.closed {
+		return
+	}
+	rt.receipts[receipt.SubscriptionID] = receipt
+
+	delivered, final := 0, 0
+	for _, r := range rt.receipts {
+		switch r.Status {
+		case ReceiptDelivered:
+			delivered++
+			final++
+		case ReceiptFailed:
+			final++
+		}
+	}
+	if delivered >= rt.quorum || final == len(rt.receipts) {
+		rt.closed = true
+		close(rt.done)
+	}
+}
+
+func (rt *receiptTracker) snapshot() []DeliveryReceipt {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	receipts := make([]DeliveryReceipt, 0, len(rt.receipts))
+	for _, r := range rt.receipts {
+		receipts = append(receipts, r)
+	}
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].SubscriptionID < receipts[j].SubscriptionID })
+	return receipts
+}
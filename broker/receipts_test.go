@@ -0,0 +1,125 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ivanbulyk/vortexq/internal/urlpolicy"
+)
+
+// Test receipt URLs are checked against the URL policy before publishing
+func TestPublishRejectedReceiptURL(t *testing.T) {
+	policy, err := urlpolicy.New(urlpolicy.Config{AllowedSchemes: []string{"https"}})
+	if err != nil {
+		t.Fatalf("urlpolicy.New error: %v", err)
+	}
+	v := NewVortexQ[any]()
+	v.URLPolicy = policy
+	for _, receiptURL := range []string{"http://example.com/receipts", "https://127.0.0.1/receipts"} {
+		if _, err := v.Publish(Message[any]{ID: "m", Pattern: "t", ReceiptURL: receiptURL}); !errors.Is(err, urlpolicy.ErrForbidden) {
+			t.Errorf("Publish with receipt URL %q error = %v; want ErrForbidden", receiptURL, err)
+		}
+	}
+	if _, ok := v.Topics.Load("t"); ok {
+		t.Error("rejected message published")
+	}
+}
+
+// Test PublishAndWait reports a receipt per subscriber once their outcome is final
+func TestPublishAndWait(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad" {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	receipts := make(chan DeliveryReceipt, 2)
+	callback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var receipt DeliveryReceipt
+		if err := json.NewDecoder(r.Body).Decode(&receipt); err != nil {
+			t.Errorf("decode receipt: %v", err)
+		}
+		receipts <- receipt
+	}))
+	defer callback.Close()
+
+	v := NewVortexQ[any]()
+	for _, path := range []string{"/ok", "/bad"} {
+		if err := v.Subscribe(Subscription{ID: path, SubscriberAddress: server.URL + path, TopicName: "t"}); err != nil {
+			t.Fatalf("subscribe error: %v", err)
+		}
+	}
+	swirlUntilDone(t, v)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, got, err := v.PublishAndWait(ctx, Message[any]{ID: "m1", Pattern: "t", ReceiptURL: callback.URL}, 0)
+	if err != nil {
+		t.Fatalf("PublishAndWait error: %v", err)
+	}
+	if len(got) != 2 || got[0].SubscriptionID != "/bad" || got[0].Status != ReceiptFailed ||
+		got[1].SubscriptionID != "/ok" || got[1].Status != ReceiptDelivered {
+		t.Errorf("receipts = %+v", got)
+	}
+
+	// the callback receives the same final receipts
+	seen := map[string]string{}
+	for i := 0; i < 2; i++ {
+		select {
+		case r := <-receipts:
+			seen[r.SubscriptionID] = r.Status
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for receipt callbacks")
+		}
+	}
+	if seen["/ok"] != ReceiptDelivered || seen["/bad"] != ReceiptFailed {
+		t.Errorf("callback receipts = %v", seen)
+	}
+}
+
+// Test a quorum returns before slow subscribers answered, and the timeout reports pending ones
+func TestPublishAndWaitQuorum(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	v := NewVortexQ[any]()
+	for _, path := range []string{"/fast", "/slow"} {
+		if err := v.Subscribe(Subscription{ID: path, SubscriberAddress: server.URL + path, TopicName: "t"}); err != nil {
+			t.Fatalf("subscribe error: %v", err)
+		}
+	}
+	go func() { _ = v.Swirl() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, got, err := v.PublishAndWait(ctx, Message[any]{Pattern: "t"}, 1); err != nil || got[0].Status != ReceiptDelivered {
+		t.Errorf("quorum 1: receipts %+v, error %v", got, err)
+	}
+
+	short, cancelShort := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancelShort()
+	_, got, err := v.PublishAndWait(short, Message[any]{Pattern: "t"}, 0)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("all: error = %v; want context.DeadlineExceeded", err)
+	}
+	if len(got) != 2 || got[1].Status != ReceiptPending {
+		t.Errorf("all: receipts %+v; want /slow pending", got)
+	}
+
+	// nobody subscribed means nothing to wait for
+	if _, got, err := v.PublishAndWait(ctx, Message[any]{Pattern: "empty"}, 0); err != nil || len(got) != 0 {
+		t.Errorf("no subscribers: receipts %+v, error %v", got, err)
+	}
+}
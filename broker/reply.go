@@ -0,0 +1,55 @@
+package broker
+
+import (
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"log/slog"
+	"strconv"
+)
+
+// maxReplyBody bounds the subscriber response captured into a reply topic.
+const maxReplyBody = 1 << 20
+
+// publishReplies publishes the subscriber response to the reply topic of the
+// subscription and to the reply_to topic of a request. A request is only
+// answered by a response with a body or echoing its correlation ID, an empty
+// 202 leaves the reply to be published later.
+func (vq *VortexQ[T]) publishReplies(msg Message[T], sub Subscription, resp webhookResponse) {
+	if sub.ReplyTopic != "" {
+		vq.publishReply(sub.ReplyTopic, msg, sub, resp)
+	}
+	replied := len(resp.Body) > 0 || (msg.CorrelationID != "" && resp.CorrelationID == msg.CorrelationID)
+	if msg.ReplyTo != "" && msg.ReplyTo != sub.ReplyTopic && replied {
+		vq.publishReply(msg.ReplyTo, msg, sub, resp)
+	}
+}
+
+// publishReply publishes the subscriber response as a message correlated to the
+// delivered one, by its correlation ID when it has one.
+func (vq *VortexQ[T]) publishReply(topic string, msg Message[T], sub Subscription, resp webhookResponse) {
+	const op = "broker.VortexQ.publishReply"
+
+	correlationID := msg.CorrelationID
+	if correlationID == "" {
+		correlationID = msg.ID
+	}
+	reply := Message[T]{
+		ID:            NewID(),
+		Pattern:       topic,
+		Source:        "/vortexq/subscriptions/" + sub.ID,
+		ContentType:   resp.ContentType,
+		CorrelationID: correlationID,
+		Headers:       map[string]string{"status_code": strconv.Itoa(resp.StatusCode)},
+	}
+	if len(resp.Body) > 0 {
+		// without a content type, only a well-formed JSON body is decoded as JSON
+		if err := reply.SetPayload(resp.Body); err != nil {
+			vq.Logger.With(slog.String("op", op)).Error("can't capture reply", slog.String("subscription", sub.ID),
+				slog.String("message", msg.ID), logging.Err(err))
+			return
+		}
+	}
+	if _, err := vq.Publish(reply); err != nil {
+		vq.Logger.With(slog.String("op", op)).Error("can't publish reply", slog.String("subscription", sub.ID),
+			slog.String("message", msg.ID), logging.Err(err))
+	}
+}
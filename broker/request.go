@@ -0,0 +1,51 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+)
+
+// ReplyInboxPrefix prefixes the topics replies to requests are published to.
+const ReplyInboxPrefix = "_inbox."
+
+// Request publishes the message with reply_to and a fresh correlation_id set and
+// waits until a reply carrying that correlation ID is published or ctx is done.
+func (vq *VortexQ[T]) Request(ctx context.Context, msg Message[T]) (Message[T], error) {
+	const op = "broker.VortexQ.Request"
+	if msg.ID == "" {
+		msg.ID = NewID()
+	}
+	// the ID is up to the client, requests reusing it must not share replies
+	msg.CorrelationID = NewID()
+	msg.ReplyTo = ReplyInboxPrefix + msg.CorrelationID
+
+	replies := make(chan Message[T], 1)
+	vq.waiters.Store(msg.CorrelationID, replies)
+	defer vq.waiters.Delete(msg.CorrelationID)
+
+	if _, err := vq.Publish(msg); err != nil {
+		return Message[T]{}, fmt.Errorf("%s: %w", op, err)
+	}
+
+	select {
+	case reply := <-replies:
+		return reply, nil
+	case <-ctx.Done():
+		return Message[T]{}, fmt.Errorf("%s: %w", op, ctx.Err())
+	}
+}
+
+// completeRequest hands a published reply to the request waiting for it.
+func (vq *VortexQ[T]) completeRequest(msg Message[T]) {
+	// only replies published to the inbox of the request complete it, not the request itself
+	if msg.CorrelationID == "" || msg.Pattern != ReplyInboxPrefix+msg.CorrelationID {
+		return
+	}
+	if w, ok := vq.waiters.Load(msg.CorrelationID); ok {
+		select {
+		case w.(chan Message[T]) <- msg:
+		default:
+			// a reply was handed over already
+		}
+	}
+}
@@ -0,0 +1,188 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// swirlUntilDone keeps swirling like the app does, until the test ends
+func swirlUntilDone(t *testing.T, v *VortexQ[any]) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			_ = v.Swirl()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+}
+
+// Test Request returns the subscriber response as the reply
+func TestRequestReply(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-VortexQ-Reply-To") == "" || r.Header.Get("X-VortexQ-Correlation-ID") == "" {
+			t.Errorf("missing reply headers: %v", r.Header)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"answer":"pong"}`))
+	}))
+	defer server.Close()
+
+	v := NewVortexQ[any]()
+	if err := v.Subscribe(Subscription{ID: "svc", SubscriberAddress: server.URL, TopicName: "ping"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	swirlUntilDone(t, v)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := v.Request(ctx, Message[any]{ID: "r1", Pattern: "ping", Data: "ping"})
+	if err != nil {
+		t.Fatalf("Request error: %v", err)
+	}
+	if reply.CorrelationID == "" || reply.CorrelationID == "r1" || !reflect.DeepEqual(reply.Data, map[string]any{"answer": "pong"}) {
+		t.Errorf("reply = %+v", reply)
+	}
+	if reply.Pattern != ReplyInboxPrefix+reply.CorrelationID {
+		t.Errorf("reply topic = %q; want %q", reply.Pattern, ReplyInboxPrefix+reply.CorrelationID)
+	}
+	if _, ok := v.Topics.Load(reply.Pattern); ok {
+		t.Errorf("inbox %q retained as a topic", reply.Pattern)
+	}
+}
+
+// Test a 202 Accepted without an ack token is published as a reply too
+func TestReplyAccepted(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	v := NewVortexQ[any]()
+	if err := v.Subscribe(Subscription{ID: "worker", SubscriberAddress: server.URL, TopicName: "jobs", ReplyTopic: "results"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	v.Publish(Message[any]{ID: "job-1", Pattern: "jobs"})
+	_ = v.Swirl()
+	if replies := v.Messages("results"); len(replies) != 1 || replies[0].Headers["status_code"] != "202" {
+		t.Errorf("replies = %+v; want the 202 response", replies)
+	}
+}
+
+// Test a reply published later by the subscriber completes the request
+func TestRequestAsyncReply(t *testing.T) {
+	v := NewVortexQ[any]()
+	v.PublicURL = "http://vq.example.com"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		correlationID := r.Header.Get("X-VortexQ-Correlation-ID")
+		go v.Publish(Message[any]{ID: "answer", Pattern: r.Header.Get("X-VortexQ-Reply-To"), Data: "later", CorrelationID: correlationID})
+	}))
+	defer server.Close()
+	if err := v.Subscribe(Subscription{ID: "svc", SubscriberAddress: server.URL, TopicName: "jobs", AckMode: AckModeAsync}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	swirlUntilDone(t, v)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := v.Request(ctx, Message[any]{Pattern: "jobs"})
+	if err != nil {
+		t.Fatalf("Request error: %v", err)
+	}
+	if reply.ID != "answer" || reply.Data != "later" {
+		t.Errorf("reply = %+v", reply)
+	}
+}
+
+// Test Request gives up when nobody answers
+func TestRequestTimeout(t *testing.T) {
+	v := NewVortexQ[any]()
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := v.Request(ctx, Message[any]{Pattern: "nobody"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Request error = %v; want context.DeadlineExceeded", err)
+	}
+	msgs := v.Messages("nobody")
+	if len(msgs) != 1 || msgs[0].CorrelationID == "" || msgs[0].CorrelationID == msgs[0].ID ||
+		msgs[0].ReplyTo != ReplyInboxPrefix+msgs[0].CorrelationID {
+		t.Errorf("request message = %+v", msgs)
+	}
+}
+
+// Test requests reusing a message ID each get their own reply
+func TestRequestReusedID(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var wreq WebhookRequest[any]
+		_ = json.NewDecoder(r.Body).Decode(&wreq)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(wreq.EventData.Data)
+	}))
+	defer server.Close()
+	v := NewVortexQ[any]()
+	if err := v.Subscribe(Subscription{ID: "echo", SubscriberAddress: server.URL, TopicName: "echo"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	swirlUntilDone(t, v)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, data := range []string{"a", "b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, err := v.Request(ctx, Message[any]{ID: "same", Pattern: "echo", Data: data})
+			if err != nil || reply.Data != data {
+				t.Errorf("Request(%q) = %+v, %v", data, reply.Data, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Test an empty sync response doesn't answer the request, an echoed correlation ID does
+func TestRequestEmptyResponse(t *testing.T) {
+	echo := make(chan bool, 2)
+	echo <- false
+	echo <- true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if <-echo {
+			w.Header().Set("X-VortexQ-Correlation-ID", r.Header.Get("X-VortexQ-Correlation-ID"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+	v := NewVortexQ[any]()
+	if err := v.Subscribe(Subscription{ID: "svc", SubscriberAddress: server.URL, TopicName: "jobs"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	swirlUntilDone(t, v)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := v.Request(ctx, Message[any]{Pattern: "jobs"}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Request answered by an empty 202: %v", err)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := v.Request(ctx, Message[any]{Pattern: "jobs"})
+	if err != nil || reply.Headers["status_code"] != "204" {
+		t.Errorf("Request = %+v, %v; want the 204 response", reply, err)
+	}
+}
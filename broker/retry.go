@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy decides whether and when a failed delivery is attempted again.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts per message and subscription
+	MaxAttempts int
+	// BaseDelay is the delay before the first retry, doubled on every attempt
+	BaseDelay time.Duration
+	// MaxDelay caps the exponential backoff, Retry-After is honoured as sent
+	MaxDelay time.Duration
+	// PermanentFailureCodes are response codes that are never retried
+	PermanentFailureCodes map[int]bool
+}
+
+// DefaultRetryPolicy returns the policy used when nothing is configured.
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   time.Second,
+		MaxDelay:    5 * time.Minute,
+		PermanentFailureCodes: map[int]bool{
+			http.StatusBadRequest:            true,
+			http.StatusUnauthorized:          true,
+			http.StatusForbidden:             true,
+			http.StatusMethodNotAllowed:      true,
+			http.StatusRequestEntityTooLarge: true,
+			http.StatusUnsupportedMediaType:  true,
+			http.StatusUnprocessableEntity:   true,
+		},
+	}
+}
+
+// pendingDelivery is a delivery waiting for its next attempt.
+type pendingDelivery[T any] struct {
+	msg       Message[T]
+	sub       Subscription
+	attempt   int
+	notBefore time.Time
+	// ackToken identifies the attempt of an async subscription
+	ackToken string
+}
+
+// backoff returns the delay before the given attempt number.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := p.BaseDelay
+	for i := 2; i < attempt && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	return delay
+}
+
+// parseRetryAfter reads a Retry-After header given either in seconds or as an HTTP date.
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
@@ -0,0 +1,103 @@
+package broker
+
+import "fmt"
+
+const (
+	// SubscriptionActive subscriptions receive deliveries
+	SubscriptionActive = "active"
+	// SubscriptionDisabled subscriptions are skipped, e.g. after a 410 Gone
+	SubscriptionDisabled = "disabled"
+)
+
+// Active reports whether the subscription should receive deliveries.
+func (s Subscription) Active() bool {
+	return s.State != SubscriptionDisabled
+}
+
+// FindSubscription looks a subscription up by its ID.
+func (vq *VortexQ[T]) FindSubscription(id string) (Subscription, bool) {
+	var found Subscription
+	var ok bool
+	vq.Subscriptions.Range(func(_, value interface{}) bool {
+		for _, sub := range value.([]Subscription) {
+			if sub.ID == id {
+				found, ok = sub, true
+				return false
+			}
+		}
+		return true
+	})
+	return found, ok
+}
+
+// ListSubscriptions returns all subscriptions across topics.
+func (vq *VortexQ[T]) ListSubscriptions() []Subscription {
+	subs := make([]Subscription, 0)
+	vq.Subscriptions.Range(func(_, value interface{}) bool {
+		subs = append(subs, value.([]Subscription)...)
+		return true
+	})
+	return subs
+}
+
+// setSubscriptionState updates the state of every subscription with the given ID.
+func (vq *VortexQ[T]) setSubscriptionState(id, state, reason string) {
+	vq.updateSubscription(id, func(s *Subscription) {
+		s.State = state
+		s.StateReason = reason
+	})
+}
+
+// updateSubscription applies update to every subscription with the given ID.
+func (vq *VortexQ[T]) updateSubscription(id string, update func(*Subscription)) {
+	vq.subsMu.Lock()
+	defer vq.subsMu.Unlock()
+
+	vq.Subscriptions.Range(func(key, value interface{}) bool {
+		subs := value.([]Subscription)
+		for i := range subs {
+			if subs[i].ID != id {
+				continue
+			}
+			// copy on write, readers may still hold the old slice
+			updated := append([]Subscription(nil), subs...)
+			for j := range updated {
+				if updated[j].ID == id {
+					update(&updated[j])
+				}
+			}
+			vq.Subscriptions.Store(key, updated)
+			break
+		}
+		return true
+	})
+}
+
+// Unsubscribe removes every subscription with the given ID together with its cursor.
+func (vq *VortexQ[T]) Unsubscribe(id string) error {
+	const op = "broker.VortexQ.Unsubscribe"
+	vq.subsMu.Lock()
+	defer vq.subsMu.Unlock()
+
+	found := false
+	vq.Subscriptions.Range(func(key, value interface{}) bool {
+		subs := value.([]Subscription)
+		kept := make([]Subscription, 0, len(subs))
+		for _, sub := range subs {
+			if sub.ID == id {
+				found = true
+				continue
+			}
+			kept = append(kept, sub)
+		}
+		if len(kept) != len(subs) {
+			vq.Subscriptions.Store(key, kept)
+		}
+		return true
+	})
+	if !found {
+		return fmt.Errorf("%s: subscription %q: %w", op, id, ErrNotFound)
+	}
+	vq.deleteCursors(id)
+	return nil
+}
@@ -0,0 +1,110 @@
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DeliveryTemplate rewrites the outgoing webhook request of a subscription.
+// Headers and Body are Go text/template strings rendered with TemplateData.
+type DeliveryTemplate struct {
+	Method  string            `json:"method,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+}
+
+// TemplateData is what delivery templates are rendered with.
+type TemplateData[T any] struct {
+	Message   Message[T]
+	Topic     string
+	Timestamp time.Time
+}
+
+// RenderedRequest is the outcome of rendering a DeliveryTemplate.
+type RenderedRequest struct {
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+}
+
+var templateMethods = map[string]bool{
+	http.MethodPost: true, http.MethodPut: true, http.MethodPatch: true,
+	http.MethodGet: true, http.MethodDelete: true,
+}
+
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// Validate parses all templates and checks the method.
+func (dt DeliveryTemplate) Validate() error {
+	_, _, err := dt.parse()
+	return err
+}
+
+// RenderTemplate renders the delivery template for the given message.
+func RenderTemplate[T any](dt DeliveryTemplate, msg Message[T]) (RenderedRequest, error) {
+	body, headers, err := dt.parse()
+	if err != nil {
+		return RenderedRequest{}, err
+	}
+
+	data := TemplateData[T]{Message: msg, Topic: msg.Pattern, Timestamp: time.Now().UTC()}
+	render := func(t *template.Template) (string, error) {
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return "", fmt.Errorf("%w: rendering %s: %v", ErrInvalidSubscription, t.Name(), err)
+		}
+		return buf.String(), nil
+	}
+
+	rendered := RenderedRequest{Method: http.MethodPost, Headers: make(map[string]string, len(headers))}
+	if dt.Method != "" {
+		rendered.Method = strings.ToUpper(dt.Method)
+	}
+	for name, t := range headers {
+		if rendered.Headers[name], err = render(t); err != nil {
+			return RenderedRequest{}, err
+		}
+	}
+	if rendered.Body, err = render(body); err != nil {
+		return RenderedRequest{}, err
+	}
+	if _, ok := rendered.Headers["Content-Type"]; !ok {
+		rendered.Headers["Content-Type"] = "application/json"
+	}
+	return rendered, nil
+}
+
+func (dt DeliveryTemplate) parse() (*template.Template, map[string]*template.Template, error) {
+	if dt.Method != "" && !templateMethods[strings.ToUpper(dt.Method)] {
+		return nil, nil, fmt.Errorf("%w: template method %q is not supported", ErrInvalidSubscription, dt.Method)
+	}
+	body, err := template.New("body").Funcs(templateFuncs).Option("missingkey=error").Parse(dt.Body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: template body: %v", ErrInvalidSubscription, err)
+	}
+	headers := make(map[string]*template.Template, len(dt.Headers))
+	for name, value := range dt.Headers {
+		canonical := http.CanonicalHeaderKey(name)
+		if canonical == "" || strings.ContainsAny(canonical, " :\r\n") {
+			return nil, nil, fmt.Errorf("%w: template header name %q is invalid", ErrInvalidSubscription, name)
+		}
+		t, err := template.New("header " + canonical).Funcs(templateFuncs).Option("missingkey=error").Parse(value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: template header %s: %v", ErrInvalidSubscription, canonical, err)
+		}
+		headers[canonical] = t
+	}
+	return body, headers, nil
+}
@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test RenderTemplate rewrites method, headers and body from the message
+func TestRenderTemplate(t *testing.T) {
+	dt := DeliveryTemplate{
+		Method:  "put",
+		Headers: map[string]string{"x-event-id": "{{.Message.ID}}"},
+		Body:    `{"text":{{json (printf "%s on %s" .Message.Data .Topic)}}}`,
+	}
+	got, err := RenderTemplate(dt, Message[string]{ID: "7", Pattern: "alerts", Data: "disk full"})
+	if err != nil {
+		t.Fatalf("RenderTemplate error: %v", err)
+	}
+	if got.Method != http.MethodPut {
+		t.Errorf("Method = %q; want %q", got.Method, http.MethodPut)
+	}
+	if got.Headers["X-Event-Id"] != "7" || got.Headers["Content-Type"] != "application/json" {
+		t.Errorf("Headers = %v", got.Headers)
+	}
+	if want := `{"text":"disk full on alerts"}`; got.Body != want {
+		t.Errorf("Body = %s; want %s", got.Body, want)
+	}
+}
+
+// Test invalid templates are reported as invalid subscriptions
+func TestTemplateValidate(t *testing.T) {
+	for name, dt := range map[string]DeliveryTemplate{
+		"method": {Method: "TRACE"},
+		"body":   {Body: "{{.Message.ID"},
+		"header": {Headers: map[string]string{"X-A": "{{end}}"}},
+		"name":   {Headers: map[string]string{"bad name": "x"}},
+	} {
+		if err := dt.Validate(); !errors.Is(err, ErrInvalidSubscription) {
+			t.Errorf("%s: Validate() = %v; want ErrInvalidSubscription", name, err)
+		}
+	}
+
+	// execution errors surface at render time
+	_, err := RenderTemplate(DeliveryTemplate{Body: "{{.Nope}}"}, Message[string]{})
+	if !errors.Is(err, ErrInvalidSubscription) {
+		t.Errorf("RenderTemplate() = %v; want ErrInvalidSubscription", err)
+	}
+}
+
+// Test the delivery honours the subscription template
+func TestDeliverWithTemplate(t *testing.T) {
+	var method, body, header string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		method, body, header = r.Method, string(b), r.Header.Get("X-Topic")
+	}))
+	defer server.Close()
+
+	v := NewVortexQ[string]()
+	sub := Subscription{ID: "s", SubscriberAddress: server.URL, TopicName: "t", Template: &DeliveryTemplate{
+		Method:  http.MethodPatch,
+		Headers: map[string]string{"X-Topic": "{{.Topic | upper}}"},
+		Body:    "{{.Message.Data}}",
+	}}
+	if err := v.Subscribe(sub); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	if _, err := v.postWebhook(Message[string]{ID: "1", Pattern: "t", Data: "raw"}, sub, ""); err != nil {
+		t.Fatalf("postWebhook error: %v", err)
+	}
+	if method != http.MethodPatch || body != "raw" || header != "T" {
+		t.Errorf("got %s %q with X-Topic %q", method, body, header)
+	}
+
+	sub.Template = &DeliveryTemplate{Body: "{{"}
+	if err := v.Subscribe(sub); !errors.Is(err, ErrInvalidSubscription) {
+		t.Errorf("Subscribe with invalid template = %v; want ErrInvalidSubscription", err)
+	}
+}
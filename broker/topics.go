@@ -0,0 +1,320 @@
+package broker
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// StartEarliest starts a subscription at the oldest retained message
+	StartEarliest = "earliest"
+	// StartLatest starts a subscription with the next published message, it is the default
+	StartLatest = "latest"
+	// StartTimestamp starts a subscription at the first message published at or after Time
+	StartTimestamp = "timestamp"
+	// StartOffset starts a subscription at Offset
+	StartOffset = "offset"
+
+	// DefaultRetentionMaxMessages bounds the number of retained messages per topic
+	DefaultRetentionMaxMessages = 10000
+	// DefaultRetentionMaxAge bounds the age of retained messages
+	DefaultRetentionMaxAge = 24 * time.Hour
+)
+
+// ErrNotFound is returned when a subscription or topic doesn't exist.
+var ErrNotFound = errors.New("not found")
+
+// StartPosition tells where in a topic a subscription starts reading.
+type StartPosition struct {
+	From   string    `json:"from"`
+	Time   time.Time `json:"time,omitzero"`
+	Offset int64     `json:"offset,omitempty"`
+}
+
+// Retention bounds how many messages topics keep for replay.
+type Retention struct {
+	MaxMessages int
+	MaxAge      time.Duration
+}
+
+// DefaultRetention returns the retention used when nothing is configured.
+func DefaultRetention() Retention {
+	return Retention{MaxMessages: DefaultRetentionMaxMessages, MaxAge: DefaultRetentionMaxAge}
+}
+
+// Validate checks the position is one of the known kinds.
+func (sp StartPosition) Validate() error {
+	switch sp.From {
+	case "", StartEarliest, StartLatest, StartOffset:
+	case StartTimestamp:
+		if sp.Time.IsZero() {
+			return fmt.Errorf("%w: start position %q needs a time", ErrInvalidSubscription, sp.From)
+		}
+	default:
+		return fmt.Errorf("%w: unknown start position %q", ErrInvalidSubscription, sp.From)
+	}
+	return nil
+}
+
+// TopicInfo describes a topic by the offsets it retains.
+type TopicInfo struct {
+	Name string `json:"name"`
+	// FirstOffset is the offset of the oldest retained message
+	FirstOffset int64 `json:"first_offset"`
+	// NextOffset is the offset the next published message gets
+	NextOffset int64 `json:"next_offset"`
+}
+
+// topicLog holds the retained messages of a topic, each with its offset.
+type topicLog[T any] struct {
+	mu      sync.RWMutex
+	entries []logEntry[T]
+	// next is the offset the next published message gets
+	next int64
+	// dropped is set once the log was removed from the topics
+	dropped bool
+}
+
+type logEntry[T any] struct {
+	msg         Message[T]
+	publishedAt time.Time
+}
+
+// append reports false when the log was dropped, the message goes to the new log of the topic.
+func (tl *topicLog[T]) append(msg Message[T], now time.Time, retention Retention) (int64, bool) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	if tl.dropped {
+		return 0, false
+	}
+	msg.Offset = tl.next
+	tl.next++
+	tl.entries = append(tl.entries, logEntry[T]{msg: msg, publishedAt: now})
+	tl.trim(now, retention)
+	return msg.Offset, true
+}
+
+// trim must be called with the lock held.
+func (tl *topicLog[T]) trim(now time.Time, retention Retention) {
+	drop := 0
+	if retention.MaxMessages > 0 && len(tl.entries) > retention.MaxMessages {
+		drop = len(tl.entries) - retention.MaxMessages
+	}
+	if retention.MaxAge > 0 {
+		cutoff := now.Add(-retention.MaxAge)
+		for drop < len(tl.entries) && tl.entries[drop].publishedAt.Before(cutoff) {
+			drop++
+		}
+	}
+	tl.entries = tl.entries[drop:]
+}
+
+// first returns the offset of the oldest retained message.
+func (tl *topicLog[T]) first() int64 {
+	if len(tl.entries) == 0 {
+		return tl.next
+	}
+	return tl.entries[0].msg.Offset
+}
+
+// from returns up to limit messages starting at offset, limit <= 0 means all.
+// The returned offset is where the next read continues.
+func (tl *topicLog[T]) from(offset int64, limit int) ([]Message[T], int64) {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+
+	if offset < tl.first() {
+		offset = tl.first()
+	}
+	start := int(offset - tl.first())
+	if start >= len(tl.entries) {
+		return nil, tl.next
+	}
+	end := len(tl.entries)
+	if limit > 0 && start+limit < end {
+		end = start + limit
+	}
+	msgs := make([]Message[T], 0, end-start)
+	for _, e := range tl.entries[start:end] {
+		msgs = append(msgs, e.msg)
+	}
+	return msgs, offset + int64(len(msgs))
+}
+
+// resolve turns a start position into an offset.
+func (tl *topicLog[T]) resolve(sp StartPosition) int64 {
+	tl.mu.RLock()
+	defer tl.mu.RUnlock()
+
+	switch sp.From {
+	case StartEarliest:
+		return tl.first()
+	case StartTimestamp:
+		i := sort.Search(len(tl.entries), func(i int) bool {
+			return !tl.entries[i].publishedAt.Before(sp.Time)
+		})
+		if i == len(tl.entries) {
+			return tl.next
+		}
+		return tl.entries[i].msg.Offset
+	case StartOffset:
+		return min(max(sp.Offset, tl.first()), tl.next)
+	default:
+		return tl.next
+	}
+}
+
+// topic returns the log of the named topic, creating it when missing.
+func (vq *VortexQ[T]) topic(name string) (*topicLog[T], bool) {
+	if tl, ok := vq.Topics.Load(name); ok {
+		return tl.(*topicLog[T]), false
+	}
+	tl, loaded := vq.Topics.LoadOrStore(name, &topicLog[T]{})
+	return tl.(*topicLog[T]), !loaded
+}
+
+// Messages returns the retained messages of a topic, oldest first.
+func (vq *VortexQ[T]) Messages(topic string) []Message[T] {
+	tl, ok := vq.Topics.Load(topic)
+	if !ok {
+		return nil
+	}
+	msgs, _ := tl.(*topicLog[T]).from(0, 0)
+	return msgs
+}
+
+// ReadTopic returns up to limit messages of a topic starting at offset, limit <= 0
+// means all. The returned offset is where the next read continues.
+func (vq *VortexQ[T]) ReadTopic(topic string, offset int64, limit int) ([]Message[T], int64, error) {
+	const op = "broker.VortexQ.ReadTopic"
+	tl, ok := vq.Topics.Load(topic)
+	if !ok {
+		return nil, 0, fmt.Errorf("%s: topic %q: %w", op, topic, ErrNotFound)
+	}
+	msgs, next := tl.(*topicLog[T]).from(offset, limit)
+	return msgs, next, nil
+}
+
+// ListTopics returns the topics sorted by name.
+func (vq *VortexQ[T]) ListTopics() []TopicInfo {
+	var topics []TopicInfo
+	vq.Topics.Range(func(key, value any) bool {
+		tl := value.(*topicLog[T])
+		tl.mu.RLock()
+		topics = append(topics, TopicInfo{Name: key.(string), FirstOffset: tl.first(), NextOffset: tl.next})
+		tl.mu.RUnlock()
+		return true
+	})
+	sort.Slice(topics, func(i, j int) bool { return topics[i].Name < topics[j].Name })
+	return topics
+}
+
+// TopicOffset resolves a start position in a topic to an offset.
+func (vq *VortexQ[T]) TopicOffset(topic string, position StartPosition) (int64, error) {
+	const op = "broker.VortexQ.TopicOffset"
+	if err := position.Validate(); err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	tl, ok := vq.Topics.Load(topic)
+	if !ok {
+		return 0, fmt.Errorf("%s: topic %q: %w", op, topic, ErrNotFound)
+	}
+	return tl.(*topicLog[T]).resolve(position), nil
+}
+
+// Seek moves the cursor of a subscription, so that it replays or skips messages.
+func (vq *VortexQ[T]) Seek(subscriptionID string, position StartPosition) error {
+	const op = "broker.VortexQ.Seek"
+	if err := position.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	found := false
+	for _, sub := range vq.ListSubscriptions() {
+		if sub.ID != subscriptionID {
+			continue
+		}
+		found = true
+		if !IsTopicPattern(sub.TopicName) {
+			vq.topic(sub.TopicName)
+		}
+		for name, tl := range vq.topicsMatching(sub.TopicName) {
+			vq.setCursor(name, sub, tl.resolve(position))
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s: subscription %q: %w", op, subscriptionID, ErrNotFound)
+	}
+	return nil
+}
+
+// cursorKey identifies the cursor of a subscription in a topic, pattern
+// subscriptions have one per matching topic.
+func cursorKey(topic, subscriptionID string) string {
+	return topic + "\x00" + subscriptionID
+}
+
+func (vq *VortexQ[T]) setCursor(topic string, sub Subscription, offset int64) {
+	vq.cursors.Store(cursorKey(topic, sub.ID), offset)
+}
+
+// cursor returns the next offset of the subscription in the topic, a topic
+// unknown to the subscription, i.e. created after a pattern subscribed, starts
+// at its first message.
+func (vq *VortexQ[T]) cursor(topic string, sub Subscription) int64 {
+	offset, _ := vq.cursors.LoadOrStore(cursorKey(topic, sub.ID), int64(0))
+	return offset.(int64)
+}
+
+// advanceCursor moves the cursor from old to next unless it was moved meanwhile, e.g. by Seek.
+func (vq *VortexQ[T]) advanceCursor(topic string, sub Subscription, old, next int64) {
+	vq.cursors.CompareAndSwap(cursorKey(topic, sub.ID), old, next)
+}
+
+// deleteCursors drops the cursors of a subscription in every topic.
+func (vq *VortexQ[T]) deleteCursors(subscriptionID string) {
+	vq.cursors.Range(func(key, _ any) bool {
+		if strings.HasSuffix(key.(string), "\x00"+subscriptionID) {
+			vq.cursors.Delete(key)
+		}
+		return true
+	})
+}
+
+// isInbox reports whether the topic is a reply inbox, NATS clients name theirs _INBOX.
+func isInbox(topic string) bool {
+	return len(topic) > len(ReplyInboxPrefix) && strings.EqualFold(topic[:len(ReplyInboxPrefix)], ReplyInboxPrefix)
+}
+
+// dropConsumedInboxes removes the inboxes whose messages every subscription
+// read, together with their cursors, replies are private to a requester.
+func (vq *VortexQ[T]) dropConsumedInboxes() {
+	vq.Topics.Range(func(key, value any) bool {
+		name, tl := key.(string), value.(*topicLog[T])
+		if !isInbox(name) {
+			return true
+		}
+		subs := vq.subscriptionsFor(name)
+		tl.mu.Lock()
+		for _, sub := range subs {
+			if vq.cursor(name, sub) < tl.next {
+				tl.mu.Unlock()
+				return true
+			}
+		}
+		tl.dropped = true
+		vq.Topics.CompareAndDelete(name, tl)
+		tl.mu.Unlock()
+		vq.cursors.Range(func(key, _ any) bool {
+			if strings.HasPrefix(key.(string), name+"\x00") {
+				vq.cursors.Delete(key)
+			}
+			return true
+		})
+		return true
+	})
+}
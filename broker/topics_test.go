@@ -0,0 +1,221 @@
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recorder is a webhook endpoint remembering the IDs it received
+type recorder struct {
+	mu  sync.Mutex
+	ids []string
+	*httptest.Server
+}
+
+func newRecorder(t *testing.T) *recorder {
+	rec := &recorder{}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req WebhookRequest[string]
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("decode error: %v", err)
+		}
+		rec.mu.Lock()
+		rec.ids = append(rec.ids, req.EventData.ID)
+		rec.mu.Unlock()
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+func (rec *recorder) take() map[string]bool {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	got := make(map[string]bool, len(rec.ids))
+	for _, id := range rec.ids {
+		got[id] = true
+	}
+	rec.ids = nil
+	return got
+}
+
+// Test a subscription starts at the requested position
+func TestSubscribeStartPosition(t *testing.T) {
+	v := NewVortexQ[string]()
+	for _, id := range []string{"a", "b", "c"} {
+		v.Publish(Message[string]{ID: id, Pattern: "t", Data: id})
+	}
+
+	tests := map[string]struct {
+		start *StartPosition
+		want  int
+	}{
+		"default":  {nil, 0},
+		"latest":   {&StartPosition{From: StartLatest}, 0},
+		"earliest": {&StartPosition{From: StartEarliest}, 3},
+		"offset":   {&StartPosition{From: StartOffset, Offset: 1}, 2},
+		"past":     {&StartPosition{From: StartTimestamp, Time: time.Now().Add(-time.Hour)}, 3},
+		"future":   {&StartPosition{From: StartTimestamp, Time: time.Now().Add(time.Hour)}, 0},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			rec := newRecorder(t)
+			sub := Subscription{ID: name, SubscriberAddress: rec.URL, TopicName: "t", Start: tt.start}
+			if err := v.Subscribe(sub); err != nil {
+				t.Fatalf("subscribe error: %v", err)
+			}
+			if err := v.Swirl(); err != nil {
+				t.Fatalf("Swirl error: %v", err)
+			}
+			if got := rec.take(); len(got) != tt.want {
+				t.Errorf("received %v; want %d messages", got, tt.want)
+			}
+		})
+	}
+
+	err := v.Subscribe(Subscription{ID: "x", SubscriberAddress: "http://h", TopicName: "t", Start: &StartPosition{From: "middle"}})
+	if !errors.Is(err, ErrInvalidSubscription) {
+		t.Errorf("unknown start position error = %v; want ErrInvalidSubscription", err)
+	}
+}
+
+// Test Seek rewinds a subscription to replay retained messages
+func TestSeekReplays(t *testing.T) {
+	v := NewVortexQ[string]()
+	rec := newRecorder(t)
+	if err := v.Subscribe(Subscription{ID: "s", SubscriberAddress: rec.URL, TopicName: "t"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	v.Publish(Message[string]{ID: "a", Pattern: "t"})
+	v.Publish(Message[string]{ID: "b", Pattern: "t"})
+	if err := v.Swirl(); err != nil {
+		t.Fatalf("Swirl error: %v", err)
+	}
+	if got := rec.take(); len(got) != 2 {
+		t.Fatalf("first pass received %v; want 2 messages", got)
+	}
+
+	if err := v.Seek("s", StartPosition{From: StartOffset, Offset: 1}); err != nil {
+		t.Fatalf("Seek error: %v", err)
+	}
+	if err := v.Swirl(); err != nil {
+		t.Fatalf("Swirl error: %v", err)
+	}
+	if got := rec.take(); len(got) != 1 || !got["b"] {
+		t.Errorf("replay received %v; want only b", got)
+	}
+
+	if err := v.Seek("missing", StartPosition{From: StartEarliest}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Seek unknown subscription = %v; want ErrNotFound", err)
+	}
+}
+
+// Test retention trims topics by count and by age
+func TestRetention(t *testing.T) {
+	v := NewVortexQ[string]()
+	v.Retention = Retention{MaxMessages: 2, MaxAge: time.Hour}
+	for _, id := range []string{"a", "b", "c"} {
+		v.Publish(Message[string]{ID: id, Pattern: "t"})
+	}
+	msgs := v.Messages("t")
+	if len(msgs) != 2 || msgs[0].ID != "b" || msgs[0].Offset != 1 {
+		t.Fatalf("retained %+v; want b and c", msgs)
+	}
+
+	tl, _ := v.topic("t")
+	tl.mu.Lock()
+	tl.trim(time.Now().Add(2*time.Hour), v.Retention)
+	tl.mu.Unlock()
+	if msgs := v.Messages("t"); len(msgs) != 0 {
+		t.Errorf("expired messages retained: %+v", msgs)
+	}
+	// offsets keep growing after the topic was emptied
+	if offset, err := v.Publish(Message[string]{ID: "d", Pattern: "t"}); err != nil || offset != 3 {
+		t.Errorf("offset after trim = %d, %v; want 3", offset, err)
+	}
+}
+
+// Test a topic is read in pages from an offset
+func TestReadTopic(t *testing.T) {
+	v := NewVortexQ[string]()
+	if _, _, err := v.ReadTopic("t", 0, 0); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("ReadTopic of a missing topic error = %v; want ErrNotFound", err)
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		v.Publish(Message[string]{ID: id, Pattern: "t"})
+	}
+	msgs, next, err := v.ReadTopic("t", 1, 1)
+	if err != nil || len(msgs) != 1 || msgs[0].ID != "b" || next != 2 {
+		t.Fatalf("ReadTopic(t, 1, 1) = %+v, %d, %v; want b and 2", msgs, next, err)
+	}
+	msgs, next, _ = v.ReadTopic("t", 10, 0)
+	if len(msgs) != 0 || next != 3 {
+		t.Errorf("ReadTopic past the end = %+v, %d; want nothing and 3", msgs, next)
+	}
+}
+
+// Test topics list their offsets and resolve start positions
+func TestListTopics(t *testing.T) {
+	v := NewVortexQ[string]()
+	v.Retention = Retention{MaxMessages: 2}
+	for _, topic := range []string{"b", "a", "a", "a"} {
+		v.Publish(Message[string]{ID: topic, Pattern: topic})
+	}
+	want := []TopicInfo{{Name: "a", FirstOffset: 1, NextOffset: 3}, {Name: "b", FirstOffset: 0, NextOffset: 1}}
+	if got := v.ListTopics(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ListTopics = %+v; want %+v", got, want)
+	}
+
+	for position, want := range map[string]int64{StartEarliest: 1, StartLatest: 3} {
+		if got, err := v.TopicOffset("a", StartPosition{From: position}); err != nil || got != want {
+			t.Errorf("TopicOffset(a, %s) = %d, %v; want %d", position, got, err, want)
+		}
+	}
+	if got, _ := v.TopicOffset("a", StartPosition{From: StartTimestamp, Time: time.Now().Add(-time.Hour)}); got != 1 {
+		t.Errorf("TopicOffset of an hour ago = %d; want 1", got)
+	}
+	if _, err := v.TopicOffset("c", StartPosition{From: StartEarliest}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("TopicOffset of a missing topic error = %v; want ErrNotFound", err)
+	}
+}
+
+// Test inboxes are dropped once every subscription read their replies
+func TestDropConsumedInboxes(t *testing.T) {
+	rec := newRecorder(t)
+	v := NewVortexQ[string]()
+	if offset, err := v.Publish(Message[string]{ID: "lost", Pattern: "_INBOX.abc.1"}); err != nil || offset != 0 {
+		t.Errorf("publish to inbox without subscribers = %d, %v", offset, err)
+	}
+	if _, ok := v.Topics.Load("_INBOX.abc.1"); ok {
+		t.Error("inbox without subscribers retained")
+	}
+
+	if err := v.Subscribe(Subscription{ID: "requester", SubscriberAddress: rec.URL, TopicName: "_INBOX.abc.*"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	v.Publish(Message[string]{ID: "reply", Pattern: "_INBOX.abc.2"})
+	v.Publish(Message[string]{ID: "kept", Pattern: "orders"})
+	_ = v.Swirl()
+
+	if got := rec.take(); !got["reply"] {
+		t.Errorf("delivered %v; want reply", got)
+	}
+	if _, ok := v.Topics.Load("_INBOX.abc.2"); ok {
+		t.Error("consumed inbox retained")
+	}
+	if _, ok := v.Topics.Load("orders"); !ok {
+		t.Error("topic dropped; only inboxes are")
+	}
+	v.cursors.Range(func(key, _ any) bool {
+		if strings.HasPrefix(key.(string), "_INBOX.") {
+			t.Errorf("cursor %q retained", key)
+		}
+		return true
+	})
+}
@@ -0,0 +1,58 @@
+package amqp_app
+
+import (
+	"context"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Protocol marks the subscriptions consumed over AMQP.
+const Protocol = "amqp"
+
+type App struct {
+	log    *slog.Logger
+	funcs  broker.VortexQFuncs
+	server *tcpserver.Server
+
+	// heartbeat is the interval the server proposes in connection.tune
+	heartbeat time.Duration
+
+	mu        sync.Mutex
+	exchanges map[string]*exchange
+	queues    map[string]*queue
+}
+
+// New creates new AMQP app listening on addr, exchanges and queues map onto
+// broker topics and subscriptions.
+func New(log *slog.Logger, funcs broker.VortexQFuncs, addr string) *App {
+	a := &App{
+		log:       log,
+		funcs:     funcs,
+		heartbeat: _heartbeat,
+		exchanges: builtinExchanges(),
+		queues:    make(map[string]*queue),
+	}
+	a.server = tcpserver.New(log, Protocol, addr, a.handle)
+	return a
+}
+
+// MustRun runs AMQP server and panics if any error occurs.
+func (a *App) MustRun() {
+	if err := a.server.Run(); err != nil {
+		panic(err)
+	}
+}
+
+// Ready is closed once the server accepts connections.
+func (a *App) Ready() <-chan struct{} {
+	return a.server.Ready()
+}
+
+// Stop closes the listener and the client connections, waiting for them to end
+// until timeoutCtx is done.
+func (a *App) Stop(timeoutCtx context.Context) error {
+	return a.server.Stop(timeoutCtx)
+}
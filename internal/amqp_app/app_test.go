@@ -0,0 +1,269 @@
+package amqp_app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver/tcpservertest"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// startApp serves AMQP on a loopback port, swirls the broker and returns its URL
+func startApp(t *testing.T) (*broker.VortexQ[any], string) {
+	t.Helper()
+	vq := broker.NewVortexQ[any]()
+	vq.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	vq.Retry.BaseDelay = 10 * time.Millisecond
+	app := New(vq.Logger, vq, "127.0.0.1:0")
+
+	addr := tcpservertest.Start(t, vq, app.server.Serve, app.Stop)
+	return vq, "amqp://guest:guest@" + addr + "/"
+}
+
+func open(t *testing.T, url string) *amqp.Channel {
+	t.Helper()
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatalf("channel error: %v", err)
+	}
+	return ch
+}
+
+func next(t *testing.T, deliveries <-chan amqp.Delivery) amqp.Delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(2 * time.Second):
+		t.Fatal("no delivery")
+		return amqp.Delivery{}
+	}
+}
+
+// Test topic exchange bindings route AMQP and VortexQ messages onto the queue
+func TestPublishConsume(t *testing.T) {
+	vq, url := startApp(t)
+	ch := open(t, url)
+	ctx := context.Background()
+
+	if err := ch.ExchangeDeclare("orders", "topic", true, false, false, false, nil); err != nil {
+		t.Fatalf("exchange declare error: %v", err)
+	}
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		t.Fatalf("queue declare error: %v", err)
+	}
+	if err := ch.QueueBind(q.Name, "eu.#", "orders", false, nil); err != nil {
+		t.Fatalf("queue bind error: %v", err)
+	}
+	deliveries, err := ch.Consume(q.Name, "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("consume error: %v", err)
+	}
+	if err := ch.Confirm(false); err != nil {
+		t.Fatalf("confirm error: %v", err)
+	}
+
+	confirm, err := ch.PublishWithDeferredConfirmWithContext(ctx, "orders", "eu.created", false, false, amqp.Publishing{
+		ContentType: "application/json", Headers: amqp.Table{"region": "eu", "n": int32(7)}, CorrelationId: "c1", Body: []byte(`{"n":7}`),
+	})
+	if err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	if ok, err := confirm.WaitContext(ctx); !ok || err != nil {
+		t.Fatalf("confirm = %v, %v; want an ack", ok, err)
+	}
+	_ = ch.PublishWithContext(ctx, "orders", "us.created", false, false, amqp.Publishing{Body: []byte("elsewhere")})
+
+	stored := vq.Messages("orders.eu.created")
+	if len(stored) != 1 || stored[0].ContentType != "application/json" || !reflect.DeepEqual(stored[0].Data, map[string]any{"n": float64(7)}) ||
+		stored[0].CorrelationID != "c1" || !reflect.DeepEqual(stored[0].Headers, map[string]string{"region": "eu", "n": "7"}) {
+		t.Errorf("stored messages = %+v; want the JSON one with its headers", stored)
+	}
+
+	d := next(t, deliveries)
+	if string(d.Body) != `{"n":7}` || d.RoutingKey != "orders.eu.created" || d.ContentType != "application/json" || d.Headers["region"] != "eu" || d.Redelivered {
+		t.Errorf("delivery = %+v; want the JSON message", d)
+	}
+	_ = d.Ack(false)
+	vq.Publish(broker.Message[any]{ID: "m2", Pattern: "orders.eu", Data: "from vortexq"})
+	d = next(t, deliveries)
+	if string(d.Body) != `"from vortexq"` || d.MessageId != "m2" {
+		t.Errorf("delivery = %+v; want the VortexQ message", d)
+	}
+	_ = d.Ack(false)
+	select {
+	case d := <-deliveries:
+		t.Errorf("got %q from %s; want nothing", d.Body, d.RoutingKey)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Test consumers share a queue in turn, prefetch holds back deliveries and rejected ones come back
+func TestCompetingConsumers(t *testing.T) {
+	_, url := startApp(t)
+	producer := open(t, url)
+	ctx := context.Background()
+	if _, err := producer.QueueDeclare("jobs", true, false, false, false, nil); err != nil {
+		t.Fatalf("queue declare error: %v", err)
+	}
+
+	counts := make(chan string, 100)
+	for _, name := range []string{"a", "b"} {
+		ch := open(t, url)
+		deliveries, err := ch.Consume("jobs", name, true, false, false, false, nil)
+		if err != nil {
+			t.Fatalf("consume error: %v", err)
+		}
+		go func() {
+			for range deliveries {
+				counts <- name
+			}
+		}()
+	}
+	for i := range 10 {
+		_ = producer.PublishWithContext(ctx, "", "jobs", false, false, amqp.Publishing{Body: fmt.Append(nil, i)})
+	}
+	got := map[string]int{}
+	for range 10 {
+		select {
+		case name := <-counts:
+			got[name]++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("consumers got %v; want 10 messages", got)
+		}
+	}
+	if got["a"] != 5 || got["b"] != 5 {
+		t.Errorf("split = %v; want 5 each", got)
+	}
+
+	slow := open(t, url)
+	if _, err := slow.QueueDeclare("slow", false, false, false, false, nil); err != nil {
+		t.Fatalf("queue declare error: %v", err)
+	}
+	if err := slow.Qos(1, 0, false); err != nil {
+		t.Fatalf("qos error: %v", err)
+	}
+	deliveries, err := slow.Consume("slow", "", false, false, false, false, nil)
+	if err != nil {
+		t.Fatalf("consume error: %v", err)
+	}
+	for _, body := range []string{"first", "second"} {
+		_ = producer.PublishWithContext(ctx, "", "slow", false, false, amqp.Publishing{Body: []byte(body)})
+	}
+	d := next(t, deliveries)
+	if string(d.Body) != "first" {
+		t.Fatalf("delivery = %q; want first", d.Body)
+	}
+	select {
+	case d := <-deliveries:
+		t.Fatalf("got %q beyond the prefetch", d.Body)
+	case <-time.After(100 * time.Millisecond):
+	}
+	_ = d.Nack(false, true)
+	// the second message may pass the redelivery
+	seen := map[string]bool{}
+	for range 2 {
+		d := next(t, deliveries)
+		seen[string(d.Body)] = d.Redelivered
+		_ = d.Ack(false)
+	}
+	if redelivered, ok := seen["first"]; !ok || !redelivered || seen["second"] {
+		t.Errorf("deliveries = %v; want first redelivered and second", seen)
+	}
+}
+
+// Test fanout exchanges, returns of unroutable messages and channel errors
+func TestFanoutAndErrors(t *testing.T) {
+	_, url := startApp(t)
+	ch := open(t, url)
+	ctx := context.Background()
+
+	if err := ch.ExchangeDeclare("events", "fanout", false, false, false, false, nil); err != nil {
+		t.Fatalf("exchange declare error: %v", err)
+	}
+	var queues []<-chan amqp.Delivery
+	for _, name := range []string{"audit", "mail"} {
+		_, _ = ch.QueueDeclare(name, false, false, false, false, nil)
+		if err := ch.QueueBind(name, "ignored", "events", false, nil); err != nil {
+			t.Fatalf("queue bind error: %v", err)
+		}
+		deliveries, err := ch.Consume(name, "", true, false, false, false, nil)
+		if err != nil {
+			t.Fatalf("consume error: %v", err)
+		}
+		queues = append(queues, deliveries)
+	}
+	_ = ch.PublishWithContext(ctx, "events", "any", false, false, amqp.Publishing{Body: []byte("hello")})
+	for _, deliveries := range queues {
+		if d := next(t, deliveries); string(d.Body) != "hello" || d.RoutingKey != "events" {
+			t.Errorf("delivery = %q on %s; want hello on events", d.Body, d.RoutingKey)
+		}
+	}
+
+	returns := ch.NotifyReturn(make(chan amqp.Return, 1))
+	_ = ch.PublishWithContext(ctx, "amq.direct", "nobody", true, false, amqp.Publishing{Body: []byte("lost")})
+	select {
+	case r := <-returns:
+		if r.ReplyCode != amqp.NoRoute || string(r.Body) != "lost" {
+			t.Errorf("return = %+v; want NO_ROUTE", r)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("unroutable mandatory message wasn't returned")
+	}
+
+	var amqpErr *amqp.Error
+	if err := ch.ExchangeDeclare("events", "topic", false, false, false, false, nil); !errors.As(err, &amqpErr) || amqpErr.Code != amqp.PreconditionFailed {
+		t.Errorf("redeclare with another kind error = %v; want PRECONDITION_FAILED", err)
+	}
+	ch = open(t, url)
+	if _, err := ch.QueueDeclarePassive("missing", false, false, false, false, nil); !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotFound {
+		t.Errorf("passive declare error = %v; want NOT_FOUND", err)
+	}
+	ch = open(t, url)
+	if err := ch.QueueBind("audit", "a.#.b", "amq.topic", false, nil); !errors.As(err, &amqpErr) || amqpErr.Code != amqp.NotImplemented {
+		t.Errorf("bind with inner '#' error = %v; want NOT_IMPLEMENTED", err)
+	}
+}
+
+// Test binding keys map onto topic patterns
+func TestPatterns(t *testing.T) {
+	exchanges := builtinExchanges()
+	exchanges["orders"] = &exchange{name: "orders", kind: kindTopic}
+	exchanges["events"] = &exchange{name: "events", kind: kindFanout}
+	tests := []struct {
+		exchange, key string
+		want          []string
+	}{
+		{"amq.direct", "jobs", []string{"jobs"}},
+		{"amq.topic", "#", []string{">"}},
+		{"amq.topic", "a.*.c", []string{"a.*.c"}},
+		{"orders", "eu.#", []string{"orders.eu.>", "orders.eu"}},
+		{"orders", "#", []string{"orders.>", "orders"}},
+		{"events", "ignored", []string{"events"}},
+	}
+	for _, tt := range tests {
+		got, err := exchanges[tt.exchange].patterns(tt.key)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("patterns(%s, %q) = %v, %v; want %v", tt.exchange, tt.key, got, err, tt.want)
+		}
+	}
+	if _, err := exchanges["amq.direct"].patterns("a.*"); err == nil {
+		t.Error("direct binding with a wildcard succeeded; want an error")
+	}
+	if got := exchanges["orders"].topic("eu.created"); got != "orders.eu.created" {
+		t.Errorf("topic = %q; want orders.eu.created", got)
+	}
+}
@@ -0,0 +1,501 @@
+package amqp_app
+
+import (
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"log/slog"
+	"sync"
+)
+
+// channel is a channel of a connection, its consumers end and its unacked
+// deliveries are requeued when it closes.
+type channel struct {
+	c  *conn
+	id uint16
+
+	// closing, prefetch, confirm, published and publish are owned by the read loop
+	closing   bool
+	prefetch  int
+	confirm   bool
+	published uint64
+	// publish is the basic.publish waiting for its content
+	publish *publishing
+
+	mu        sync.Mutex
+	closed    bool
+	consumers map[string]*consumer
+	unacked   map[uint64]pending
+	tag       uint64
+}
+
+// publishing is a published message while its content frames arrive.
+type publishing struct {
+	exchange  string
+	key       string
+	topic     string
+	mandatory bool
+	header    bool
+	size      uint64
+	props     properties
+	body      []byte
+}
+
+// pending is a delivery awaiting its ack.
+type pending struct {
+	token string
+	cons  *consumer
+}
+
+func newChannel(c *conn, id uint16) *channel {
+	return &channel{c: c, id: id, consumers: make(map[string]*consumer), unacked: make(map[uint64]pending)}
+}
+
+func (ch *channel) reply(w *writer) error {
+	return ch.c.writeMethod(ch.id, w)
+}
+
+// method runs a method of the channel.
+func (ch *channel) method(m methodID, r *reader) error {
+	a := ch.c.app
+	switch m {
+	case channelFlow:
+		active := r.bit()
+		if err := r.done(); err != nil {
+			return err
+		}
+		return ch.reply(newMethod(channelFlowOk).bit(active))
+
+	case exchangeDeclare:
+		r.short()
+		name, kind := r.shortstr(), r.shortstr()
+		passive, _, _, _, noWait := r.bit(), r.bit(), r.bit(), r.bit(), r.bit()
+		r.table()
+		if err := r.done(); err != nil {
+			return err
+		}
+		if err := a.declareExchange(name, kind, passive); err != nil {
+			return err
+		}
+		if noWait {
+			return nil
+		}
+		return ch.reply(newMethod(exchangeDeclareOk))
+
+	case exchangeDelete:
+		r.short()
+		name := r.shortstr()
+		_, noWait := r.bit(), r.bit()
+		if err := r.done(); err != nil {
+			return err
+		}
+		if err := a.deleteExchange(name); err != nil {
+			return err
+		}
+		if noWait {
+			return nil
+		}
+		return ch.reply(newMethod(exchangeDeleteOk))
+
+	case queueDeclare:
+		r.short()
+		name := r.shortstr()
+		passive, _, exclusive, autoDelete, noWait := r.bit(), r.bit(), r.bit(), r.bit(), r.bit()
+		r.table()
+		if err := r.done(); err != nil {
+			return err
+		}
+		name, consumers, err := a.declareQueue(ch.c, name, passive, exclusive, autoDelete)
+		if err != nil {
+			return err
+		}
+		if noWait {
+			return nil
+		}
+		// messages are counted by the broker cursors only, so none are reported
+		return ch.reply(newMethod(queueDeclareOk).shortstr(name).long(0).long(uint32(consumers)))
+
+	case queueBind:
+		r.short()
+		queue, exchange, key := r.shortstr(), r.shortstr(), r.shortstr()
+		noWait := r.bit()
+		r.table()
+		if err := r.done(); err != nil {
+			return err
+		}
+		if err := a.bindQueue(ch.c, queue, exchange, key); err != nil {
+			return err
+		}
+		if noWait {
+			return nil
+		}
+		return ch.reply(newMethod(queueBindOk))
+
+	case queueUnbind:
+		r.short()
+		queue, exchange, key := r.shortstr(), r.shortstr(), r.shortstr()
+		r.table()
+		if err := r.done(); err != nil {
+			return err
+		}
+		if err := a.unbindQueue(ch.c, queue, exchange, key); err != nil {
+			return err
+		}
+		return ch.reply(newMethod(queueUnbindOk))
+
+	case queueDelete:
+		r.short()
+		name := r.shortstr()
+		ifUnused, _, noWait := r.bit(), r.bit(), r.bit()
+		if err := r.done(); err != nil {
+			return err
+		}
+		consumers, err := a.deleteQueue(ch.c, name, ifUnused)
+		if err != nil {
+			return err
+		}
+		for _, cons := range consumers {
+			cons.ch.cancelled(cons)
+		}
+		if noWait {
+			return nil
+		}
+		return ch.reply(newMethod(queueDeleteOk).long(0))
+
+	case basicQos:
+		r.long()
+		count := r.short()
+		r.bit()
+		if err := r.done(); err != nil {
+			return err
+		}
+		// the prefetch count applies to every consumer of the channel on its own
+		ch.prefetch = int(count)
+		return ch.reply(newMethod(basicQosOk))
+
+	case basicConsume:
+		r.short()
+		queue, tag := r.shortstr(), r.shortstr()
+		_, noAck, exclusive, noWait := r.bit(), r.bit(), r.bit(), r.bit()
+		r.table()
+		if err := r.done(); err != nil {
+			return err
+		}
+		return ch.consume(queue, tag, noAck, exclusive, noWait)
+
+	case basicCancel:
+		tag := r.shortstr()
+		noWait := r.bit()
+		if err := r.done(); err != nil {
+			return err
+		}
+		ch.mu.Lock()
+		cons, ok := ch.consumers[tag]
+		delete(ch.consumers, tag)
+		ch.mu.Unlock()
+		if ok {
+			a.removeConsumer(cons)
+		}
+		if noWait {
+			return nil
+		}
+		return ch.reply(newMethod(basicCancelOk).shortstr(tag))
+
+	case basicPublish:
+		r.short()
+		exchange, key := r.shortstr(), r.shortstr()
+		mandatory, immediate := r.bit(), r.bit()
+		if err := r.done(); err != nil {
+			return err
+		}
+		if immediate {
+			return connError(replyNotImplemented, "immediate publishing is not supported")
+		}
+		a.mu.Lock()
+		e, ok := a.exchanges[exchange]
+		a.mu.Unlock()
+		if !ok {
+			return channelError(replyNotFound, "no exchange '%s'", exchange)
+		}
+		ch.publish = &publishing{exchange: exchange, key: key, topic: e.topic(key), mandatory: mandatory}
+		return nil
+
+	case basicAck:
+		tag, multiple := r.longlong(), r.bit()
+		if err := r.done(); err != nil {
+			return err
+		}
+		return ch.settle(tag, multiple, true, false)
+
+	case basicReject:
+		tag, requeue := r.longlong(), r.bit()
+		if err := r.done(); err != nil {
+			return err
+		}
+		return ch.settle(tag, false, false, requeue)
+
+	case basicNack:
+		tag, multiple, requeue := r.longlong(), r.bit(), r.bit()
+		if err := r.done(); err != nil {
+			return err
+		}
+		return ch.settle(tag, multiple, false, requeue)
+
+	case confirmSelect:
+		noWait := r.bit()
+		if err := r.done(); err != nil {
+			return err
+		}
+		ch.confirm = true
+		if noWait {
+			return nil
+		}
+		return ch.reply(newMethod(confirmSelectOk))
+	}
+	return connError(replyNotImplemented, "method %d.%d is not supported", m.class(), m.method())
+}
+
+// consume starts a consumer, holding the channel lock until consume-ok is
+// written so that no delivery precedes it.
+func (ch *channel) consume(queue, tag string, noAck, exclusive, noWait bool) error {
+	if tag == "" {
+		tag = "amq.ctag-" + broker.NewID()
+	}
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if _, ok := ch.consumers[tag]; ok {
+		return connError(replyNotAllowed, "consumer tag '%s' is in use", tag)
+	}
+	cons := &consumer{tag: tag, ch: ch, noAck: noAck, prefetch: ch.prefetch}
+	ch.consumers[tag] = cons
+	if err := ch.c.app.addConsumer(ch.c, cons, queue, exclusive); err != nil {
+		delete(ch.consumers, tag)
+		return err
+	}
+	if noWait {
+		return nil
+	}
+	return ch.reply(newMethod(basicConsumeOk).shortstr(tag))
+}
+
+// content collects the header and body frames of the pending publish and
+// routes the message once it is complete.
+func (ch *channel) content(f frame) error {
+	p := ch.publish
+	switch {
+	case p == nil:
+		return connError(replyUnexpectedFrame, "content frame without basic.publish")
+	case f.typ == frameHeader && !p.header:
+		size, props, err := readContentHeader(f.payload)
+		if err != nil {
+			return err
+		}
+		if size > _maxBodySize {
+			ch.publish = nil
+			return channelError(replyPreconditionFailed, "message size %d exceeds the maximum %d", size, _maxBodySize)
+		}
+		p.header, p.size, p.props = true, size, props
+		p.body = make([]byte, 0, size)
+	case f.typ == frameBody && p.header:
+		p.body = append(p.body, f.payload...)
+		if uint64(len(p.body)) > p.size {
+			return connError(replyFrameError, "content exceeds its size of %d bytes", p.size)
+		}
+	default:
+		return connError(replyUnexpectedFrame, "unexpected content frame")
+	}
+	if !p.header || uint64(len(p.body)) < p.size {
+		return nil
+	}
+	ch.publish = nil
+	return ch.route(p)
+}
+
+// route publishes the message to its topic, mandatory messages nobody is
+// subscribed to are returned instead.
+func (ch *channel) route(p *publishing) error {
+	a := ch.c.app
+	switch {
+	case p.topic != "" && (!p.mandatory || a.routable(p.topic)):
+		msg, err := toMessage(p.topic, p.props, p.body)
+		if err != nil {
+			return channelError(replyPreconditionFailed, "invalid payload: %v", err)
+		}
+		// the exchange validated the topic already
+		_, _ = a.funcs.Publish(msg)
+	case p.mandatory:
+		w := newMethod(basicReturn).short(replyNoRoute).shortstr("NO_ROUTE").shortstr(p.exchange).shortstr(p.key)
+		if err := ch.c.writeContent(ch.id, w, p.props, p.body); err != nil {
+			return err
+		}
+	}
+	if !ch.confirm {
+		return nil
+	}
+	// publishing is synchronous, so a message is confirmed right away
+	ch.published++
+	return ch.reply(newMethod(basicAck).longlong(ch.published).bit(false))
+}
+
+// routable reports whether any subscription receives messages of topic.
+func (a *App) routable(topic string) bool {
+	for _, sub := range a.funcs.ListSubscriptions() {
+		if broker.MatchTopic(sub.TopicName, topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// settle acks or rejects the delivery with tag, or all up to it when multiple,
+// tag 0 with multiple settles every delivery. Rejected deliveries that aren't
+// requeued are dropped.
+func (ch *channel) settle(tag uint64, multiple, ack, requeue bool) error {
+	ch.mu.Lock()
+	var settled []pending
+	if multiple {
+		for t, p := range ch.unacked {
+			if t <= tag || tag == 0 {
+				settled = append(settled, p)
+				delete(ch.unacked, t)
+			}
+		}
+	} else if p, ok := ch.unacked[tag]; ok {
+		settled = append(settled, p)
+		delete(ch.unacked, tag)
+	}
+	ch.mu.Unlock()
+	if len(settled) == 0 && tag != 0 {
+		return channelError(replyPreconditionFailed, "unknown delivery tag %d", tag)
+	}
+
+	a := ch.c.app
+	for _, p := range settled {
+		// a token may have expired and been redelivered meanwhile
+		if ack || !requeue {
+			_ = a.funcs.Ack(p.token)
+		} else {
+			_ = a.funcs.Nack(p.token)
+		}
+		a.settled(p.cons)
+	}
+	return nil
+}
+
+// release ends the consumers of the channel and requeues its unacked deliveries.
+func (ch *channel) release() {
+	a := ch.c.app
+	ch.mu.Lock()
+	consumers := make([]*consumer, 0, len(ch.consumers))
+	for _, cons := range ch.consumers {
+		consumers = append(consumers, cons)
+	}
+	ch.mu.Unlock()
+	// consumers leave their queues first, so that no delivery is handed to a closed channel
+	for _, cons := range consumers {
+		a.removeConsumer(cons)
+	}
+
+	ch.mu.Lock()
+	ch.closed = true
+	unacked := ch.unacked
+	ch.consumers, ch.unacked = make(map[string]*consumer), make(map[uint64]pending)
+	ch.mu.Unlock()
+	for _, p := range unacked {
+		_ = a.funcs.Nack(p.token)
+	}
+}
+
+// cancelled tells the client about a consumer whose queue was deleted.
+func (ch *channel) cancelled(cons *consumer) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closed || ch.consumers[cons.tag] != cons {
+		return
+	}
+	delete(ch.consumers, cons.tag)
+	_ = ch.reply(newMethod(basicCancel).shortstr(cons.tag).bit(true))
+}
+
+// deliver sends the delivery with basic.deliver, it reports false when the
+// consumer is gone, so that the queue hands it to another one.
+func (ch *channel) deliver(cons *consumer, d broker.Delivery[any]) bool {
+	const op = "amqp_app.channel.deliver"
+	a := ch.c.app
+
+	body, contentType, err := d.Message.Payload()
+	if err != nil {
+		ch.c.log.With(slog.String("op", op)).Warn("can't encode message", slog.String("message", d.Message.ID), logging.Err(err))
+		_ = a.funcs.Ack(d.AckToken)
+		if !cons.noAck {
+			a.settled(cons)
+		}
+		return true
+	}
+
+	// tags are assigned and written under the lock to reach the client in order
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closed || ch.consumers[cons.tag] != cons {
+		return false
+	}
+	ch.tag++
+	if cons.noAck {
+		_ = a.funcs.Ack(d.AckToken)
+	} else {
+		ch.unacked[ch.tag] = pending{token: d.AckToken, cons: cons}
+	}
+	w := newMethod(basicDeliver).shortstr(cons.tag).longlong(ch.tag).bit(d.Attempt > 1).shortstr("").shortstr(d.Message.Pattern)
+	if err := ch.c.writeContent(ch.id, w, messageProperties(d.Message, contentType), body); err != nil {
+		_ = ch.c.nc.Close()
+	}
+	return true
+}
+
+// toMessage maps published content onto a message of topic, header values
+// become strings.
+func toMessage(topic string, p properties, body []byte) (broker.Message[any], error) {
+	msg := broker.Message[any]{
+		ID:            p.messageID,
+		Pattern:       topic,
+		Source:        p.appID,
+		Type:          p.typ,
+		Time:          p.timestamp,
+		ContentType:   p.contentType,
+		CorrelationID: p.correlationID,
+		ReplyTo:       p.replyTo,
+	}
+	if msg.ID == "" {
+		msg.ID = broker.NewID()
+	}
+	for k, v := range p.headers {
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string, len(p.headers))
+		}
+		if b, ok := v.([]byte); ok {
+			v = string(b)
+		}
+		msg.Headers[k] = fmt.Sprint(v)
+	}
+	err := msg.SetPayload(body)
+	return msg, err
+}
+
+func messageProperties(msg broker.Message[any], contentType string) properties {
+	p := properties{
+		contentType:   contentType,
+		correlationID: msg.CorrelationID,
+		replyTo:       msg.ReplyTo,
+		messageID:     msg.ID,
+		timestamp:     msg.Time,
+		typ:           msg.Type,
+		appID:         msg.Source,
+	}
+	if len(msg.Headers) > 0 {
+		p.headers = make(map[string]any, len(msg.Headers))
+		for k, v := range msg.Headers {
+			p.headers[k] = v
+		}
+	}
+	return p
+}
@@ -0,0 +1,340 @@
+package amqp_app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	_heartbeat     = 60 * time.Second
+	_handshakeWait = 10 * time.Second
+	_closeWait     = time.Second
+	_writeWait     = 10 * time.Second
+	_frameMax      = 128 * 1024
+	_frameMin      = 4096
+	_channelMax    = 2047
+	_maxBodySize   = 16 << 20
+
+	productName = "VortexQ"
+)
+
+var errProtocolHeader = errors.New("unsupported protocol header")
+
+// conn is a client connection, its channels and exclusive queues end with it.
+type conn struct {
+	app *App
+	nc  net.Conn
+	r   *bufio.Reader
+	log *slog.Logger
+
+	// frameMax, channelMax and heartbeat are settled by connection.tune-ok
+	frameMax   uint32
+	channelMax uint16
+	heartbeat  time.Duration
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	writeMu sync.Mutex
+
+	// channels is owned by the read loop
+	channels map[uint16]*channel
+}
+
+func (a *App) handle(nc net.Conn) {
+	const op = "amqp_app.App.handle"
+
+	c := &conn{
+		app:        a,
+		nc:         nc,
+		r:          bufio.NewReader(nc),
+		log:        a.log.With(slog.String("remote", nc.RemoteAddr().String())),
+		frameMax:   _frameMax,
+		channelMax: _channelMax,
+		channels:   make(map[uint16]*channel),
+	}
+	c.ctx, c.cancel = context.WithCancel(a.server.Context())
+	defer c.cancel()
+	defer nc.Close()
+	defer c.end()
+
+	err := c.handshake()
+	if err == nil {
+		go c.beat()
+		err = c.serve()
+	}
+	var ae *amqpError
+	if errors.As(err, &ae) {
+		c.closeWith(ae)
+	}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		c.log.With(slog.String("op", op)).Warn("amqp connection failed", logging.Err(err))
+	}
+}
+
+// handshake negotiates the connection up to connection.open-ok. Any credentials
+// are accepted, the listener is meant to be reached by trusted services only.
+func (c *conn) handshake() error {
+	_ = c.nc.SetReadDeadline(time.Now().Add(_handshakeWait))
+	header := make([]byte, len(protocolHeader))
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		return err
+	}
+	if !bytes.Equal(header, protocolHeader) {
+		_ = c.write(protocolHeader)
+		return errProtocolHeader
+	}
+
+	start := newMethod(connectionStart).octet(0).octet(9).table(serverProperties()).
+		longstr([]byte("PLAIN AMQPLAIN")).longstr([]byte("en_US"))
+	if err := c.writeMethod(0, start); err != nil {
+		return err
+	}
+	if _, err := c.expect(connectionStartOk); err != nil {
+		return err
+	}
+
+	tune := newMethod(connectionTune).short(_channelMax).long(_frameMax).short(uint16(c.app.heartbeat / time.Second))
+	if err := c.writeMethod(0, tune); err != nil {
+		return err
+	}
+	r, err := c.expect(connectionTuneOk)
+	if err != nil {
+		return err
+	}
+	channelMax, frameMax, heartbeat := r.short(), r.long(), r.short()
+	if err := r.done(); err != nil {
+		return err
+	}
+	if channelMax > 0 && channelMax < c.channelMax {
+		c.channelMax = channelMax
+	}
+	switch {
+	case frameMax > 0 && frameMax < _frameMin:
+		return connError(replyNotAllowed, "frame maximum %d is below %d", frameMax, _frameMin)
+	case frameMax > 0 && frameMax < c.frameMax:
+		c.frameMax = frameMax
+	}
+	c.heartbeat = time.Duration(heartbeat) * time.Second
+
+	// the virtual host is accepted whatever it is, topics have no hosts
+	if _, err := c.expect(connectionOpen); err != nil {
+		return err
+	}
+	if err := c.writeMethod(0, newMethod(connectionOpenOk).shortstr("")); err != nil {
+		return err
+	}
+	return c.nc.SetReadDeadline(time.Time{})
+}
+
+func serverProperties() map[string]any {
+	return map[string]any{
+		"product":  productName,
+		"platform": "Go",
+		"capabilities": map[string]any{
+			"publisher_confirms":     true,
+			"basic.nack":             true,
+			"consumer_cancel_notify": true,
+			"per_consumer_qos":       true,
+		},
+	}
+}
+
+// expect reads the next connection method, which must be m.
+func (c *conn) expect(m methodID) (*reader, error) {
+	for {
+		f, err := readFrame(c.r, c.frameMax)
+		if err != nil {
+			return nil, err
+		}
+		if f.typ == frameHeartbeat {
+			continue
+		}
+		got, r := parseMethod(f)
+		if f.typ != frameMethod || f.channel != 0 || got != m {
+			return nil, connError(replyCommandInvalid, "expected method %d.%d", m.class(), m.method())
+		}
+		return r, nil
+	}
+}
+
+func parseMethod(f frame) (methodID, *reader) {
+	r := &reader{b: f.payload}
+	m := methodID(r.short())<<16 | methodID(r.short())
+	return m, r
+}
+
+// beat sends heartbeats at half the negotiated interval.
+func (c *conn) beat() {
+	if c.heartbeat == 0 {
+		return
+	}
+	ticker := time.NewTicker(c.heartbeat / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.write(appendFrame(nil, frameHeartbeat, 0, nil)); err != nil {
+				_ = c.nc.Close()
+				return
+			}
+		}
+	}
+}
+
+// serve runs the frames of the client until it closes the connection, channel
+// errors close the channel only.
+func (c *conn) serve() error {
+	for {
+		if c.heartbeat > 0 {
+			_ = c.nc.SetReadDeadline(time.Now().Add(2 * c.heartbeat))
+		}
+		f, err := readFrame(c.r, c.frameMax)
+		if err != nil {
+			return err
+		}
+
+		var m methodID
+		switch f.typ {
+		case frameHeartbeat:
+			continue
+		case frameMethod:
+			var r *reader
+			m, r = parseMethod(f)
+			if f.channel == 0 {
+				switch m {
+				case connectionClose:
+					return c.writeMethod(0, newMethod(connectionCloseOk))
+				case connectionCloseOk:
+					return nil
+				}
+				err = connError(replyCommandInvalid, "method %d.%d is not a connection method", m.class(), m.method())
+				break
+			}
+			err = c.channelMethod(f.channel, m, r)
+		case frameHeader, frameBody:
+			m = basicPublish
+			ch, ok := c.channels[f.channel]
+			switch {
+			case !ok:
+				err = connError(replyChannelError, "channel %d is not open", f.channel)
+			case !ch.closing:
+				err = ch.content(f)
+			}
+		default:
+			err = connError(replyFrameError, "unknown frame type %d", f.typ)
+		}
+
+		var ae *amqpError
+		if !errors.As(err, &ae) {
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if ae.method == 0 {
+			ae.method = m
+		}
+		if ae.conn {
+			return ae
+		}
+		if err := c.closeChannel(c.channels[f.channel], ae); err != nil {
+			return err
+		}
+	}
+}
+
+// channelMethod runs a method of channel id, only channel.close-ok is expected
+// of a channel the server closed.
+func (c *conn) channelMethod(id uint16, m methodID, r *reader) error {
+	ch, ok := c.channels[id]
+	switch {
+	case m == channelOpen:
+		if ok || id > c.channelMax {
+			return connError(replyChannelError, "channel %d can't be opened", id)
+		}
+		c.channels[id] = newChannel(c, id)
+		return c.writeMethod(id, newMethod(channelOpenOk).longstr(nil))
+	case !ok:
+		return connError(replyChannelError, "channel %d is not open", id)
+	case m == channelClose:
+		ch.release()
+		delete(c.channels, id)
+		return c.writeMethod(id, newMethod(channelCloseOk))
+	case ch.closing:
+		if m == channelCloseOk {
+			delete(c.channels, id)
+		}
+		return nil
+	}
+	return ch.method(m, r)
+}
+
+// closeChannel answers a channel error with channel.close.
+func (c *conn) closeChannel(ch *channel, ae *amqpError) error {
+	ch.release()
+	ch.closing = true
+	w := newMethod(channelClose).short(ae.code).shortstr(ae.text).short(ae.method.class()).short(ae.method.method())
+	return c.writeMethod(ch.id, w)
+}
+
+// closeWith answers a connection error with connection.close and waits a
+// moment for the client to confirm.
+func (c *conn) closeWith(ae *amqpError) {
+	w := newMethod(connectionClose).short(ae.code).shortstr(ae.text).short(ae.method.class()).short(ae.method.method())
+	if err := c.writeMethod(0, w); err != nil {
+		return
+	}
+	_ = c.nc.SetReadDeadline(time.Now().Add(_closeWait))
+	for {
+		f, err := readFrame(c.r, c.frameMax)
+		if err != nil {
+			return
+		}
+		if m, _ := parseMethod(f); f.typ == frameMethod && f.channel == 0 && m == connectionCloseOk {
+			return
+		}
+	}
+}
+
+// end releases the channels and drops the exclusive queues of a closed connection.
+func (c *conn) end() {
+	for _, ch := range c.channels {
+		ch.release()
+	}
+	c.app.dropOwned(c)
+}
+
+func (c *conn) write(b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.nc.SetWriteDeadline(time.Now().Add(_writeWait))
+	_, err := c.nc.Write(b)
+	return err
+}
+
+func (c *conn) writeMethod(channel uint16, w *writer) error {
+	return c.write(appendFrame(nil, frameMethod, channel, w.b))
+}
+
+// writeContent writes a content method with its header and body frames at once,
+// so that deliveries on other channels don't interleave.
+func (c *conn) writeContent(channel uint16, w *writer, p properties, body []byte) error {
+	b := appendFrame(nil, frameMethod, channel, w.b)
+	b = appendFrame(b, frameHeader, channel, appendContentHeader(uint64(len(body)), p))
+	for chunk := int(c.frameMax) - 8; len(body) > 0; {
+		n := min(chunk, len(body))
+		b = appendFrame(b, frameBody, channel, body[:n])
+		body = body[n:]
+	}
+	return c.write(b)
+}
@@ -0,0 +1,317 @@
+package amqp_app
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"time"
+)
+
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xCE
+)
+
+// protocolHeader opens every AMQP 0-9-1 connection.
+var protocolHeader = []byte("AMQP\x00\x00\x09\x01")
+
+var errMalformed = errors.New("malformed frame")
+
+// frame is a frame of any type, channel 0 carries the connection methods.
+type frame struct {
+	typ     byte
+	channel uint16
+	payload []byte
+}
+
+// readFrame reads the next frame, frames over max bytes are a framing error.
+func readFrame(r *bufio.Reader, max uint32) (frame, error) {
+	var hdr [7]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return frame{}, err
+	}
+	size := binary.BigEndian.Uint32(hdr[3:])
+	if max > 0 && size > max-8 {
+		return frame{}, connError(replyFrameError, "frame of %d bytes exceeds the frame maximum %d", size, max)
+	}
+	payload := make([]byte, int(size)+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return frame{}, err
+	}
+	if payload[size] != frameEnd {
+		return frame{}, connError(replyFrameError, "frame end missing")
+	}
+	return frame{typ: hdr[0], channel: binary.BigEndian.Uint16(hdr[1:]), payload: payload[:size]}, nil
+}
+
+func appendFrame(dst []byte, typ byte, channel uint16, payload []byte) []byte {
+	dst = append(dst, typ)
+	dst = binary.BigEndian.AppendUint16(dst, channel)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(payload)))
+	dst = append(dst, payload...)
+	return append(dst, frameEnd)
+}
+
+// reader decodes method arguments and content headers, the first error sticks.
+type reader struct {
+	b   []byte
+	err error
+	// bits holds the packed bit fields not read yet, nbits how many remain
+	bits  byte
+	nbits int
+}
+
+func (r *reader) next(n int) []byte {
+	r.nbits = 0
+	if r.err != nil || len(r.b) < n {
+		r.err = errMalformed
+		return nil
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+// done reports malformed arguments as a syntax error.
+func (r *reader) done() error {
+	if r.err != nil {
+		return connError(replySyntaxError, "malformed arguments")
+	}
+	return nil
+}
+
+func (r *reader) octet() uint8 {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) short() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) long() uint32 {
+	if b := r.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) longlong() uint64 {
+	if b := r.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) shortstr() string {
+	return string(r.next(int(r.octet())))
+}
+
+func (r *reader) longstr() []byte {
+	return r.next(int(r.long()))
+}
+
+// bit reads the next of the bit fields packed into octets.
+func (r *reader) bit() bool {
+	if r.nbits == 0 {
+		b := r.octet()
+		r.bits, r.nbits = b, 8
+	}
+	v := r.bits&1 == 1
+	r.bits >>= 1
+	r.nbits--
+	return v
+}
+
+func (r *reader) table() map[string]any {
+	b := r.longstr()
+	if r.err != nil {
+		return nil
+	}
+	t := make(map[string]any)
+	tr := &reader{b: b}
+	for len(tr.b) > 0 && tr.err == nil {
+		key := tr.shortstr()
+		t[key] = tr.value()
+	}
+	if tr.err != nil {
+		r.err = tr.err
+	}
+	return t
+}
+
+// value reads a field value of a table or an array.
+func (r *reader) value() any {
+	switch r.octet() {
+	case 't':
+		return r.octet() != 0
+	case 'b':
+		return int8(r.octet())
+	case 'B':
+		return r.octet()
+	case 's':
+		return int16(r.short())
+	case 'u':
+		return r.short()
+	case 'I':
+		return int32(r.long())
+	case 'i':
+		return r.long()
+	case 'l':
+		return int64(r.longlong())
+	case 'f':
+		return math.Float32frombits(r.long())
+	case 'd':
+		return math.Float64frombits(r.longlong())
+	case 'D':
+		scale := r.octet()
+		return float64(int32(r.long())) / math.Pow10(int(scale))
+	case 'S':
+		return string(r.longstr())
+	case 'x':
+		return r.longstr()
+	case 'T':
+		return time.Unix(int64(r.longlong()), 0).UTC()
+	case 'F':
+		return r.table()
+	case 'A':
+		ar := &reader{b: r.longstr()}
+		var values []any
+		for len(ar.b) > 0 && ar.err == nil {
+			values = append(values, ar.value())
+		}
+		if ar.err != nil {
+			r.err = ar.err
+		}
+		return values
+	case 'V':
+		return nil
+	default:
+		r.err = errMalformed
+		return nil
+	}
+}
+
+// writer encodes method arguments and content headers.
+type writer struct {
+	b []byte
+	// bitAt is the octet the next bit field goes into, nbits how many it holds
+	bitAt int
+	nbits int
+}
+
+// newMethod starts the payload of a method frame.
+func newMethod(m methodID) *writer {
+	w := &writer{}
+	return w.short(m.class()).short(m.method())
+}
+
+func (w *writer) octet(v uint8) *writer {
+	w.nbits = 0
+	w.b = append(w.b, v)
+	return w
+}
+
+func (w *writer) short(v uint16) *writer {
+	w.nbits = 0
+	w.b = binary.BigEndian.AppendUint16(w.b, v)
+	return w
+}
+
+func (w *writer) long(v uint32) *writer {
+	w.nbits = 0
+	w.b = binary.BigEndian.AppendUint32(w.b, v)
+	return w
+}
+
+func (w *writer) longlong(v uint64) *writer {
+	w.nbits = 0
+	w.b = binary.BigEndian.AppendUint64(w.b, v)
+	return w
+}
+
+// shortstr writes s, cut to the 255 bytes a short string holds.
+func (w *writer) shortstr(s string) *writer {
+	if len(s) > math.MaxUint8 {
+		s = s[:math.MaxUint8]
+	}
+	w.octet(uint8(len(s)))
+	w.b = append(w.b, s...)
+	return w
+}
+
+func (w *writer) longstr(b []byte) *writer {
+	w.long(uint32(len(b)))
+	w.b = append(w.b, b...)
+	return w
+}
+
+// bit packs v with the bit fields written right before it.
+func (w *writer) bit(v bool) *writer {
+	if w.nbits == 0 || w.nbits == 8 {
+		w.b = append(w.b, 0)
+		w.bitAt, w.nbits = len(w.b)-1, 0
+	}
+	if v {
+		w.b[w.bitAt] |= 1 << w.nbits
+	}
+	w.nbits++
+	return w
+}
+
+// table writes t with its keys sorted.
+func (w *writer) table(t map[string]any) *writer {
+	tw := &writer{}
+	keys := make([]string, 0, len(t))
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		tw.shortstr(k)
+		tw.value(t[k])
+	}
+	return w.longstr(tw.b)
+}
+
+func (w *writer) value(v any) {
+	switch v := v.(type) {
+	case bool:
+		w.octet('t')
+		if v {
+			w.octet(1)
+		} else {
+			w.octet(0)
+		}
+	case int:
+		w.octet('l').longlong(uint64(v))
+	case int32:
+		w.octet('I').long(uint32(v))
+	case int64:
+		w.octet('l').longlong(uint64(v))
+	case string:
+		w.octet('S').longstr([]byte(v))
+	case []byte:
+		w.octet('x').longstr(v)
+	case time.Time:
+		w.octet('T').longlong(uint64(v.Unix()))
+	case map[string]any:
+		w.octet('F').table(v)
+	case nil:
+		w.octet('V')
+	default:
+		w.octet('S').longstr(fmt.Append(nil, v))
+	}
+}
@@ -0,0 +1,261 @@
+package amqp_app
+
+import (
+	"fmt"
+	"time"
+)
+
+// methodID is the class id in the high and the method id in the low 16 bits.
+type methodID uint32
+
+func (m methodID) class() uint16  { return uint16(m >> 16) }
+func (m methodID) method() uint16 { return uint16(m) }
+
+const (
+	classConnection = 10
+	classChannel    = 20
+	classExchange   = 40
+	classQueue      = 50
+	classBasic      = 60
+	classConfirm    = 85
+)
+
+const (
+	connectionStart   methodID = classConnection<<16 | 10
+	connectionStartOk methodID = classConnection<<16 | 11
+	connectionTune    methodID = classConnection<<16 | 30
+	connectionTuneOk  methodID = classConnection<<16 | 31
+	connectionOpen    methodID = classConnection<<16 | 40
+	connectionOpenOk  methodID = classConnection<<16 | 41
+	connectionClose   methodID = classConnection<<16 | 50
+	connectionCloseOk methodID = classConnection<<16 | 51
+
+	channelOpen    methodID = classChannel<<16 | 10
+	channelOpenOk  methodID = classChannel<<16 | 11
+	channelFlow    methodID = classChannel<<16 | 20
+	channelFlowOk  methodID = classChannel<<16 | 21
+	channelClose   methodID = classChannel<<16 | 40
+	channelCloseOk methodID = classChannel<<16 | 41
+
+	exchangeDeclare   methodID = classExchange<<16 | 10
+	exchangeDeclareOk methodID = classExchange<<16 | 11
+	exchangeDelete    methodID = classExchange<<16 | 20
+	exchangeDeleteOk  methodID = classExchange<<16 | 21
+
+	queueDeclare   methodID = classQueue<<16 | 10
+	queueDeclareOk methodID = classQueue<<16 | 11
+	queueBind      methodID = classQueue<<16 | 20
+	queueBindOk    methodID = classQueue<<16 | 21
+	queueDelete    methodID = classQueue<<16 | 40
+	queueDeleteOk  methodID = classQueue<<16 | 41
+	queueUnbind    methodID = classQueue<<16 | 50
+	queueUnbindOk  methodID = classQueue<<16 | 51
+
+	basicQos       methodID = classBasic<<16 | 10
+	basicQosOk     methodID = classBasic<<16 | 11
+	basicConsume   methodID = classBasic<<16 | 20
+	basicConsumeOk methodID = classBasic<<16 | 21
+	basicCancel    methodID = classBasic<<16 | 30
+	basicCancelOk  methodID = classBasic<<16 | 31
+	basicPublish   methodID = classBasic<<16 | 40
+	basicReturn    methodID = classBasic<<16 | 50
+	basicDeliver   methodID = classBasic<<16 | 60
+	basicAck       methodID = classBasic<<16 | 80
+	basicReject    methodID = classBasic<<16 | 90
+	basicNack      methodID = classBasic<<16 | 120
+
+	confirmSelect   methodID = classConfirm<<16 | 10
+	confirmSelectOk methodID = classConfirm<<16 | 11
+)
+
+// reply codes of the specification
+const (
+	replyNoRoute            = 312
+	replyAccessRefused      = 403
+	replyNotFound           = 404
+	replyResourceLocked     = 405
+	replyPreconditionFailed = 406
+	replyFrameError         = 501
+	replySyntaxError        = 502
+	replyCommandInvalid     = 503
+	replyChannelError       = 504
+	replyUnexpectedFrame    = 505
+	replyNotAllowed         = 530
+	replyNotImplemented     = 540
+)
+
+// amqpError closes the channel the failing method came on, or the whole
+// connection for connection errors.
+type amqpError struct {
+	code   uint16
+	text   string
+	method methodID
+	conn   bool
+}
+
+func (e *amqpError) Error() string { return fmt.Sprintf("%d %s", e.code, e.text) }
+
+func channelError(code uint16, format string, args ...any) *amqpError {
+	return &amqpError{code: code, text: fmt.Sprintf(format, args...)}
+}
+
+func connError(code uint16, format string, args ...any) *amqpError {
+	return &amqpError{code: code, text: fmt.Sprintf(format, args...), conn: true}
+}
+
+// properties are the basic class properties of a content header.
+type properties struct {
+	contentType     string
+	contentEncoding string
+	headers         map[string]any
+	deliveryMode    uint8
+	priority        uint8
+	correlationID   string
+	replyTo         string
+	expiration      string
+	messageID       string
+	timestamp       time.Time
+	typ             string
+	userID          string
+	appID           string
+}
+
+// property flags, from the highest bit down in the order of the properties
+const (
+	flagContentType = 1 << (15 - iota)
+	flagContentEncoding
+	flagHeaders
+	flagDeliveryMode
+	flagPriority
+	flagCorrelationID
+	flagReplyTo
+	flagExpiration
+	flagMessageID
+	flagTimestamp
+	flagType
+	flagUserID
+	flagAppID
+	flagClusterID
+)
+
+// readContentHeader decodes the payload of a content header frame.
+func readContentHeader(b []byte) (size uint64, p properties, err error) {
+	r := &reader{b: b}
+	if class := r.short(); class != classBasic && r.err == nil {
+		return 0, p, connError(replyFrameError, "content header of class %d", class)
+	}
+	r.short() // weight
+	size = r.longlong()
+	flags := r.short()
+	// flag words end with bit 0 clear, this subset knows only the first
+	for f := flags; f&1 == 1 && r.err == nil; {
+		f = r.short()
+	}
+
+	if flags&flagContentType != 0 {
+		p.contentType = r.shortstr()
+	}
+	if flags&flagContentEncoding != 0 {
+		p.contentEncoding = r.shortstr()
+	}
+	if flags&flagHeaders != 0 {
+		p.headers = r.table()
+	}
+	if flags&flagDeliveryMode != 0 {
+		p.deliveryMode = r.octet()
+	}
+	if flags&flagPriority != 0 {
+		p.priority = r.octet()
+	}
+	if flags&flagCorrelationID != 0 {
+		p.correlationID = r.shortstr()
+	}
+	if flags&flagReplyTo != 0 {
+		p.replyTo = r.shortstr()
+	}
+	if flags&flagExpiration != 0 {
+		p.expiration = r.shortstr()
+	}
+	if flags&flagMessageID != 0 {
+		p.messageID = r.shortstr()
+	}
+	if flags&flagTimestamp != 0 {
+		p.timestamp = time.Unix(int64(r.longlong()), 0).UTC()
+	}
+	if flags&flagType != 0 {
+		p.typ = r.shortstr()
+	}
+	if flags&flagUserID != 0 {
+		p.userID = r.shortstr()
+	}
+	if flags&flagAppID != 0 {
+		p.appID = r.shortstr()
+	}
+	if flags&flagClusterID != 0 {
+		r.shortstr()
+	}
+	if r.err != nil {
+		return 0, p, connError(replyFrameError, "malformed content header")
+	}
+	return size, p, nil
+}
+
+// appendContentHeader encodes a content header with the set properties.
+func appendContentHeader(size uint64, p properties) []byte {
+	var flags uint16
+	props := &writer{}
+	if p.contentType != "" {
+		flags |= flagContentType
+		props.shortstr(p.contentType)
+	}
+	if p.contentEncoding != "" {
+		flags |= flagContentEncoding
+		props.shortstr(p.contentEncoding)
+	}
+	if len(p.headers) > 0 {
+		flags |= flagHeaders
+		props.table(p.headers)
+	}
+	if p.deliveryMode != 0 {
+		flags |= flagDeliveryMode
+		props.octet(p.deliveryMode)
+	}
+	if p.priority != 0 {
+		flags |= flagPriority
+		props.octet(p.priority)
+	}
+	if p.correlationID != "" {
+		flags |= flagCorrelationID
+		props.shortstr(p.correlationID)
+	}
+	if p.replyTo != "" {
+		flags |= flagReplyTo
+		props.shortstr(p.replyTo)
+	}
+	if p.expiration != "" {
+		flags |= flagExpiration
+		props.shortstr(p.expiration)
+	}
+	if p.messageID != "" {
+		flags |= flagMessageID
+		props.shortstr(p.messageID)
+	}
+	if !p.timestamp.IsZero() {
+		flags |= flagTimestamp
+		props.longlong(uint64(p.timestamp.Unix()))
+	}
+	if p.typ != "" {
+		flags |= flagType
+		props.shortstr(p.typ)
+	}
+	if p.userID != "" {
+		flags |= flagUserID
+		props.shortstr(p.userID)
+	}
+	if p.appID != "" {
+		flags |= flagAppID
+		props.shortstr(p.appID)
+	}
+	w := (&writer{}).short(classBasic).short(0).longlong(size).short(flags)
+	return append(w.b, props.b...)
+}
@@ -0,0 +1,500 @@
+package amqp_app
+
+import (
+	"context"
+	"errors"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+)
+
+// exchange kinds
+const (
+	kindDirect = "direct"
+	kindTopic  = "topic"
+	kindFanout = "fanout"
+)
+
+// exchange routes messages onto topics, it holds no state of its own.
+type exchange struct {
+	name string
+	kind string
+}
+
+func builtinExchanges() map[string]*exchange {
+	return map[string]*exchange{
+		"":           {name: "", kind: kindDirect},
+		"amq.direct": {name: "amq.direct", kind: kindDirect},
+		"amq.topic":  {name: "amq.topic", kind: kindTopic},
+		"amq.fanout": {name: "amq.fanout", kind: kindFanout},
+	}
+}
+
+// prefix is the topic the routing keys of the exchange go under, the default,
+// amq.direct and amq.topic exchanges route onto the bare keys.
+func (e *exchange) prefix() string {
+	switch e.name {
+	case "", "amq.direct", "amq.topic":
+		return ""
+	}
+	return e.name
+}
+
+// topic returns the topic a message published with key goes to, empty when
+// the key maps onto no valid topic.
+func (e *exchange) topic(key string) string {
+	t := e.prefix()
+	if e.kind != kindFanout {
+		t = joinTopic(t, key)
+	}
+	if broker.ValidateTopicName(t) != nil || broker.ValidateTopicPattern(t) != nil {
+		return ""
+	}
+	return t
+}
+
+// patterns returns the topic patterns a binding with key subscribes to. In
+// topic exchanges '*' stays a single level and a trailing '#' matches the
+// prefix and everything below it.
+func (e *exchange) patterns(key string) ([]string, error) {
+	var patterns []string
+	switch e.kind {
+	case kindFanout:
+		patterns = []string{e.prefix()}
+	case kindDirect:
+		patterns = []string{e.topic(key)}
+	case kindTopic:
+		words := strings.Split(key, ".")
+		last := len(words) - 1
+		if i := slices.Index(words, "#"); i >= 0 && i < last {
+			return nil, channelError(replyNotImplemented, "'#' is only supported as the last word of a binding key")
+		}
+		if words[last] != "#" {
+			patterns = []string{joinTopic(e.prefix(), key)}
+			break
+		}
+		base := joinTopic(e.prefix(), strings.Join(words[:last], "."))
+		patterns = []string{joinTopic(base, ">")}
+		if base != "" {
+			patterns = append(patterns, base)
+		}
+	}
+	for _, p := range patterns {
+		if p == "" || broker.ValidateTopicPattern(p) != nil {
+			return nil, channelError(replyPreconditionFailed, "binding key %q of exchange %q maps onto no topic", key, e.name)
+		}
+	}
+	return patterns, nil
+}
+
+func joinTopic(prefix, key string) string {
+	switch {
+	case prefix == "":
+		return key
+	case key == "":
+		return prefix
+	}
+	return prefix + "." + key
+}
+
+// queue consumes a broker subscription for every topic pattern bound to it and
+// hands the messages to its consumers in turn.
+type queue struct {
+	name       string
+	owner      *conn
+	autoDelete bool
+	// bindings maps the exchange and routing key of a binding onto its patterns
+	bindings map[[2]string][]string
+	subs     map[string]*binding
+
+	consumers []*consumer
+	next      int
+	exclusive bool
+	// ctx ends the consumption of the subscriptions once no consumer is left
+	ctx    context.Context
+	cancel context.CancelFunc
+	// ready is closed and replaced whenever a consumer may take a message
+	ready chan struct{}
+}
+
+// binding is the broker subscription of a pattern, shared by the bindings mapping onto it.
+type binding struct {
+	id   string
+	refs int
+}
+
+func subscriptionID(queue, pattern string) string {
+	return "amqp:" + queue + ":" + pattern
+}
+
+// consumer is a basic.consume of a channel.
+type consumer struct {
+	tag      string
+	ch       *channel
+	queue    *queue
+	noAck    bool
+	prefetch int
+	// unacked counts the deliveries awaiting an ack, guarded by App.mu
+	unacked int
+}
+
+func (a *App) declareExchange(name, kind string, passive bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	e, ok := a.exchanges[name]
+	switch {
+	case passive && !ok:
+		return channelError(replyNotFound, "no exchange '%s'", name)
+	case passive:
+		return nil
+	case ok && e.kind != kind:
+		return channelError(replyPreconditionFailed, "exchange '%s' is of kind %s, not %s", name, e.kind, kind)
+	case ok:
+		return nil
+	case strings.HasPrefix(name, "amq."):
+		return channelError(replyAccessRefused, "exchange name '%s' is reserved", name)
+	}
+	switch kind {
+	case kindDirect, kindTopic, kindFanout:
+	default:
+		return connError(replyCommandInvalid, "exchange kind %q is not supported", kind)
+	}
+	if broker.ValidateTopicName(name) != nil || broker.ValidateTopicPattern(name) != nil {
+		return channelError(replyPreconditionFailed, "exchange name '%s' is not a valid topic", name)
+	}
+	a.exchanges[name] = &exchange{name: name, kind: kind}
+	return nil
+}
+
+// deleteExchange removes the exchange together with the bindings to it.
+func (a *App) deleteExchange(name string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := builtinExchanges()[name]; ok {
+		return channelError(replyAccessRefused, "exchange '%s' can't be deleted", name)
+	}
+	delete(a.exchanges, name)
+	for _, q := range a.queues {
+		for key := range q.bindings {
+			if key[0] == name {
+				a.unbindLocked(q, key)
+			}
+		}
+	}
+	return nil
+}
+
+// declareQueue creates the queue bound to the default exchange under its own
+// name, an empty name gets generated. It returns the name and the consumer count.
+func (a *App) declareQueue(c *conn, name string, passive, exclusive, autoDelete bool) (string, int, error) {
+	const op = "amqp_app.App.declareQueue"
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	q, ok := a.queues[name]
+	switch {
+	case ok && q.owner != nil && q.owner != c:
+		return "", 0, channelError(replyResourceLocked, "queue '%s' is exclusive to another connection", name)
+	case ok:
+		return name, len(q.consumers), nil
+	case passive:
+		return "", 0, channelError(replyNotFound, "no queue '%s'", name)
+	case strings.HasPrefix(name, "amq."):
+		return "", 0, channelError(replyAccessRefused, "queue name '%s' is reserved", name)
+	case name == "":
+		name = "amq.gen-" + broker.NewID()
+	}
+	if broker.ValidateTopicName(name) != nil || broker.ValidateTopicPattern(name) != nil {
+		return "", 0, channelError(replyPreconditionFailed, "queue name '%s' is not a valid topic", name)
+	}
+
+	q = &queue{
+		name:       name,
+		autoDelete: autoDelete,
+		bindings:   make(map[[2]string][]string),
+		subs:       make(map[string]*binding),
+		ready:      make(chan struct{}),
+	}
+	if exclusive {
+		q.owner = c
+	}
+	if err := a.bindLocked(q, [2]string{"", name}, []string{name}); err != nil {
+		a.log.With(slog.String("op", op)).Warn("failed to subscribe queue", slog.String("queue", name), logging.Err(err))
+		return "", 0, channelError(replyPreconditionFailed, "queue '%s' can't be subscribed", name)
+	}
+	a.queues[name] = q
+	return name, 0, nil
+}
+
+// bindQueue subscribes the queue to the topics the routing key maps onto in the exchange.
+func (a *App) bindQueue(c *conn, queue, exchange, key string) error {
+	const op = "amqp_app.App.bindQueue"
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	q, err := a.queueLocked(c, queue)
+	if err != nil {
+		return err
+	}
+	e, ok := a.exchanges[exchange]
+	switch {
+	case !ok:
+		return channelError(replyNotFound, "no exchange '%s'", exchange)
+	case exchange == "":
+		return channelError(replyAccessRefused, "queues can't be bound to the default exchange")
+	}
+	patterns, err := e.patterns(key)
+	if err != nil {
+		return err
+	}
+	if err := a.bindLocked(q, [2]string{exchange, key}, patterns); err != nil {
+		a.log.With(slog.String("op", op)).Warn("failed to bind queue", slog.String("queue", queue), logging.Err(err))
+		return channelError(replyPreconditionFailed, "queue '%s' can't be bound", queue)
+	}
+	return nil
+}
+
+func (a *App) unbindQueue(c *conn, queue, exchange, key string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	q, err := a.queueLocked(c, queue)
+	if err != nil {
+		return err
+	}
+	if exchange == "" {
+		return channelError(replyAccessRefused, "queues can't be unbound from the default exchange")
+	}
+	a.unbindLocked(q, [2]string{exchange, key})
+	return nil
+}
+
+func (a *App) queueLocked(c *conn, name string) (*queue, error) {
+	q, ok := a.queues[name]
+	switch {
+	case !ok:
+		return nil, channelError(replyNotFound, "no queue '%s'", name)
+	case q.owner != nil && q.owner != c:
+		return nil, channelError(replyResourceLocked, "queue '%s' is exclusive to another connection", name)
+	}
+	return q, nil
+}
+
+// bindLocked subscribes the patterns not bound to the queue yet, a failure
+// undoes the subscriptions of the binding.
+func (a *App) bindLocked(q *queue, key [2]string, patterns []string) error {
+	if _, ok := q.bindings[key]; ok {
+		return nil
+	}
+	q.bindings[key] = nil
+	for _, p := range patterns {
+		if b, ok := q.subs[p]; ok {
+			b.refs++
+			q.bindings[key] = append(q.bindings[key], p)
+			continue
+		}
+		b := &binding{id: subscriptionID(q.name, p), refs: 1}
+		if err := a.funcs.Subscribe(broker.Subscription{ID: b.id, TopicName: p, Protocol: Protocol}); err != nil {
+			a.unbindLocked(q, key)
+			return err
+		}
+		q.subs[p] = b
+		q.bindings[key] = append(q.bindings[key], p)
+		if q.cancel != nil {
+			go a.consume(q.ctx, q, b.id, p)
+		}
+	}
+	return nil
+}
+
+// unbindLocked drops the subscriptions no other binding of the queue maps onto.
+func (a *App) unbindLocked(q *queue, key [2]string) {
+	for _, p := range q.bindings[key] {
+		b := q.subs[p]
+		if b.refs--; b.refs > 0 {
+			continue
+		}
+		delete(q.subs, p)
+		_ = a.funcs.Unsubscribe(b.id)
+	}
+	delete(q.bindings, key)
+}
+
+// deleteQueue drops the queue and returns its consumers, which the caller notifies.
+func (a *App) deleteQueue(c *conn, name string, ifUnused bool) ([]*consumer, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	q, ok := a.queues[name]
+	switch {
+	case !ok:
+		return nil, nil
+	case q.owner != nil && q.owner != c:
+		return nil, channelError(replyResourceLocked, "queue '%s' is exclusive to another connection", name)
+	case ifUnused && len(q.consumers) > 0:
+		return nil, channelError(replyPreconditionFailed, "queue '%s' is in use", name)
+	}
+	return a.dropLocked(q), nil
+}
+
+// dropOwned drops the exclusive queues of a closed connection.
+func (a *App) dropOwned(c *conn) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, q := range a.queues {
+		if q.owner == c {
+			a.dropLocked(q)
+		}
+	}
+}
+
+func (a *App) dropLocked(q *queue) []*consumer {
+	delete(a.queues, q.name)
+	for key := range q.bindings {
+		a.unbindLocked(q, key)
+	}
+	consumers := q.consumers
+	q.consumers = nil
+	a.stopLocked(q)
+	return consumers
+}
+
+// addConsumer attaches the consumer to its queue, the first one starts the
+// consumption of the bound subscriptions.
+func (a *App) addConsumer(c *conn, cons *consumer, name string, exclusive bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	q, err := a.queueLocked(c, name)
+	if err != nil {
+		return err
+	}
+	switch {
+	case q.exclusive:
+		return channelError(replyAccessRefused, "queue '%s' has an exclusive consumer", name)
+	case exclusive && len(q.consumers) > 0:
+		return channelError(replyAccessRefused, "queue '%s' already has consumers", name)
+	}
+	cons.queue = q
+	q.consumers = append(q.consumers, cons)
+	q.exclusive = exclusive
+	if q.cancel == nil {
+		q.ctx, q.cancel = context.WithCancel(a.server.Context())
+		for p, b := range q.subs {
+			go a.consume(q.ctx, q, b.id, p)
+		}
+	}
+	a.wakeLocked(q)
+	return nil
+}
+
+// removeConsumer detaches the consumer, the last one stops the consumption and
+// deletes an auto-delete queue.
+func (a *App) removeConsumer(cons *consumer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	q := cons.queue
+	i := slices.Index(q.consumers, cons)
+	if i < 0 {
+		return
+	}
+	q.consumers = slices.Delete(q.consumers, i, i+1)
+	q.exclusive = false
+	if len(q.consumers) > 0 {
+		return
+	}
+	if q.autoDelete && a.queues[q.name] == q {
+		a.dropLocked(q)
+		return
+	}
+	a.stopLocked(q)
+}
+
+func (a *App) stopLocked(q *queue) {
+	if q.cancel != nil {
+		q.cancel()
+		q.cancel = nil
+	}
+	a.wakeLocked(q)
+}
+
+// settled returns the prefetch credit of an acked or rejected delivery.
+func (a *App) settled(cons *consumer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	cons.unacked--
+	a.wakeLocked(cons.queue)
+}
+
+func (a *App) wakeLocked(q *queue) {
+	close(q.ready)
+	q.ready = make(chan struct{})
+}
+
+// consume streams a bound subscription into the queue until ctx is done. The
+// consumer of a queue that just lost its last consumer may still be detaching
+// from the subscription, so attaching is retried.
+func (a *App) consume(ctx context.Context, q *queue, id, pattern string) {
+	const op = "amqp_app.App.consume"
+	for {
+		deliveries, err := a.funcs.Consume(ctx, broker.Subscription{ID: id, TopicName: pattern, Protocol: Protocol}, broker.ConsumeOptions{})
+		switch {
+		case errors.Is(err, broker.ErrConsumerAttached):
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(10 * time.Millisecond):
+				continue
+			}
+		case err != nil:
+			a.log.With(slog.String("op", op)).Warn("failed to consume queue binding", slog.String("queue", q.name),
+				slog.String("subscription", id), logging.Err(err))
+			return
+		}
+		for d := range deliveries {
+			a.dispatch(ctx, q, d)
+		}
+		return
+	}
+}
+
+// dispatch hands the delivery to the next consumer with prefetch credit, waiting
+// for one. A delivery nobody takes before ctx is done is nacked for redelivery.
+func (a *App) dispatch(ctx context.Context, q *queue, d broker.Delivery[any]) {
+	for {
+		a.mu.Lock()
+		cons := q.pick()
+		if cons == nil {
+			ready := q.ready
+			a.mu.Unlock()
+			select {
+			case <-ready:
+				continue
+			case <-ctx.Done():
+				_ = a.funcs.Nack(d.AckToken)
+				return
+			}
+		}
+		if !cons.noAck {
+			cons.unacked++
+		}
+		a.mu.Unlock()
+		if cons.ch.deliver(cons, d) {
+			return
+		}
+		if !cons.noAck {
+			a.settled(cons)
+		}
+	}
+}
+
+// pick returns the next consumer in turn with prefetch credit, nil if none has.
+func (q *queue) pick() *consumer {
+	n := len(q.consumers)
+	for i := range n {
+		cons := q.consumers[(q.next+i)%n]
+		if cons.noAck || cons.prefetch == 0 || cons.unacked < cons.prefetch {
+			q.next = (q.next + i + 1) % n
+			return cons
+		}
+	}
+	return nil
+}
@@ -2,16 +2,30 @@ package app
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/gin-gonic/gin"
 	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/amqp_app"
 	"github.com/ivanbulyk/vortexq/internal/config"
+	"github.com/ivanbulyk/vortexq/internal/grpc_app"
+	"github.com/ivanbulyk/vortexq/internal/handoff"
 	"github.com/ivanbulyk/vortexq/internal/http_app"
 	"github.com/ivanbulyk/vortexq/internal/http_app/routes"
+	"github.com/ivanbulyk/vortexq/internal/kafka_app"
 	"github.com/ivanbulyk/vortexq/internal/logging"
+	"github.com/ivanbulyk/vortexq/internal/mqtt_app"
+	"github.com/ivanbulyk/vortexq/internal/nats_app"
+	"github.com/ivanbulyk/vortexq/internal/resp_app"
+	"github.com/ivanbulyk/vortexq/internal/stomp_app"
+	"github.com/ivanbulyk/vortexq/internal/systemd"
+	"github.com/ivanbulyk/vortexq/internal/urlpolicy"
 	"github.com/ivanbulyk/vortexq/internal/version"
+	"github.com/ivanbulyk/vortexq/internal/wire_app"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 
 	"golang.org/x/sync/errgroup"
 	"log/slog"
@@ -24,10 +38,27 @@ const (
 	_shutdownPeriod      = 15 * time.Second
 	_shutdownHardPeriod  = 3 * time.Second
 	_readinessDrainDelay = 5 * time.Second
+	_upgradeTimeout      = 30 * time.Second
 )
 
 type App struct {
 	HTTPApp *http_app.App
+	// GRPCApp is nil when the gRPC server is disabled
+	GRPCApp *grpc_app.App
+	// MQTTApp is nil when the MQTT listener is disabled
+	MQTTApp *mqtt_app.App
+	// RESPApp is nil when the Redis protocol listener is disabled
+	RESPApp *resp_app.App
+	// STOMPApp is nil when the STOMP listener is disabled
+	STOMPApp *stomp_app.App
+	// WireApp is nil when the native protocol listener is disabled
+	WireApp *wire_app.App
+	// KafkaApp is nil when the Kafka protocol listener is disabled
+	KafkaApp *kafka_app.App
+	// NATSApp is nil when the NATS listener is disabled
+	NATSApp *nats_app.App
+	// AMQPApp is nil when the AMQP listener is disabled
+	AMQPApp *amqp_app.App
 }
 
 // New returns an App instance.
@@ -53,6 +84,10 @@ func run() error {
 	// Setup signal context
 	rootCtx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
+	// The upgrade signal would kill the process until it's handled
+	upgrades := make(chan os.Signal, 1)
+	handoff.NotifyUpgrade(upgrades)
+	defer signal.Stop(upgrades)
 
 	cfg := &config.ServerAppConfig{}
 	cfg.LoadFromEnv()
@@ -62,9 +97,33 @@ func run() error {
 	router.Use(gin.Logger())
 	router.Use(routes.RequestMetricsMiddleware())
 
+	// Restrict where webhooks can be delivered to
+	policy, err := urlpolicy.New(urlpolicy.Config{
+		AllowedSchemes: cfg.WebhookAllowedSchemes,
+		AllowedHosts:   cfg.WebhookAllowedHosts,
+		DeniedHosts:    cfg.WebhookDeniedHosts,
+		AllowPrivate:   cfg.WebhookAllowPrivate,
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
 	// Initialize the broker
 	vq := broker.NewVortexQ[any]()
 	vq.Logger = log
+	vq.URLPolicy = policy
+	vq.Deliveries = broker.NewDeliveryLog(cfg.DeliveryLogMaxRecords, cfg.DeliveryLogRetention)
+	vq.Retry = broker.RetryPolicy{
+		MaxAttempts:           cfg.DeliveryMaxAttempts,
+		BaseDelay:             cfg.DeliveryRetryBaseDelay,
+		MaxDelay:              cfg.DeliveryRetryMaxDelay,
+		PermanentFailureCodes: make(map[int]bool, len(cfg.DeliveryPermanentFailureCodes)),
+	}
+	for _, code := range cfg.DeliveryPermanentFailureCodes {
+		vq.Retry.PermanentFailureCodes[code] = true
+	}
+	vq.Retention = broker.Retention{MaxMessages: cfg.RetentionMaxMessages, MaxAge: cfg.RetentionMaxAge}
+	vq.PublicURL = cfg.PublicURL
 
 	// Set up the VortexQ handler
 	vortexqHandler := routes.NewVortexQHandler(vq)
@@ -77,11 +136,24 @@ func run() error {
 	}
 
 	// Register custom metrics
-	vortexqHandler.CustomRegistry.MustRegister(routes.HttpRequestTotal, routes.HttpRequestErrorTotal)
+	vortexqHandler.CustomRegistry.MustRegister(routes.HttpRequestTotal, routes.HttpRequestErrorTotal, routes.SSEConnections)
 
 	// Set up routes
 	SetUpRoutes(router, vortexqHandler)
 
+	var mqttApp *mqtt_app.App
+	if cfg.MQTTEnabled {
+		mqttApp = mqtt_app.New(log, vq, cfg.GetMQTTAddress())
+		if cfg.MQTTWebSocket {
+			router.GET("/mqtt", gin.WrapF(mqttApp.ServeWebSocket))
+		}
+	}
+
+	listeners, err := httpListeners(cfg)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
 	// Ensure in-flight requests aren't canceled immediately on SIGTERM
 	ongoingCtx, stopOngoingGracefully := context.WithCancel(context.Background())
 
@@ -94,6 +166,29 @@ func run() error {
 	}
 
 	application := New(log, server)
+	application.HTTPApp.Listeners = listeners
+	if cfg.GRPCEnabled {
+		application.GRPCApp = grpc_app.New(log, vq, cfg.GetGRPCAddress())
+	}
+	application.MQTTApp = mqttApp
+	if cfg.RESPEnabled {
+		application.RESPApp = resp_app.New(log, vq, cfg.GetRESPAddress())
+	}
+	if cfg.STOMPEnabled {
+		application.STOMPApp = stomp_app.New(log, vq, cfg.GetSTOMPAddress())
+	}
+	if cfg.WireEnabled {
+		application.WireApp = wire_app.New(log, vq, cfg.GetWireAddress())
+	}
+	if cfg.KafkaEnabled {
+		application.KafkaApp = kafka_app.New(log, vq, cfg.GetKafkaAddress())
+	}
+	if cfg.NATSEnabled {
+		application.NATSApp = nats_app.New(log, vq, cfg.GetNATSAddress())
+	}
+	if cfg.AMQPEnabled {
+		application.AMQPApp = amqp_app.New(log, vq, cfg.GetAMQPAddress())
+	}
 
 	g, ctx := errgroup.WithContext(ongoingCtx)
 
@@ -104,34 +199,147 @@ func run() error {
 		application.HTTPApp.MustRun()
 		return ctx.Err()
 	})
+	if application.GRPCApp != nil {
+		g.Go(func() error {
+			application.GRPCApp.MustRun()
+			return ctx.Err()
+		})
+	}
+	if application.MQTTApp != nil {
+		g.Go(func() error {
+			application.MQTTApp.MustRun()
+			return ctx.Err()
+		})
+	}
+	if application.RESPApp != nil {
+		g.Go(func() error {
+			application.RESPApp.MustRun()
+			return ctx.Err()
+		})
+	}
+	if application.STOMPApp != nil {
+		g.Go(func() error {
+			application.STOMPApp.MustRun()
+			return ctx.Err()
+		})
+	}
+	if application.WireApp != nil {
+		g.Go(func() error {
+			application.WireApp.MustRun()
+			return ctx.Err()
+		})
+	}
+	if application.KafkaApp != nil {
+		g.Go(func() error {
+			application.KafkaApp.MustRun()
+			return ctx.Err()
+		})
+	}
+	if application.NATSApp != nil {
+		g.Go(func() error {
+			application.NATSApp.MustRun()
+			return ctx.Err()
+		})
+	}
+	if application.AMQPApp != nil {
+		g.Go(func() error {
+			application.AMQPApp.MustRun()
+			return ctx.Err()
+		})
+	}
+	// listening is closed once every listener is registered for the handoff
+	listening := make(chan struct{})
+	g.Go(func() error {
+		if !application.waitListening(ctx) {
+			return nil
+		}
+		close(listening)
+		if err := handoff.Ready(); err != nil {
+			log.With(slog.String("op", op)).Warn("failed to notify the previous process", logging.Err(err))
+		}
+		if _, err := systemd.Notify(systemd.Ready); err != nil {
+			log.With(slog.String("op", op)).Warn("failed to notify readiness", logging.Err(err))
+		}
+		return nil
+	})
 	g.Go(func() error {
+		tick := time.NewTicker(time.Second)
+		defer tick.Stop()
 		for {
+			// every second, and right away when an attached consumer has work
 			select {
-			case <-time.Tick(time.Second):
-				err := vq.Swirl()
-				if err != nil {
-					log.With(slog.String("op", op)).Error("failed to swirl messages", logging.Err(err))
-				}
-
+			case <-tick.C:
+			case <-vq.Wake():
 			case <-ctx.Done():
 				return ctx.Err()
 			}
+			err := vq.Swirl()
+			if err != nil {
+				log.With(slog.String("op", op)).Error("failed to swirl messages", logging.Err(err))
+			}
 		}
 	})
 
-	// Wait for a signal
-	<-rootCtx.Done()
+	// Wait for a signal, the upgrade signal hands the listeners to a new process
+	// first. It waits for the listeners, the new process would bind the others again
+	upgraded := false
+	for !upgraded && rootCtx.Err() == nil {
+		select {
+		case <-rootCtx.Done():
+		case <-upgrades:
+			select {
+			case <-listening:
+				upgraded = upgrade(rootCtx, log)
+			case <-rootCtx.Done():
+			}
+		}
+	}
 	stop()
-	vortexqHandler.IsShuttingDown.Store(true)
-	log.With(slog.String("op", op)).Info("received shutdown signal, shutting down..")
+	// End WebSockets and event streams, their clients reconnect elsewhere and
+	// the HTTP server doesn't wait for them
+	vortexqHandler.Shutdown()
+	if upgraded {
+		// the new process serves on the same sockets, there is nothing to drain
+		log.With(slog.String("op", op)).Info("handed over to the new process, shutting down..")
+	} else {
+		vortexqHandler.IsShuttingDown.Store(true)
+		if _, err := systemd.Notify(systemd.Stopping); err != nil {
+			log.With(slog.String("op", op)).Warn("failed to notify shutdown", logging.Err(err))
+		}
+		log.With(slog.String("op", op)).Info("received shutdown signal, shutting down..")
 
-	// Give time for readiness check to propagate
-	time.Sleep(_readinessDrainDelay)
-	log.With(slog.String("op", op)).Info("readiness check propagated, now waiting for ongoing requests to finish..")
+		// Give time for readiness check to propagate
+		time.Sleep(_readinessDrainDelay)
+		log.With(slog.String("op", op)).Info("readiness check propagated, now waiting for ongoing requests to finish..")
+	}
 
 	shutdownCtx, cancel := context.WithTimeout(context.Background(), _shutdownPeriod)
 	defer cancel()
-	err := application.HTTPApp.Stop(shutdownCtx)
+	err = application.HTTPApp.Stop(shutdownCtx)
+	if application.GRPCApp != nil {
+		err = errors.Join(err, application.GRPCApp.Stop(shutdownCtx))
+	}
+	if application.MQTTApp != nil {
+		err = errors.Join(err, application.MQTTApp.Stop(shutdownCtx))
+	}
+	if application.RESPApp != nil {
+		err = errors.Join(err, application.RESPApp.Stop(shutdownCtx))
+	}
+	if application.STOMPApp != nil {
+		err = errors.Join(err, application.STOMPApp.Stop(shutdownCtx))
+	}
+	if application.WireApp != nil {
+		err = errors.Join(err, application.WireApp.Stop(shutdownCtx))
+	}
+	if application.KafkaApp != nil {
+		err = errors.Join(err, application.KafkaApp.Stop(shutdownCtx))
+	}
+	if application.NATSApp != nil {
+		err = errors.Join(err, application.NATSApp.Stop(shutdownCtx))
+	}
+	if application.AMQPApp != nil {
+		err = errors.Join(err, application.AMQPApp.Stop(shutdownCtx))
+	}
 	stopOngoingGracefully()
 	if err != nil {
 		log.Error("failed to wait for ongoing requests to finish, waiting for forced cancellation", logging.Err(err))
@@ -148,12 +356,124 @@ func run() error {
 	return nil
 }
 
+// waitListening waits until every enabled server accepts connections, it
+// reports false when ctx is done first.
+func (a *App) waitListening(ctx context.Context) bool {
+	readies := []<-chan struct{}{a.HTTPApp.Ready()}
+	if a.GRPCApp != nil {
+		readies = append(readies, a.GRPCApp.Ready())
+	}
+	if a.MQTTApp != nil {
+		readies = append(readies, a.MQTTApp.Ready())
+	}
+	if a.RESPApp != nil {
+		readies = append(readies, a.RESPApp.Ready())
+	}
+	if a.STOMPApp != nil {
+		readies = append(readies, a.STOMPApp.Ready())
+	}
+	if a.WireApp != nil {
+		readies = append(readies, a.WireApp.Ready())
+	}
+	if a.KafkaApp != nil {
+		readies = append(readies, a.KafkaApp.Ready())
+	}
+	if a.NATSApp != nil {
+		readies = append(readies, a.NATSApp.Ready())
+	}
+	if a.AMQPApp != nil {
+		readies = append(readies, a.AMQPApp.Ready())
+	}
+	for _, ready := range readies {
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// httpListeners returns the sockets handed over by the previous process of an
+// upgrade, the sockets passed by systemd socket activation or a Unix socket,
+// none means the HTTP server listens on TCP.
+func httpListeners(cfg *config.ServerAppConfig) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for i := 0; ; i++ {
+		lis, ok, err := handoff.Take("http/" + strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		listeners = append(listeners, lis)
+	}
+	if len(listeners) > 0 {
+		return listeners, nil
+	}
+
+	listeners, err := systemd.Listeners()
+	if err != nil {
+		return nil, err
+	}
+	if len(listeners) == 0 && cfg.SocketPath != "" {
+		lis, err := http_app.ListenUnix(cfg.SocketPath, cfg.SocketMode)
+		if err != nil {
+			return nil, err
+		}
+		listeners = []net.Listener{lis}
+	}
+	for i, lis := range listeners {
+		handoff.Add("http/"+strconv.Itoa(i), lis)
+	}
+	return listeners, nil
+}
+
+// upgrade starts a new process on the listeners and reports whether it took
+// over, this process keeps serving when it didn't.
+func upgrade(ctx context.Context, log *slog.Logger) bool {
+	const op = "app.upgrade"
+	log = log.With(slog.String("op", op))
+
+	log.Info("received upgrade signal, starting the new process..")
+	ctx, cancel := context.WithTimeout(ctx, _upgradeTimeout)
+	defer cancel()
+	pid, err := handoff.Upgrade(ctx)
+	if err != nil {
+		log.Error("upgrade failed, serving on", logging.Err(err))
+		return false
+	}
+	// the service manager follows the new process, it may not accept its
+	// readiness notification before this one
+	if _, err := systemd.Notify(fmt.Sprintf("MAINPID=%d\n%s", pid, systemd.Ready)); err != nil {
+		log.Warn("failed to notify the new main process", logging.Err(err))
+	}
+	log.Info("new process is ready", slog.Int("pid", pid))
+	return true
+}
+
 func SetUpRoutes(router *gin.Engine, vortexqHandler *routes.VortexQHandler) {
 
 	router.GET("/", vortexqHandler.IndexHandler)
 	router.POST("/publish", vortexqHandler.PublishHandler)
+	router.POST("/publish/batch", vortexqHandler.PublishBatchHandler)
 	router.POST("/subscribe", vortexqHandler.SubscribeHandler)
+	router.POST("/request", vortexqHandler.RequestHandler)
 	router.GET("/healthz", routes.LivenessHandler)
 	router.GET("/readyz", vortexqHandler.ReadinessHandler)
 	router.GET("/metrics", vortexqHandler.PrometheusHandler())
+	router.GET("/subscriptions", vortexqHandler.ListSubscriptionsHandler)
+	router.GET("/subscriptions/:id", vortexqHandler.GetSubscriptionHandler)
+	router.POST("/subscriptions/:id/seek", vortexqHandler.SeekSubscriptionHandler)
+	router.GET("/subscriptions/:id/deliveries", vortexqHandler.SubscriptionDeliveriesHandler)
+	router.GET("/messages/:id/deliveries", vortexqHandler.MessageDeliveriesHandler)
+	router.POST("/templates/render", vortexqHandler.RenderTemplateHandler)
+	router.POST("/acks/:token", vortexqHandler.AckHandler)
+	router.POST("/nacks/:token", vortexqHandler.NackHandler)
+	router.GET("/ws", vortexqHandler.WebSocketHandler)
+	router.GET("/graphql", vortexqHandler.GraphQLHandler)
+	router.POST("/graphql", vortexqHandler.GraphQLHandler)
+	router.PUT("/topics/:name", vortexqHandler.PublishRawHandler)
+	router.GET("/topics/:name/events", vortexqHandler.TopicEventsHandler)
 }
@@ -4,6 +4,9 @@ import (
 	"fmt"
 	"github.com/ivanbulyk/vortexq/internal/version"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
@@ -14,6 +17,52 @@ const (
 	envServerServiceRelease   = "SERVER_SERVICE_RELEASE"
 	envServerServiceBuildTime = "SERVER_SERVICE_BUILD_TIME"
 	envServerServiceCommit    = "SERVER_SERVICE_COMMIT"
+
+	envSocketPath = "SERVER_SERVICE_SOCKET_PATH"
+	envSocketMode = "SERVER_SERVICE_SOCKET_MODE"
+
+	envWebhookAllowedSchemes = "SERVER_SERVICE_WEBHOOK_ALLOWED_SCHEMES"
+	envWebhookAllowedHosts   = "SERVER_SERVICE_WEBHOOK_ALLOWED_HOSTS"
+	envWebhookDeniedHosts    = "SERVER_SERVICE_WEBHOOK_DENIED_HOSTS"
+	envWebhookAllowPrivate   = "SERVER_SERVICE_WEBHOOK_ALLOW_PRIVATE"
+
+	envDeliveryLogMaxRecords = "SERVER_SERVICE_DELIVERY_LOG_MAX_RECORDS"
+	envDeliveryLogRetention  = "SERVER_SERVICE_DELIVERY_LOG_RETENTION"
+
+	envDeliveryMaxAttempts           = "SERVER_SERVICE_DELIVERY_MAX_ATTEMPTS"
+	envDeliveryRetryBaseDelay        = "SERVER_SERVICE_DELIVERY_RETRY_BASE_DELAY"
+	envDeliveryRetryMaxDelay         = "SERVER_SERVICE_DELIVERY_RETRY_MAX_DELAY"
+	envDeliveryPermanentFailureCodes = "SERVER_SERVICE_DELIVERY_PERMANENT_FAILURE_CODES"
+
+	envRetentionMaxMessages = "SERVER_SERVICE_RETENTION_MAX_MESSAGES"
+	envRetentionMaxAge      = "SERVER_SERVICE_RETENTION_MAX_AGE"
+
+	envPublicURL = "SERVER_SERVICE_PUBLIC_URL"
+
+	envGRPCEnabled = "SERVER_SERVICE_GRPC_ENABLED"
+	envGRPCPort    = "SERVER_SERVICE_GRPC_PORT"
+
+	envMQTTEnabled   = "SERVER_SERVICE_MQTT_ENABLED"
+	envMQTTPort      = "SERVER_SERVICE_MQTT_PORT"
+	envMQTTWebSocket = "SERVER_SERVICE_MQTT_WEBSOCKET"
+
+	envRESPEnabled = "SERVER_SERVICE_RESP_ENABLED"
+	envRESPPort    = "SERVER_SERVICE_RESP_PORT"
+
+	envSTOMPEnabled = "SERVER_SERVICE_STOMP_ENABLED"
+	envSTOMPPort    = "SERVER_SERVICE_STOMP_PORT"
+
+	envWireEnabled = "SERVER_SERVICE_WIRE_ENABLED"
+	envWirePort    = "SERVER_SERVICE_WIRE_PORT"
+
+	envKafkaEnabled = "SERVER_SERVICE_KAFKA_ENABLED"
+	envKafkaPort    = "SERVER_SERVICE_KAFKA_PORT"
+
+	envNATSEnabled = "SERVER_SERVICE_NATS_ENABLED"
+	envNATSPort    = "SERVER_SERVICE_NATS_PORT"
+
+	envAMQPEnabled = "SERVER_SERVICE_AMQP_ENABLED"
+	envAMQPPort    = "SERVER_SERVICE_AMQP_PORT"
 )
 
 // ServerAppConfig ...
@@ -25,6 +74,76 @@ type ServerAppConfig struct {
 	Release   string
 	BuildTime string
 	Commit    string
+
+	// SocketPath makes the HTTP server listen on a Unix socket instead of Host and Port
+	SocketPath string
+	// SocketMode is the file mode of the Unix socket
+	SocketMode os.FileMode
+
+	// WebhookAllowedSchemes lists URL schemes accepted for subscriber addresses
+	WebhookAllowedSchemes []string
+	// WebhookAllowedHosts lists host names or CIDRs subscribers are restricted to, empty means any
+	WebhookAllowedHosts []string
+	// WebhookDeniedHosts lists host names or CIDRs subscribers can never point to
+	WebhookDeniedHosts []string
+	// WebhookAllowPrivate permits delivery to loopback, private and link-local ranges
+	WebhookAllowPrivate bool
+
+	// DeliveryLogMaxRecords bounds the number of kept delivery attempts
+	DeliveryLogMaxRecords int
+	// DeliveryLogRetention bounds the age of kept delivery attempts
+	DeliveryLogRetention time.Duration
+
+	// DeliveryMaxAttempts is the number of attempts per message and subscription
+	DeliveryMaxAttempts int
+	// DeliveryRetryBaseDelay is the first retry delay, doubled on each further attempt
+	DeliveryRetryBaseDelay time.Duration
+	// DeliveryRetryMaxDelay caps the retry backoff
+	DeliveryRetryMaxDelay time.Duration
+	// DeliveryPermanentFailureCodes are subscriber response codes that are never retried
+	DeliveryPermanentFailureCodes []int
+
+	// RetentionMaxMessages bounds the messages kept per topic for replay
+	RetentionMaxMessages int
+	// RetentionMaxAge bounds the age of messages kept for replay
+	RetentionMaxAge time.Duration
+
+	// PublicURL is the base URL subscribers reach the API on, async acks are refused without it
+	PublicURL string
+
+	// GRPCEnabled starts the gRPC server next to the HTTP server
+	GRPCEnabled bool
+	GRPCPort    string
+
+	// MQTTEnabled starts the MQTT listener next to the HTTP server
+	MQTTEnabled bool
+	MQTTPort    string
+	// MQTTWebSocket also serves MQTT over WebSocket on GET /mqtt of the HTTP server
+	MQTTWebSocket bool
+
+	// RESPEnabled starts the Redis protocol listener next to the HTTP server
+	RESPEnabled bool
+	RESPPort    string
+
+	// STOMPEnabled starts the STOMP listener next to the HTTP server
+	STOMPEnabled bool
+	STOMPPort    string
+
+	// WireEnabled starts the native binary protocol listener next to the HTTP server
+	WireEnabled bool
+	WirePort    string
+
+	// KafkaEnabled starts the Kafka protocol listener next to the HTTP server
+	KafkaEnabled bool
+	KafkaPort    string
+
+	// NATSEnabled starts the NATS listener next to the HTTP server
+	NATSEnabled bool
+	NATSPort    string
+
+	// AMQPEnabled starts the AMQP listener next to the HTTP server
+	AMQPEnabled bool
+	AMQPPort    string
 }
 
 // GetCombinedAddress with Host and Port
@@ -32,6 +151,46 @@ func (cfg *ServerAppConfig) GetCombinedAddress() string {
 	return fmt.Sprintf("%s:%s", cfg.Host, cfg.Port)
 }
 
+// GetGRPCAddress with Host and GRPCPort
+func (cfg *ServerAppConfig) GetGRPCAddress() string {
+	return fmt.Sprintf("%s:%s", cfg.Host, cfg.GRPCPort)
+}
+
+// GetMQTTAddress with Host and MQTTPort
+func (cfg *ServerAppConfig) GetMQTTAddress() string {
+	return fmt.Sprintf("%s:%s", cfg.Host, cfg.MQTTPort)
+}
+
+// GetRESPAddress with Host and RESPPort
+func (cfg *ServerAppConfig) GetRESPAddress() string {
+	return fmt.Sprintf("%s:%s", cfg.Host, cfg.RESPPort)
+}
+
+// GetSTOMPAddress with Host and STOMPPort
+func (cfg *ServerAppConfig) GetSTOMPAddress() string {
+	return fmt.Sprintf("%s:%s", cfg.Host, cfg.STOMPPort)
+}
+
+// GetWireAddress with Host and WirePort
+func (cfg *ServerAppConfig) GetWireAddress() string {
+	return fmt.Sprintf("%s:%s", cfg.Host, cfg.WirePort)
+}
+
+// GetKafkaAddress with Host and KafkaPort
+func (cfg *ServerAppConfig) GetKafkaAddress() string {
+	return fmt.Sprintf("%s:%s", cfg.Host, cfg.KafkaPort)
+}
+
+// GetNATSAddress with Host and NATSPort
+func (cfg *ServerAppConfig) GetNATSAddress() string {
+	return fmt.Sprintf("%s:%s", cfg.Host, cfg.NATSPort)
+}
+
+// GetAMQPAddress with Host and AMQPPort
+func (cfg *ServerAppConfig) GetAMQPAddress() string {
+	return fmt.Sprintf("%s:%s", cfg.Host, cfg.AMQPPort)
+}
+
 // LoadFromEnv form environment variables
 func (cfg *ServerAppConfig) LoadFromEnv() {
 	cfg.Host = os.Getenv(envServerServiceHost)
@@ -62,5 +221,113 @@ func (cfg *ServerAppConfig) LoadFromEnv() {
 	if len(cfg.Commit) == 0 {
 		cfg.Commit = version.Commit
 	}
+	cfg.SocketPath = os.Getenv(envSocketPath)
+	cfg.SocketMode = 0o660
+	if mode, err := strconv.ParseUint(os.Getenv(envSocketMode), 8, 32); err == nil && mode <= 0o777 {
+		cfg.SocketMode = os.FileMode(mode)
+	}
+	cfg.WebhookAllowedSchemes = splitList(os.Getenv(envWebhookAllowedSchemes))
+	if len(cfg.WebhookAllowedSchemes) == 0 {
+		cfg.WebhookAllowedSchemes = []string{"http", "https"}
+	}
+	cfg.WebhookAllowedHosts = splitList(os.Getenv(envWebhookAllowedHosts))
+	cfg.WebhookDeniedHosts = splitList(os.Getenv(envWebhookDeniedHosts))
+	cfg.WebhookAllowPrivate = parseBool(os.Getenv(envWebhookAllowPrivate), false)
+	cfg.DeliveryLogMaxRecords = parseInt(os.Getenv(envDeliveryLogMaxRecords), 10000)
+	cfg.DeliveryLogRetention = parseDuration(os.Getenv(envDeliveryLogRetention), 24*time.Hour)
+	cfg.DeliveryMaxAttempts = parseInt(os.Getenv(envDeliveryMaxAttempts), 5)
+	cfg.DeliveryRetryBaseDelay = parseDuration(os.Getenv(envDeliveryRetryBaseDelay), time.Second)
+	cfg.DeliveryRetryMaxDelay = parseDuration(os.Getenv(envDeliveryRetryMaxDelay), 5*time.Minute)
+	cfg.DeliveryPermanentFailureCodes = nil
+	for _, code := range splitList(os.Getenv(envDeliveryPermanentFailureCodes)) {
+		if n, err := strconv.Atoi(code); err == nil {
+			cfg.DeliveryPermanentFailureCodes = append(cfg.DeliveryPermanentFailureCodes, n)
+		}
+	}
+	if len(cfg.DeliveryPermanentFailureCodes) == 0 {
+		cfg.DeliveryPermanentFailureCodes = []int{400, 401, 403, 405, 413, 415, 422}
+	}
+	cfg.RetentionMaxMessages = parseInt(os.Getenv(envRetentionMaxMessages), 10000)
+	cfg.RetentionMaxAge = parseDuration(os.Getenv(envRetentionMaxAge), 24*time.Hour)
+	cfg.PublicURL = strings.TrimSuffix(os.Getenv(envPublicURL), "/")
+	cfg.GRPCEnabled = parseBool(os.Getenv(envGRPCEnabled), false)
+	cfg.GRPCPort = os.Getenv(envGRPCPort)
+	if len(cfg.GRPCPort) == 0 {
+		cfg.GRPCPort = "50051"
+	}
+	cfg.MQTTEnabled = parseBool(os.Getenv(envMQTTEnabled), false)
+	cfg.MQTTPort = os.Getenv(envMQTTPort)
+	if len(cfg.MQTTPort) == 0 {
+		cfg.MQTTPort = "1883"
+	}
+	cfg.MQTTWebSocket = parseBool(os.Getenv(envMQTTWebSocket), false)
+	cfg.RESPEnabled = parseBool(os.Getenv(envRESPEnabled), false)
+	cfg.RESPPort = os.Getenv(envRESPPort)
+	if len(cfg.RESPPort) == 0 {
+		cfg.RESPPort = "6379"
+	}
+	cfg.STOMPEnabled = parseBool(os.Getenv(envSTOMPEnabled), false)
+	cfg.STOMPPort = os.Getenv(envSTOMPPort)
+	if len(cfg.STOMPPort) == 0 {
+		cfg.STOMPPort = "61613"
+	}
+	cfg.WireEnabled = parseBool(os.Getenv(envWireEnabled), false)
+	cfg.WirePort = os.Getenv(envWirePort)
+	if len(cfg.WirePort) == 0 {
+		cfg.WirePort = "7400"
+	}
+	cfg.KafkaEnabled = parseBool(os.Getenv(envKafkaEnabled), false)
+	cfg.KafkaPort = os.Getenv(envKafkaPort)
+	if len(cfg.KafkaPort) == 0 {
+		cfg.KafkaPort = "9092"
+	}
+	cfg.NATSEnabled = parseBool(os.Getenv(envNATSEnabled), false)
+	cfg.NATSPort = os.Getenv(envNATSPort)
+	if len(cfg.NATSPort) == 0 {
+		cfg.NATSPort = "4222"
+	}
+	cfg.AMQPEnabled = parseBool(os.Getenv(envAMQPEnabled), false)
+	cfg.AMQPPort = os.Getenv(envAMQPPort)
+	if len(cfg.AMQPPort) == 0 {
+		cfg.AMQPPort = "5672"
+	}
 
 }
+
+// parseInt parses a positive integer, falling back to def
+func parseInt(value string, def int) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return def
+	}
+	return n
+}
+
+// parseBool parses a boolean such as "true" or "0", falling back to def
+func parseBool(value string, def bool) bool {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return def
+	}
+	return b
+}
+
+// parseDuration parses a positive duration such as "90s", falling back to def
+func parseDuration(value string, def time.Duration) time.Duration {
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return def
+	}
+	return d
+}
+
+// splitList splits a comma separated value, dropping empty entries
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
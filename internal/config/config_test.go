@@ -2,7 +2,9 @@ package config
 
 import (
 	"os"
+	"reflect"
 	"testing"
+	"time"
 )
 
 // Test GetCombinedAddress concatenates host and port
@@ -24,6 +26,38 @@ func TestLoadFromEnvDefaults(t *testing.T) {
 		envServerServiceRelease,
 		envServerServiceBuildTime,
 		envServerServiceCommit,
+		envSocketPath,
+		envSocketMode,
+		envWebhookAllowedSchemes,
+		envWebhookAllowedHosts,
+		envWebhookDeniedHosts,
+		envWebhookAllowPrivate,
+		envDeliveryLogMaxRecords,
+		envDeliveryLogRetention,
+		envDeliveryMaxAttempts,
+		envDeliveryRetryBaseDelay,
+		envDeliveryRetryMaxDelay,
+		envDeliveryPermanentFailureCodes,
+		envRetentionMaxMessages,
+		envRetentionMaxAge,
+		envPublicURL,
+		envGRPCEnabled,
+		envGRPCPort,
+		envMQTTEnabled,
+		envMQTTPort,
+		envMQTTWebSocket,
+		envRESPEnabled,
+		envRESPPort,
+		envSTOMPEnabled,
+		envSTOMPPort,
+		envWireEnabled,
+		envWirePort,
+		envKafkaEnabled,
+		envKafkaPort,
+		envNATSEnabled,
+		envNATSPort,
+		envAMQPEnabled,
+		envAMQPPort,
 	}
 	for _, key := range vars {
 		_ = os.Unsetenv(key)
@@ -41,6 +75,57 @@ func TestLoadFromEnvDefaults(t *testing.T) {
 	if cfg.LogLevel != "local" {
 		t.Errorf("default LogLevel = %q; want %q", cfg.LogLevel, "local")
 	}
+	if cfg.SocketPath != "" || cfg.SocketMode != 0o660 {
+		t.Errorf("default socket = %q, %v; want none, %v", cfg.SocketPath, cfg.SocketMode, os.FileMode(0o660))
+	}
+	if !reflect.DeepEqual(cfg.WebhookAllowedSchemes, []string{"http", "https"}) {
+		t.Errorf("default WebhookAllowedSchemes = %v; want [http https]", cfg.WebhookAllowedSchemes)
+	}
+	if cfg.WebhookAllowPrivate {
+		t.Error("default WebhookAllowPrivate = true; want false")
+	}
+	if cfg.DeliveryLogMaxRecords != 10000 {
+		t.Errorf("default DeliveryLogMaxRecords = %d; want %d", cfg.DeliveryLogMaxRecords, 10000)
+	}
+	if cfg.DeliveryLogRetention != 24*time.Hour {
+		t.Errorf("default DeliveryLogRetention = %v; want %v", cfg.DeliveryLogRetention, 24*time.Hour)
+	}
+	if cfg.DeliveryMaxAttempts != 5 {
+		t.Errorf("default DeliveryMaxAttempts = %d; want %d", cfg.DeliveryMaxAttempts, 5)
+	}
+	if !reflect.DeepEqual(cfg.DeliveryPermanentFailureCodes, []int{400, 401, 403, 405, 413, 415, 422}) {
+		t.Errorf("default DeliveryPermanentFailureCodes = %v", cfg.DeliveryPermanentFailureCodes)
+	}
+	if cfg.RetentionMaxMessages != 10000 || cfg.RetentionMaxAge != 24*time.Hour {
+		t.Errorf("default retention = %d, %v; want 10000, 24h", cfg.RetentionMaxMessages, cfg.RetentionMaxAge)
+	}
+	if cfg.PublicURL != "" {
+		t.Errorf("default PublicURL = %q; want none", cfg.PublicURL)
+	}
+	if cfg.GRPCEnabled || cfg.GetGRPCAddress() != "0.0.0.0:50051" {
+		t.Errorf("default gRPC = %v, %q; want false, %q", cfg.GRPCEnabled, cfg.GetGRPCAddress(), "0.0.0.0:50051")
+	}
+	if cfg.MQTTEnabled || cfg.MQTTWebSocket || cfg.GetMQTTAddress() != "0.0.0.0:1883" {
+		t.Errorf("default MQTT = %v, %v, %q; want false, false, %q", cfg.MQTTEnabled, cfg.MQTTWebSocket, cfg.GetMQTTAddress(), "0.0.0.0:1883")
+	}
+	if cfg.RESPEnabled || cfg.GetRESPAddress() != "0.0.0.0:6379" {
+		t.Errorf("default RESP = %v, %q; want false, %q", cfg.RESPEnabled, cfg.GetRESPAddress(), "0.0.0.0:6379")
+	}
+	if cfg.STOMPEnabled || cfg.GetSTOMPAddress() != "0.0.0.0:61613" {
+		t.Errorf("default STOMP = %v, %q; want false, %q", cfg.STOMPEnabled, cfg.GetSTOMPAddress(), "0.0.0.0:61613")
+	}
+	if cfg.WireEnabled || cfg.GetWireAddress() != "0.0.0.0:7400" {
+		t.Errorf("default wire = %v, %q; want false, %q", cfg.WireEnabled, cfg.GetWireAddress(), "0.0.0.0:7400")
+	}
+	if cfg.KafkaEnabled || cfg.GetKafkaAddress() != "0.0.0.0:9092" {
+		t.Errorf("default Kafka = %v, %q; want false, %q", cfg.KafkaEnabled, cfg.GetKafkaAddress(), "0.0.0.0:9092")
+	}
+	if cfg.NATSEnabled || cfg.GetNATSAddress() != "0.0.0.0:4222" {
+		t.Errorf("default NATS = %v, %q; want false, %q", cfg.NATSEnabled, cfg.GetNATSAddress(), "0.0.0.0:4222")
+	}
+	if cfg.AMQPEnabled || cfg.GetAMQPAddress() != "0.0.0.0:5672" {
+		t.Errorf("default AMQP = %v, %q; want false, %q", cfg.AMQPEnabled, cfg.GetAMQPAddress(), "0.0.0.0:5672")
+	}
 }
 
 // Test LoadFromEnv respects provided environment variables
@@ -53,6 +138,38 @@ func TestLoadFromEnvOverrides(t *testing.T) {
 	t.Setenv(envServerServiceRelease, "rel")
 	t.Setenv(envServerServiceBuildTime, "bt")
 	t.Setenv(envServerServiceCommit, "cm")
+	t.Setenv(envWebhookAllowedSchemes, "https")
+	t.Setenv(envWebhookAllowedHosts, " hooks.example.com, 10.0.0.0/8 ,")
+	t.Setenv(envWebhookDeniedHosts, "169.254.169.254")
+	t.Setenv(envWebhookAllowPrivate, "true")
+	t.Setenv(envDeliveryLogMaxRecords, "50")
+	t.Setenv(envDeliveryLogRetention, "90m")
+	t.Setenv(envDeliveryMaxAttempts, "3")
+	t.Setenv(envDeliveryRetryBaseDelay, "2s")
+	t.Setenv(envDeliveryRetryMaxDelay, "1m")
+	t.Setenv(envDeliveryPermanentFailureCodes, "400, 404,bogus")
+	t.Setenv(envRetentionMaxMessages, "100")
+	t.Setenv(envRetentionMaxAge, "2h")
+	t.Setenv(envPublicURL, "https://vortexq.example.com/")
+	t.Setenv(envGRPCEnabled, "true")
+	t.Setenv(envGRPCPort, "6000")
+	t.Setenv(envMQTTEnabled, "true")
+	t.Setenv(envMQTTPort, "8883")
+	t.Setenv(envMQTTWebSocket, "1")
+	t.Setenv(envRESPEnabled, "true")
+	t.Setenv(envRESPPort, "6380")
+	t.Setenv(envSTOMPEnabled, "true")
+	t.Setenv(envSTOMPPort, "61614")
+	t.Setenv(envWireEnabled, "true")
+	t.Setenv(envWirePort, "7401")
+	t.Setenv(envKafkaEnabled, "true")
+	t.Setenv(envKafkaPort, "9093")
+	t.Setenv(envNATSEnabled, "true")
+	t.Setenv(envNATSPort, "4223")
+	t.Setenv(envAMQPEnabled, "true")
+	t.Setenv(envAMQPPort, "5673")
+	t.Setenv(envSocketPath, "/run/vortexq/http.sock")
+	t.Setenv(envSocketMode, "600")
 
 	cfg := &ServerAppConfig{}
 	cfg.LoadFromEnv()
@@ -77,4 +194,64 @@ func TestLoadFromEnvOverrides(t *testing.T) {
 	if cfg.Commit != "cm" {
 		t.Errorf("Commit override = %q; want %q", cfg.Commit, "cm")
 	}
+	if !reflect.DeepEqual(cfg.WebhookAllowedSchemes, []string{"https"}) {
+		t.Errorf("WebhookAllowedSchemes override = %v; want [https]", cfg.WebhookAllowedSchemes)
+	}
+	if !reflect.DeepEqual(cfg.WebhookAllowedHosts, []string{"hooks.example.com", "10.0.0.0/8"}) {
+		t.Errorf("WebhookAllowedHosts override = %v", cfg.WebhookAllowedHosts)
+	}
+	if !reflect.DeepEqual(cfg.WebhookDeniedHosts, []string{"169.254.169.254"}) {
+		t.Errorf("WebhookDeniedHosts override = %v", cfg.WebhookDeniedHosts)
+	}
+	if !cfg.WebhookAllowPrivate {
+		t.Error("WebhookAllowPrivate override = false; want true")
+	}
+	if cfg.DeliveryLogMaxRecords != 50 {
+		t.Errorf("DeliveryLogMaxRecords override = %d; want %d", cfg.DeliveryLogMaxRecords, 50)
+	}
+	if cfg.DeliveryLogRetention != 90*time.Minute {
+		t.Errorf("DeliveryLogRetention override = %v; want %v", cfg.DeliveryLogRetention, 90*time.Minute)
+	}
+	if cfg.DeliveryMaxAttempts != 3 {
+		t.Errorf("DeliveryMaxAttempts override = %d; want %d", cfg.DeliveryMaxAttempts, 3)
+	}
+	if cfg.DeliveryRetryBaseDelay != 2*time.Second || cfg.DeliveryRetryMaxDelay != time.Minute {
+		t.Errorf("retry delays override = %v, %v; want 2s, 1m", cfg.DeliveryRetryBaseDelay, cfg.DeliveryRetryMaxDelay)
+	}
+	if !reflect.DeepEqual(cfg.DeliveryPermanentFailureCodes, []int{400, 404}) {
+		t.Errorf("DeliveryPermanentFailureCodes override = %v; want [400 404]", cfg.DeliveryPermanentFailureCodes)
+	}
+	if cfg.RetentionMaxMessages != 100 || cfg.RetentionMaxAge != 2*time.Hour {
+		t.Errorf("retention override = %d, %v; want 100, 2h", cfg.RetentionMaxMessages, cfg.RetentionMaxAge)
+	}
+	if cfg.PublicURL != "https://vortexq.example.com" {
+		t.Errorf("PublicURL override = %q; want %q", cfg.PublicURL, "https://vortexq.example.com")
+	}
+	if !cfg.GRPCEnabled || cfg.GRPCPort != "6000" {
+		t.Errorf("gRPC override = %v, %q; want true, %q", cfg.GRPCEnabled, cfg.GRPCPort, "6000")
+	}
+	if !cfg.MQTTEnabled || !cfg.MQTTWebSocket || cfg.MQTTPort != "8883" {
+		t.Errorf("MQTT override = %v, %v, %q; want true, true, %q", cfg.MQTTEnabled, cfg.MQTTWebSocket, cfg.MQTTPort, "8883")
+	}
+	if !cfg.RESPEnabled || cfg.RESPPort != "6380" {
+		t.Errorf("RESP override = %v, %q; want true, %q", cfg.RESPEnabled, cfg.RESPPort, "6380")
+	}
+	if !cfg.STOMPEnabled || cfg.STOMPPort != "61614" {
+		t.Errorf("STOMP override = %v, %q; want true, %q", cfg.STOMPEnabled, cfg.STOMPPort, "61614")
+	}
+	if !cfg.WireEnabled || cfg.WirePort != "7401" {
+		t.Errorf("wire override = %v, %q; want true, %q", cfg.WireEnabled, cfg.WirePort, "7401")
+	}
+	if !cfg.KafkaEnabled || cfg.KafkaPort != "9093" {
+		t.Errorf("Kafka override = %v, %q; want true, %q", cfg.KafkaEnabled, cfg.KafkaPort, "9093")
+	}
+	if !cfg.NATSEnabled || cfg.NATSPort != "4223" {
+		t.Errorf("NATS override = %v, %q; want true, %q", cfg.NATSEnabled, cfg.NATSPort, "4223")
+	}
+	if !cfg.AMQPEnabled || cfg.AMQPPort != "5673" {
+		t.Errorf("AMQP override = %v, %q; want true, %q", cfg.AMQPEnabled, cfg.AMQPPort, "5673")
+	}
+	if cfg.SocketPath != "/run/vortexq/http.sock" || cfg.SocketMode != 0o600 {
+		t.Errorf("socket override = %q, %v; want %q, %v", cfg.SocketPath, cfg.SocketMode, "/run/vortexq/http.sock", os.FileMode(0o600))
+	}
 }
@@ -0,0 +1,100 @@
+package grpc_app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/handoff"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	vortexqv1 "github.com/ivanbulyk/vortexq/proto/vortexq/v1"
+	"google.golang.org/grpc"
+	"log/slog"
+	"net"
+	"sync"
+)
+
+type App struct {
+	log        *slog.Logger
+	grpcServer *grpc.Server
+	service    *Server
+	addr       string
+
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// New creates new gRPC server app serving the VortexQ service on addr.
+func New(log *slog.Logger, funcs broker.VortexQFuncs, addr string) *App {
+	grpcServer := grpc.NewServer()
+	service := NewServer(log, funcs)
+	vortexqv1.RegisterVortexQServiceServer(grpcServer, service)
+
+	return &App{
+		log:        log,
+		grpcServer: grpcServer,
+		service:    service,
+		addr:       addr,
+		ready:      make(chan struct{}),
+	}
+}
+
+// MustRun runs gRPC server and panics if any error occurs.
+func (a *App) MustRun() {
+	if err := a.run(); err != nil {
+		panic(err)
+	}
+}
+
+// Ready is closed once the server accepts connections.
+func (a *App) Ready() <-chan struct{} {
+	return a.ready
+}
+
+// Run runs gRPC server.
+func (a *App) run() error {
+	const op = "grpc_app.App.run"
+
+	lis, err := handoff.Listen("tcp", a.addr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return a.serve(lis)
+}
+
+func (a *App) serve(lis net.Listener) error {
+	const op = "grpc_app.App.serve"
+
+	a.log.With(slog.String("op", op)).Info("grpc server listening at ", slog.String("addr", lis.Addr().String()))
+	a.readyOnce.Do(func() { close(a.ready) })
+	if err := a.grpcServer.Serve(lis); err != nil && !errors.Is(err, grpc.ErrServerStopped) {
+		a.log.With(slog.String("op", op)).Error("failed to run grpc server: \n", logging.Err(err))
+		return fmt.Errorf("%s: %w", op, err)
+	}
+
+	return nil
+}
+
+// Stop ends the Consume streams and waits for the other calls to finish, calls
+// still running when timeoutCtx is done are canceled.
+func (a *App) Stop(timeoutCtx context.Context) error {
+	const op = "grpc_app.App.Stop"
+
+	a.log.With(slog.String("op", op)).
+		Info("grpc server shutdown")
+
+	a.service.Shutdown()
+	stopped := make(chan struct{})
+	go func() {
+		a.grpcServer.GracefulStop()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-timeoutCtx.Done():
+		a.grpcServer.Stop()
+		return fmt.Errorf("%s: %w", op, timeoutCtx.Err())
+	}
+}
@@ -0,0 +1,131 @@
+package grpc_app
+
+import (
+	"github.com/ivanbulyk/vortexq/broker"
+	vortexqv1 "github.com/ivanbulyk/vortexq/proto/vortexq/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func messageFromProto(pm *vortexqv1.Message) (broker.Message[any], error) {
+	msg := broker.Message[any]{
+		ID:            pm.GetId(),
+		Pattern:       pm.GetTopic(),
+		ContentType:   pm.GetContentType(),
+		Source:        pm.GetSource(),
+		Type:          pm.GetType(),
+		Headers:       pm.GetHeaders(),
+		CorrelationID: pm.GetCorrelationId(),
+		ReplyTo:       pm.GetReplyTo(),
+		ReceiptURL:    pm.GetReceiptUrl(),
+	}
+	if pm.GetTime() != nil {
+		msg.Time = pm.GetTime().AsTime()
+	}
+	if err := msg.SetPayload(pm.GetData()); err != nil {
+		return msg, status.Errorf(codes.InvalidArgument, "message data: %v", err)
+	}
+	return msg, nil
+}
+
+func messageToProto(msg broker.Message[any]) (*vortexqv1.Message, error) {
+	pm := &vortexqv1.Message{
+		Id:            msg.ID,
+		Topic:         msg.Pattern,
+		ContentType:   msg.ContentType,
+		Source:        msg.Source,
+		Type:          msg.Type,
+		Headers:       msg.Headers,
+		Offset:        msg.Offset,
+		CorrelationId: msg.CorrelationID,
+		ReplyTo:       msg.ReplyTo,
+		ReceiptUrl:    msg.ReceiptURL,
+	}
+	if !msg.Time.IsZero() {
+		pm.Time = timestamppb.New(msg.Time)
+	}
+	if msg.Data != nil {
+		data, contentType, err := msg.Payload()
+		if err != nil {
+			return nil, err
+		}
+		pm.Data, pm.ContentType = data, contentType
+	}
+	return pm, nil
+}
+
+func deliveryToProto(d broker.Delivery[any]) (*vortexqv1.Delivery, error) {
+	msg, err := messageToProto(d.Message)
+	if err != nil {
+		return nil, err
+	}
+	return &vortexqv1.Delivery{
+		Message:        msg,
+		SubscriptionId: d.SubscriptionID,
+		Attempt:        int32(d.Attempt),
+		AckToken:       d.AckToken,
+	}, nil
+}
+
+func startPositionFromProto(sp *vortexqv1.StartPosition) broker.StartPosition {
+	position := broker.StartPosition{From: sp.GetFrom(), Offset: sp.GetOffset()}
+	if sp.GetTime() != nil {
+		position.Time = sp.GetTime().AsTime()
+	}
+	return position
+}
+
+func startPositionToProto(sp broker.StartPosition) *vortexqv1.StartPosition {
+	position := &vortexqv1.StartPosition{From: sp.From, Offset: sp.Offset}
+	if !sp.Time.IsZero() {
+		position.Time = timestamppb.New(sp.Time)
+	}
+	return position
+}
+
+func subscriptionFromProto(ps *vortexqv1.Subscription) (broker.Subscription, error) {
+	if ps == nil {
+		return broker.Subscription{}, status.Error(codes.InvalidArgument, "subscription is required")
+	}
+	sub := broker.Subscription{
+		ID:                 ps.GetId(),
+		SubscriberAddress:  ps.GetSubscriberAddress(),
+		TopicName:          ps.GetTopic(),
+		Format:             ps.GetFormat(),
+		ReplyTopic:         ps.GetReplyTopic(),
+		AckMode:            ps.GetAckMode(),
+		AckDeadlineSeconds: int(ps.GetAckDeadlineSeconds()),
+		Protocol:           ps.GetProtocol(),
+	}
+	if t := ps.GetTemplate(); t != nil {
+		sub.Template = &broker.DeliveryTemplate{Method: t.GetMethod(), Headers: t.GetHeaders(), Body: t.GetBody()}
+	}
+	if ps.GetStart() != nil {
+		start := startPositionFromProto(ps.GetStart())
+		sub.Start = &start
+	}
+	return sub, nil
+}
+
+func subscriptionToProto(sub broker.Subscription) *vortexqv1.Subscription {
+	ps := &vortexqv1.Subscription{
+		Id:                 sub.ID,
+		SubscriberAddress:  sub.SubscriberAddress,
+		Topic:              sub.TopicName,
+		Format:             sub.Format,
+		ReplyTopic:         sub.ReplyTopic,
+		AckMode:            sub.AckMode,
+		AckDeadlineSeconds: int32(sub.AckDeadlineSeconds),
+		Protocol:           sub.Protocol,
+		State:              sub.State,
+		StateReason:        sub.StateReason,
+	}
+	if sub.Template != nil {
+		ps.Template = &vortexqv1.DeliveryTemplate{Method: sub.Template.Method, Headers: sub.Template.Headers, Body: sub.Template.Body}
+	}
+	if sub.Start != nil {
+		ps.Start = startPositionToProto(*sub.Start)
+	}
+	return ps
+}
@@ -0,0 +1,196 @@
+package grpc_app
+
+import (
+	"context"
+	"errors"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"github.com/ivanbulyk/vortexq/internal/urlpolicy"
+	vortexqv1 "github.com/ivanbulyk/vortexq/proto/vortexq/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// Protocol marks the subscriptions consumed over gRPC.
+const Protocol = "grpc"
+
+// Server implements the VortexQ gRPC service on top of the broker.
+type Server struct {
+	vortexqv1.UnimplementedVortexQServiceServer
+	funcs broker.VortexQFuncs
+	log   *slog.Logger
+
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+// NewServer creates the gRPC service backed by funcs.
+func NewServer(log *slog.Logger, funcs broker.VortexQFuncs) *Server {
+	return &Server{funcs: funcs, log: log, shutdown: make(chan struct{})}
+}
+
+// Shutdown ends the running Consume streams, so that the server can stop gracefully.
+func (s *Server) Shutdown() {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+}
+
+func (s *Server) Publish(_ context.Context, req *vortexqv1.PublishRequest) (*vortexqv1.PublishResponse, error) {
+	msg, err := messageFromProto(req.GetMessage())
+	if err != nil {
+		return nil, err
+	}
+	offset, err := s.funcs.Publish(msg)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &vortexqv1.PublishResponse{Id: msg.ID, Offset: offset}, nil
+}
+
+func (s *Server) PublishBatch(stream vortexqv1.VortexQService_PublishBatchServer) error {
+	const op = "grpc_app.Server.PublishBatch"
+	resp := &vortexqv1.PublishBatchResponse{}
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			s.log.With(slog.String("op", op)).Info("published batch", slog.Int("messages", len(resp.Results)))
+			return stream.SendAndClose(resp)
+		}
+		if err != nil {
+			return err
+		}
+		msg, err := messageFromProto(req.GetMessage())
+		if err != nil {
+			return err
+		}
+		offset, err := s.funcs.Publish(msg)
+		if err != nil {
+			return statusError(err)
+		}
+		resp.Results = append(resp.Results, &vortexqv1.PublishResponse{Id: msg.ID, Offset: offset})
+	}
+}
+
+func (s *Server) Subscribe(_ context.Context, req *vortexqv1.SubscribeRequest) (*vortexqv1.SubscribeResponse, error) {
+	sub, err := subscriptionFromProto(req.GetSubscription())
+	if err != nil {
+		return nil, err
+	}
+	if sub.ID == "" {
+		sub.ID = broker.NewID()
+	}
+	if err := s.funcs.Subscribe(sub); err != nil {
+		return nil, statusError(err)
+	}
+	if stored, ok := s.funcs.FindSubscription(sub.ID); ok {
+		sub = stored
+	}
+	return &vortexqv1.SubscribeResponse{Subscription: subscriptionToProto(sub)}, nil
+}
+
+func (s *Server) Unsubscribe(_ context.Context, req *vortexqv1.UnsubscribeRequest) (*vortexqv1.UnsubscribeResponse, error) {
+	if err := s.funcs.Unsubscribe(req.GetId()); err != nil {
+		return nil, statusError(err)
+	}
+	return &vortexqv1.UnsubscribeResponse{}, nil
+}
+
+func (s *Server) GetSubscription(_ context.Context, req *vortexqv1.GetSubscriptionRequest) (*vortexqv1.GetSubscriptionResponse, error) {
+	sub, ok := s.funcs.FindSubscription(req.GetId())
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "subscription %q not found", req.GetId())
+	}
+	return &vortexqv1.GetSubscriptionResponse{Subscription: subscriptionToProto(sub)}, nil
+}
+
+func (s *Server) ListSubscriptions(context.Context, *vortexqv1.ListSubscriptionsRequest) (*vortexqv1.ListSubscriptionsResponse, error) {
+	resp := &vortexqv1.ListSubscriptionsResponse{}
+	for _, sub := range s.funcs.ListSubscriptions() {
+		resp.Subscriptions = append(resp.Subscriptions, subscriptionToProto(sub))
+	}
+	return resp, nil
+}
+
+func (s *Server) Seek(_ context.Context, req *vortexqv1.SeekRequest) (*vortexqv1.SeekResponse, error) {
+	if err := s.funcs.Seek(req.GetId(), startPositionFromProto(req.GetPosition())); err != nil {
+		return nil, statusError(err)
+	}
+	return &vortexqv1.SeekResponse{}, nil
+}
+
+func (s *Server) Consume(req *vortexqv1.ConsumeRequest, stream vortexqv1.VortexQService_ConsumeServer) error {
+	const op = "grpc_app.Server.Consume"
+	if req.GetTopic() == "" {
+		return status.Error(codes.InvalidArgument, "topic is required")
+	}
+	sub := broker.Subscription{
+		ID:                 req.GetSubscriptionId(),
+		TopicName:          req.GetTopic(),
+		AckDeadlineSeconds: int(req.GetAckDeadlineSeconds()),
+		Protocol:           Protocol,
+	}
+	if req.GetStart() != nil {
+		start := startPositionFromProto(req.GetStart())
+		sub.Start = &start
+	}
+	opts := broker.ConsumeOptions{MaxInFlight: int(req.GetMaxInFlight()), AutoAck: req.GetAutoAck()}
+
+	deliveries, err := s.funcs.Consume(stream.Context(), sub, opts)
+	if err != nil {
+		return statusError(err)
+	}
+	log := s.log.With(slog.String("op", op), slog.String("topic", sub.TopicName))
+	log.Info("consumer attached", slog.String("subscription", sub.ID))
+
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return status.FromContextError(stream.Context().Err()).Err()
+			}
+			delivery, err := deliveryToProto(d)
+			if err != nil {
+				log.Error("can't encode delivery", slog.String("message", d.Message.ID), logging.Err(err))
+				if d.AckToken != "" {
+					_ = s.funcs.Nack(d.AckToken)
+				}
+				continue
+			}
+			if err := stream.Send(&vortexqv1.ConsumeResponse{Delivery: delivery}); err != nil {
+				return err
+			}
+		case <-s.shutdown:
+			return status.Error(codes.Unavailable, "server is shutting down")
+		}
+	}
+}
+
+func (s *Server) Ack(_ context.Context, req *vortexqv1.AckRequest) (*vortexqv1.AckResponse, error) {
+	if err := s.funcs.Ack(req.GetAckToken()); err != nil {
+		return nil, statusError(err)
+	}
+	return &vortexqv1.AckResponse{}, nil
+}
+
+func (s *Server) Nack(_ context.Context, req *vortexqv1.NackRequest) (*vortexqv1.NackResponse, error) {
+	if err := s.funcs.Nack(req.GetAckToken()); err != nil {
+		return nil, statusError(err)
+	}
+	return &vortexqv1.NackResponse{}, nil
+}
+
+// statusError maps broker errors onto gRPC status codes.
+func statusError(err error) error {
+	switch {
+	case errors.Is(err, broker.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, broker.ErrInvalidSubscription), errors.Is(err, broker.ErrInvalidTopic), errors.Is(err, urlpolicy.ErrForbidden):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, broker.ErrConsumerAttached), errors.Is(err, broker.ErrSubscriptionExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	default:
+		return status.Error(codes.Internal, err.Error())
+	}
+}
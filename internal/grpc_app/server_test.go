@@ -0,0 +1,147 @@
+package grpc_app
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ivanbulyk/vortexq/broker"
+	vortexqv1 "github.com/ivanbulyk/vortexq/proto/vortexq/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// startApp serves the gRPC app over an in-memory listener and swirls the broker
+func startApp(t *testing.T) (*App, vortexqv1.VortexQServiceClient) {
+	t.Helper()
+	vq := broker.NewVortexQ[any]()
+	app := New(slog.Default(), vq, "bufconn")
+
+	lis := bufconn.Listen(1 << 20)
+	go func() { _ = app.serve(lis) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for ctx.Err() == nil {
+			_ = vq.Swirl()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+		cancel()
+		_ = app.Stop(context.Background())
+	})
+	return app, vortexqv1.NewVortexQServiceClient(conn)
+}
+
+// Test messages published over gRPC are consumed and acked over a stream
+func TestPublishAndConsume(t *testing.T) {
+	_, client := startApp(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	stream, err := client.Consume(ctx, &vortexqv1.ConsumeRequest{SubscriptionId: "c1", Topic: "orders", MaxInFlight: 1})
+	if err != nil {
+		t.Fatalf("Consume error: %v", err)
+	}
+	// the stream creates the subscription once the call reached the server
+	for {
+		if resp, err := client.GetSubscription(ctx, &vortexqv1.GetSubscriptionRequest{Id: "c1"}); err == nil {
+			if resp.Subscription.Protocol != Protocol {
+				t.Errorf("subscription protocol = %q; want %q", resp.Subscription.Protocol, Protocol)
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	resp, err := client.Publish(ctx, &vortexqv1.PublishRequest{Message: &vortexqv1.Message{
+		Id: "m1", Topic: "orders", Data: []byte(`{"n":1}`), ContentType: "application/json",
+	}})
+	if err != nil || resp.Offset != 0 {
+		t.Fatalf("Publish = %v, %v; want offset 0", resp, err)
+	}
+	batch, err := client.PublishBatch(ctx)
+	if err != nil {
+		t.Fatalf("PublishBatch error: %v", err)
+	}
+	for _, id := range []string{"m2", "m3"} {
+		if err := batch.Send(&vortexqv1.PublishBatchRequest{Message: &vortexqv1.Message{Id: id, Topic: "orders", Data: []byte("text"), ContentType: "text/plain"}}); err != nil {
+			t.Fatalf("batch send error: %v", err)
+		}
+	}
+	results, err := batch.CloseAndRecv()
+	if err != nil || len(results.Results) != 2 || results.Results[1].Offset != 2 {
+		t.Fatalf("PublishBatch = %v, %v", results, err)
+	}
+
+	// with one message in flight, each ack lets the next one through
+	for _, want := range []string{"m1", "m2", "m3"} {
+		got, err := stream.Recv()
+		if err != nil {
+			t.Fatalf("Recv error: %v", err)
+		}
+		d := got.Delivery
+		if d.Message.Id != want || d.AckToken == "" || d.Attempt != 1 {
+			t.Fatalf("delivery = %v; want %s", d, want)
+		}
+		if want == "m1" && string(d.Message.Data) != `{"n":1}` {
+			t.Errorf("data = %s; want {\"n\":1}", d.Message.Data)
+		}
+		if want == "m2" && string(d.Message.Data) != "text" {
+			t.Errorf("data = %s; want text", d.Message.Data)
+		}
+		if _, err := client.Ack(ctx, &vortexqv1.AckRequest{AckToken: d.AckToken}); err != nil {
+			t.Fatalf("Ack error: %v", err)
+		}
+	}
+
+	_, err = client.Ack(ctx, &vortexqv1.AckRequest{AckToken: "unknown"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Ack of unknown token code = %v; want NotFound", status.Code(err))
+	}
+	second, err := client.Consume(ctx, &vortexqv1.ConsumeRequest{SubscriptionId: "c1", Topic: "orders"})
+	if err != nil {
+		t.Fatalf("Consume error: %v", err)
+	}
+	if _, err := second.Recv(); status.Code(err) != codes.AlreadyExists {
+		t.Errorf("second consumer code = %v; want AlreadyExists", status.Code(err))
+	}
+}
+
+// Test Stop ends running Consume streams
+func TestStopEndsConsume(t *testing.T) {
+	app, client := startApp(t)
+	stream, err := client.Consume(context.Background(), &vortexqv1.ConsumeRequest{Topic: "t", AutoAck: true})
+	if err != nil {
+		t.Fatalf("Consume error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := client.Subscribe(ctx, &vortexqv1.SubscribeRequest{Subscription: &vortexqv1.Subscription{
+		Id: "s1", Topic: "t", SubscriberAddress: "http://localhost", Format: "xml",
+	}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Subscribe with unknown format code = %v; want InvalidArgument", status.Code(err))
+	}
+
+	if err := app.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.Unavailable {
+		t.Errorf("Recv after Stop code = %v; want Unavailable", status.Code(err))
+	}
+}
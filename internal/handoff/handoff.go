@@ -0,0 +1,110 @@
+// Package handoff passes the listening sockets of the process to a newly
+// started copy of its executable, so a binary upgrade never refuses a
+// connection: both processes accept on the same sockets until the old one stops.
+package handoff
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+)
+
+const (
+	// envListeners names the inherited listeners in the order of their descriptors
+	envListeners = "VORTEXQ_HANDOFF_LISTENERS"
+	// envParent is the PID of the process that handed its listeners over
+	envParent = "VORTEXQ_HANDOFF_PARENT"
+
+	// readyFD is the pipe the child reports readiness on, the listeners follow it
+	readyFD     = 3
+	_readyToken = "ready\n"
+)
+
+var (
+	// ErrInProgress is returned by Upgrade while another upgrade runs.
+	ErrInProgress = errors.New("upgrade already in progress")
+	// ErrUnsupported is returned by Upgrade where listeners can't be passed on.
+	ErrUnsupported = errors.New("upgrade not supported on this platform")
+)
+
+var (
+	mu sync.Mutex
+	// listeners are handed to the next process by name
+	listeners = make(map[string]net.Listener)
+	names     []string
+	upgrading bool
+
+	inheritOnce sync.Once
+	inherited   map[string]*os.File
+	ready       *os.File
+)
+
+// Listen returns the listener inherited for the address, or listens on it,
+// and hands it over on the next upgrade.
+func Listen(network, addr string) (net.Listener, error) {
+	name := network + "://" + addr
+	lis, ok, err := Take(name)
+	if err != nil || ok {
+		return lis, err
+	}
+	lis, err = net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	Add(name, lis)
+	return lis, nil
+}
+
+// Take returns the listener inherited under the name, if any, and hands it
+// over on the next upgrade.
+func Take(name string) (net.Listener, bool, error) {
+	const op = "handoff.Take"
+	inherit()
+	mu.Lock()
+	f, ok := inherited[name]
+	delete(inherited, name)
+	mu.Unlock()
+	if !ok {
+		return nil, false, nil
+	}
+	lis, err := net.FileListener(f)
+	_ = f.Close()
+	if err != nil {
+		return nil, false, fmt.Errorf("%s: %s: %w", op, name, err)
+	}
+	Add(name, lis)
+	return lis, true, nil
+}
+
+// Add hands the listener over under the name on the next upgrade.
+func Add(name string, lis net.Listener) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := listeners[name]; !ok {
+		names = append(names, name)
+	}
+	listeners[name] = lis
+}
+
+// Ready tells the parent process the listeners are served, it does nothing
+// when the process wasn't started by an upgrade. Listeners not taken yet keep
+// queueing connections until they are.
+func Ready() error {
+	const op = "handoff.Ready"
+	inherit()
+	mu.Lock()
+	defer mu.Unlock()
+	if ready == nil {
+		return nil
+	}
+	_, err := io.WriteString(ready, _readyToken)
+	_ = ready.Close()
+	ready = nil
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
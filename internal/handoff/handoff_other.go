@@ -0,0 +1,21 @@
+//go:build !unix
+
+package handoff
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// NotifyUpgrade does nothing, there is no upgrade signal here.
+func NotifyUpgrade(c chan<- os.Signal) {}
+
+// inherit does nothing, listeners are never inherited here.
+func inherit() {}
+
+// Upgrade fails, descriptors can't be passed to a new process here.
+func Upgrade(ctx context.Context) (int, error) {
+	const op = "handoff.Upgrade"
+	return 0, fmt.Errorf("%s: %w", op, ErrUnsupported)
+}
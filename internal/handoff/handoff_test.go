@@ -0,0 +1,85 @@
+//go:build unix
+
+package handoff
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+const _testAddr = "127.0.0.1:0"
+
+// TestMain runs the test binary as the new process of an upgrade when it is
+// started with inherited listeners.
+func TestMain(m *testing.M) {
+	if os.Getenv(envListeners) != "" {
+		os.Exit(runChild())
+	}
+	os.Exit(m.Run())
+}
+
+// runChild answers one connection on the inherited listener with "child"
+func runChild() int {
+	lis, ok, err := Take("tcp://" + _testAddr)
+	if err != nil || !ok {
+		return 1
+	}
+	if err := Ready(); err != nil {
+		return 1
+	}
+	conn, err := lis.Accept()
+	if err != nil {
+		return 1
+	}
+	_, _ = io.WriteString(conn, "child")
+	_ = conn.Close()
+	return 0
+}
+
+// Test the new process serves on the listener once the old one closed it
+func TestUpgrade(t *testing.T) {
+	lis, err := Listen("tcp", _testAddr)
+	if err != nil {
+		t.Fatalf("Listen error: %v", err)
+	}
+	addr := lis.Addr().String()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	pid, err := Upgrade(ctx)
+	if err != nil || pid == 0 {
+		t.Fatalf("Upgrade = %d, %v; want the new process", pid, err)
+	}
+	_ = lis.Close()
+
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, _ := io.ReadAll(conn)
+	if string(got) != "child" {
+		t.Errorf("answer = %q; want the new process", got)
+	}
+}
+
+// Test listeners that can't be passed on fail the upgrade before anything starts
+func TestUpgradeUnsupportedListener(t *testing.T) {
+	Add("pipe", &pipeListener{})
+	defer func() {
+		mu.Lock()
+		delete(listeners, "pipe")
+		names = names[:len(names)-1]
+		mu.Unlock()
+	}()
+	if _, err := Upgrade(context.Background()); err == nil {
+		t.Error("Upgrade with a pipe listener succeeded; want an error")
+	}
+}
+
+type pipeListener struct{ net.Listener }
@@ -0,0 +1,148 @@
+//go:build unix
+
+package handoff
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+)
+
+// filer is implemented by the TCP and Unix listeners.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// NotifyUpgrade relays SIGUSR2, the upgrade signal, to c.
+func NotifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// inherit picks up the descriptors passed by the parent process once.
+func inherit() {
+	inheritOnce.Do(func() {
+		raw, parent := os.Getenv(envListeners), os.Getenv(envParent)
+		_ = os.Unsetenv(envListeners)
+		_ = os.Unsetenv(envParent)
+		if raw == "" || parent != strconv.Itoa(os.Getppid()) {
+			return
+		}
+		var inheritedNames []string
+		if err := json.Unmarshal([]byte(raw), &inheritedNames); err != nil {
+			return
+		}
+		ready = os.NewFile(readyFD, "handoff-ready")
+		inherited = make(map[string]*os.File, len(inheritedNames))
+		for i, name := range inheritedNames {
+			inherited[name] = os.NewFile(uintptr(readyFD+1+i), name)
+		}
+	})
+}
+
+// Upgrade starts the executable again with the same arguments and the
+// listeners, and waits until it reports ready. It returns the PID of the new
+// process, which serves next to this one until this one stops.
+func Upgrade(ctx context.Context) (int, error) {
+	const op = "handoff.Upgrade"
+
+	mu.Lock()
+	if upgrading {
+		mu.Unlock()
+		return 0, fmt.Errorf("%s: %w", op, ErrInProgress)
+	}
+	upgrading = true
+	files := make([]*os.File, 0, len(names))
+	handed := make([]string, 0, len(names))
+	var err error
+	for _, name := range names {
+		l, ok := listeners[name].(filer)
+		if !ok {
+			err = fmt.Errorf("%s: listener %s can't be handed over", op, name)
+			break
+		}
+		var f *os.File
+		if f, err = l.File(); err != nil {
+			err = fmt.Errorf("%s: %s: %w", op, name, err)
+			break
+		}
+		files = append(files, f)
+		handed = append(handed, name)
+	}
+	mu.Unlock()
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+		mu.Lock()
+		upgrading = false
+		mu.Unlock()
+	}()
+	if err != nil {
+		return 0, err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() { _ = readyR.Close() }()
+	encoded, _ := json.Marshal(handed)
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.Env = append(os.Environ(), envListeners+"="+string(encoded), envParent+"="+strconv.Itoa(os.Getpid()))
+	cmd.ExtraFiles = append([]*os.File{readyW}, files...)
+	err = cmd.Start()
+	_ = readyW.Close()
+	if err != nil {
+		return 0, fmt.Errorf("%s: %w", op, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	readied := make(chan error, 1)
+	go func() {
+		buf := make([]byte, len(_readyToken))
+		_, err := io.ReadFull(readyR, buf)
+		readied <- err
+	}()
+
+	select {
+	case err := <-readied:
+		if err == nil {
+			keepUnixSockets()
+			return cmd.Process.Pid, nil
+		}
+		// the pipe closed without the token, the child went away
+		_ = cmd.Process.Kill()
+		return 0, fmt.Errorf("%s: new process failed before it was ready: %w", op, err)
+	case err := <-exited:
+		return 0, fmt.Errorf("%s: new process exited before it was ready: %v", op, err)
+	case <-ctx.Done():
+		_ = cmd.Process.Kill()
+		return 0, fmt.Errorf("%s: %w", op, ctx.Err())
+	}
+}
+
+// keepUnixSockets stops the listeners of this process from removing socket
+// files the new process serves on.
+func keepUnixSockets() {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, lis := range listeners {
+		if ul, ok := lis.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+}
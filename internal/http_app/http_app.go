@@ -4,14 +4,26 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/ivanbulyk/vortexq/internal/handoff"
 	"github.com/ivanbulyk/vortexq/internal/logging"
+	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"sync"
 )
 
 type App struct {
 	log        *slog.Logger
 	httpServer *http.Server
+
+	// Listeners are served instead of listening on the server address, such as
+	// a Unix socket or the sockets passed by systemd socket activation
+	Listeners []net.Listener
+
+	ready     chan struct{}
+	readyOnce sync.Once
 }
 
 // New creates new http server app.
@@ -20,6 +32,7 @@ func New(log *slog.Logger, httpServer *http.Server) *App {
 	return &App{
 		log:        log,
 		httpServer: httpServer,
+		ready:      make(chan struct{}),
 	}
 }
 
@@ -30,19 +43,73 @@ func (a *App) MustRun() {
 	}
 }
 
+// Ready is closed once the server accepts connections.
+func (a *App) Ready() <-chan struct{} {
+	return a.ready
+}
+
 // Run runs HTTP server.
 func (a *App) run() error {
 	const op = "http_app.App.run"
+	log := a.log.With(slog.String("op", op))
 
-	a.log.With(slog.String("op", op)).Info("server listening at ", slog.String("addr", a.httpServer.Addr))
-	if err := a.httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
-		a.log.With(slog.String("op", op)).Error("failed to run server: \n", logging.Err(err))
+	listeners := a.Listeners
+	if len(listeners) == 0 {
+		lis, err := handoff.Listen("tcp", a.httpServer.Addr)
+		if err != nil {
+			log.Error("failed to run server: \n", logging.Err(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		listeners = []net.Listener{lis}
+	}
+
+	errs := make(chan error, len(listeners))
+	for _, lis := range listeners {
+		log.Info("server listening at ", slog.String("addr", lis.Addr().String()), slog.String("network", lis.Addr().Network()))
+		go func() { errs <- a.httpServer.Serve(lis) }()
+	}
+	a.readyOnce.Do(func() { close(a.ready) })
+
+	var err error
+	for range listeners {
+		if errServe := <-errs; errServe != nil && !errors.Is(errServe, http.ErrServerClosed) && err == nil {
+			err = errServe
+			// one failing listener takes the others down
+			_ = a.httpServer.Close()
+		}
+	}
+	if err != nil {
+		log.Error("failed to run server: \n", logging.Err(err))
 		return fmt.Errorf("%s: %w", op, err)
 	}
 
 	return nil
 }
 
+// ListenUnix listens on a Unix socket at path with the file mode, replacing
+// the socket a previous process left behind.
+func ListenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	const op = "http_app.ListenUnix"
+
+	if info, err := os.Stat(path); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s: %s exists and is not a socket", op, path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("%s: %w", op, err)
+		}
+	}
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		_ = lis.Close()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return lis, nil
+}
+
 // Stop stops HTTP server.
 func (a *App) Stop(timeoutCtx context.Context) error {
 	const op = "http_app.App.Stop"
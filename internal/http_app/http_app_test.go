@@ -0,0 +1,75 @@
+package http_app
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Test the server answers on a Unix socket with the requested file mode
+func TestServeUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "http.sock")
+	// a socket left behind by a previous process is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	_ = stale.Close()
+
+	lis, err := ListenUnix(path, 0o600)
+	if err != nil {
+		t.Fatalf("ListenUnix error: %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode = %v, %v; want %v", info.Mode().Perm(), err, os.FileMode(0o600))
+	}
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	})}
+	app := New(slog.New(slog.NewTextHandler(io.Discard, nil)), server)
+	app.Listeners = []net.Listener{lis}
+	done := make(chan error, 1)
+	go func() { done <- app.run() }()
+	select {
+	case <-app.Ready():
+	case <-time.After(2 * time.Second):
+		t.Fatal("server not ready")
+	}
+
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://vortexq/")
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("body = %q; want ok", body)
+	}
+
+	if err := app.Stop(context.Background()); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("run error = %v; want nil after Stop", err)
+	}
+
+	// other files are never removed
+	file := filepath.Join(t.TempDir(), "file")
+	_ = os.WriteFile(file, nil, 0o600)
+	if _, err := ListenUnix(file, 0o600); err == nil {
+		t.Error("ListenUnix over a regular file succeeded; want an error")
+	}
+}
@@ -0,0 +1,32 @@
+package routes
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/ivanbulyk/vortexq/broker"
+	"net/http"
+)
+
+// AckHandler confirms an async delivery through the URL given in X-VortexQ-Ack-URL.
+func (vh VortexQHandler) AckHandler(ctx *gin.Context) {
+	vh.settleDelivery(ctx, vh.funcs.Ack, "delivery acknowledged")
+}
+
+// NackHandler rejects an async delivery through the URL given in X-VortexQ-Nack-URL,
+// the message is retried like a failed delivery.
+func (vh VortexQHandler) NackHandler(ctx *gin.Context) {
+	vh.settleDelivery(ctx, vh.funcs.Nack, "delivery rejected")
+}
+
+func (vh VortexQHandler) settleDelivery(ctx *gin.Context, settle func(token string) error, message string) {
+	if err := settle(ctx.Param("token")); err != nil {
+		if errors.Is(err, broker.ErrNotFound) {
+			// unknown, already settled or past its ack deadline
+			ctx.JSON(http.StatusNotFound, gin.H{"message": "delivery not awaiting an ack", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": "failed to settle delivery", "error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": message})
+}
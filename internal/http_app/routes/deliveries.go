@@ -0,0 +1,18 @@
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+)
+
+// SubscriptionDeliveriesHandler lists the recorded delivery attempts of a subscription.
+func (vh VortexQHandler) SubscriptionDeliveriesHandler(ctx *gin.Context) {
+	id := ctx.Param("id")
+	ctx.JSON(http.StatusOK, gin.H{"subscription_id": id, "deliveries": vh.funcs.SubscriptionDeliveries(id)})
+}
+
+// MessageDeliveriesHandler lists the recorded delivery attempts of a message.
+func (vh VortexQHandler) MessageDeliveriesHandler(ctx *gin.Context) {
+	id := ctx.Param("id")
+	ctx.JSON(http.StatusOK, gin.H{"message_id": id, "deliveries": vh.funcs.MessageDeliveries(id)})
+}
@@ -0,0 +1,513 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+	"github.com/ivanbulyk/vortexq/broker"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// GraphQLProtocol marks the subscriptions consumed by GraphQL subscriptions
+	GraphQLProtocol = "graphql"
+
+	_graphQLDefaultLimit = 100
+	_graphQLMaxLimit     = 1000
+)
+
+// graphQLRequest is a GraphQL operation posted over HTTP or started over a WebSocket.
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+// GraphQLHandler runs the queries and mutations posted as JSON or given in the
+// URL, subscriptions run over a WebSocket with the graphql-transport-ws or the
+// legacy graphql-ws protocol.
+func (vh VortexQHandler) GraphQLHandler(ctx *gin.Context) {
+	if websocket.IsWebSocketUpgrade(ctx.Request) {
+		vh.graphQLWebSocket(ctx)
+		return
+	}
+
+	var req graphQLRequest
+	if ctx.Request.Method == http.MethodGet {
+		req.Query, req.OperationName = ctx.Query("query"), ctx.Query("operationName")
+		if vars := ctx.Query("variables"); vars != "" {
+			if err := json.Unmarshal([]byte(vars), &req.Variables); err != nil {
+				ctx.JSON(http.StatusBadRequest, graphQLError("invalid variables: "+err.Error()))
+				return
+			}
+		}
+	} else if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, graphQLError("invalid request body: "+err.Error()))
+		return
+	}
+	if req.Query == "" {
+		ctx.JSON(http.StatusBadRequest, graphQLError("query is required"))
+		return
+	}
+
+	switch operationType(req) {
+	case ast.OperationTypeSubscription:
+		ctx.JSON(http.StatusBadRequest, graphQLError("subscriptions need a WebSocket"))
+		return
+	case ast.OperationTypeMutation:
+		if ctx.Request.Method == http.MethodGet {
+			ctx.JSON(http.StatusMethodNotAllowed, graphQLError("mutations need a POST request"))
+			return
+		}
+	}
+	ctx.JSON(http.StatusOK, vh.runGraphQL(ctx.Request.Context(), req))
+}
+
+func (vh VortexQHandler) runGraphQL(ctx context.Context, req graphQLRequest) *graphql.Result {
+	return graphql.Do(graphql.Params{
+		Schema:         *vh.schema,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        ctx,
+	})
+}
+
+func graphQLError(message string) gin.H {
+	return gin.H{"errors": []gin.H{{"message": message}}}
+}
+
+// operationType returns the type of the operation a request runs, empty when
+// the query doesn't parse, its validation reports that.
+func operationType(req graphQLRequest) string {
+	doc, err := parser.Parse(parser.ParseParams{Source: req.Query})
+	if err != nil {
+		return ""
+	}
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if ok && (req.OperationName == "" || (op.Name != nil && op.Name.Value == req.OperationName)) {
+			return op.Operation
+		}
+	}
+	return ""
+}
+
+// jsonScalar carries message data and headers as they are.
+var jsonScalar = graphql.NewScalar(graphql.ScalarConfig{
+	Name:         "JSON",
+	Description:  "Any JSON value",
+	Serialize:    func(v any) any { return v },
+	ParseValue:   func(v any) any { return v },
+	ParseLiteral: parseJSONLiteral,
+})
+
+func parseJSONLiteral(v ast.Value) any {
+	switch v := v.(type) {
+	case *ast.StringValue:
+		return v.Value
+	case *ast.BooleanValue:
+		return v.Value
+	case *ast.EnumValue:
+		return v.Value
+	case *ast.IntValue, *ast.FloatValue:
+		f, _ := strconv.ParseFloat(v.GetValue().(string), 64)
+		return f
+	case *ast.ListValue:
+		values := make([]any, 0, len(v.Values))
+		for _, item := range v.Values {
+			values = append(values, parseJSONLiteral(item))
+		}
+		return values
+	case *ast.ObjectValue:
+		fields := make(map[string]any, len(v.Fields))
+		for _, f := range v.Fields {
+			fields[f.Name.Value] = parseJSONLiteral(f.Value)
+		}
+		return fields
+	}
+	return nil
+}
+
+// field resolves a field of a T source with get.
+func field[T any](typ graphql.Output, get func(T) any) *graphql.Field {
+	return &graphql.Field{Type: typ, Resolve: func(p graphql.ResolveParams) (any, error) {
+		return get(p.Source.(T)), nil
+	}}
+}
+
+// optionalTime leaves zero times out.
+func optionalTime(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
+
+// messagePage is a page of topic messages with the offset the next page starts at.
+type messagePage struct {
+	messages []broker.Message[any]
+	next     int64
+}
+
+// newSchema builds the GraphQL schema on top of funcs, it panics on a broken
+// schema definition.
+func newSchema(funcs broker.VortexQFuncs) *graphql.Schema {
+	nonNull := graphql.NewNonNull
+	type message = broker.Message[any]
+
+	messageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Message",
+		Fields: graphql.Fields{
+			"id":    field(nonNull(graphql.ID), func(m message) any { return m.ID }),
+			"topic": field(nonNull(graphql.String), func(m message) any { return m.Pattern }),
+			"data": field(jsonScalar, func(m message) any {
+				// raw payloads of binary protocols read as text
+				if b, ok := m.Data.([]byte); ok {
+					return string(b)
+				}
+				return m.Data
+			}),
+			"source":        field(graphql.String, func(m message) any { return m.Source }),
+			"type":          field(graphql.String, func(m message) any { return m.Type }),
+			"time":          field(graphql.DateTime, func(m message) any { return optionalTime(m.Time) }),
+			"contentType":   field(graphql.String, func(m message) any { return m.ContentType }),
+			"headers":       field(jsonScalar, func(m message) any { return m.Headers }),
+			"offset":        field(nonNull(graphql.Int), func(m message) any { return m.Offset }),
+			"correlationId": field(graphql.String, func(m message) any { return m.CorrelationID }),
+			"replyTo":       field(graphql.String, func(m message) any { return m.ReplyTo }),
+		},
+	})
+	pageType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "MessagePage",
+		Fields: graphql.Fields{
+			"messages":   field(nonNull(graphql.NewList(nonNull(messageType))), func(p messagePage) any { return p.messages }),
+			"nextOffset": field(nonNull(graphql.Int), func(p messagePage) any { return p.next }),
+		},
+	})
+	pageArgs := graphql.FieldConfigArgument{
+		"offset": {Type: graphql.Int, Description: "offset of the first message, the oldest retained by default"},
+		"limit":  {Type: graphql.Int, DefaultValue: _graphQLDefaultLimit, Description: "at most 1000 messages, 100 by default"},
+	}
+	readPage := func(topic string, args map[string]any) (any, error) {
+		offset, _ := args["offset"].(int)
+		limit, _ := args["limit"].(int)
+		if limit <= 0 {
+			limit = _graphQLDefaultLimit
+		}
+		msgs, next, err := funcs.ReadTopic(topic, int64(offset), min(limit, _graphQLMaxLimit))
+		if err != nil {
+			return nil, err
+		}
+		return messagePage{messages: msgs, next: next}, nil
+	}
+
+	topicType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Topic",
+		Fields: graphql.Fields{
+			"name":        field(nonNull(graphql.String), func(t broker.TopicInfo) any { return t.Name }),
+			"firstOffset": field(nonNull(graphql.Int), func(t broker.TopicInfo) any { return t.FirstOffset }),
+			"nextOffset":  field(nonNull(graphql.Int), func(t broker.TopicInfo) any { return t.NextOffset }),
+			"messages": &graphql.Field{
+				Type: nonNull(pageType),
+				Args: pageArgs,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return readPage(p.Source.(broker.TopicInfo).Name, p.Args)
+				},
+			},
+		},
+	})
+
+	deliveryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Delivery",
+		Fields: graphql.Fields{
+			"messageId":         field(nonNull(graphql.ID), func(d broker.DeliveryRecord) any { return d.MessageID }),
+			"subscriptionId":    field(nonNull(graphql.ID), func(d broker.DeliveryRecord) any { return d.SubscriptionID }),
+			"topicName":         field(nonNull(graphql.String), func(d broker.DeliveryRecord) any { return d.TopicName }),
+			"subscriberAddress": field(graphql.String, func(d broker.DeliveryRecord) any { return d.SubscriberAddress }),
+			"attempt":           field(nonNull(graphql.Int), func(d broker.DeliveryRecord) any { return d.Attempt }),
+			"statusCode":        field(graphql.Int, func(d broker.DeliveryRecord) any { return d.StatusCode }),
+			"latencyMs":         field(nonNull(graphql.Int), func(d broker.DeliveryRecord) any { return d.LatencyMs }),
+			"error":             field(graphql.String, func(d broker.DeliveryRecord) any { return d.Error }),
+			"timestamp":         field(nonNull(graphql.DateTime), func(d broker.DeliveryRecord) any { return d.Timestamp }),
+		},
+	})
+
+	subscriptionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "TopicSubscription",
+		Fields: graphql.Fields{
+			"id":                 field(nonNull(graphql.ID), func(s broker.Subscription) any { return s.ID }),
+			"topicName":          field(nonNull(graphql.String), func(s broker.Subscription) any { return s.TopicName }),
+			"subscriberAddress":  field(graphql.String, func(s broker.Subscription) any { return s.SubscriberAddress }),
+			"format":             field(graphql.String, func(s broker.Subscription) any { return s.Format }),
+			"protocol":           field(graphql.String, func(s broker.Subscription) any { return s.Protocol }),
+			"ackMode":            field(graphql.String, func(s broker.Subscription) any { return s.AckMode }),
+			"ackDeadlineSeconds": field(graphql.Int, func(s broker.Subscription) any { return s.AckDeadlineSeconds }),
+			"replyTopic":         field(graphql.String, func(s broker.Subscription) any { return s.ReplyTopic }),
+			"state":              field(graphql.String, func(s broker.Subscription) any { return s.State }),
+			"stateReason":        field(graphql.String, func(s broker.Subscription) any { return s.StateReason }),
+			"deliveries": field(nonNull(graphql.NewList(nonNull(deliveryType))), func(s broker.Subscription) any {
+				return funcs.SubscriptionDeliveries(s.ID)
+			}),
+		},
+	})
+
+	startInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "StartInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"from":   {Type: nonNull(graphql.String), Description: "earliest, latest, offset or timestamp"},
+			"offset": {Type: graphql.Int},
+			"time":   {Type: graphql.DateTime},
+		},
+	})
+	messageInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "MessageInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"id":            {Type: graphql.ID, Description: "generated when left out"},
+			"topic":         {Type: nonNull(graphql.String)},
+			"data":          {Type: jsonScalar},
+			"source":        {Type: graphql.String},
+			"type":          {Type: graphql.String},
+			"contentType":   {Type: graphql.String},
+			"headers":       {Type: jsonScalar, Description: "an object of string values"},
+			"correlationId": {Type: graphql.String},
+			"replyTo":       {Type: graphql.String},
+		},
+	})
+	subscriptionInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "SubscriptionInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"id":                 {Type: graphql.ID, Description: "generated when missing"},
+			"topicName":          {Type: nonNull(graphql.String)},
+			"subscriberAddress":  {Type: nonNull(graphql.String)},
+			"format":             {Type: graphql.String},
+			"ackMode":            {Type: graphql.String},
+			"ackDeadlineSeconds": {Type: graphql.Int},
+			"replyTopic":         {Type: graphql.String},
+			"start":              {Type: startInput},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"topics": &graphql.Field{
+				Type:    nonNull(graphql.NewList(nonNull(topicType))),
+				Resolve: func(graphql.ResolveParams) (any, error) { return funcs.ListTopics(), nil },
+			},
+			"topic": &graphql.Field{
+				Type: topicType,
+				Args: graphql.FieldConfigArgument{"name": {Type: nonNull(graphql.String)}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					for _, t := range funcs.ListTopics() {
+						if t.Name == p.Args["name"] {
+							return t, nil
+						}
+					}
+					return nil, nil
+				},
+			},
+			"messages": &graphql.Field{
+				Type: nonNull(pageType),
+				Args: graphql.FieldConfigArgument{
+					"topic":  {Type: nonNull(graphql.String)},
+					"offset": pageArgs["offset"],
+					"limit":  pageArgs["limit"],
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return readPage(p.Args["topic"].(string), p.Args)
+				},
+			},
+			"messageDeliveries": &graphql.Field{
+				Type: nonNull(graphql.NewList(nonNull(deliveryType))),
+				Args: graphql.FieldConfigArgument{"id": {Type: nonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return funcs.MessageDeliveries(p.Args["id"].(string)), nil
+				},
+			},
+			"subscriptions": &graphql.Field{
+				Type:    nonNull(graphql.NewList(nonNull(subscriptionType))),
+				Resolve: func(graphql.ResolveParams) (any, error) { return funcs.ListSubscriptions(), nil },
+			},
+			"subscription": &graphql.Field{
+				Type: subscriptionType,
+				Args: graphql.FieldConfigArgument{"id": {Type: nonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					if sub, ok := funcs.FindSubscription(p.Args["id"].(string)); ok {
+						return sub, nil
+					}
+					return nil, nil
+				},
+			},
+		},
+	})
+
+	settle := func(nack bool) *graphql.Field {
+		return &graphql.Field{
+			Type: nonNull(graphql.Boolean),
+			Args: graphql.FieldConfigArgument{"token": {Type: nonNull(graphql.String)}},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				if nack {
+					return true, funcs.Nack(p.Args["token"].(string))
+				}
+				return true, funcs.Ack(p.Args["token"].(string))
+			},
+		}
+	}
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"publish": &graphql.Field{
+				Type: nonNull(messageType),
+				Args: graphql.FieldConfigArgument{"input": {Type: nonNull(messageInput)}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					msg, err := messageFromInput(p.Args["input"].(map[string]any))
+					if err != nil {
+						return nil, err
+					}
+					if msg.Offset, err = funcs.Publish(msg); err != nil {
+						return nil, err
+					}
+					return msg, nil
+				},
+			},
+			"subscribe": &graphql.Field{
+				Type: nonNull(subscriptionType),
+				Args: graphql.FieldConfigArgument{"input": {Type: nonNull(subscriptionInput)}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					in := p.Args["input"].(map[string]any)
+					sub := broker.Subscription{
+						TopicName:         in["topicName"].(string),
+						SubscriberAddress: in["subscriberAddress"].(string),
+					}
+					if sub.ID, _ = in["id"].(string); sub.ID == "" {
+						sub.ID = broker.NewID()
+					}
+					sub.Format, _ = in["format"].(string)
+					sub.AckMode, _ = in["ackMode"].(string)
+					sub.AckDeadlineSeconds, _ = in["ackDeadlineSeconds"].(int)
+					sub.ReplyTopic, _ = in["replyTopic"].(string)
+					if start, ok := in["start"].(map[string]any); ok {
+						position := startFromInput(start)
+						sub.Start = &position
+					}
+					if err := funcs.Subscribe(sub); err != nil {
+						return nil, err
+					}
+					sub, _ = funcs.FindSubscription(sub.ID)
+					return sub, nil
+				},
+			},
+			"unsubscribe": &graphql.Field{
+				Type: nonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{"id": {Type: nonNull(graphql.ID)}},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return true, funcs.Unsubscribe(p.Args["id"].(string))
+				},
+			},
+			"seek": &graphql.Field{
+				Type: nonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"id":       {Type: nonNull(graphql.ID)},
+					"position": {Type: nonNull(startInput)},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return true, funcs.Seek(p.Args["id"].(string), startFromInput(p.Args["position"].(map[string]any)))
+				},
+			},
+			"ack":  settle(false),
+			"nack": settle(true),
+		},
+	})
+
+	subscription := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Subscription",
+		Fields: graphql.Fields{
+			"messages": &graphql.Field{
+				Type:        nonNull(messageType),
+				Description: "streams the messages of a topic or pattern",
+				Args: graphql.FieldConfigArgument{
+					"topic": {Type: nonNull(graphql.String)},
+					"start": {Type: startInput},
+				},
+				// every message published on the stream is the source of an execution
+				Resolve: func(p graphql.ResolveParams) (any, error) { return p.Source, nil },
+				Subscribe: func(p graphql.ResolveParams) (any, error) {
+					sub := broker.Subscription{ID: broker.NewID(), TopicName: p.Args["topic"].(string), Protocol: GraphQLProtocol}
+					if start, ok := p.Args["start"].(map[string]any); ok {
+						position := startFromInput(start)
+						sub.Start = &position
+					}
+					deliveries, err := funcs.Consume(p.Context, sub, broker.ConsumeOptions{AutoAck: true, Ephemeral: true})
+					if err != nil {
+						return nil, err
+					}
+					out := make(chan any)
+					go func() {
+						defer close(out)
+						for d := range deliveries {
+							select {
+							case out <- d.Message:
+							case <-p.Context.Done():
+								return
+							}
+						}
+					}()
+					return out, nil
+				},
+			},
+		},
+	})
+
+	schema, err := graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation, Subscription: subscription})
+	if err != nil {
+		panic(err)
+	}
+	return &schema
+}
+
+func messageFromInput(in map[string]any) (broker.Message[any], error) {
+	msg := broker.Message[any]{Pattern: in["topic"].(string), Data: in["data"]}
+	msg.ID, _ = in["id"].(string)
+	if msg.ID == "" {
+		msg.ID = broker.NewID()
+	}
+	msg.Source, _ = in["source"].(string)
+	msg.Type, _ = in["type"].(string)
+	msg.ContentType, _ = in["contentType"].(string)
+	msg.CorrelationID, _ = in["correlationId"].(string)
+	msg.ReplyTo, _ = in["replyTo"].(string)
+	if headers, ok := in["headers"]; ok && headers != nil {
+		fields, ok := headers.(map[string]any)
+		if !ok {
+			return msg, errors.New("headers must be an object")
+		}
+		msg.Headers = make(map[string]string, len(fields))
+		for k, v := range fields {
+			s, ok := v.(string)
+			if !ok {
+				return msg, errors.New("header " + k + " must be a string")
+			}
+			msg.Headers[k] = s
+		}
+	}
+	return msg, nil
+}
+
+func startFromInput(in map[string]any) broker.StartPosition {
+	position := broker.StartPosition{From: in["from"].(string)}
+	if offset, ok := in["offset"].(int); ok {
+		position.Offset = int64(offset)
+	}
+	if t, ok := in["time"].(time.Time); ok {
+		position.Time = t
+	}
+	return position
+}
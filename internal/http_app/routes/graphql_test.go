@@ -0,0 +1,258 @@
+package routes
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/ivanbulyk/vortexq/broker"
+)
+
+type graphQLResponse struct {
+	Data   map[string]any   `json:"data"`
+	Errors []map[string]any `json:"errors"`
+}
+
+func postGraphQL(t *testing.T, r http.Handler, query string, variables map[string]any) graphQLResponse {
+	t.Helper()
+	body, _ := json.Marshal(graphQLRequest{Query: query, Variables: variables})
+	w := performRequest(r, http.MethodPost, "/graphql", strings.NewReader(string(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, body %s", w.Code, w.Body)
+	}
+	var resp graphQLResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	return resp
+}
+
+func TestGraphQLHandler(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.GET("/graphql", h.GraphQLHandler)
+	r.POST("/graphql", h.GraphQLHandler)
+
+	resp := postGraphQL(t, r, `mutation($in: MessageInput!) { publish(input: $in) { id topic data offset headers } }`, map[string]any{
+		"in": map[string]any{"topic": "orders", "data": map[string]any{"n": 1}, "headers": map[string]any{"region": "eu"}},
+	})
+	published, _ := resp.Data["publish"].(map[string]any)
+	if len(resp.Errors) > 0 || published["id"] == "" || published["topic"] != "orders" || published["offset"] != float64(0) {
+		t.Fatalf("publish = %+v", resp)
+	}
+	resp = postGraphQL(t, r, `mutation { publish(input: {topic: "orders", data: {n: 2}}) { offset } }`, nil)
+	if len(resp.Errors) > 0 {
+		t.Fatalf("publish with literals = %+v", resp)
+	}
+	if resp = postGraphQL(t, r, `mutation { publish(input: {topic: "orders.*"}) { id } }`, nil); len(resp.Errors) == 0 {
+		t.Error("publish to a pattern succeeded; want an error")
+	}
+
+	resp = postGraphQL(t, r, `{ topics { name nextOffset messages(limit: 1) { messages { data headers } nextOffset } } }`, nil)
+	topics, _ := resp.Data["topics"].([]any)
+	if len(resp.Errors) > 0 || len(topics) != 1 {
+		t.Fatalf("topics = %+v", resp)
+	}
+	topic := topics[0].(map[string]any)
+	page := topic["messages"].(map[string]any)
+	msgs := page["messages"].([]any)
+	if topic["name"] != "orders" || topic["nextOffset"] != float64(2) || len(msgs) != 1 || page["nextOffset"] != float64(1) {
+		t.Fatalf("topic = %+v", topic)
+	}
+	if first := msgs[0].(map[string]any); first["data"].(map[string]any)["n"] != float64(1) || first["headers"].(map[string]any)["region"] != "eu" {
+		t.Errorf("first message = %+v", first)
+	}
+
+	resp = postGraphQL(t, r, `mutation { subscribe(input: {id: "s1", topicName: "orders", subscriberAddress: "http://localhost:9/hook"}) { id topicName state } }`, nil)
+	if sub, _ := resp.Data["subscribe"].(map[string]any); len(resp.Errors) > 0 || sub["id"] != "s1" || sub["topicName"] != "orders" {
+		t.Fatalf("subscribe = %+v", resp)
+	}
+	resp = postGraphQL(t, r, `{ subscriptions { id } subscription(id: "s1") { deliveries { attempt } } missing: subscription(id: "nope") { id } }`, nil)
+	if subs, _ := resp.Data["subscriptions"].([]any); len(resp.Errors) > 0 || len(subs) != 1 || resp.Data["missing"] != nil {
+		t.Fatalf("subscriptions = %+v", resp)
+	}
+	resp = postGraphQL(t, r, `mutation { seek(id: "s1", position: {from: "offset", offset: 1}) unsubscribe(id: "s1") }`, nil)
+	if len(resp.Errors) > 0 || resp.Data["seek"] != true || resp.Data["unsubscribe"] != true {
+		t.Fatalf("seek and unsubscribe = %+v", resp)
+	}
+	if resp = postGraphQL(t, r, `mutation { ack(token: "nope") }`, nil); len(resp.Errors) == 0 {
+		t.Error("ack of an unknown token succeeded; want an error")
+	}
+
+	query := url.Values{"query": {`query($t: String!) { messages(topic: $t, offset: 1) { messages { offset } } }`}, "variables": {`{"t":"orders"}`}}
+	w := performRequest(r, http.MethodGet, "/graphql?"+query.Encode(), nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"messages":[{"offset":1}]`) {
+		t.Errorf("GET query = %d %s", w.Code, w.Body)
+	}
+	query = url.Values{"query": {`mutation { unsubscribe(id: "x") }`}}
+	if w := performRequest(r, http.MethodGet, "/graphql?"+query.Encode(), nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET mutation status = %d; want 405", w.Code)
+	}
+	w = performRequest(r, http.MethodPost, "/graphql", strings.NewReader(`{"query":"subscription { messages(topic: \"orders\") { id } }"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("subscription over POST status = %d; want 400", w.Code)
+	}
+}
+
+// dialGraphQL serves /graphql for the broker and dials it with the subprotocol
+func dialGraphQL(t *testing.T, vq *broker.VortexQ[any], subprotocol string) *websocket.Conn {
+	t.Helper()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.GET("/graphql", h.GraphQLHandler)
+	server := httptest.NewServer(r)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				_ = vq.Swirl()
+			}
+		}
+	}()
+
+	dialer := websocket.Dialer{Subprotocols: []string{subprotocol}}
+	conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/graphql", nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+		h.Shutdown()
+		close(done)
+		server.Close()
+	})
+	return conn
+}
+
+func readGraphQLMessage(t *testing.T, conn *websocket.Conn) graphQLWSMessage {
+	t.Helper()
+	var msg graphQLWSMessage
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	return msg
+}
+
+func TestGraphQLMessagesLimit(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	for i := 0; i < _graphQLMaxLimit+1; i++ {
+		_, _ = vq.Publish(broker.Message[any]{ID: broker.NewID(), Pattern: "t", Data: i})
+	}
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.POST("/graphql", h.GraphQLHandler)
+
+	for _, tc := range []struct {
+		limit int
+		want  int
+	}{{0, _graphQLDefaultLimit}, {-1, _graphQLDefaultLimit}, {5, 5}, {_graphQLMaxLimit + 1, _graphQLMaxLimit}} {
+		resp := postGraphQL(t, r, `query($limit: Int) { messages(topic: "t", limit: $limit) { messages { offset } } }`, map[string]any{"limit": tc.limit})
+		page, _ := resp.Data["messages"].(map[string]any)
+		if msgs, _ := page["messages"].([]any); len(resp.Errors) > 0 || len(msgs) != tc.want {
+			t.Errorf("limit %d: got %d messages, errors %v; want %d", tc.limit, len(msgs), resp.Errors, tc.want)
+		}
+	}
+}
+
+func TestGraphQLSubscription(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	conn := dialGraphQL(t, vq, graphQLTransportWS)
+
+	_ = conn.WriteJSON(graphQLWSMessage{Type: gqlConnectionInit})
+	if ack := readGraphQLMessage(t, conn); ack.Type != gqlConnectionAck {
+		t.Fatalf("init reply = %+v", ack)
+	}
+	_ = conn.WriteJSON(graphQLWSMessage{Type: gqlPing})
+	if pong := readGraphQLMessage(t, conn); pong.Type != gqlPong {
+		t.Fatalf("ping reply = %+v", pong)
+	}
+
+	vq.Publish(broker.Message[any]{ID: "m1", Pattern: "orders.eu", Data: "hello"})
+	_ = conn.WriteJSON(graphQLWSMessage{ID: "1", Type: gqlSubscribe, Payload: marshalPayload(graphQLRequest{
+		Query: `subscription { messages(topic: "orders.*", start: {from: "earliest"}) { id topic data } }`,
+	})})
+	next := readGraphQLMessage(t, conn)
+	var result graphQLResponse
+	_ = json.Unmarshal(next.Payload, &result)
+	msg, _ := result.Data["messages"].(map[string]any)
+	if next.Type != gqlNext || next.ID != "1" || msg["topic"] != "orders.eu" || msg["data"] != "hello" {
+		t.Fatalf("next = %+v, %s", next, next.Payload)
+	}
+
+	_ = conn.WriteJSON(graphQLWSMessage{ID: "2", Type: gqlSubscribe, Payload: marshalPayload(graphQLRequest{Query: `{ topics { name } }`})})
+	for {
+		msg := readGraphQLMessage(t, conn)
+		if msg.ID == "1" {
+			continue
+		}
+		if msg.ID != "2" || msg.Type != gqlNext || !strings.Contains(string(msg.Payload), "orders.eu") {
+			t.Fatalf("query reply = %+v, %s", msg, msg.Payload)
+		}
+		break
+	}
+	for msg := readGraphQLMessage(t, conn); msg.ID != "2" || msg.Type != gqlComplete; msg = readGraphQLMessage(t, conn) {
+		if msg.ID != "1" {
+			t.Fatalf("message = %+v; want the query complete", msg)
+		}
+	}
+
+	_ = conn.WriteJSON(graphQLWSMessage{ID: "1", Type: gqlComplete})
+	_ = conn.WriteJSON(graphQLWSMessage{Type: gqlConnectionInit})
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, gqlCloseTooManyInitRequest) {
+				t.Errorf("read error = %v; want close %d", err, gqlCloseTooManyInitRequest)
+			}
+			break
+		}
+	}
+}
+
+func TestGraphQLLegacySubscription(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	conn := dialGraphQL(t, vq, graphQLWS)
+
+	_ = conn.WriteJSON(graphQLWSMessage{Type: gqlConnectionInit})
+	if ack := readGraphQLMessage(t, conn); ack.Type != gqlConnectionAck {
+		t.Fatalf("init reply = %+v", ack)
+	}
+	_ = conn.WriteJSON(graphQLWSMessage{ID: "a", Type: gqlStart, Payload: marshalPayload(graphQLRequest{
+		Query: `subscription { messages(topic: "jobs", start: {from: "earliest"}) { id } }`,
+	})})
+	vq.Publish(broker.Message[any]{ID: "j1", Pattern: "jobs", Data: 1})
+	for {
+		msg := readGraphQLMessage(t, conn)
+		if msg.Type == gqlKeepAlive {
+			continue
+		}
+		if msg.Type != gqlData || msg.ID != "a" || !strings.Contains(string(msg.Payload), `"id":"j1"`) {
+			t.Fatalf("data = %+v, %s", msg, msg.Payload)
+		}
+		break
+	}
+	_ = conn.WriteJSON(graphQLWSMessage{ID: "a", Type: gqlStop})
+	_ = conn.WriteJSON(graphQLWSMessage{Type: gqlConnectionTerminate})
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+				t.Errorf("read error = %v; want a normal close", err)
+			}
+			break
+		}
+	}
+}
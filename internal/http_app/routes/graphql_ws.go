@@ -0,0 +1,382 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// WebSocket subprotocols of GraphQL subscriptions, graphql-ws names the legacy
+// subscriptions-transport-ws protocol.
+const (
+	graphQLTransportWS = "graphql-transport-ws"
+	graphQLWS          = "graphql-ws"
+
+	_graphQLInitTimeout = 10 * time.Second
+)
+
+// Message types of both protocols, the legacy one starts operations with
+// start, stops them with stop and sends their results as data.
+const (
+	gqlConnectionInit      = "connection_init"
+	gqlConnectionAck       = "connection_ack"
+	gqlConnectionError     = "connection_error"
+	gqlConnectionTerminate = "connection_terminate"
+	gqlKeepAlive           = "ka"
+	gqlPing                = "ping"
+	gqlPong                = "pong"
+	gqlSubscribe           = "subscribe"
+	gqlStart               = "start"
+	gqlNext                = "next"
+	gqlData                = "data"
+	gqlError               = "error"
+	gqlComplete            = "complete"
+	gqlStop                = "stop"
+)
+
+// Close codes of graphql-transport-ws.
+const (
+	gqlCloseBadRequest         = 4400
+	gqlCloseUnauthorized       = 4401
+	gqlCloseInitTimeout        = 4408
+	gqlCloseSubscriberExists   = 4409
+	gqlCloseTooManyInitRequest = 4429
+)
+
+// graphQLWSMessage is a message of either protocol in either direction.
+type graphQLWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+var graphQLUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	Subprotocols:    []string{graphQLTransportWS, graphQLWS},
+	CheckOrigin:     wsUpgrader.CheckOrigin,
+}
+
+// gqlConn is a GraphQL WebSocket connection, its operations end with it.
+type gqlConn struct {
+	vh     VortexQHandler
+	conn   *websocket.Conn
+	log    *slog.Logger
+	legacy bool
+	send   chan graphQLWSMessage
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	init bool
+	ops  map[string]context.CancelFunc
+	// closeCode and closeReason are sent in the close frame
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+}
+
+func (vh VortexQHandler) graphQLWebSocket(ctx *gin.Context) {
+	const op = "http_app.App.GraphQLHandler"
+	log := vh.Logger.With(slog.String("op", op))
+
+	conn, err := graphQLUpgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// the upgrader already answered with an error status
+		log.Warn("graphql websocket upgrade failed", logging.Err(err))
+		return
+	}
+
+	c := &gqlConn{
+		vh:     vh,
+		conn:   conn,
+		log:    log,
+		legacy: conn.Subprotocol() == graphQLWS,
+		send:   make(chan graphQLWSMessage, _wsSendBufferSize),
+		ops:    make(map[string]context.CancelFunc),
+	}
+	if conn.Subprotocol() == "" {
+		msg := websocket.FormatCloseMessage(websocket.CloseProtocolError, "unsupported subprotocol")
+		_ = conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(_wsWriteWait))
+		_ = conn.Close()
+		return
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	defer c.cancel()
+
+	go c.writeLoop()
+	go func() {
+		timer := time.NewTimer(_graphQLInitTimeout)
+		defer timer.Stop()
+		select {
+		case <-vh.done:
+			c.close(websocket.CloseGoingAway, "server shutting down")
+		case <-timer.C:
+			c.mu.Lock()
+			init := c.init
+			c.mu.Unlock()
+			if !init {
+				c.close(gqlCloseInitTimeout, "connection initialisation timeout")
+			}
+			select {
+			case <-vh.done:
+				c.close(websocket.CloseGoingAway, "server shutting down")
+			case <-c.ctx.Done():
+			}
+		case <-c.ctx.Done():
+		}
+	}()
+	c.readLoop()
+}
+
+func (c *gqlConn) readLoop() {
+	defer c.close(websocket.CloseNormalClosure, "")
+
+	c.conn.SetReadLimit(_wsMaxFrameSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(_wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(_wsPongWait))
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) && c.ctx.Err() == nil {
+				c.log.Warn("graphql websocket read failed", logging.Err(err))
+			}
+			return
+		}
+		_ = c.conn.SetReadDeadline(time.Now().Add(_wsPongWait))
+		var msg graphQLWSMessage
+		if err := json.Unmarshal(data, &msg); err != nil || msg.Type == "" {
+			c.close(gqlCloseBadRequest, "invalid message")
+			return
+		}
+		if !c.handle(msg) {
+			return
+		}
+	}
+}
+
+// handle runs a client message, it returns false once the connection is closed.
+func (c *gqlConn) handle(msg graphQLWSMessage) bool {
+	c.mu.Lock()
+	init := c.init
+	c.mu.Unlock()
+
+	switch msg.Type {
+	case gqlConnectionInit:
+		if init {
+			c.close(gqlCloseTooManyInitRequest, "too many initialisation requests")
+			return false
+		}
+		c.mu.Lock()
+		c.init = true
+		c.mu.Unlock()
+		c.reply(graphQLWSMessage{Type: gqlConnectionAck})
+		if c.legacy {
+			c.reply(graphQLWSMessage{Type: gqlKeepAlive})
+		}
+	case gqlPing:
+		if !c.legacy {
+			c.reply(graphQLWSMessage{Type: gqlPong, Payload: msg.Payload})
+		}
+	case gqlPong:
+	case gqlSubscribe, gqlStart:
+		if (msg.Type == gqlStart) != c.legacy {
+			return c.badRequest("unknown message type " + msg.Type)
+		}
+		if !init {
+			if c.legacy {
+				c.reply(graphQLWSMessage{Type: gqlConnectionError, Payload: marshalPayload(gin.H{"message": "connection not initialised"})})
+				return true
+			}
+			c.close(gqlCloseUnauthorized, "unauthorized")
+			return false
+		}
+		var req graphQLRequest
+		if msg.ID == "" || json.Unmarshal(msg.Payload, &req) != nil || req.Query == "" {
+			return c.badRequest("invalid " + msg.Type + " message")
+		}
+		return c.start(msg.ID, req)
+	case gqlComplete, gqlStop:
+		if (msg.Type == gqlStop) != c.legacy {
+			return c.badRequest("unknown message type " + msg.Type)
+		}
+		c.mu.Lock()
+		cancel, ok := c.ops[msg.ID]
+		delete(c.ops, msg.ID)
+		c.mu.Unlock()
+		if ok {
+			cancel()
+		}
+	case gqlConnectionTerminate:
+		if c.legacy {
+			c.close(websocket.CloseNormalClosure, "")
+			return false
+		}
+		return c.badRequest("unknown message type " + msg.Type)
+	default:
+		return c.badRequest("unknown message type " + msg.Type)
+	}
+	return true
+}
+
+// badRequest closes graphql-transport-ws connections, the legacy protocol
+// answers with a connection error instead.
+func (c *gqlConn) badRequest(reason string) bool {
+	if c.legacy {
+		c.reply(graphQLWSMessage{Type: gqlConnectionError, Payload: marshalPayload(gin.H{"message": reason})})
+		return true
+	}
+	c.close(gqlCloseBadRequest, reason)
+	return false
+}
+
+// start runs an operation and streams its results until it completes or the
+// client stops it.
+func (c *gqlConn) start(id string, req graphQLRequest) bool {
+	c.mu.Lock()
+	if _, exists := c.ops[id]; exists {
+		c.mu.Unlock()
+		if c.legacy {
+			c.reply(graphQLWSMessage{ID: id, Type: gqlError, Payload: marshalPayload(gin.H{"message": "subscriber for " + id + " already exists"})})
+			return true
+		}
+		c.close(gqlCloseSubscriberExists, "subscriber for "+id+" already exists")
+		return false
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.ops[id] = cancel
+	c.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		var results <-chan *graphql.Result
+		if operationType(req) == ast.OperationTypeSubscription {
+			results = graphql.Subscribe(graphql.Params{
+				Schema:         *c.vh.schema,
+				RequestString:  req.Query,
+				VariableValues: req.Variables,
+				OperationName:  req.OperationName,
+				Context:        ctx,
+			})
+		} else {
+			result := make(chan *graphql.Result, 1)
+			result <- c.vh.runGraphQL(ctx, req)
+			close(result)
+			results = result
+		}
+
+		next := gqlNext
+		if c.legacy {
+			next = gqlData
+		}
+		first := true
+		for result := range results {
+			// the executor stops sending only after seeing ctx done, keep draining
+			if ctx.Err() != nil {
+				continue
+			}
+			if first && result.HasErrors() && result.Data == nil && !c.legacy {
+				c.reply(graphQLWSMessage{ID: id, Type: gqlError, Payload: marshalPayload(result.Errors)})
+				c.finish(ctx, id)
+				return
+			}
+			first = false
+			c.reply(graphQLWSMessage{ID: id, Type: next, Payload: marshalPayload(result)})
+		}
+		if ctx.Err() == nil {
+			c.reply(graphQLWSMessage{ID: id, Type: gqlComplete})
+		}
+		c.finish(ctx, id)
+	}()
+	return true
+}
+
+// finish forgets an operation that ended by itself, a stopped one is already
+// gone and its ID may run another operation.
+func (c *gqlConn) finish(ctx context.Context, id string) {
+	if ctx.Err() != nil {
+		return
+	}
+	c.mu.Lock()
+	delete(c.ops, id)
+	c.mu.Unlock()
+}
+
+func marshalPayload(v any) json.RawMessage {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		payload, _ = json.Marshal([]gin.H{{"message": err.Error()}})
+	}
+	return payload
+}
+
+// reply queues a message without blocking, a full queue means the client is
+// too slow and gets disconnected.
+func (c *gqlConn) reply(msg graphQLWSMessage) bool {
+	select {
+	case c.send <- msg:
+		return true
+	case <-c.ctx.Done():
+		return false
+	default:
+		c.log.Warn("disconnecting slow graphql websocket consumer", slog.String("remote", c.conn.RemoteAddr().String()))
+		c.close(websocket.ClosePolicyViolation, "slow consumer")
+		return false
+	}
+}
+
+// close ends the connection and its operations, the first caller picks the close code.
+func (c *gqlConn) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeReason = code, reason
+		c.cancel()
+	})
+}
+
+func (c *gqlConn) writeLoop() {
+	ticker := time.NewTicker(_wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = c.conn.Close()
+	}()
+
+	for {
+		select {
+		case msg := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(_wsWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(_wsWriteWait))
+			// legacy clients watch for keep alive messages instead of pings
+			if c.legacy && c.conn.WriteJSON(graphQLWSMessage{Type: gqlKeepAlive}) != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(_wsWriteWait)); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.ctx.Done():
+			if c.closeCode != websocket.CloseAbnormalClosure {
+				msg := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+				_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(_wsWriteWait))
+			}
+			return
+		}
+	}
+}
@@ -9,9 +9,11 @@ import (
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/urlpolicy"
 	"github.com/ivanbulyk/vortexq/internal/version"
 )
 
@@ -73,11 +75,7 @@ func TestPublishHandler(t *testing.T) {
 	}
 
 	// ensure broker recorded the message
-	val, ok := vq.Topics.Load("p")
-	if !ok {
-		t.Fatalf("expected topic %q", "p")
-	}
-	msgs := val.([]broker.Message[any])
+	msgs := vq.Messages("p")
 	if len(msgs) != 1 || !reflect.DeepEqual(msgs[0], msg) {
 		t.Errorf("got published messages %v, want [%v]", msgs, msg)
 	}
@@ -89,6 +87,264 @@ func TestPublishHandler(t *testing.T) {
 	}
 }
 
+// TestPublishHandlerCloudEvents verifies structured and binary CloudEvents are accepted
+func TestPublishHandlerCloudEvents(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.POST("/publish", h.PublishHandler)
+
+	// structured mode, topic taken from the event type
+	req := httptest.NewRequest(http.MethodPost, "/publish",
+		strings.NewReader(`{"specversion":"1.0","id":"e1","source":"/s","type":"orders","data":{"n":1}}`))
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("structured status = %d; want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	// binary mode, topic overridden by the query
+	req = httptest.NewRequest(http.MethodPost, "/publish?topic=audit", strings.NewReader(`"hello"`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("ce-specversion", "1.0")
+	req.Header.Set("ce-id", "e2")
+	req.Header.Set("ce-source", "/s")
+	req.Header.Set("ce-type", "orders")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("binary status = %d; want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	for topic, id := range map[string]string{"orders": "e1", "audit": "e2"} {
+		if msgs := vq.Messages(topic); len(msgs) != 1 || msgs[0].ID != id || msgs[0].Source != "/s" {
+			t.Errorf("topic %q messages = %+v", topic, msgs)
+		}
+	}
+
+	// missing required attributes
+	req = httptest.NewRequest(http.MethodPost, "/publish", strings.NewReader(`{"specversion":"1.0"}`))
+	req.Header.Set("Content-Type", "application/cloudevents+json")
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid cloudevent status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// TestPublishBatchHandler verifies JSON array and NDJSON batches in both modes
+func TestPublishBatchHandler(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.POST("/publish/batch", h.PublishBatchHandler)
+
+	type response struct {
+		Published int           `json:"published"`
+		Failed    int           `json:"failed"`
+		Results   []BatchResult `json:"results"`
+	}
+	batch := func(path, body string) (int, response) {
+		t.Helper()
+		w := performRequest(r, http.MethodPost, path, strings.NewReader(body))
+		var resp response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid JSON response: %v: %s", err, w.Body.String())
+		}
+		return w.Code, resp
+	}
+
+	// best effort array, the invalid messages fail on their own
+	code, resp := batch("/publish/batch", `[{"id":"a1","pattern":"orders","data":1}, {"pattern":"orders.*"}, {"pattern":7}, {"pattern":"orders","data":2}]`)
+	if code != http.StatusOK || resp.Published != 2 || resp.Failed != 2 || len(resp.Results) != 4 {
+		t.Fatalf("array batch = %d %+v", code, resp)
+	}
+	if res := resp.Results[0]; res.ID != "a1" || res.Offset == nil || *res.Offset != 0 || res.Error != "" {
+		t.Errorf("first result = %+v", res)
+	}
+	if resp.Results[1].Error == "" || resp.Results[2].Error == "" || resp.Results[3].ID == "" || *resp.Results[3].Offset != 1 {
+		t.Errorf("results = %+v", resp.Results)
+	}
+
+	// NDJSON stream
+	code, resp = batch("/publish/batch", "{\"pattern\":\"audit\",\"data\":\"x\"}\n{\"pattern\":\"audit\",\"data\":\"y\"}\n")
+	if code != http.StatusOK || resp.Published != 2 || len(vq.Messages("audit")) != 2 {
+		t.Fatalf("ndjson batch = %d %+v", code, resp)
+	}
+
+	// a malformed message ends the stream, the ones before it stay published
+	code, resp = batch("/publish/batch", "{\"pattern\":\"audit\"}\n{bad\n{\"pattern\":\"audit\"}\n")
+	if code != http.StatusBadRequest || resp.Published != 1 || len(vq.Messages("audit")) != 3 {
+		t.Errorf("malformed batch = %d %+v", code, resp)
+	}
+
+	// atomic batches publish nothing unless every message is valid
+	code, resp = batch("/publish/batch?mode=atomic", `[{"pattern":"jobs"}, {"pattern":""}]`)
+	if code != http.StatusBadRequest || resp.Published != 0 || len(vq.Messages("jobs")) != 0 || resp.Results[0].Error == "" {
+		t.Errorf("rejected atomic batch = %d %+v", code, resp)
+	}
+	code, resp = batch("/publish/batch?mode=atomic", `[{"pattern":"jobs"}, {"pattern":"jobs"}`)
+	if code != http.StatusBadRequest || len(vq.Messages("jobs")) != 0 {
+		t.Errorf("truncated atomic batch = %d %+v", code, resp)
+	}
+	code, resp = batch("/publish/batch?mode=atomic", `[{"pattern":"jobs"}, {"pattern":"jobs"}]`)
+	if code != http.StatusOK || resp.Published != 2 || len(vq.Messages("jobs")) != 2 || *resp.Results[1].Offset != 1 {
+		t.Errorf("atomic batch = %d %+v", code, resp)
+	}
+
+	if code, _ := batch("/publish/batch?mode=all", `[]`); code != http.StatusBadRequest {
+		t.Errorf("unknown mode status = %d; want %d", code, http.StatusBadRequest)
+	}
+	if code, _ := batch("/publish/batch", ``); code != http.StatusBadRequest {
+		t.Errorf("empty body status = %d; want %d", code, http.StatusBadRequest)
+	}
+}
+
+// TestPublishRawHandler verifies raw bodies are published with their content type and headers
+func TestPublishRawHandler(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.PUT("/topics/:name", h.PublishRawHandler)
+
+	put := func(path, contentType string, body []byte, header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, path, bytes.NewReader(body))
+		if contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		for name, value := range header {
+			req.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	png := []byte{0x89, 'P', 'N', 'G', 0, 0xff}
+	w := put("/topics/images", "image/png", png, map[string]string{
+		"X-VortexQ-Message-ID": "img1", "X-Meta-Title": "logo", "Content-Encoding": "identity", "X-Other": "dropped",
+	})
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d; want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	msgs := vq.Messages("images")
+	want := map[string]string{"title": "logo", "Content-Encoding": "identity"}
+	if len(msgs) != 1 || msgs[0].ID != "img1" || msgs[0].ContentType != "image/png" || !reflect.DeepEqual(msgs[0].Data, png) ||
+		!reflect.DeepEqual(msgs[0].Headers, want) {
+		t.Fatalf("published = %+v", msgs)
+	}
+
+	// text stays text, JSON is decoded
+	put("/topics/csv", "text/csv", []byte("a,b\n1,2\n"), nil)
+	put("/topics/json", "application/json", []byte(`{"n":1}`), nil)
+	if msgs := vq.Messages("csv"); len(msgs) != 1 || msgs[0].Data != "a,b\n1,2\n" || msgs[0].ID == "" {
+		t.Errorf("csv messages = %+v", msgs)
+	}
+	if msgs := vq.Messages("json"); len(msgs) != 1 || !reflect.DeepEqual(msgs[0].Data, map[string]any{"n": float64(1)}) {
+		t.Errorf("json messages = %+v", msgs)
+	}
+
+	if w := put("/topics/json", "application/json", []byte(`{bad`), nil); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid JSON status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := put("/topics/a.*", "text/plain", []byte("x"), nil); w.Code != http.StatusBadRequest {
+		t.Errorf("pattern topic status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+	if w := put("/topics/big", "application/octet-stream", make([]byte, _maxRawBodySize+1), nil); w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized body status = %d; want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+// TestPublishHandlerWaitDelivered verifies the synchronous publish mode
+func TestPublishHandlerWaitDelivered(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	vq := broker.NewVortexQ[any]()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.POST("/publish", h.PublishHandler)
+	if err := vq.Subscribe(broker.Subscription{ID: "s1", SubscriberAddress: server.URL, TopicName: "t"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				_ = vq.Swirl()
+			}
+		}
+	}()
+
+	w := performRequest(r, http.MethodPost, "/publish?wait=delivered&timeout=5s&quorum=all", strings.NewReader(`{"id":"m1","pattern":"t"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("wait=delivered status = %d; want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var resp struct {
+		Receipts []broker.DeliveryReceipt `json:"receipts"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	if len(resp.Receipts) != 1 || resp.Receipts[0].SubscriptionID != "s1" || resp.Receipts[0].Status != broker.ReceiptDelivered {
+		t.Errorf("receipts = %+v", resp.Receipts)
+	}
+
+	for _, query := range []string{"wait=acked", "wait=delivered&quorum=-1", "wait=delivered&timeout=x"} {
+		w = performRequest(r, http.MethodPost, "/publish?"+query, strings.NewReader(`{"pattern":"t"}`))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s status = %d; want %d", query, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+// TestRequestHandler verifies the request blocks until a correlated reply is published
+func TestRequestHandler(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.POST("/request", h.RequestHandler)
+
+	// answer every request on the "echo" topic by hand
+	go func() {
+		for i := 0; i < 500; i++ {
+			for _, m := range vq.Messages("echo") {
+				vq.Publish(broker.Message[any]{ID: "reply", Pattern: m.ReplyTo, Data: m.Data, CorrelationID: m.CorrelationID})
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	w := performRequest(r, http.MethodPost, "/request?timeout=2s", strings.NewReader(`{"id":"q1","pattern":"echo","data":"hi"}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("RequestHandler status = %d; want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var resp struct {
+		Data broker.Message[any] `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	if resp.Data.CorrelationID == "" || resp.Data.CorrelationID == "q1" || resp.Data.Data != "hi" {
+		t.Errorf("reply = %+v", resp.Data)
+	}
+
+	w = performRequest(r, http.MethodPost, "/request?timeout=10ms", strings.NewReader(`{"pattern":"silent"}`))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Errorf("unanswered request status = %d; want %d", w.Code, http.StatusGatewayTimeout)
+	}
+	w = performRequest(r, http.MethodPost, "/request?timeout=forever", strings.NewReader(`{"pattern":"silent"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid timeout status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
 // TestSubscribeHandler verifies subscribing via HTTP updates the broker subscriptions
 func TestSubscribeHandler(t *testing.T) {
 	vq := broker.NewVortexQ[any]()
@@ -109,10 +365,30 @@ func TestSubscribeHandler(t *testing.T) {
 		t.Fatalf("expected subscription for topic %q", "t")
 	}
 	subs := val.([]broker.Subscription)
+	sub.State = broker.SubscriptionActive
 	if len(subs) != 1 || subs[0] != sub {
 		t.Errorf("got subscriptions %v, want [%v]", subs, sub)
 	}
 
+	// the ID is taken already
+	w = performRequest(r, http.MethodPost, "/subscribe", bytes.NewReader(body))
+	if w.Code != http.StatusConflict {
+		t.Errorf("SubscribeHandler duplicate status = %d; want %d", w.Code, http.StatusConflict)
+	}
+
+	// a missing ID is generated and returned
+	body, _ = json.Marshal(broker.Subscription{SubscriberAddress: "a", TopicName: "t"})
+	w = performRequest(r, http.MethodPost, "/subscribe", bytes.NewReader(body))
+	var resp struct {
+		Data broker.Subscription `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("SubscribeHandler without ID = %d, %s", w.Code, w.Body)
+	}
+	if stored, ok := vq.FindSubscription(resp.Data.ID); resp.Data.ID == "" || !ok || stored != resp.Data {
+		t.Errorf("returned subscription %+v; want the stored one", resp.Data)
+	}
+
 	// invalid JSON
 	w = performRequest(r, http.MethodPost, "/subscribe", bytes.NewReader([]byte("bad")))
 	if w.Code != http.StatusBadRequest {
@@ -120,6 +396,239 @@ func TestSubscribeHandler(t *testing.T) {
 	}
 }
 
+// TestSubscribeHandlerRejectedAddress verifies the URL policy surfaces as a 400
+func TestSubscribeHandlerRejectedAddress(t *testing.T) {
+	policy, err := urlpolicy.New(urlpolicy.Config{AllowedSchemes: []string{"http", "https"}})
+	if err != nil {
+		t.Fatalf("urlpolicy.New error: %v", err)
+	}
+	vq := broker.NewVortexQ[any]()
+	vq.URLPolicy = policy
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.POST("/subscribe", h.SubscribeHandler)
+
+	for _, addr := range []string{"http://127.0.0.1:9000/admin", "http://169.254.169.254/", "file:///etc/passwd"} {
+		body, _ := json.Marshal(broker.Subscription{ID: "1", SubscriberAddress: addr, TopicName: "t"})
+		w := performRequest(r, http.MethodPost, "/subscribe", bytes.NewReader(body))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("SubscribeHandler(%q) status = %d; want %d", addr, w.Code, http.StatusBadRequest)
+		}
+	}
+	if _, ok := vq.Subscriptions.Load("t"); ok {
+		t.Error("rejected subscriptions must not be stored")
+	}
+}
+
+// TestPublishHandlerRejectedReceiptURL verifies the URL policy guards receipt URLs with a 400
+func TestPublishHandlerRejectedReceiptURL(t *testing.T) {
+	policy, err := urlpolicy.New(urlpolicy.Config{AllowedSchemes: []string{"http", "https"}})
+	if err != nil {
+		t.Fatalf("urlpolicy.New error: %v", err)
+	}
+	vq := broker.NewVortexQ[any]()
+	vq.URLPolicy = policy
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.POST("/publish", h.PublishHandler)
+	r.POST("/publish/batch", h.PublishBatchHandler)
+
+	body := `{"pattern":"t","receipt_url":"http://169.254.169.254/"}`
+	for _, path := range []string{"/publish", "/publish?wait=delivered&timeout=1s", "/publish/batch?mode=atomic"} {
+		w := performRequest(r, http.MethodPost, path, strings.NewReader(body))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s status = %d; want %d: %s", path, w.Code, http.StatusBadRequest, w.Body)
+		}
+	}
+	if msgs := vq.Messages("t"); len(msgs) != 0 {
+		t.Errorf("rejected messages published: %+v", msgs)
+	}
+}
+
+// TestDeliveriesHandlers verifies delivery attempts are queryable per subscription and message
+func TestDeliveriesHandlers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	vq := broker.NewVortexQ[any]()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.GET("/subscriptions/:id/deliveries", h.SubscriptionDeliveriesHandler)
+	r.GET("/messages/:id/deliveries", h.MessageDeliveriesHandler)
+
+	if err := vq.Subscribe(broker.Subscription{ID: "s1", SubscriberAddress: server.URL, TopicName: "t"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	vq.Publish(broker.Message[any]{ID: "m1", Pattern: "t", Data: "d"})
+	if err := vq.Swirl(); err != nil {
+		t.Fatalf("Swirl error: %v", err)
+	}
+
+	for _, path := range []string{"/subscriptions/s1/deliveries", "/messages/m1/deliveries"} {
+		w := performRequest(r, http.MethodGet, path, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s status = %d; want %d", path, w.Code, http.StatusOK)
+		}
+		var resp struct {
+			Deliveries []broker.DeliveryRecord `json:"deliveries"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid JSON response: %v", err)
+		}
+		if len(resp.Deliveries) != 1 {
+			t.Fatalf("GET %s returned %d deliveries; want 1", path, len(resp.Deliveries))
+		}
+		d := resp.Deliveries[0]
+		if d.MessageID != "m1" || d.SubscriptionID != "s1" || d.StatusCode != http.StatusOK || d.ResponseBody != "ok" {
+			t.Errorf("GET %s unexpected delivery %+v", path, d)
+		}
+	}
+
+	w := performRequest(r, http.MethodGet, "/messages/unknown/deliveries", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"deliveries":[]`) {
+		t.Errorf("unknown message: status %d body %s", w.Code, w.Body.String())
+	}
+}
+
+// TestSubscriptionHandlers verifies subscription state is visible through the API
+func TestSubscriptionHandlers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusGone)
+	}))
+	defer server.Close()
+
+	vq := broker.NewVortexQ[any]()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.GET("/subscriptions", h.ListSubscriptionsHandler)
+	r.GET("/subscriptions/:id", h.GetSubscriptionHandler)
+
+	if err := vq.Subscribe(broker.Subscription{ID: "s1", SubscriberAddress: server.URL, TopicName: "t"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	getState := func() string {
+		w := performRequest(r, http.MethodGet, "/subscriptions/s1", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET /subscriptions/s1 status = %d; want %d", w.Code, http.StatusOK)
+		}
+		var resp struct {
+			Subscription broker.Subscription `json:"subscription"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("invalid JSON response: %v", err)
+		}
+		return resp.Subscription.State
+	}
+	if got := getState(); got != broker.SubscriptionActive {
+		t.Errorf("state = %q; want %q", got, broker.SubscriptionActive)
+	}
+
+	vq.Publish(broker.Message[any]{ID: "m1", Pattern: "t", Data: "d"})
+	if err := vq.Swirl(); err != nil {
+		t.Fatalf("Swirl error: %v", err)
+	}
+	if got := getState(); got != broker.SubscriptionDisabled {
+		t.Errorf("state after 410 = %q; want %q", got, broker.SubscriptionDisabled)
+	}
+
+	w := performRequest(r, http.MethodGet, "/subscriptions", nil)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"state":"disabled"`) {
+		t.Errorf("GET /subscriptions: status %d body %s", w.Code, w.Body.String())
+	}
+	w = performRequest(r, http.MethodGet, "/subscriptions/unknown", nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("GET unknown subscription status = %d; want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+// TestRenderTemplateHandler verifies the template dry run
+func TestRenderTemplateHandler(t *testing.T) {
+	h := NewVortexQHandler(nil)
+	r := gin.New()
+	r.POST("/templates/render", h.RenderTemplateHandler)
+
+	body := `{"template":{"headers":{"X-Id":"{{.Message.ID}}"},"body":"{\"text\":{{json .Message.Data}}}"},
+		"message":{"id":"1","pattern":"p","data":"hi"}}`
+	w := performRequest(r, http.MethodPost, "/templates/render", strings.NewReader(body))
+	if w.Code != http.StatusOK {
+		t.Fatalf("RenderTemplateHandler status = %d; want %d: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	var resp struct {
+		Rendered broker.RenderedRequest `json:"rendered"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("invalid JSON response: %v", err)
+	}
+	if resp.Rendered.Method != http.MethodPost || resp.Rendered.Headers["X-Id"] != "1" || resp.Rendered.Body != `{"text":"hi"}` {
+		t.Errorf("rendered = %+v", resp.Rendered)
+	}
+
+	w = performRequest(r, http.MethodPost, "/templates/render", strings.NewReader(`{"template":{"body":"{{"}}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid template status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+// TestSeekSubscriptionHandler verifies the cursor of a subscription can be moved
+func TestSeekSubscriptionHandler(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.POST("/subscriptions/:id/seek", h.SeekSubscriptionHandler)
+
+	if err := vq.Subscribe(broker.Subscription{ID: "s1", SubscriberAddress: "http://example.com", TopicName: "t"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	w := performRequest(r, http.MethodPost, "/subscriptions/s1/seek", strings.NewReader(`{"from":"earliest"}`))
+	if w.Code != http.StatusOK {
+		t.Errorf("seek status = %d; want %d", w.Code, http.StatusOK)
+	}
+	w = performRequest(r, http.MethodPost, "/subscriptions/s1/seek", strings.NewReader(`{"from":"sideways"}`))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid seek status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+	w = performRequest(r, http.MethodPost, "/subscriptions/nope/seek", strings.NewReader(`{"from":"earliest"}`))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown subscription seek status = %d; want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestAckHandlers(t *testing.T) {
+	ackURLs := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ackURLs <- r.Header.Get("X-VortexQ-Ack-URL")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer server.Close()
+
+	vq := broker.NewVortexQ[any]()
+	vq.PublicURL = "http://vq.example.com"
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.POST("/acks/:token", h.AckHandler)
+	r.POST("/nacks/:token", h.NackHandler)
+
+	if err := vq.Subscribe(broker.Subscription{ID: "s1", SubscriberAddress: server.URL, TopicName: "t", AckMode: broker.AckModeAsync}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	vq.Publish(broker.Message[any]{ID: "m1", Pattern: "t"})
+	_ = vq.Swirl()
+	ackURL := <-ackURLs
+
+	w := performRequest(r, http.MethodPost, ackURL[strings.Index(ackURL, "/acks/"):], nil)
+	if w.Code != http.StatusOK {
+		t.Errorf("ack status = %d; want %d", w.Code, http.StatusOK)
+	}
+	w = performRequest(r, http.MethodPost, strings.Replace(ackURL[strings.Index(ackURL, "/acks/"):], "/acks/", "/nacks/", 1), nil)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("nack of an acked delivery status = %d; want %d", w.Code, http.StatusNotFound)
+	}
+}
+
 func TestHealthzAndReadinessHandler(t *testing.T) {
 	h := NewVortexQHandler(nil)
 
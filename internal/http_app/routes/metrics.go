@@ -18,6 +18,11 @@ var (
 		Name: "api_http_request_error_total",
 		Help: "Total number of errors returned by the API",
 	}, []string{"path", "status"})
+
+	SSEConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "api_sse_connections",
+		Help: "Number of open Server-Sent Events streams",
+	})
 )
 
 // PrometheusHandler Custom metrics handler with custom registry
@@ -1,26 +1,120 @@
 package routes
 
 import (
+	"context"
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/ivanbulyk/vortexq/broker"
 	"github.com/ivanbulyk/vortexq/internal/logging"
+	"github.com/ivanbulyk/vortexq/internal/urlpolicy"
+	"io"
 	"log/slog"
 	"net/http"
+	"strconv"
 )
 
 func (vh VortexQHandler) PublishHandler(ctx *gin.Context) {
 	const op = "http_app.App.PublishHandler"
-	message := broker.Message[any]{}
+	message, ok := bindMessage(ctx)
+	if !ok {
+		return
+	}
 
-	if err := ctx.ShouldBindJSON(&message); err != nil {
-		ctx.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request body", "error": err.Error()})
+	switch ctx.Query("wait") {
+	case "":
+	case "delivered":
+		vh.publishAndWait(ctx, message)
+		return
+	default:
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "Invalid wait mode", "error": "wait must be \"delivered\""})
 		return
 	}
 
 	// Perform the publish
-	vh.funcs.Publish(message)
+	offset, err := vh.funcs.Publish(message)
+	if err != nil {
+		if !rejectMessage(ctx, err) {
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": "failed to publish", "error": err.Error()})
+		}
+		return
+	}
+	message.Offset = offset
 	vh.Logger.With(slog.String("op", op)).Info("published message", logging.Attr("message", message))
 
 	// Send JSON response indicating success
 	ctx.JSON(http.StatusOK, gin.H{"message": "message published", "data": message})
 }
+
+// bindMessage reads a message given as JSON or as a CloudEvent, it writes the
+// error response itself and reports whether the handler can go on.
+func bindMessage(ctx *gin.Context) (broker.Message[any], bool) {
+	message := broker.Message[any]{}
+
+	if broker.IsCloudEvent(ctx.Request.Header) {
+		// CloudEvents in structured or binary content mode, the topic defaults to the event type
+		body, err := io.ReadAll(ctx.Request.Body)
+		if err == nil {
+			message, err = broker.ParseCloudEvent[any](ctx.Request.Header, body)
+		}
+		if err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "Invalid cloudevent", "error": err.Error()})
+			return message, false
+		}
+		if topic := ctx.Query("topic"); topic != "" {
+			message.Pattern = topic
+		}
+	} else if err := ctx.ShouldBindJSON(&message); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request body", "error": err.Error()})
+		return message, false
+	}
+	return message, true
+}
+
+// rejectMessage answers 400 when the broker refused the message as invalid, it
+// reports whether it did.
+func rejectMessage(ctx *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, broker.ErrInvalidTopic):
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "Invalid topic", "error": err.Error()})
+	case errors.Is(err, urlpolicy.ErrForbidden):
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "receipt url rejected", "error": err.Error()})
+	default:
+		return false
+	}
+	return true
+}
+
+// publishAndWait answers once the subscribers acknowledged the message, the
+// quorum is given as ?quorum=all or a number and the timeout as ?timeout=10s.
+func (vh VortexQHandler) publishAndWait(ctx *gin.Context, message broker.Message[any]) {
+	const op = "http_app.App.PublishHandler"
+
+	timeout, ok := queryTimeout(ctx)
+	if !ok {
+		return
+	}
+	quorum := 0
+	if raw := ctx.Query("quorum"); raw != "" && raw != "all" {
+		n, err := strconv.Atoi(raw)
+		if err != nil || n <= 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "Invalid quorum", "error": "quorum must be \"all\" or a positive number"})
+			return
+		}
+		quorum = n
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx.Request.Context(), timeout)
+	defer cancel()
+	offset, receipts, err := vh.funcs.PublishAndWait(waitCtx, message, quorum)
+	if rejectMessage(ctx, err) {
+		return
+	}
+	message.Offset = offset
+	if err != nil {
+		vh.Logger.With(slog.String("op", op)).Warn("delivery not confirmed", logging.Attr("message", message.ID), logging.Err(err))
+		ctx.JSON(http.StatusGatewayTimeout, gin.H{"message": "delivery not confirmed before timeout", "data": message, "receipts": receipts})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "message delivered", "data": message, "receipts": receipts})
+}
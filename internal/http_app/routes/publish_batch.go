@@ -0,0 +1,180 @@
+package routes
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ivanbulyk/vortexq/broker"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// Batch publish modes, best effort publishes every valid message while atomic
+// publishes nothing unless all of them are valid.
+const (
+	BatchBestEffort = "best_effort"
+	BatchAtomic     = "atomic"
+
+	// _maxAtomicBatch bounds the messages an atomic batch holds before publishing
+	_maxAtomicBatch = 100_000
+)
+
+// BatchResult is the outcome of one message of a batch, by its position in the body.
+type BatchResult struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	Topic string `json:"topic,omitempty"`
+	// Offset is set once the message is published
+	Offset *int64 `json:"offset,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// PublishBatchHandler publishes a JSON array of messages or a stream of
+// newline delimited ones, decoding them one at a time. The mode is given as
+// ?mode=best_effort, the default, or ?mode=atomic.
+func (vh VortexQHandler) PublishBatchHandler(ctx *gin.Context) {
+	const op = "http_app.App.PublishBatchHandler"
+
+	mode := ctx.DefaultQuery("mode", BatchBestEffort)
+	if mode != BatchBestEffort && mode != BatchAtomic {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "Invalid batch mode", "error": "mode must be \"best_effort\" or \"atomic\""})
+		return
+	}
+
+	var (
+		results   []BatchResult
+		pending   []broker.Message[any]
+		published int
+	)
+	err := decodeBatch(ctx.Request.Body, func(i int, msg broker.Message[any], err error) error {
+		if err := ctx.Request.Context().Err(); err != nil {
+			return err
+		}
+		result := BatchResult{Index: i, ID: msg.ID, Topic: msg.Pattern}
+		if err == nil {
+			err = vh.validateBatchMessage(&msg)
+			result.ID = msg.ID
+		}
+		switch {
+		case err != nil:
+			result.Error = err.Error()
+		case mode == BatchAtomic:
+			if len(pending) == _maxAtomicBatch {
+				return fmt.Errorf("atomic batches hold at most %d messages", _maxAtomicBatch)
+			}
+			pending = append(pending, msg)
+		default:
+			offset, err := vh.funcs.Publish(msg)
+			if err != nil {
+				result.Error = err.Error()
+				break
+			}
+			result.Offset = &offset
+			published++
+		}
+		results = append(results, result)
+		return nil
+	})
+
+	failed := len(results) - published - len(pending)
+	if mode == BatchAtomic && (err != nil || failed > 0) {
+		// nothing was published, the valid messages are dropped with the batch
+		for i := range results {
+			if results[i].Error == "" {
+				results[i].Error = "batch rejected"
+			}
+		}
+		message := "batch rejected"
+		if err != nil {
+			message = "batch rejected: " + err.Error()
+		}
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": message, "published": 0, "failed": len(results), "results": results})
+		return
+	}
+	for i, msg := range pending {
+		// validated with the batch, publishing can't fail anymore
+		offset, _ := vh.funcs.Publish(msg)
+		results[i].Offset = &offset
+		published++
+	}
+	vh.Logger.With(slog.String("op", op)).Info("published batch",
+		slog.String("mode", mode), slog.Int("published", published), slog.Int("failed", failed))
+
+	if err != nil {
+		// the messages before the malformed one are published
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request body", "error": err.Error(),
+			"published": published, "failed": failed, "results": results})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "batch published", "published": published, "failed": failed, "results": results})
+}
+
+// decodeBatch calls fn with every message of a JSON array or of a stream of
+// JSON values such as NDJSON, err is set for messages of the wrong shape. It
+// stops at the first error of fn or of malformed JSON.
+func decodeBatch(body io.Reader, fn func(i int, msg broker.Message[any], err error) error) error {
+	r := bufio.NewReader(body)
+	first, err := peekNonSpace(r)
+	if err == io.EOF {
+		return errors.New("empty batch")
+	}
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(r)
+	array := first == '['
+	if array {
+		_, _ = dec.Token()
+	}
+	for i := 0; ; i++ {
+		if array && !dec.More() {
+			if _, err := dec.Token(); err != nil {
+				return fmt.Errorf("message %d: %w", i, err)
+			}
+			return nil
+		}
+		var msg broker.Message[any]
+		err := dec.Decode(&msg)
+		if err == io.EOF && !array {
+			return nil
+		}
+		var typeErr *json.UnmarshalTypeError
+		if err != nil && !errors.As(err, &typeErr) {
+			// the decoder can't find the next message after a syntax error
+			return fmt.Errorf("message %d: %w", i, err)
+		}
+		if err := fn(i, msg, err); err != nil {
+			return err
+		}
+	}
+}
+
+func peekNonSpace(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			_, _ = r.ReadByte()
+		default:
+			return b[0], nil
+		}
+	}
+}
+
+// validateBatchMessage checks the topic and receipt URL and picks an ID for messages without one.
+func (vh VortexQHandler) validateBatchMessage(msg *broker.Message[any]) error {
+	if err := vh.funcs.ValidateMessage(*msg); err != nil {
+		return err
+	}
+	if msg.ID == "" {
+		msg.ID = broker.NewID()
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package routes
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// _maxRawBodySize bounds the payloads published with PUT /topics/:name
+const _maxRawBodySize = 16 << 20
+
+// PublishRawHandler publishes the request body as it is to the topic, keeping
+// its Content-Type. The content headers and X-Meta-* headers are kept as
+// message headers, the X-VortexQ-Message-ID, X-VortexQ-Correlation-ID and
+// X-VortexQ-Reply-To headers set the message attributes of the same name.
+func (vh VortexQHandler) PublishRawHandler(ctx *gin.Context) {
+	const op = "http_app.App.PublishRawHandler"
+
+	topic := ctx.Param("name")
+	body, err := io.ReadAll(http.MaxBytesReader(ctx.Writer, ctx.Request.Body, _maxRawBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"message": "Payload too large", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "Invalid request body", "error": err.Error()})
+		return
+	}
+
+	header := ctx.Request.Header
+	message := broker.Message[any]{
+		ID:            header.Get("X-VortexQ-Message-ID"),
+		Pattern:       topic,
+		ContentType:   header.Get("Content-Type"),
+		CorrelationID: header.Get("X-VortexQ-Correlation-ID"),
+		ReplyTo:       header.Get("X-VortexQ-Reply-To"),
+	}
+	if message.ID == "" {
+		message.ID = broker.NewID()
+	}
+	for name, values := range header {
+		switch {
+		case broker.IsContentHeader(name):
+			message.Headers = setHeader(message.Headers, name, values[0])
+		case strings.HasPrefix(name, broker.MetaHeaderPrefix) && len(name) > len(broker.MetaHeaderPrefix):
+			message.Headers = setHeader(message.Headers, strings.ToLower(name[len(broker.MetaHeaderPrefix):]), values[0])
+		}
+	}
+	// the content type decides, JSON is decoded and anything else kept as bytes or text
+	if err := message.SetPayload(body); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "Invalid payload", "error": err.Error()})
+		return
+	}
+
+	offset, err := vh.funcs.Publish(message)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "Invalid topic", "error": err.Error()})
+		return
+	}
+	message.Offset = offset
+	vh.Logger.With(slog.String("op", op)).Info("published raw message",
+		logging.Attr("id", message.ID), logging.Attr("topic", topic), slog.Int("size", len(body)))
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "message published", "id": message.ID, "topic": topic, "offset": message.Offset})
+}
+
+func setHeader(headers map[string]string, name, value string) map[string]string {
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	headers[name] = value
+	return headers
+}
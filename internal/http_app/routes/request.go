@@ -0,0 +1,65 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	_defaultRequestTimeout = 30 * time.Second
+	_maxRequestTimeout     = 5 * time.Minute
+)
+
+// RequestHandler publishes a message and blocks until a reply correlated to it is
+// published or the timeout given as ?timeout=10s expires.
+func (vh VortexQHandler) RequestHandler(ctx *gin.Context) {
+	const op = "http_app.App.RequestHandler"
+
+	timeout, ok := queryTimeout(ctx)
+	if !ok {
+		return
+	}
+
+	message, ok := bindMessage(ctx)
+	if !ok {
+		return
+	}
+
+	reqCtx, cancel := context.WithTimeout(ctx.Request.Context(), timeout)
+	defer cancel()
+	reply, err := vh.funcs.Request(reqCtx, message)
+	if rejectMessage(ctx, err) {
+		return
+	}
+	if err != nil {
+		vh.Logger.With(slog.String("op", op)).Warn("no reply received", logging.Attr("message", message.ID), logging.Err(err))
+		if errors.Is(err, context.DeadlineExceeded) {
+			ctx.JSON(http.StatusGatewayTimeout, gin.H{"message": "no reply before timeout", "error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"message": "request aborted", "error": err.Error()})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"message": "reply received", "data": reply})
+}
+
+// queryTimeout reads ?timeout=, it writes the error response itself and
+// reports whether the handler can go on.
+func queryTimeout(ctx *gin.Context) (time.Duration, bool) {
+	raw := ctx.Query("timeout")
+	if raw == "" {
+		return _defaultRequestTimeout, true
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d <= 0 || d > _maxRequestTimeout {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid timeout", "error": "timeout must be a duration up to " + _maxRequestTimeout.String()})
+		return 0, false
+	}
+	return d, true
+}
@@ -0,0 +1,120 @@
+package routes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// SSEProtocol marks the subscriptions consumed over /topics/:name/events
+	SSEProtocol = "sse"
+
+	_sseKeepAlivePeriod = 15 * time.Second
+	// _sseHeaderFilterPrefix marks query parameters filtering on message headers, e.g. ?header.region=eu
+	_sseHeaderFilterPrefix = "header."
+)
+
+// TopicEventsHandler streams the messages of a topic as text/event-stream. The
+// event ID is the message offset, so that a reconnecting client resumes after
+// Last-Event-ID from the retained messages.
+func (vh VortexQHandler) TopicEventsHandler(ctx *gin.Context) {
+	const op = "http_app.App.TopicEventsHandler"
+	topic := ctx.Param("name")
+	if broker.IsTopicPattern(topic) {
+		// offsets, and so event IDs, are only unique within a topic
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid topic", "error": "patterns are not supported, use /ws"})
+		return
+	}
+
+	start := &broker.StartPosition{From: broker.StartLatest}
+	lastEventID := ctx.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		// EventSource can't set headers on the first connection
+		lastEventID = ctx.Query("last_event_id")
+	}
+	if lastEventID != "" {
+		offset, err := strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || offset < 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid Last-Event-ID", "error": "event IDs are message offsets"})
+			return
+		}
+		start = &broker.StartPosition{From: broker.StartOffset, Offset: offset + 1}
+	}
+	filters := make(map[string]string)
+	for key, values := range ctx.Request.URL.Query() {
+		if name, ok := strings.CutPrefix(key, _sseHeaderFilterPrefix); ok && len(values) > 0 {
+			filters[name] = values[0]
+		}
+	}
+
+	streamCtx, cancel := context.WithCancel(ctx.Request.Context())
+	defer cancel()
+	sub := broker.Subscription{TopicName: topic, Start: start, Protocol: SSEProtocol}
+	deliveries, err := vh.funcs.Consume(streamCtx, sub, broker.ConsumeOptions{AutoAck: true})
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": "failed to subscribe", "error": err.Error()})
+		return
+	}
+	SSEConnections.Inc()
+	defer SSEConnections.Dec()
+
+	log := vh.Logger.With(slog.String("op", op), slog.String("topic", topic))
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	// keeps reverse proxies from buffering the stream
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Flush()
+
+	keepAlive := time.NewTicker(_sseKeepAlivePeriod)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return
+			}
+			if !matchHeaders(d.Message, filters) {
+				continue
+			}
+			data, err := json.Marshal(d.Message)
+			if err != nil {
+				log.Error("can't encode event", slog.String("message", d.Message.ID), logging.Err(err))
+				continue
+			}
+			if _, err := fmt.Fprintf(ctx.Writer, "id: %d\ndata: %s\n\n", d.Message.Offset, data); err != nil {
+				return
+			}
+			ctx.Writer.Flush()
+		case <-keepAlive.C:
+			if _, err := fmt.Fprint(ctx.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			ctx.Writer.Flush()
+		case <-vh.done:
+			// clients reconnect with Last-Event-ID, e.g. to another instance
+			return
+		case <-streamCtx.Done():
+			return
+		}
+	}
+}
+
+func matchHeaders(msg broker.Message[any], filters map[string]string) bool {
+	for name, value := range filters {
+		if msg.Headers[name] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package routes
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTopicEventsHandler(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.GET("/topics/:name/events", h.TopicEventsHandler)
+	server := httptest.NewServer(r)
+	defer server.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				_ = vq.Swirl()
+			}
+		}
+	}()
+
+	vq.Publish(broker.Message[any]{ID: "m0", Pattern: "t"})
+	vq.Publish(broker.Message[any]{ID: "m1", Pattern: "t", Headers: map[string]string{"region": "us"}})
+	vq.Publish(broker.Message[any]{ID: "m2", Pattern: "t", Headers: map[string]string{"region": "eu"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/topics/t/events?header.region=eu", nil)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request error: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q; want text/event-stream", ct)
+	}
+
+	// resumed after offset 0, m1 is filtered out by its header
+	lines := bufio.NewScanner(resp.Body)
+	var id, data string
+	for lines.Scan() && lines.Text() != "" {
+		if v, ok := strings.CutPrefix(lines.Text(), "id: "); ok {
+			id = v
+		}
+		if v, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			data = v
+		}
+	}
+	var msg broker.Message[any]
+	if err := json.Unmarshal([]byte(data), &msg); err != nil {
+		t.Fatalf("invalid event data %q: %v", data, err)
+	}
+	if id != "2" || msg.ID != "m2" {
+		t.Errorf("event = %s %+v; want id 2 with m2", id, msg)
+	}
+	if got := testutil.ToFloat64(SSEConnections); got != 1 {
+		t.Errorf("SSEConnections = %v; want 1", got)
+	}
+
+	// the stream ends on shutdown
+	h.Shutdown()
+	for lines.Scan() {
+	}
+	if err := lines.Err(); err != nil {
+		t.Errorf("stream error after shutdown: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(SSEConnections) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if got := testutil.ToFloat64(SSEConnections); got != 0 {
+		t.Errorf("SSEConnections after shutdown = %v; want 0", got)
+	}
+
+	w := performRequest(r, http.MethodGet, "/topics/t/events?last_event_id=x", nil)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid Last-Event-ID status = %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
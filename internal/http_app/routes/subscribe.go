@@ -1,9 +1,11 @@
 package routes
 
 import (
+	"errors"
 	"github.com/gin-gonic/gin"
 	"github.com/ivanbulyk/vortexq/broker"
 	"github.com/ivanbulyk/vortexq/internal/logging"
+	"github.com/ivanbulyk/vortexq/internal/urlpolicy"
 	"log/slog"
 	"net/http"
 )
@@ -17,13 +19,31 @@ func (vh VortexQHandler) SubscribeHandler(ctx *gin.Context) {
 		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid request body", "error": err.Error()})
 		return
 	}
+	if subscription.ID == "" {
+		subscription.ID = broker.NewID()
+	}
 
 	if err := vh.funcs.Subscribe(subscription); err != nil {
+		if errors.Is(err, urlpolicy.ErrForbidden) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "subscriber address rejected", "error": err.Error()})
+			return
+		}
+		if errors.Is(err, broker.ErrInvalidSubscription) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid subscription", "error": err.Error()})
+			return
+		}
+		if errors.Is(err, broker.ErrSubscriptionExists) {
+			ctx.JSON(http.StatusConflict, gin.H{"message": "subscription already exists", "error": err.Error()})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{"message": "failed to subscribe", "error": err.Error()})
 		return
 	}
 
+	if stored, ok := vh.funcs.FindSubscription(subscription.ID); ok {
+		subscription = stored
+	}
 	vh.Logger.With(slog.String("op", op)).Info("subscription received", logging.Attr("subscription", subscription))
-	ctx.JSON(http.StatusOK, gin.H{"message": "subscription processed successfully"})
+	ctx.JSON(http.StatusOK, gin.H{"message": "subscription processed successfully", "data": subscription})
 
 }
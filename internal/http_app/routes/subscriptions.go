@@ -0,0 +1,45 @@
+package routes
+
+import (
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/ivanbulyk/vortexq/broker"
+	"net/http"
+)
+
+// ListSubscriptionsHandler lists all subscriptions together with their state.
+func (vh VortexQHandler) ListSubscriptionsHandler(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"subscriptions": vh.funcs.ListSubscriptions()})
+}
+
+// GetSubscriptionHandler returns a single subscription together with its state.
+func (vh VortexQHandler) GetSubscriptionHandler(ctx *gin.Context) {
+	sub, ok := vh.funcs.FindSubscription(ctx.Param("id"))
+	if !ok {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": "subscription not found"})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"subscription": sub})
+}
+
+// SeekSubscriptionHandler rewinds or fast-forwards the cursor of a subscription.
+func (vh VortexQHandler) SeekSubscriptionHandler(ctx *gin.Context) {
+	var position broker.StartPosition
+	if err := ctx.ShouldBindJSON(&position); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid request body", "error": err.Error()})
+		return
+	}
+
+	if err := vh.funcs.Seek(ctx.Param("id"), position); err != nil {
+		switch {
+		case errors.Is(err, broker.ErrNotFound):
+			ctx.JSON(http.StatusNotFound, gin.H{"message": "subscription not found", "error": err.Error()})
+		case errors.Is(err, broker.ErrInvalidSubscription):
+			ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid position", "error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": "failed to seek", "error": err.Error()})
+		}
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"message": "subscription cursor moved", "position": position})
+}
@@ -0,0 +1,29 @@
+package routes
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/ivanbulyk/vortexq/broker"
+	"net/http"
+)
+
+// RenderTemplateRequest is the body of a template dry run.
+type RenderTemplateRequest struct {
+	Template broker.DeliveryTemplate `json:"template"`
+	Message  broker.Message[any]     `json:"message"`
+}
+
+// RenderTemplateHandler renders a delivery template against a sample message without delivering it.
+func (vh VortexQHandler) RenderTemplateHandler(ctx *gin.Context) {
+	var req RenderTemplateRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid request body", "error": err.Error()})
+		return
+	}
+
+	rendered, err := broker.RenderTemplate(req.Template, req.Message)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid template", "error": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"rendered": rendered})
+}
@@ -1,10 +1,12 @@
 package routes
 
 import (
+	"github.com/graphql-go/graphql"
 	"github.com/ivanbulyk/vortexq/broker"
 	"github.com/ivanbulyk/vortexq/internal/version"
 	"github.com/prometheus/client_golang/prometheus"
 	"log/slog"
+	"sync"
 	"sync/atomic"
 )
 
@@ -14,6 +16,12 @@ type VortexQHandler struct {
 	CustomRegistry *prometheus.Registry
 	Version        *version.Version
 	Logger         *slog.Logger
+
+	schema *graphql.Schema
+
+	// done is closed by Shutdown to end long-lived connections such as WebSockets
+	done         chan struct{}
+	shutdownOnce *sync.Once
 }
 
 // NewVortexQHandler creates a new VortexQHandler with the provided vortexQFuncs implementation.
@@ -24,5 +32,13 @@ func NewVortexQHandler(funcs broker.VortexQFuncs) *VortexQHandler {
 		CustomRegistry: prometheus.NewRegistry(),
 		Version:        version.NewVersion(),
 		Logger:         slog.Default(),
+		schema:         newSchema(funcs),
+		done:           make(chan struct{}),
+		shutdownOnce:   &sync.Once{},
 	}
 }
+
+// Shutdown ends the long-lived connections, http.Server.Shutdown doesn't wait for them.
+func (vh VortexQHandler) Shutdown() {
+	vh.shutdownOnce.Do(func() { close(vh.done) })
+}
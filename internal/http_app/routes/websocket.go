@@ -0,0 +1,258 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// WebSocketProtocol marks the subscriptions consumed over /ws
+	WebSocketProtocol = "websocket"
+
+	_wsWriteWait      = 10 * time.Second
+	_wsPongWait       = 60 * time.Second
+	_wsPingPeriod     = _wsPongWait * 9 / 10
+	_wsMaxFrameSize   = 64 << 10
+	_wsSendBufferSize = 256
+)
+
+// Frame types exchanged over /ws, clients send subscribe, unsubscribe, ack and nack.
+const (
+	wsSubscribe    = "subscribe"
+	wsSubscribed   = "subscribed"
+	wsUnsubscribe  = "unsubscribe"
+	wsUnsubscribed = "unsubscribed"
+	wsMessage      = "message"
+	wsAck          = "ack"
+	wsNack         = "nack"
+	wsError        = "error"
+)
+
+// WebSocketFrame is a JSON frame of the /ws protocol in either direction.
+type WebSocketFrame struct {
+	Type string `json:"type"`
+	// ID names the subscription, the server picks one when subscribing without
+	ID    string `json:"id,omitempty"`
+	Topic string `json:"topic,omitempty"`
+	// Ack makes the client ack or nack every message with its token
+	Ack         bool                  `json:"ack,omitempty"`
+	MaxInFlight int                   `json:"max_in_flight,omitempty"`
+	Start       *broker.StartPosition `json:"start,omitempty"`
+	Token       string                `json:"token,omitempty"`
+	Attempt     int                   `json:"attempt,omitempty"`
+	Message     *broker.Message[any]  `json:"message,omitempty"`
+	Error       string                `json:"error,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// dashboards are served from other origins, access control belongs in front of the broker
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// wsConn is a client connection, its subscriptions end with it.
+type wsConn struct {
+	vh     VortexQHandler
+	conn   *websocket.Conn
+	log    *slog.Logger
+	send   chan WebSocketFrame
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc
+	// closeCode and closeReason are sent in the close frame
+	closeOnce   sync.Once
+	closeCode   int
+	closeReason string
+}
+
+// WebSocketHandler upgrades to a WebSocket to subscribe to topics or patterns and
+// receive their messages as JSON frames. Clients that don't read fast enough are
+// disconnected.
+func (vh VortexQHandler) WebSocketHandler(ctx *gin.Context) {
+	const op = "http_app.App.WebSocketHandler"
+	log := vh.Logger.With(slog.String("op", op))
+
+	conn, err := wsUpgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// the upgrader already answered with an error status
+		log.Warn("websocket upgrade failed", logging.Err(err))
+		return
+	}
+
+	c := &wsConn{
+		vh:   vh,
+		conn: conn,
+		log:  log,
+		send: make(chan WebSocketFrame, _wsSendBufferSize),
+		subs: make(map[string]context.CancelFunc),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	defer c.cancel()
+
+	go c.writeLoop()
+	go func() {
+		select {
+		case <-vh.done:
+			c.close(websocket.CloseGoingAway, "server shutting down")
+		case <-c.ctx.Done():
+		}
+	}()
+	c.readLoop()
+}
+
+func (c *wsConn) readLoop() {
+	defer c.close(websocket.CloseNormalClosure, "")
+
+	c.conn.SetReadLimit(_wsMaxFrameSize)
+	_ = c.conn.SetReadDeadline(time.Now().Add(_wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(_wsPongWait))
+	})
+
+	for {
+		var frame WebSocketFrame
+		if err := c.conn.ReadJSON(&frame); err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) && c.ctx.Err() == nil {
+				c.log.Warn("websocket read failed", logging.Err(err))
+			}
+			return
+		}
+		c.handle(frame)
+	}
+}
+
+func (c *wsConn) handle(frame WebSocketFrame) {
+	switch frame.Type {
+	case wsSubscribe:
+		c.subscribe(frame)
+	case wsUnsubscribe:
+		c.mu.Lock()
+		cancel, ok := c.subs[frame.ID]
+		delete(c.subs, frame.ID)
+		c.mu.Unlock()
+		if !ok {
+			c.reply(WebSocketFrame{Type: wsError, ID: frame.ID, Error: "unknown subscription"})
+			return
+		}
+		cancel()
+		c.reply(WebSocketFrame{Type: wsUnsubscribed, ID: frame.ID})
+	case wsAck, wsNack:
+		settle := c.vh.funcs.Ack
+		if frame.Type == wsNack {
+			settle = c.vh.funcs.Nack
+		}
+		if err := settle(frame.Token); err != nil {
+			c.reply(WebSocketFrame{Type: wsError, Token: frame.Token, Error: err.Error()})
+		}
+	default:
+		c.reply(WebSocketFrame{Type: wsError, Error: "unknown frame type " + frame.Type})
+	}
+}
+
+func (c *wsConn) subscribe(frame WebSocketFrame) {
+	if frame.Topic == "" {
+		c.reply(WebSocketFrame{Type: wsError, ID: frame.ID, Error: "topic is required"})
+		return
+	}
+	// a named subscription outlives the connection and keeps its cursor
+	opts := broker.ConsumeOptions{MaxInFlight: frame.MaxInFlight, AutoAck: !frame.Ack, Ephemeral: frame.ID == ""}
+	id := frame.ID
+	if id == "" {
+		id = broker.NewID()
+	}
+	c.mu.Lock()
+	_, exists := c.subs[id]
+	c.mu.Unlock()
+	if exists {
+		c.reply(WebSocketFrame{Type: wsError, ID: id, Error: "already subscribed"})
+		return
+	}
+
+	sub := broker.Subscription{ID: id, TopicName: frame.Topic, Start: frame.Start, Protocol: WebSocketProtocol}
+	ctx, cancel := context.WithCancel(c.ctx)
+	deliveries, err := c.vh.funcs.Consume(ctx, sub, opts)
+	if err != nil {
+		cancel()
+		c.reply(WebSocketFrame{Type: wsError, ID: frame.ID, Topic: frame.Topic, Error: err.Error()})
+		return
+	}
+	c.mu.Lock()
+	c.subs[id] = cancel
+	c.mu.Unlock()
+	c.reply(WebSocketFrame{Type: wsSubscribed, ID: id, Topic: frame.Topic})
+
+	go func() {
+		for d := range deliveries {
+			msg := d.Message
+			out := WebSocketFrame{Type: wsMessage, ID: id, Topic: msg.Pattern, Token: d.AckToken, Attempt: d.Attempt, Message: &msg}
+			if !c.reply(out) {
+				return
+			}
+		}
+	}()
+}
+
+// reply queues a frame without blocking, a full queue means the client is too
+// slow and gets disconnected.
+func (c *wsConn) reply(frame WebSocketFrame) bool {
+	select {
+	case c.send <- frame:
+		return true
+	case <-c.ctx.Done():
+		return false
+	default:
+		c.log.Warn("disconnecting slow websocket consumer", slog.String("remote", c.conn.RemoteAddr().String()))
+		c.close(websocket.ClosePolicyViolation, "slow consumer")
+		return false
+	}
+}
+
+// close ends the connection and its subscriptions, the first caller picks the close code.
+func (c *wsConn) close(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeCode, c.closeReason = code, reason
+		c.cancel()
+	})
+}
+
+func (c *wsConn) writeLoop() {
+	ticker := time.NewTicker(_wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		_ = c.conn.Close()
+	}()
+
+	for {
+		select {
+		case frame := <-c.send:
+			_ = c.conn.SetWriteDeadline(time.Now().Add(_wsWriteWait))
+			if err := c.conn.WriteJSON(frame); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(_wsWriteWait)); err != nil {
+				c.close(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.ctx.Done():
+			if c.closeCode != websocket.CloseAbnormalClosure {
+				msg := websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+				_ = c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(_wsWriteWait))
+			}
+			return
+		}
+	}
+}
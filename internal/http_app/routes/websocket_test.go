@@ -0,0 +1,142 @@
+package routes
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/ivanbulyk/vortexq/broker"
+)
+
+// startWebSocket serves /ws for the broker, swirling it until the test ends
+func startWebSocket(t *testing.T, vq *broker.VortexQ[any]) (*VortexQHandler, *websocket.Conn) {
+	t.Helper()
+	h := NewVortexQHandler(vq)
+	r := gin.New()
+	r.GET("/ws", h.WebSocketHandler)
+	server := httptest.NewServer(r)
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Millisecond):
+				_ = vq.Swirl()
+			}
+		}
+	}()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+		h.Shutdown()
+		close(done)
+		server.Close()
+	})
+	return h, conn
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) WebSocketFrame {
+	t.Helper()
+	var frame WebSocketFrame
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := conn.ReadJSON(&frame); err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	return frame
+}
+
+func TestWebSocketHandler(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	h, conn := startWebSocket(t, vq)
+
+	if err := conn.WriteJSON(WebSocketFrame{Type: wsSubscribe, Topic: "orders.*", Ack: true}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	subscribed := readFrame(t, conn)
+	if subscribed.Type != wsSubscribed || subscribed.ID == "" {
+		t.Fatalf("subscribe reply = %+v", subscribed)
+	}
+
+	vq.Publish(broker.Message[any]{ID: "m1", Pattern: "orders.eu", Data: "hello"})
+	msg := readFrame(t, conn)
+	if msg.Type != wsMessage || msg.ID != subscribed.ID || msg.Topic != "orders.eu" || msg.Token == "" ||
+		msg.Message == nil || msg.Message.Data != "hello" {
+		t.Fatalf("message frame = %+v", msg)
+	}
+	// nacked, the message comes again
+	if err := conn.WriteJSON(WebSocketFrame{Type: wsNack, Token: msg.Token}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	again := readFrame(t, conn)
+	if again.Message == nil || again.Message.ID != "m1" || again.Attempt != 2 {
+		t.Fatalf("redelivery = %+v", again)
+	}
+	if err := conn.WriteJSON(WebSocketFrame{Type: wsAck, Token: again.Token}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+
+	if err := conn.WriteJSON(WebSocketFrame{Type: wsUnsubscribe, ID: subscribed.ID}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if frame := readFrame(t, conn); frame.Type != wsUnsubscribed {
+		t.Fatalf("unsubscribe reply = %+v", frame)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(vq.ListSubscriptions()) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if subs := vq.ListSubscriptions(); len(subs) != 0 {
+		t.Errorf("subscriptions after unsubscribe = %+v", subs)
+	}
+
+	if err := conn.WriteJSON(WebSocketFrame{Type: "publish"}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	if frame := readFrame(t, conn); frame.Type != wsError {
+		t.Errorf("unknown frame reply = %+v", frame)
+	}
+
+	h.Shutdown()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Errorf("read after shutdown error = %v; want going away", err)
+	}
+}
+
+// Test a client that doesn't read is disconnected
+func TestWebSocketSlowConsumer(t *testing.T) {
+	vq := broker.NewVortexQ[any]()
+	_, conn := startWebSocket(t, vq)
+
+	if err := conn.WriteJSON(WebSocketFrame{Type: wsSubscribe, Topic: "t"}); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	readFrame(t, conn)
+	payload := strings.Repeat("x", 16<<10)
+	for i := 0; i < 4*_wsSendBufferSize; i++ {
+		vq.Publish(broker.Message[any]{Pattern: "t", Data: payload})
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, _, err := conn.ReadMessage()
+		if err == nil {
+			continue
+		}
+		if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Errorf("read error = %v; want policy violation close", err)
+		}
+		return
+	}
+}
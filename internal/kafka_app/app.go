@@ -0,0 +1,48 @@
+package kafka_app
+
+import (
+	"context"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver"
+	"log/slog"
+	"sync/atomic"
+)
+
+type App struct {
+	log    *slog.Logger
+	funcs  broker.VortexQFuncs
+	server *tcpserver.Server
+
+	groups *coordinator
+	// producerIDs hands out the ids of InitProducerId
+	producerIDs atomic.Int64
+}
+
+// New creates new Kafka protocol app listening on addr.
+func New(log *slog.Logger, funcs broker.VortexQFuncs, addr string) *App {
+	a := &App{
+		log:   log,
+		funcs: funcs,
+	}
+	a.server = tcpserver.New(log, "kafka", addr, a.handle)
+	a.groups = newCoordinator(a.server.Context())
+	return a
+}
+
+// MustRun runs Kafka protocol server and panics if any error occurs.
+func (a *App) MustRun() {
+	if err := a.server.Run(); err != nil {
+		panic(err)
+	}
+}
+
+// Ready is closed once the server accepts connections.
+func (a *App) Ready() <-chan struct{} {
+	return a.server.Ready()
+}
+
+// Stop closes the listener and the client connections, waiting for them to end
+// until timeoutCtx is done.
+func (a *App) Stop(timeoutCtx context.Context) error {
+	return a.server.Stop(timeoutCtx)
+}
@@ -0,0 +1,169 @@
+package kafka_app
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver/tcpservertest"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+// startApp serves the Kafka protocol on a loopback port, swirls the broker and returns its address
+func startApp(t *testing.T) (*broker.VortexQ[any], string) {
+	t.Helper()
+	vq := broker.NewVortexQ[any]()
+	vq.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	app := New(vq.Logger, vq, "127.0.0.1:0")
+
+	addr := tcpservertest.Start(t, vq, app.server.Serve, app.Stop)
+	return vq, addr
+}
+
+func newClient(t *testing.T, addr string, opts ...kgo.Opt) *kgo.Client {
+	t.Helper()
+	opts = append([]kgo.Opt{
+		kgo.SeedBrokers(addr),
+		kgo.ProducerBatchCompression(kgo.NoCompression()),
+		kgo.FetchMaxWait(200 * time.Millisecond),
+	}, opts...)
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		t.Fatalf("client error: %v", err)
+	}
+	t.Cleanup(client.Close)
+	return client
+}
+
+// poll fetches until n records arrived
+func poll(t *testing.T, ctx context.Context, client *kgo.Client, n int) []*kgo.Record {
+	t.Helper()
+	var records []*kgo.Record
+	for len(records) < n {
+		fetches := client.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("got %d records; want %d", len(records), n)
+		}
+		if errs := fetches.Errors(); len(errs) > 0 {
+			t.Fatalf("fetch errors: %v", errs)
+		}
+		records = append(records, fetches.Records()...)
+	}
+	return records
+}
+
+// Test records produced by Kafka clients become messages and messages are fetched as records
+func TestProduceFetch(t *testing.T) {
+	vq, addr := startApp(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	producer := newClient(t, addr)
+	results := producer.ProduceSync(ctx,
+		&kgo.Record{Topic: "orders.created", Key: []byte("k1"), Value: []byte(`{"n":1}`), Headers: []kgo.RecordHeader{{Key: "content-type", Value: []byte("application/json")}, {Key: "source", Value: []byte("shop")}}},
+		&kgo.Record{Topic: "orders.created", Value: []byte("plain")},
+	)
+	if err := results.FirstErr(); err != nil {
+		t.Fatalf("produce error: %v", err)
+	}
+	if err := producer.ProduceSync(ctx, &kgo.Record{Topic: "orders.*", Value: []byte("x")}).FirstErr(); err == nil {
+		t.Error("produce to a pattern succeeded; want an error")
+	}
+
+	msgs := vq.Messages("orders.created")
+	if len(msgs) != 2 {
+		t.Fatalf("topic holds %d messages; want 2", len(msgs))
+	}
+	if msgs[0].ContentType != "application/json" || !reflect.DeepEqual(msgs[0].Data, map[string]any{"n": float64(1)}) ||
+		msgs[0].Headers[keyHeader] != "k1" || msgs[0].Headers["source"] != "shop" {
+		t.Errorf("first message = %+v; want the JSON record with its key and headers", msgs[0])
+	}
+	vq.Publish(broker.Message[any]{ID: "m3", Pattern: "orders.created", Data: "from vortexq"})
+
+	consumer := newClient(t, addr,
+		kgo.ConsumeTopics("orders.created"),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	records := poll(t, ctx, consumer, 3)
+	for i, want := range []string{`{"n":1}`, "plain", `"from vortexq"`} {
+		if string(records[i].Value) != want || records[i].Offset != int64(i) {
+			t.Errorf("record %d = %q at %d; want %q", i, records[i].Value, records[i].Offset, want)
+		}
+	}
+	if string(records[0].Key) != "k1" || records[1].Key != nil {
+		t.Errorf("keys = %q, %q; want k1 and none", records[0].Key, records[1].Key)
+	}
+	if h := records[0].Headers; len(h) != 2 || h[0].Key != "content-type" || string(h[0].Value) != "application/json" {
+		t.Errorf("headers = %+v; want the content type and source", h)
+	}
+}
+
+// Test a consumer group commits its offsets and a new member resumes from them
+func TestConsumerGroup(t *testing.T) {
+	vq, addr := startApp(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	for i := range 10 {
+		vq.Publish(broker.Message[any]{ID: fmt.Sprint("m", i), Pattern: "jobs", Data: i})
+	}
+
+	group := func() *kgo.Client {
+		return newClient(t, addr,
+			kgo.ConsumerGroup("workers"),
+			kgo.ConsumeTopics("jobs"),
+			kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+			kgo.DisableAutoCommit(),
+		)
+	}
+	first := group()
+	records := poll(t, ctx, first, 10)
+	if records[9].Offset != 9 {
+		t.Fatalf("last offset = %d; want 9", records[9].Offset)
+	}
+	if err := first.CommitRecords(ctx, records...); err != nil {
+		t.Fatalf("commit error: %v", err)
+	}
+	first.Close()
+
+	for i := 10; i < 15; i++ {
+		vq.Publish(broker.Message[any]{ID: fmt.Sprint("m", i), Pattern: "jobs", Data: i})
+	}
+	records = poll(t, ctx, group(), 5)
+	if records[0].Offset != 10 || string(records[0].Value) != "10" {
+		t.Errorf("resumed at %d with %q; want offset 10", records[0].Offset, records[0].Value)
+	}
+}
+
+// Test batches encoded for fetches decode into the same records
+func TestRecordBatch(t *testing.T) {
+	now := time.UnixMilli(1700000000000).UTC()
+	msgs := []broker.Message[any]{
+		{Pattern: "t", Data: []byte{0, 1}, ContentType: "application/octet-stream", Time: now, Offset: 4, Headers: map[string]string{keyHeader: "k"}},
+		{Pattern: "t", Data: "s", Time: now.Add(time.Second), Offset: 5},
+	}
+	b, err := appendBatch(nil, msgs)
+	if err != nil {
+		t.Fatalf("appendBatch error: %v", err)
+	}
+	records, err := readBatches(b)
+	if err != nil {
+		t.Fatalf("readBatches error: %v", err)
+	}
+	want := []record{
+		{key: []byte("k"), value: []byte{0, 1}, headers: [][2]string{{contentTypeHeader, "application/octet-stream"}}, timestamp: now},
+		{value: []byte(`"s"`), headers: [][2]string{{contentTypeHeader, "application/json"}}, timestamp: now.Add(time.Second)},
+	}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("records = %+v; want %+v", records, want)
+	}
+
+	b[len(b)-1] ^= 0xff
+	if _, err := readBatches(b); err == nil {
+		t.Error("corrupted batch decoded; want a crc error")
+	}
+}
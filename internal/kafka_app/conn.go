@@ -0,0 +1,469 @@
+package kafka_app
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"github.com/twmb/franz-go/pkg/kbin"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	_maxRequestSize = 100 << 20
+	_writeWait      = 10 * time.Second
+	// _fetchPoll is how often a long-polling fetch looks for new messages
+	_fetchPoll = 20 * time.Millisecond
+	// _fetchLimit bounds the messages of a partition in one fetch response
+	_fetchLimit = 1000
+
+	// nodeID is the id of the only broker of the cluster
+	nodeID    = 0
+	clusterID = "vortexq"
+
+	// listOffsetsLatest and listOffsetsEarliest are the special timestamps of ListOffsets
+	listOffsetsLatest   = -1
+	listOffsetsEarliest = -2
+)
+
+// supported holds the version ranges of the handled requests.
+var supported = map[int16][2]int16{
+	(&kmsg.ProduceRequest{}).Key():         {3, 9},
+	(&kmsg.FetchRequest{}).Key():           {4, 12},
+	(&kmsg.ListOffsetsRequest{}).Key():     {1, 7},
+	(&kmsg.MetadataRequest{}).Key():        {0, 12},
+	(&kmsg.OffsetCommitRequest{}).Key():    {0, 8},
+	(&kmsg.OffsetFetchRequest{}).Key():     {0, 7},
+	(&kmsg.FindCoordinatorRequest{}).Key(): {0, 4},
+	(&kmsg.JoinGroupRequest{}).Key():       {0, 9},
+	(&kmsg.HeartbeatRequest{}).Key():       {0, 4},
+	(&kmsg.LeaveGroupRequest{}).Key():      {0, 5},
+	(&kmsg.SyncGroupRequest{}).Key():       {0, 5},
+	(&kmsg.ApiVersionsRequest{}).Key():     {0, 3},
+	(&kmsg.InitProducerIDRequest{}).Key():  {0, 4},
+}
+
+var errUnsupported = errors.New("unsupported request")
+
+// conn is a client connection, its requests are answered in order.
+type conn struct {
+	app *App
+	nc  net.Conn
+	log *slog.Logger
+	// host and port are where the client reached the broker, they are advertised in metadata
+	host string
+	port int32
+}
+
+// header is the header of a request.
+type header struct {
+	key           int16
+	version       int16
+	correlationID int32
+	clientID      string
+}
+
+func (a *App) handle(nc net.Conn) {
+	const op = "kafka_app.App.handle"
+
+	c := &conn{
+		app: a,
+		nc:  nc,
+		log: a.log.With(slog.String("remote", nc.RemoteAddr().String())),
+	}
+	defer nc.Close()
+
+	host, port, _ := net.SplitHostPort(nc.LocalAddr().String())
+	p, _ := strconv.Atoi(port)
+	c.host, c.port = host, int32(p)
+
+	if err := c.serve(); err != nil && !errors.Is(err, io.EOF) && a.server.Context().Err() == nil {
+		c.log.With(slog.String("op", op)).Warn("kafka connection closed", logging.Err(err))
+	}
+}
+
+// serve reads requests until the connection ends, unknown requests close it.
+func (c *conn) serve() error {
+	r := bufio.NewReaderSize(c.nc, 64<<10)
+	w := bufio.NewWriterSize(c.nc, 64<<10)
+	var size [4]byte
+	for {
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return err
+		}
+		n := int32(binary.BigEndian.Uint32(size[:]))
+		if n < 8 || n > _maxRequestSize {
+			return fmt.Errorf("request size %d", n)
+		}
+		body := make([]byte, n)
+		if _, err := io.ReadFull(r, body); err != nil {
+			return err
+		}
+
+		h, req, err := readRequest(body)
+		var resp kmsg.Response
+		switch {
+		case errors.Is(err, errUnsupported) && h.key == (&kmsg.ApiVersionsRequest{}).Key():
+			// clients retry ApiVersions with the version from this answer
+			v := kmsg.NewPtrApiVersionsResponse()
+			v.ErrorCode = kerr.UnsupportedVersion.Code
+			v.ApiKeys = apiKeys()
+			resp = v
+		case err != nil:
+			return err
+		default:
+			resp = c.dispatch(h, req)
+		}
+		if resp == nil {
+			continue
+		}
+		if err := c.write(w, h, resp); err != nil {
+			return err
+		}
+	}
+}
+
+// readRequest parses the header and body of a request.
+func readRequest(b []byte) (header, kmsg.Request, error) {
+	rd := kbin.Reader{Src: b}
+	h := header{key: rd.Int16(), version: rd.Int16(), correlationID: rd.Int32()}
+	if id := rd.NullableString(); id != nil {
+		h.clientID = *id
+	}
+	versions, ok := supported[h.key]
+	if !ok || h.version < versions[0] || h.version > versions[1] {
+		return h, nil, fmt.Errorf("%w: %s v%d", errUnsupported, kmsg.NameForKey(h.key), h.version)
+	}
+	req := kmsg.RequestForKey(h.key)
+	req.SetVersion(h.version)
+	if req.IsFlexible() {
+		for n := rd.Uvarint(); n > 0; n-- {
+			rd.Uvarint()
+			rd.Span(int(rd.Uvarint()))
+		}
+	}
+	if !rd.Ok() {
+		return h, nil, fmt.Errorf("truncated %s header", kmsg.NameForKey(h.key))
+	}
+	if err := req.ReadFrom(rd.Src); err != nil {
+		return h, nil, fmt.Errorf("%s: %w", kmsg.NameForKey(h.key), err)
+	}
+	return h, req, nil
+}
+
+// write sends a response, ApiVersions responses always have the v0 header.
+func (c *conn) write(w *bufio.Writer, h header, resp kmsg.Response) error {
+	resp.SetVersion(h.version)
+	buf := make([]byte, 8, 256)
+	binary.BigEndian.PutUint32(buf[4:], uint32(h.correlationID))
+	if resp.IsFlexible() && resp.Key() != (&kmsg.ApiVersionsResponse{}).Key() {
+		buf = append(buf, 0)
+	}
+	buf = resp.AppendTo(buf)
+	binary.BigEndian.PutUint32(buf, uint32(len(buf)-4))
+
+	_ = c.nc.SetWriteDeadline(time.Now().Add(_writeWait))
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func (c *conn) dispatch(h header, req kmsg.Request) kmsg.Response {
+	switch req := req.(type) {
+	case *kmsg.ApiVersionsRequest:
+		resp := req.ResponseKind().(*kmsg.ApiVersionsResponse)
+		resp.ApiKeys = apiKeys()
+		return resp
+	case *kmsg.MetadataRequest:
+		return c.metadata(req)
+	case *kmsg.ProduceRequest:
+		return c.produce(req)
+	case *kmsg.FetchRequest:
+		return c.fetch(req)
+	case *kmsg.ListOffsetsRequest:
+		return c.listOffsets(req)
+	case *kmsg.InitProducerIDRequest:
+		resp := req.ResponseKind().(*kmsg.InitProducerIDResponse)
+		resp.ProducerID = c.app.producerIDs.Add(1)
+		return resp
+	case *kmsg.FindCoordinatorRequest:
+		return c.findCoordinator(req)
+	case *kmsg.JoinGroupRequest:
+		return c.app.groups.join(c.app.server.Context(), h.clientID, req)
+	case *kmsg.SyncGroupRequest:
+		return c.app.groups.sync(c.app.server.Context(), req)
+	case *kmsg.HeartbeatRequest:
+		return c.app.groups.heartbeat(req)
+	case *kmsg.LeaveGroupRequest:
+		return c.app.groups.leave(req)
+	case *kmsg.OffsetCommitRequest:
+		return c.app.groups.commit(req)
+	case *kmsg.OffsetFetchRequest:
+		return c.app.groups.fetchOffsets(req)
+	}
+	return nil
+}
+
+func apiKeys() []kmsg.ApiVersionsResponseApiKey {
+	keys := make([]kmsg.ApiVersionsResponseApiKey, 0, len(supported))
+	for key, versions := range supported {
+		keys = append(keys, kmsg.ApiVersionsResponseApiKey{ApiKey: key, MinVersion: versions[0], MaxVersion: versions[1]})
+	}
+	return keys
+}
+
+// validTopic tells whether name can be a Kafka topic, patterns can't.
+func validTopic(name string) bool {
+	return broker.ValidateTopicName(name) == nil
+}
+
+// metadata describes the broker itself and the topics with their only partition,
+// topics that don't exist yet are reported as empty.
+func (c *conn) metadata(req *kmsg.MetadataRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.MetadataResponse)
+	resp.Brokers = []kmsg.MetadataResponseBroker{{NodeID: nodeID, Host: c.host, Port: c.port}}
+	resp.ClusterID = kmsg.StringPtr(clusterID)
+	resp.ControllerID = nodeID
+
+	var names []string
+	if req.Topics == nil {
+		for _, t := range c.app.funcs.ListTopics() {
+			names = append(names, t.Name)
+		}
+	}
+	for _, t := range req.Topics {
+		if t.Topic != nil {
+			names = append(names, *t.Topic)
+		}
+	}
+	for _, name := range names {
+		t := kmsg.NewMetadataResponseTopic()
+		t.Topic = kmsg.StringPtr(name)
+		if !validTopic(name) {
+			t.ErrorCode = kerr.InvalidTopicException.Code
+			resp.Topics = append(resp.Topics, t)
+			continue
+		}
+		p := kmsg.NewMetadataResponseTopicPartition()
+		p.Leader = nodeID
+		p.Replicas = []int32{nodeID}
+		p.ISR = []int32{nodeID}
+		t.Partitions = []kmsg.MetadataResponseTopicPartition{p}
+		resp.Topics = append(resp.Topics, t)
+	}
+	return resp
+}
+
+func (c *conn) produce(req *kmsg.ProduceRequest) kmsg.Response {
+	const op = "kafka_app.conn.produce"
+
+	resp := req.ResponseKind().(*kmsg.ProduceResponse)
+	for _, t := range req.Topics {
+		rt := kmsg.NewProduceResponseTopic()
+		rt.Topic = t.Topic
+		for _, p := range t.Partitions {
+			rp := kmsg.NewProduceResponseTopicPartition()
+			rp.Partition = p.Partition
+			rp.ErrorCode = c.append(t.Topic, p, &rp)
+			if rp.ErrorCode != 0 {
+				c.log.With(slog.String("op", op)).
+					Warn("produce refused", slog.String("topic", t.Topic), slog.String("error", kerr.ErrorForCode(rp.ErrorCode).Error()))
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		resp.Topics = append(resp.Topics, rt)
+	}
+	if req.Acks == 0 {
+		return nil
+	}
+	return resp
+}
+
+// append publishes the records of a partition and returns the error code of it.
+func (c *conn) append(topic string, p kmsg.ProduceRequestTopicPartition, rp *kmsg.ProduceResponseTopicPartition) int16 {
+	switch {
+	case !validTopic(topic):
+		return kerr.InvalidTopicException.Code
+	case p.Partition != 0:
+		return kerr.UnknownTopicOrPartition.Code
+	}
+	records, err := readBatches(p.Records)
+	switch {
+	case errors.Is(err, errUnsupportedCompress):
+		return kerr.UnsupportedCompressionType.Code
+	case err != nil:
+		return kerr.CorruptMessage.Code
+	}
+	msgs := make([]broker.Message[any], 0, len(records))
+	for _, r := range records {
+		msg, err := r.toMessage(topic)
+		if err != nil {
+			return kerr.InvalidRecord.Code
+		}
+		msgs = append(msgs, msg)
+	}
+	rp.BaseOffset = -1
+	for i, msg := range msgs {
+		offset, err := c.app.funcs.Publish(msg)
+		if err != nil {
+			return kerr.InvalidTopicException.Code
+		}
+		if i == 0 {
+			rp.BaseOffset = offset
+		}
+	}
+	rp.LogAppendTime = -1
+	rp.LogStartOffset = c.earliest(topic)
+	return 0
+}
+
+// earliest is the first offset of a topic, 0 for topics that don't exist yet.
+func (c *conn) earliest(topic string) int64 {
+	offset, _ := c.app.funcs.TopicOffset(topic, broker.StartPosition{From: broker.StartEarliest})
+	return offset
+}
+
+// fetch reads the topics from the requested offsets, it waits up to
+// MaxWaitMillis for messages when there are none.
+func (c *conn) fetch(req *kmsg.FetchRequest) kmsg.Response {
+	deadline := time.Now().Add(time.Duration(req.MaxWaitMillis) * time.Millisecond)
+	for {
+		resp, n := c.read(req)
+		if n > 0 || req.MinBytes <= 0 || !time.Now().Before(deadline) {
+			return resp
+		}
+		select {
+		case <-time.After(_fetchPoll):
+		case <-c.app.server.Context().Done():
+			return resp
+		}
+	}
+}
+
+// read builds the fetch response and returns the number of messages in it.
+func (c *conn) read(req *kmsg.FetchRequest) (*kmsg.FetchResponse, int) {
+	const op = "kafka_app.conn.read"
+
+	resp := req.ResponseKind().(*kmsg.FetchResponse)
+	var count int
+	budget := int(req.MaxBytes)
+	for _, t := range req.Topics {
+		rt := kmsg.NewFetchResponseTopic()
+		rt.Topic = t.Topic
+		for _, p := range t.Partitions {
+			rp := kmsg.NewFetchResponseTopicPartition()
+			rp.Partition = p.Partition
+			first, next, ok := c.bounds(t.Topic)
+			rp.HighWatermark, rp.LastStableOffset, rp.LogStartOffset = next, next, first
+			switch {
+			case !validTopic(t.Topic):
+				rp.ErrorCode = kerr.InvalidTopicException.Code
+			case p.Partition != 0:
+				rp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+			case p.FetchOffset < first || p.FetchOffset > next:
+				rp.ErrorCode = kerr.OffsetOutOfRange.Code
+			case ok && p.FetchOffset < next && budget > 0:
+				msgs, _, err := c.app.funcs.ReadTopic(t.Topic, p.FetchOffset, _fetchLimit)
+				if err == nil {
+					msgs = fit(msgs, min(budget, int(p.PartitionMaxBytes)))
+					rp.RecordBatches, err = appendBatch(nil, msgs)
+				}
+				if err != nil {
+					c.log.With(slog.String("op", op)).
+						Error("failed to read topic", slog.String("topic", t.Topic), logging.Err(err))
+					rp.ErrorCode = kerr.UnknownServerError.Code
+					break
+				}
+				budget -= len(rp.RecordBatches)
+				count += len(msgs)
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		resp.Topics = append(resp.Topics, rt)
+	}
+	return resp, count
+}
+
+// bounds returns the first and next offset of a topic, it reports false when
+// the topic doesn't exist.
+func (c *conn) bounds(topic string) (int64, int64, bool) {
+	first, err := c.app.funcs.TopicOffset(topic, broker.StartPosition{From: broker.StartEarliest})
+	if err != nil {
+		return 0, 0, false
+	}
+	next, _ := c.app.funcs.TopicOffset(topic, broker.StartPosition{From: broker.StartLatest})
+	return first, next, true
+}
+
+// fit trims msgs to roughly maxBytes of payload, keeping at least one message
+// so that consumers always make progress.
+func fit(msgs []broker.Message[any], maxBytes int) []broker.Message[any] {
+	size := 0
+	for i, msg := range msgs {
+		raw, _, _ := msg.Payload()
+		size += len(raw) + 64
+		if i > 0 && size > maxBytes {
+			return msgs[:i]
+		}
+	}
+	return msgs
+}
+
+func (c *conn) listOffsets(req *kmsg.ListOffsetsRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.ListOffsetsResponse)
+	for _, t := range req.Topics {
+		rt := kmsg.NewListOffsetsResponseTopic()
+		rt.Topic = t.Topic
+		for _, p := range t.Partitions {
+			rp := kmsg.NewListOffsetsResponseTopicPartition()
+			rp.Partition = p.Partition
+			rp.Timestamp = -1
+			position := broker.StartPosition{From: broker.StartTimestamp, Time: time.UnixMilli(p.Timestamp)}
+			switch p.Timestamp {
+			case listOffsetsLatest:
+				position = broker.StartPosition{From: broker.StartLatest}
+			case listOffsetsEarliest:
+				position = broker.StartPosition{From: broker.StartEarliest}
+			}
+			switch {
+			case !validTopic(t.Topic):
+				rp.ErrorCode = kerr.InvalidTopicException.Code
+			case p.Partition != 0:
+				rp.ErrorCode = kerr.UnknownTopicOrPartition.Code
+			default:
+				// topics that don't exist yet are empty
+				rp.Offset, _ = c.app.funcs.TopicOffset(t.Topic, position)
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		resp.Topics = append(resp.Topics, rt)
+	}
+	return resp
+}
+
+// findCoordinator answers that the broker coordinates every group.
+func (c *conn) findCoordinator(req *kmsg.FindCoordinatorRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.FindCoordinatorResponse)
+	resp.NodeID, resp.Host, resp.Port = nodeID, c.host, c.port
+	for _, key := range req.CoordinatorKeys {
+		resp.Coordinators = append(resp.Coordinators, kmsg.FindCoordinatorResponseCoordinator{
+			Key: key, NodeID: nodeID, Host: c.host, Port: c.port,
+		})
+	}
+	return resp
+}
+
+// groupContext bounds how long a group request may wait for the rest of the group.
+func groupContext(ctx context.Context, timeoutMillis int32) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, time.Duration(timeoutMillis)*time.Millisecond)
+}
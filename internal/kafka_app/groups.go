@@ -0,0 +1,485 @@
+package kafka_app
+
+import (
+	"context"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kmsg"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+)
+
+// _sessionCheck is how often members that stopped heartbeating are looked for
+const _sessionCheck = time.Second
+
+// groupState is where a group is in its rebalance.
+type groupState int
+
+const (
+	// groupEmpty groups have no members, only committed offsets
+	groupEmpty groupState = iota
+	// groupJoining groups wait for their members to join again
+	groupJoining
+	// groupSyncing groups wait for the assignment of the leader
+	groupSyncing
+	// groupStable groups have an assignment for every member
+	groupStable
+)
+
+// coordinator keeps the consumer groups in memory, they are lost on restart.
+type coordinator struct {
+	mu     sync.Mutex
+	groups map[string]*group
+}
+
+type group struct {
+	// mu is the lock of the coordinator, it guards the group
+	mu *sync.Mutex
+
+	state        groupState
+	generation   int32
+	protocolType string
+	protocol     string
+	leader       string
+	members      map[string]*member
+	// pending holds the member ids handed out with MEMBER_ID_REQUIRED
+	pending map[string]struct{}
+	// rebalance is the rebalance waiting for joins, nil unless joining
+	rebalance *rebalance
+	// synced is closed once the assignment is known or a new rebalance started
+	synced  chan struct{}
+	offsets map[string]map[int32]committed
+}
+
+type member struct {
+	id               string
+	protocols        []kmsg.JoinGroupRequestProtocol
+	sessionTimeout   time.Duration
+	rebalanceTimeout time.Duration
+	lastSeen         time.Time
+	// joined tells the member joined the current rebalance
+	joined     bool
+	assignment []byte
+}
+
+// rebalance is the outcome of a join phase, its fields are set before done is closed.
+type rebalance struct {
+	done       chan struct{}
+	generation int32
+	protocol   string
+	leader     string
+	members    []kmsg.JoinGroupResponseMember
+}
+
+type committed struct {
+	offset   int64
+	metadata *string
+}
+
+// newCoordinator creates the coordinator, it expires members until ctx is done.
+func newCoordinator(ctx context.Context) *coordinator {
+	c := &coordinator{groups: make(map[string]*group)}
+	go c.expire(ctx)
+	return c
+}
+
+func (c *coordinator) group(name string) *group {
+	g, ok := c.groups[name]
+	if !ok {
+		g = &group{
+			mu:      &c.mu,
+			members: make(map[string]*member),
+			pending: make(map[string]struct{}),
+			offsets: make(map[string]map[int32]committed),
+		}
+		c.groups[name] = g
+	}
+	return g
+}
+
+func (c *coordinator) join(ctx context.Context, clientID string, req *kmsg.JoinGroupRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.JoinGroupResponse)
+	fail := func(err *kerr.Error) kmsg.Response {
+		resp.ErrorCode = err.Code
+		resp.Generation = -1
+		return resp
+	}
+	if req.Group == "" {
+		return fail(kerr.InvalidGroupID)
+	}
+	if req.SessionTimeoutMillis <= 0 || len(req.Protocols) == 0 {
+		return fail(kerr.InvalidSessionTimeout)
+	}
+
+	c.mu.Lock()
+	g := c.group(req.Group)
+	if len(g.members) > 0 && (g.protocolType != req.ProtocolType || g.commonProtocol(req.Protocols) == "") {
+		c.mu.Unlock()
+		return fail(kerr.InconsistentGroupProtocol)
+	}
+	id := req.MemberID
+	if id == "" {
+		id = clientID + "-" + broker.NewID()
+		if req.Version >= 4 {
+			g.pending[id] = struct{}{}
+			c.mu.Unlock()
+			resp.MemberID = id
+			return fail(kerr.MemberIDRequired)
+		}
+	} else if _, ok := g.pending[id]; !ok && g.members[id] == nil {
+		c.mu.Unlock()
+		return fail(kerr.UnknownMemberID)
+	}
+	delete(g.pending, id)
+
+	m := g.members[id]
+	if m == nil {
+		m = &member{id: id}
+		g.members[id] = m
+	}
+	m.protocols = req.Protocols
+	m.sessionTimeout = time.Duration(req.SessionTimeoutMillis) * time.Millisecond
+	m.rebalanceTimeout = m.sessionTimeout
+	if req.Version >= 1 {
+		m.rebalanceTimeout = time.Duration(req.RebalanceTimeoutMillis) * time.Millisecond
+	}
+	m.lastSeen = time.Now()
+	m.joined = true
+	g.protocolType = req.ProtocolType
+	if g.state != groupJoining {
+		g.startRebalance()
+	}
+	r := g.rebalance
+	g.completeJoin(false)
+	c.mu.Unlock()
+
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		return fail(kerr.RebalanceInProgress)
+	}
+	i := slices.IndexFunc(r.members, func(jm kmsg.JoinGroupResponseMember) bool { return jm.MemberID == id })
+	if i < 0 {
+		return fail(kerr.UnknownMemberID)
+	}
+	resp.Generation = r.generation
+	resp.ProtocolType = kmsg.StringPtr(req.ProtocolType)
+	resp.Protocol = kmsg.StringPtr(r.protocol)
+	resp.LeaderID = r.leader
+	resp.MemberID = id
+	if id == r.leader {
+		resp.Members = r.members
+	}
+	return resp
+}
+
+// startRebalance makes the members join again, the ones that don't within
+// the longest rebalance timeout are dropped.
+func (g *group) startRebalance() {
+	if g.state == groupSyncing {
+		close(g.synced)
+	}
+	g.state = groupJoining
+	r := &rebalance{done: make(chan struct{})}
+	g.rebalance = r
+
+	var timeout time.Duration
+	for _, m := range g.members {
+		timeout = max(timeout, m.rebalanceTimeout)
+	}
+	time.AfterFunc(timeout, func() {
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.rebalance == r {
+			g.completeJoin(true)
+		}
+	})
+}
+
+// completeJoin ends the join phase once every member joined, or when force is set.
+func (g *group) completeJoin(force bool) {
+	if g.state != groupJoining {
+		return
+	}
+	for id, m := range g.members {
+		if !m.joined && !force {
+			return
+		}
+		if !m.joined {
+			delete(g.members, id)
+		}
+	}
+
+	r := g.rebalance
+	g.rebalance = nil
+	g.generation++
+	if len(g.members) == 0 {
+		g.state = groupEmpty
+		r.generation = g.generation
+		close(r.done)
+		return
+	}
+	if g.members[g.leader] == nil {
+		g.leader = slices.Min(slices.Collect(maps.Keys(g.members)))
+	}
+	g.protocol = g.commonProtocol(g.members[g.leader].protocols)
+	g.state = groupSyncing
+	g.synced = make(chan struct{})
+
+	r.generation, r.protocol, r.leader = g.generation, g.protocol, g.leader
+	for _, id := range slices.Sorted(maps.Keys(g.members)) {
+		m := g.members[id]
+		m.joined = false
+		m.assignment = nil
+		r.members = append(r.members, kmsg.JoinGroupResponseMember{MemberID: id, ProtocolMetadata: m.metadata(g.protocol)})
+	}
+	close(r.done)
+}
+
+// commonProtocol is the first of protocols every member supports.
+func (g *group) commonProtocol(protocols []kmsg.JoinGroupRequestProtocol) string {
+	for _, p := range protocols {
+		supported := true
+		for _, m := range g.members {
+			supported = supported && m.metadata(p.Name) != nil
+		}
+		if supported {
+			return p.Name
+		}
+	}
+	return ""
+}
+
+func (m *member) metadata(protocol string) []byte {
+	for _, p := range m.protocols {
+		if p.Name == protocol {
+			if p.Metadata == nil {
+				return []byte{}
+			}
+			return p.Metadata
+		}
+	}
+	return nil
+}
+
+// remove drops a member, the rest of the group rebalances.
+func (g *group) remove(id string) {
+	if g.members[id] == nil {
+		return
+	}
+	delete(g.members, id)
+	switch g.state {
+	case groupJoining:
+		g.completeJoin(false)
+	case groupSyncing, groupStable:
+		if len(g.members) == 0 {
+			if g.state == groupSyncing {
+				close(g.synced)
+			}
+			g.state = groupEmpty
+			g.generation++
+			return
+		}
+		g.startRebalance()
+	}
+}
+
+// check validates the member and generation of a request to a group.
+func (g *group) check(memberID string, generation int32) *kerr.Error {
+	switch {
+	case g == nil || g.members[memberID] == nil:
+		return kerr.UnknownMemberID
+	case g.state == groupJoining:
+		return kerr.RebalanceInProgress
+	case generation != g.generation:
+		return kerr.IllegalGeneration
+	}
+	return nil
+}
+
+func (c *coordinator) sync(ctx context.Context, req *kmsg.SyncGroupRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.SyncGroupResponse)
+	c.mu.Lock()
+	g := c.groups[req.Group]
+	if err := g.check(req.MemberID, req.Generation); err != nil {
+		c.mu.Unlock()
+		resp.ErrorCode = err.Code
+		return resp
+	}
+	m := g.members[req.MemberID]
+	m.lastSeen = time.Now()
+	if g.state == groupSyncing && req.MemberID == g.leader {
+		for _, a := range req.GroupAssignment {
+			if am := g.members[a.MemberID]; am != nil {
+				am.assignment = a.MemberAssignment
+			}
+		}
+		g.state = groupStable
+		close(g.synced)
+	}
+	synced, timeout := g.synced, m.rebalanceTimeout
+	c.mu.Unlock()
+
+	ctx, cancel := groupContext(ctx, int32(timeout.Milliseconds()))
+	defer cancel()
+	select {
+	case <-synced:
+	case <-ctx.Done():
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := g.check(req.MemberID, req.Generation); err != nil {
+		resp.ErrorCode = err.Code
+		return resp
+	}
+	if g.state != groupStable {
+		resp.ErrorCode = kerr.RebalanceInProgress.Code
+		return resp
+	}
+	resp.ProtocolType = kmsg.StringPtr(g.protocolType)
+	resp.Protocol = kmsg.StringPtr(g.protocol)
+	resp.MemberAssignment = g.members[req.MemberID].assignment
+	if resp.MemberAssignment == nil {
+		resp.MemberAssignment = []byte{}
+	}
+	return resp
+}
+
+func (c *coordinator) heartbeat(req *kmsg.HeartbeatRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.HeartbeatResponse)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g := c.groups[req.Group]
+	if g != nil && g.members[req.MemberID] != nil {
+		g.members[req.MemberID].lastSeen = time.Now()
+	}
+	if err := g.check(req.MemberID, req.Generation); err != nil {
+		resp.ErrorCode = err.Code
+	}
+	return resp
+}
+
+func (c *coordinator) leave(req *kmsg.LeaveGroupRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.LeaveGroupResponse)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g := c.groups[req.Group]
+
+	ids := []string{req.MemberID}
+	if req.Version >= 3 {
+		ids = ids[:0]
+		for _, m := range req.Members {
+			ids = append(ids, m.MemberID)
+		}
+	}
+	for _, id := range ids {
+		rm := kmsg.NewLeaveGroupResponseMember()
+		rm.MemberID = id
+		if g == nil || g.members[id] == nil {
+			rm.ErrorCode = kerr.UnknownMemberID.Code
+		} else {
+			g.remove(id)
+		}
+		resp.Members = append(resp.Members, rm)
+	}
+	if req.Version < 3 {
+		resp.ErrorCode, resp.Members = resp.Members[0].ErrorCode, nil
+	}
+	return resp
+}
+
+// commit stores offsets, generation -1 commits without being a member.
+func (c *coordinator) commit(req *kmsg.OffsetCommitRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.OffsetCommitResponse)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var err *kerr.Error
+	if req.Group == "" {
+		err = kerr.InvalidGroupID
+	}
+	g := c.groups[req.Group]
+	if err == nil && req.Version >= 1 && req.Generation >= 0 {
+		err = g.check(req.MemberID, req.Generation)
+	}
+	if err == nil {
+		g = c.group(req.Group)
+	}
+	for _, t := range req.Topics {
+		rt := kmsg.NewOffsetCommitResponseTopic()
+		rt.Topic = t.Topic
+		for _, p := range t.Partitions {
+			rp := kmsg.NewOffsetCommitResponseTopicPartition()
+			rp.Partition = p.Partition
+			if err != nil {
+				rp.ErrorCode = err.Code
+			} else {
+				if g.offsets[t.Topic] == nil {
+					g.offsets[t.Topic] = make(map[int32]committed)
+				}
+				g.offsets[t.Topic][p.Partition] = committed{offset: p.Offset, metadata: p.Metadata}
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		resp.Topics = append(resp.Topics, rt)
+	}
+	return resp
+}
+
+// fetchOffsets returns the committed offsets, -1 for partitions without one.
+func (c *coordinator) fetchOffsets(req *kmsg.OffsetFetchRequest) kmsg.Response {
+	resp := req.ResponseKind().(*kmsg.OffsetFetchResponse)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	g := c.groups[req.Group]
+
+	topics := req.Topics
+	if topics == nil && g != nil {
+		for _, topic := range slices.Sorted(maps.Keys(g.offsets)) {
+			topics = append(topics, kmsg.OffsetFetchRequestTopic{Topic: topic, Partitions: slices.Sorted(maps.Keys(g.offsets[topic]))})
+		}
+	}
+	for _, t := range topics {
+		rt := kmsg.NewOffsetFetchResponseTopic()
+		rt.Topic = t.Topic
+		for _, p := range t.Partitions {
+			rp := kmsg.NewOffsetFetchResponseTopicPartition()
+			rp.Partition = p
+			rp.Offset = -1
+			if g != nil {
+				if o, ok := g.offsets[t.Topic][p]; ok {
+					rp.Offset, rp.Metadata = o.offset, o.metadata
+				}
+			}
+			rt.Partitions = append(rt.Partitions, rp)
+		}
+		resp.Topics = append(resp.Topics, rt)
+	}
+	return resp
+}
+
+// expire drops the members whose session timed out.
+func (c *coordinator) expire(ctx context.Context) {
+	ticker := time.NewTicker(_sessionCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			c.mu.Lock()
+			for _, g := range c.groups {
+				for id, m := range g.members {
+					// members waiting for the join phase aren't expected to heartbeat
+					if !(g.state == groupJoining && m.joined) && now.Sub(m.lastSeen) > m.sessionTimeout {
+						g.remove(id)
+					}
+				}
+			}
+			c.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package kafka_app
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"hash/crc32"
+	"io"
+	"maps"
+	"slices"
+	"time"
+)
+
+const (
+	// keyHeader keeps the key of a produced record in the message headers
+	keyHeader = "kafka-key"
+	// contentTypeHeader carries the content type of a message as a record header
+	contentTypeHeader = "content-type"
+
+	// batchHeaderSize is everything of a record batch before its records
+	batchHeaderSize = 61
+	magicV2         = 2
+
+	compressionMask = 0x07
+	compressionNone = 0
+	compressionGzip = 1
+)
+
+var (
+	errCorruptBatch        = errors.New("corrupt record batch")
+	errUnsupportedCompress = errors.New("unsupported compression")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// record is a record of a batch with its absolute timestamp.
+type record struct {
+	key       []byte
+	value     []byte
+	headers   [][2]string
+	timestamp time.Time
+}
+
+// readBatches decodes the record batches of a produce request, only magic v2
+// batches without compression or with gzip are accepted.
+func readBatches(b []byte) ([]record, error) {
+	var records []record
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, fmt.Errorf("%w: truncated batch", errCorruptBatch)
+		}
+		size := int(binary.BigEndian.Uint32(b[8:12])) + 12
+		if size < batchHeaderSize || size > len(b) {
+			return nil, fmt.Errorf("%w: batch length %d", errCorruptBatch, size)
+		}
+		batch := b[:size]
+		b = b[size:]
+		if batch[16] != magicV2 {
+			return nil, fmt.Errorf("%w: magic %d", errCorruptBatch, batch[16])
+		}
+		if crc32.Checksum(batch[21:], castagnoli) != binary.BigEndian.Uint32(batch[17:21]) {
+			return nil, fmt.Errorf("%w: crc mismatch", errCorruptBatch)
+		}
+		attributes := binary.BigEndian.Uint16(batch[21:23])
+		firstTimestamp := int64(binary.BigEndian.Uint64(batch[27:35]))
+		count := int(int32(binary.BigEndian.Uint32(batch[57:61])))
+		raw := batch[batchHeaderSize:]
+		switch attributes & compressionMask {
+		case compressionNone:
+		case compressionGzip:
+			zr, err := gzip.NewReader(bytes.NewReader(raw))
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errCorruptBatch, err)
+			}
+			if raw, err = io.ReadAll(zr); err != nil {
+				return nil, fmt.Errorf("%w: %v", errCorruptBatch, err)
+			}
+		default:
+			return nil, fmt.Errorf("%w: codec %d", errUnsupportedCompress, attributes&compressionMask)
+		}
+		for range count {
+			r, rest, err := readRecord(raw, firstTimestamp)
+			if err != nil {
+				return nil, err
+			}
+			records = append(records, r)
+			raw = rest
+		}
+	}
+	return records, nil
+}
+
+func readRecord(b []byte, firstTimestamp int64) (record, []byte, error) {
+	d := varintReader{b: b}
+	length := int(d.varint())
+	if d.err != nil || length > len(d.b) {
+		return record{}, nil, fmt.Errorf("%w: record length", errCorruptBatch)
+	}
+	rest := d.b[length:]
+	d.b = d.b[:length]
+	d.take(1) // attributes
+	timestampDelta := d.varint()
+	d.varint() // offset delta
+	r := record{key: d.bytes(), value: d.bytes(), timestamp: time.UnixMilli(firstTimestamp + timestampDelta).UTC()}
+	for n := d.varint(); n > 0 && d.err == nil; n-- {
+		r.headers = append(r.headers, [2]string{string(d.bytes()), string(d.bytes())})
+	}
+	if d.err != nil {
+		return record{}, nil, d.err
+	}
+	return r, rest, nil
+}
+
+// toMessage turns a produced record into a message of topic.
+func (r record) toMessage(topic string) (broker.Message[any], error) {
+	msg := broker.Message[any]{ID: broker.NewID(), Pattern: topic, Time: r.timestamp}
+	for _, h := range r.headers {
+		if h[0] == contentTypeHeader {
+			msg.ContentType = h[1]
+			continue
+		}
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers[h[0]] = h[1]
+	}
+	if r.key != nil {
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers[keyHeader] = string(r.key)
+	}
+	return msg, msg.SetPayload(r.value)
+}
+
+// appendBatch encodes messages of consecutive offsets as one uncompressed batch.
+func appendBatch(dst []byte, msgs []broker.Message[any]) ([]byte, error) {
+	if len(msgs) == 0 {
+		return dst, nil
+	}
+	base := msgs[0].Offset
+	firstTimestamp, maxTimestamp := timestamp(msgs[0]), int64(-1)
+	for _, msg := range msgs {
+		maxTimestamp = max(maxTimestamp, timestamp(msg))
+	}
+
+	start := len(dst)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(base))
+	dst = binary.BigEndian.AppendUint32(dst, 0) // length, set below
+	dst = binary.BigEndian.AppendUint32(dst, 0) // partition leader epoch
+	dst = append(dst, magicV2)
+	dst = binary.BigEndian.AppendUint32(dst, 0) // crc, set below
+	dst = binary.BigEndian.AppendUint16(dst, 0) // attributes
+	dst = binary.BigEndian.AppendUint32(dst, uint32(msgs[len(msgs)-1].Offset-base))
+	dst = binary.BigEndian.AppendUint64(dst, uint64(firstTimestamp))
+	dst = binary.BigEndian.AppendUint64(dst, uint64(maxTimestamp))
+	dst = binary.BigEndian.AppendUint64(dst, ^uint64(0)) // producer id -1
+	dst = binary.BigEndian.AppendUint16(dst, ^uint16(0)) // producer epoch -1
+	dst = binary.BigEndian.AppendUint32(dst, ^uint32(0)) // base sequence -1
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(msgs)))
+
+	var body []byte
+	for _, msg := range msgs {
+		value, contentType, err := msg.Payload()
+		if err != nil {
+			return dst[:start], err
+		}
+		body = body[:0]
+		body = append(body, 0) // attributes
+		body = binary.AppendVarint(body, timestamp(msg)-firstTimestamp)
+		body = binary.AppendVarint(body, msg.Offset-base)
+		if key, ok := msg.Headers[keyHeader]; ok {
+			body = appendVarintBytes(body, []byte(key))
+		} else {
+			body = binary.AppendVarint(body, -1)
+		}
+		body = appendVarintBytes(body, value)
+
+		headers := maps.Clone(msg.Headers)
+		delete(headers, keyHeader)
+		if contentType != "" {
+			if headers == nil {
+				headers = make(map[string]string)
+			}
+			headers[contentTypeHeader] = contentType
+		}
+		body = binary.AppendVarint(body, int64(len(headers)))
+		for _, k := range slices.Sorted(maps.Keys(headers)) {
+			body = appendVarintBytes(body, []byte(k))
+			body = appendVarintBytes(body, []byte(headers[k]))
+		}
+		dst = binary.AppendVarint(dst, int64(len(body)))
+		dst = append(dst, body...)
+	}
+
+	binary.BigEndian.PutUint32(dst[start+8:], uint32(len(dst)-start-12))
+	binary.BigEndian.PutUint32(dst[start+17:], crc32.Checksum(dst[start+21:], castagnoli))
+	return dst, nil
+}
+
+// timestamp is the time of a message in milliseconds, -1 when it has none.
+func timestamp(msg broker.Message[any]) int64 {
+	if msg.Time.IsZero() {
+		return -1
+	}
+	return msg.Time.UnixMilli()
+}
+
+func appendVarintBytes(dst, b []byte) []byte {
+	dst = binary.AppendVarint(dst, int64(len(b)))
+	return append(dst, b...)
+}
+
+// varintReader reads the zig-zag varints of records, the first error sticks.
+type varintReader struct {
+	b   []byte
+	err error
+}
+
+func (r *varintReader) varint() int64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(r.b)
+	if n <= 0 {
+		r.err = fmt.Errorf("%w: invalid varint", errCorruptBatch)
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *varintReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.b) {
+		r.err = fmt.Errorf("%w: truncated record", errCorruptBatch)
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+// bytes reads a length-prefixed field, nil when its length is -1.
+func (r *varintReader) bytes() []byte {
+	n := r.varint()
+	if n < 0 {
+		return nil
+	}
+	if b := r.take(int(n)); b != nil {
+		return bytes.Clone(b)
+	}
+	return nil
+}
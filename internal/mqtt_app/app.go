@@ -0,0 +1,91 @@
+package mqtt_app
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver"
+	"log/slog"
+	"net/http"
+	"sync"
+)
+
+// Protocol marks the subscriptions consumed over MQTT.
+const Protocol = "mqtt"
+
+type App struct {
+	log    *slog.Logger
+	funcs  broker.VortexQFuncs
+	server *tcpserver.Server
+
+	mu       sync.Mutex
+	clients  map[string]*conn
+	sessions map[string]*session
+	retained retainedStore
+}
+
+// New creates new MQTT app listening on addr, it maps MQTT topics onto the broker.
+func New(log *slog.Logger, funcs broker.VortexQFuncs, addr string) *App {
+	a := &App{
+		log:      log,
+		funcs:    funcs,
+		clients:  make(map[string]*conn),
+		sessions: make(map[string]*session),
+	}
+	a.server = tcpserver.New(log, Protocol, addr, a.handle)
+	return a
+}
+
+// MustRun runs MQTT server and panics if any error occurs.
+func (a *App) MustRun() {
+	if err := a.server.Run(); err != nil {
+		panic(err)
+	}
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	Subprotocols:    []string{"mqtt"},
+	// devices connect from anywhere, access control belongs in front of the broker
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// ServeWebSocket speaks MQTT over a WebSocket with the mqtt subprotocol.
+func (a *App) ServeWebSocket(w http.ResponseWriter, r *http.Request) {
+	const op = "mqtt_app.App.ServeWebSocket"
+
+	if a.server.Context().Err() != nil {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	ws, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already answered with an error status
+		a.log.With(slog.String("op", op)).Warn("websocket upgrade failed", logging.Err(err))
+		return
+	}
+	a.server.Handle(&wsNetConn{Conn: ws})
+}
+
+// Ready is closed once the server accepts connections.
+func (a *App) Ready() <-chan struct{} {
+	return a.server.Ready()
+}
+
+// Stop closes the listener and disconnects the clients, waiting for their
+// connections to end until timeoutCtx is done.
+func (a *App) Stop(timeoutCtx context.Context) error {
+	a.server.StopAccepting()
+	a.mu.Lock()
+	clients := make([]*conn, 0, len(a.clients))
+	for _, c := range a.clients {
+		clients = append(clients, c)
+	}
+	a.mu.Unlock()
+	for _, c := range clients {
+		c.disconnect(reasonServerShuttingDown)
+	}
+	return a.server.Stop(timeoutCtx)
+}
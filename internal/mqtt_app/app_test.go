@@ -0,0 +1,329 @@
+package mqtt_app
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.golang/paho"
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver/tcpservertest"
+)
+
+// startApp serves the MQTT app on a loopback port and swirls the broker
+func startApp(t *testing.T) (*broker.VortexQ[any], string) {
+	vq, _, addr := startServer(t)
+	return vq, addr
+}
+
+func startServer(t *testing.T) (*broker.VortexQ[any], *App, string) {
+	t.Helper()
+	vq := broker.NewVortexQ[any]()
+	app := New(slog.Default(), vq, "127.0.0.1:0")
+
+	addr := tcpservertest.Start(t, vq, app.server.Serve, app.Stop)
+	return vq, app, addr
+}
+
+// connect returns a connected MQTT 3.1.1 client
+func connect(t *testing.T, addr string, opts *mqtt.ClientOptions) mqtt.Client {
+	t.Helper()
+	if !strings.Contains(addr, "://") {
+		addr = "tcp://" + addr
+	}
+	opts.AddBroker(addr).SetProtocolVersion(4).SetAutoReconnect(false)
+	client := mqtt.NewClient(opts)
+	if token := client.Connect(); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Connect error: %v", token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(0) })
+	return client
+}
+
+func subscribe(t *testing.T, client mqtt.Client, filter string, qos byte) <-chan mqtt.Message {
+	t.Helper()
+	received := make(chan mqtt.Message, 16)
+	token := client.Subscribe(filter, qos, func(_ mqtt.Client, m mqtt.Message) { received <- m })
+	if !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Subscribe(%q) error: %v", filter, token.Error())
+	}
+	return received
+}
+
+func publish(t *testing.T, client mqtt.Client, topic string, qos byte, retained bool, payload string) {
+	t.Helper()
+	if token := client.Publish(topic, qos, retained, payload); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Publish(%q) error: %v", topic, token.Error())
+	}
+}
+
+func receive(t *testing.T, received <-chan mqtt.Message) mqtt.Message {
+	t.Helper()
+	select {
+	case m := <-received:
+		return m
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func expectNone(t *testing.T, received <-chan mqtt.Message) {
+	t.Helper()
+	select {
+	case m := <-received:
+		t.Fatalf("unexpected message on %q: %s", m.Topic(), m.Payload())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Test MQTT topics and filters map onto the VortexQ topic hierarchy
+func TestTopicMapping(t *testing.T) {
+	for _, tc := range []struct {
+		filter   string
+		patterns []string
+	}{
+		{"sensors/kitchen/temp", []string{"sensors.kitchen.temp"}},
+		{"sensors/+/temp", []string{"sensors.*.temp"}},
+		{"sensors/#", []string{"sensors.>", "sensors"}},
+		{"#", []string{">"}},
+	} {
+		patterns, err := toPatterns(tc.filter)
+		if err != nil || !slices.Equal(patterns, tc.patterns) {
+			t.Errorf("toPatterns(%q) = %v, %v; want %v", tc.filter, patterns, err, tc.patterns)
+		}
+	}
+	for _, filter := range []string{"", "a/#/b", "a/b+", "a#", "v1.0/+"} {
+		if _, err := toPatterns(filter); err == nil {
+			t.Errorf("toPatterns(%q) succeeded; want error", filter)
+		}
+	}
+	for _, name := range []string{"a/+", "v1.0/temp"} {
+		if _, err := toTopic(name); err == nil {
+			t.Errorf("toTopic(%q) succeeded; want error", name)
+		}
+	}
+
+	for _, tc := range []struct {
+		filter, name string
+		want         bool
+	}{
+		{"a/+/c", "a/b/c", true},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"a/+", "a/b/c", false},
+		{"#", "$SYS/uptime", false},
+	} {
+		if got := matchFilter(tc.filter, tc.name); got != tc.want {
+			t.Errorf("matchFilter(%q, %q) = %v; want %v", tc.filter, tc.name, got, tc.want)
+		}
+	}
+}
+
+// Test messages flow between MQTT clients and the broker with QoS 0 and 1
+func TestPublishSubscribe(t *testing.T) {
+	vq, addr := startApp(t)
+	sub := connect(t, addr, mqtt.NewClientOptions().SetClientID("sub"))
+	pub := connect(t, addr, mqtt.NewClientOptions().SetClientID("pub"))
+
+	single := subscribe(t, sub, "sensors/+/temp", 1)
+	multi := subscribe(t, sub, "home/#", 0)
+
+	publish(t, pub, "sensors/kitchen/temp", 1, false, "21.5")
+	if m := receive(t, single); m.Topic() != "sensors/kitchen/temp" || string(m.Payload()) != "21.5" || m.Qos() != 1 {
+		t.Errorf("received %q %q qos %d; want sensors/kitchen/temp 21.5 qos 1", m.Topic(), m.Payload(), m.Qos())
+	}
+	if _, ok := vq.Topics.Load("sensors.kitchen.temp"); !ok {
+		t.Error("topic sensors.kitchen.temp was not created")
+	}
+
+	// messages published to the broker reach MQTT subscribers
+	vq.Publish(broker.Message[any]{ID: "m1", Pattern: "sensors.hall.temp", Data: "19"})
+	if m := receive(t, single); m.Topic() != "sensors/hall/temp" || string(m.Payload()) != `"19"` {
+		t.Errorf("received %q %q; want sensors/hall/temp \"19\"", m.Topic(), m.Payload())
+	}
+
+	// # also matches the parent level
+	publish(t, pub, "home", 0, false, "a")
+	publish(t, pub, "home/living/light", 0, false, "b")
+	var topics []string
+	for range 2 {
+		topics = append(topics, receive(t, multi).Topic())
+	}
+	slices.Sort(topics)
+	if !slices.Equal(topics, []string{"home", "home/living/light"}) {
+		t.Errorf("home/# received %v; want home and home/living/light", topics)
+	}
+
+	if token := sub.Unsubscribe("sensors/+/temp"); !token.WaitTimeout(5*time.Second) || token.Error() != nil {
+		t.Fatalf("Unsubscribe error: %v", token.Error())
+	}
+	if _, ok := vq.FindSubscription(subscriptionID("sub", "sensors.*.temp")); ok {
+		t.Error("subscription kept after UNSUBSCRIBE")
+	}
+	publish(t, pub, "sensors/kitchen/temp", 1, false, "22")
+	expectNone(t, single)
+}
+
+// Test retained messages are sent to new subscribers until cleared
+func TestRetained(t *testing.T) {
+	_, addr := startApp(t)
+	pub := connect(t, addr, mqtt.NewClientOptions().SetClientID("pub"))
+	publish(t, pub, "devices/d1/status", 1, true, "online")
+
+	sub := connect(t, addr, mqtt.NewClientOptions().SetClientID("sub"))
+	received := subscribe(t, sub, "devices/+/status", 1)
+	if m := receive(t, received); string(m.Payload()) != "online" || !m.Retained() {
+		t.Errorf("received %q retained %v; want retained online", m.Payload(), m.Retained())
+	}
+
+	// an empty retained message clears the topic
+	publish(t, pub, "devices/d1/status", 1, true, "")
+	receive(t, received)
+	other := connect(t, addr, mqtt.NewClientOptions().SetClientID("other"))
+	expectNone(t, subscribe(t, other, "devices/#", 1))
+}
+
+// Test the will is published when a client goes away without DISCONNECT
+func TestWill(t *testing.T) {
+	_, addr := startApp(t)
+	sub := connect(t, addr, mqtt.NewClientOptions().SetClientID("sub"))
+	received := subscribe(t, sub, "devices/+/status", 1)
+
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	e := &encoder{}
+	e.string("MQTT")
+	e.byte(version311)
+	e.byte(flagWill | flagCleanStart | 1<<3)
+	e.uint16(60)
+	e.string("d1")
+	e.string("devices/d1/status")
+	e.string("offline")
+	if _, err := nc.Write(encodePacket(packetConnect, 0, e.b)); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+	connack := make([]byte, 4)
+	if _, err := nc.Read(connack); err != nil || connack[3] != 0 {
+		t.Fatalf("CONNACK = %v, %v; want accepted", connack, err)
+	}
+	_ = nc.Close()
+
+	if m := receive(t, received); m.Topic() != "devices/d1/status" || string(m.Payload()) != "offline" {
+		t.Errorf("received %q %q; want the will", m.Topic(), m.Payload())
+	}
+
+	// a clean disconnect discards the will
+	opts := mqtt.NewClientOptions().SetClientID("d2").SetWill("devices/d2/status", "offline", 1, false)
+	connect(t, addr, opts).Disconnect(250)
+	expectNone(t, received)
+}
+
+// Test MQTT is spoken over a WebSocket too
+func TestWebSocket(t *testing.T) {
+	_, app, addr := startServer(t)
+	srv := httptest.NewServer(http.HandlerFunc(app.ServeWebSocket))
+	defer srv.Close()
+
+	ws := connect(t, "ws://"+strings.TrimPrefix(srv.URL, "http://")+"/mqtt", mqtt.NewClientOptions().SetClientID("browser"))
+	received := subscribe(t, ws, "chat/#", 0)
+	publish(t, connect(t, addr, mqtt.NewClientOptions().SetClientID("pub")), "chat/room1", 0, false, "hi")
+	if m := receive(t, received); m.Topic() != "chat/room1" || string(m.Payload()) != "hi" {
+		t.Errorf("received %q %q; want chat/room1 hi", m.Topic(), m.Payload())
+	}
+}
+
+// Test a persistent session keeps its subscriptions and messages while the client is away
+func TestPersistentSession(t *testing.T) {
+	vq, addr := startApp(t)
+	received := make(chan mqtt.Message, 16)
+	opts := func() *mqtt.ClientOptions {
+		return mqtt.NewClientOptions().SetClientID("device").SetCleanSession(false).
+			SetDefaultPublishHandler(func(_ mqtt.Client, m mqtt.Message) { received <- m })
+	}
+	client := connect(t, addr, opts())
+	subscribe(t, client, "commands/device", 1)
+	client.Disconnect(250)
+
+	vq.Publish(broker.Message[any]{ID: "c1", Pattern: "commands.device", Data: "reboot"})
+	time.Sleep(50 * time.Millisecond)
+
+	connect(t, addr, opts())
+	if m := receive(t, received); string(m.Payload()) != `"reboot"` {
+		t.Errorf("received %q; want the command published while away", m.Payload())
+	}
+
+	// a clean session drops the subscriptions
+	connect(t, addr, mqtt.NewClientOptions().SetClientID("device").SetCleanSession(true)).Disconnect(250)
+	time.Sleep(50 * time.Millisecond)
+	if _, ok := vq.FindSubscription(subscriptionID("device", "commands.device")); ok {
+		t.Error("subscription kept after a clean session")
+	}
+}
+
+// Test MQTT 5 properties map onto the message attributes
+func TestMQTT5Properties(t *testing.T) {
+	vq, addr := startApp(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	received := make(chan *paho.Publish, 1)
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	client := paho.NewClient(paho.ClientConfig{
+		Conn: nc,
+		OnPublishReceived: []func(paho.PublishReceived) (bool, error){func(pr paho.PublishReceived) (bool, error) {
+			received <- pr.Packet
+			return true, nil
+		}},
+	})
+	ack, err := client.Connect(ctx, &paho.Connect{CleanStart: true, KeepAlive: 30})
+	if err != nil || ack.ReasonCode != 0 {
+		t.Fatalf("Connect = %v, %v; want success", ack, err)
+	}
+	if ack.Properties == nil || ack.Properties.AssignedClientID == "" {
+		t.Error("CONNACK without an assigned client identifier")
+	}
+	defer func() { _ = client.Disconnect(&paho.Disconnect{}) }()
+
+	if _, err := client.Subscribe(ctx, &paho.Subscribe{Subscriptions: []paho.SubscribeOptions{{Topic: "rpc/+", QoS: 1}}}); err != nil {
+		t.Fatalf("Subscribe error: %v", err)
+	}
+	_, err = client.Publish(ctx, &paho.Publish{Topic: "rpc/ping", QoS: 1, Payload: []byte(`{"n":1}`),
+		Properties: &paho.PublishProperties{
+			ContentType:     "application/json",
+			ResponseTopic:   "rpc/replies",
+			CorrelationData: []byte("c-1"),
+			User:            paho.UserProperties{{Key: "trace", Value: "t1"}},
+		}})
+	if err != nil {
+		t.Fatalf("Publish error: %v", err)
+	}
+
+	select {
+	case p := <-received:
+		props := p.Properties
+		if p.Topic != "rpc/ping" || props.ContentType != "application/json" || props.ResponseTopic != "rpc/replies" ||
+			string(props.CorrelationData) != "c-1" || props.User.Get("trace") != "t1" {
+			t.Errorf("received %q with %+v; want the published properties", p.Topic, props)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+	}
+
+	tl, _ := vq.Topics.Load("rpc.ping")
+	if tl == nil {
+		t.Fatal("topic rpc.ping was not created")
+	}
+}
@@ -0,0 +1,762 @@
+package mqtt_app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	_connectTimeout = 10 * time.Second
+	_writeWait      = 10 * time.Second
+	_maxPacketSize  = 1 << 20
+	// _attachRetries gives a connection that was taken over time to let go of its consumers
+	_attachRetries    = 100
+	_attachRetryDelay = 10 * time.Millisecond
+)
+
+// CONNECT flags.
+const (
+	flagUsername   = 0x80
+	flagPassword   = 0x40
+	flagWillRetain = 0x20
+	flagWillQoS    = 0x18
+	flagWill       = 0x04
+	flagCleanStart = 0x02
+	flagReserved   = 0x01
+)
+
+// CONNACK return codes of MQTT 3.1.1.
+const (
+	connackUnacceptableVersion = 0x01
+	connackIdentifierRejected  = 0x02
+	connackServerUnavailable   = 0x03
+	subackFailure              = 0x80
+)
+
+// Reason codes of MQTT 5.
+const (
+	reasonSuccess                = 0x00
+	reasonDisconnectWithWill     = 0x04
+	reasonNoSubscriptionExisted  = 0x11
+	reasonUnspecifiedError       = 0x80
+	reasonProtocolError          = 0x82
+	reasonUnsupportedVersion     = 0x84
+	reasonServerUnavailable      = 0x88
+	reasonServerShuttingDown     = 0x8B
+	reasonSessionTakenOver       = 0x8E
+	reasonTopicFilterInvalid     = 0x8F
+	reasonTopicNameInvalid       = 0x90
+	reasonPayloadFormatInvalid   = 0x99
+	reasonSharedSubsNotSupported = 0x9E
+)
+
+// will is the message published when a client goes away without DISCONNECT.
+type will struct {
+	name   string
+	msg    broker.Message[any]
+	qos    byte
+	retain bool
+	empty  bool
+}
+
+// conn is a client connection, it maps the MQTT packets onto the broker.
+type conn struct {
+	app *App
+	nc  net.Conn
+	r   *bufio.Reader
+	log *slog.Logger
+
+	version        byte
+	clientID       string
+	keepAlive      time.Duration
+	sessionExpiry  uint32
+	receiveMaximum int
+	will           *will
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closed    chan struct{}
+	connected atomic.Bool
+	closeOnce sync.Once
+	writeMu   sync.Mutex
+
+	mu   sync.Mutex
+	subs map[string]context.CancelFunc
+	// inflight maps the packet IDs of outgoing QoS 1 messages to their ack tokens
+	inflight map[uint16]string
+	nextID   uint16
+	// received holds the incoming QoS 2 packet IDs until their PUBREL
+	received map[uint16]bool
+}
+
+func (a *App) handle(nc net.Conn) {
+	const op = "mqtt_app.App.handle"
+
+	c := &conn{
+		app:      a,
+		nc:       nc,
+		r:        bufio.NewReader(nc),
+		log:      a.log.With(slog.String("remote", nc.RemoteAddr().String())),
+		closed:   make(chan struct{}),
+		subs:     make(map[string]context.CancelFunc),
+		inflight: make(map[uint16]string),
+		received: make(map[uint16]bool),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+	defer close(c.closed)
+	defer c.cancel()
+	defer nc.Close()
+
+	err := c.serve()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		c.log.With(slog.String("op", op)).Warn("mqtt connection failed", logging.Err(err))
+	}
+	if c.connected.Load() {
+		c.end()
+	}
+}
+
+// serve reads the packets of the client until it disconnects.
+func (c *conn) serve() error {
+	_ = c.nc.SetReadDeadline(time.Now().Add(_connectTimeout))
+	p, err := readPacket(c.r, _maxPacketSize)
+	if err != nil {
+		return err
+	}
+	if p.kind != packetConnect {
+		return fmt.Errorf("%w: expected CONNECT, got packet type %d", errMalformed, p.kind)
+	}
+	if err := c.connect(p); err != nil {
+		return err
+	}
+
+	for {
+		deadline := time.Time{}
+		if c.keepAlive > 0 {
+			deadline = time.Now().Add(c.keepAlive * 3 / 2)
+		}
+		_ = c.nc.SetReadDeadline(deadline)
+		p, err := readPacket(c.r, _maxPacketSize)
+		if err != nil {
+			return err
+		}
+		switch p.kind {
+		case packetPublish:
+			err = c.handlePublish(p)
+		case packetPuback:
+			c.handlePuback(p)
+		case packetPubrel:
+			err = c.handlePubrel(p)
+		case packetSubscribe:
+			err = c.handleSubscribe(p)
+		case packetUnsubscribe:
+			err = c.handleUnsubscribe(p)
+		case packetPingreq:
+			err = c.write(packetPingresp, 0, nil)
+		case packetDisconnect:
+			// a normal disconnect discards the will, MQTT 5 clients may ask to publish it
+			if len(p.body) == 0 || p.body[0] != reasonDisconnectWithWill {
+				c.will = nil
+			}
+			return nil
+		case packetPubrec, packetPubcomp:
+			// outgoing messages are sent with QoS 1 at most
+		default:
+			c.disconnect(reasonProtocolError)
+			return fmt.Errorf("%w: unexpected packet type %d", errMalformed, p.kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *conn) connect(p packet) error {
+	const op = "mqtt_app.conn.connect"
+	d := &decoder{b: p.body}
+	name := d.string()
+	level := d.byte()
+	flags := d.byte()
+	keepAlive := d.uint16()
+	if d.err != nil {
+		return d.err
+	}
+	if name != "MQTT" || (level != version311 && level != version5) {
+		if level == version5 {
+			c.version = version5
+			_ = c.connack(false, reasonUnsupportedVersion, "")
+		} else {
+			_ = c.connack(false, connackUnacceptableVersion, "")
+		}
+		return fmt.Errorf("unsupported protocol %q level %d", name, level)
+	}
+	c.version = level
+	if flags&flagReserved != 0 {
+		return fmt.Errorf("%w: reserved CONNECT flag set", errMalformed)
+	}
+
+	var props properties
+	if c.version == version5 {
+		props = d.properties()
+	}
+	clientID := d.string()
+	if flags&flagWill != 0 {
+		var willProps properties
+		if c.version == version5 {
+			willProps = d.properties()
+		}
+		willName := d.string()
+		payload := d.binary()
+		if d.err != nil {
+			return d.err
+		}
+		msg, err := c.message(willName, payload, willProps)
+		if err != nil {
+			return fmt.Errorf("will: %w", err)
+		}
+		c.will = &will{
+			name:   willName,
+			msg:    msg,
+			qos:    min((flags&flagWillQoS)>>3, 1),
+			retain: flags&flagWillRetain != 0,
+			empty:  len(payload) == 0,
+		}
+	}
+	// credentials are checked in front of the broker
+	if flags&flagUsername != 0 {
+		d.string()
+	}
+	if flags&flagPassword != 0 {
+		d.binary()
+	}
+	if d.err != nil {
+		return d.err
+	}
+
+	cleanStart := flags&flagCleanStart != 0
+	assigned := ""
+	if clientID == "" {
+		if c.version == version311 && !cleanStart {
+			_ = c.connack(false, connackIdentifierRejected, "")
+			return errors.New("empty client identifier without clean session")
+		}
+		clientID = broker.NewID()
+		assigned = clientID
+	}
+	c.clientID = clientID
+	c.keepAlive = time.Duration(keepAlive) * time.Second
+	c.receiveMaximum = int(props.receiveMaximum)
+	switch {
+	case c.version == version5:
+		c.sessionExpiry = props.sessionExpiry
+	case !cleanStart:
+		c.sessionExpiry = _sessionNeverExpires
+	}
+	c.log = c.log.With(slog.String("client", clientID))
+
+	select {
+	case <-c.app.server.Context().Done():
+		code := byte(connackServerUnavailable)
+		if c.version == version5 {
+			code = reasonServerUnavailable
+		}
+		_ = c.connack(false, code, "")
+		return errors.New("server is shutting down")
+	default:
+	}
+
+	present, filters := c.app.attach(c, cleanStart)
+	if err := c.connack(present, reasonSuccess, assigned); err != nil {
+		return err
+	}
+	c.log.With(slog.String("op", op)).Info("mqtt client connected", slog.Int("version", int(c.version)), slog.Bool("session_present", present))
+
+	// the subscriptions of the session are restored without sending retained messages
+	for filter, qos := range filters {
+		if _, start := c.subscribe(filter, qos); start != nil {
+			start()
+		}
+	}
+	return nil
+}
+
+func (c *conn) connack(sessionPresent bool, code byte, assignedClientID string) error {
+	e := &encoder{}
+	if sessionPresent {
+		e.byte(0x01)
+	} else {
+		e.byte(0x00)
+	}
+	e.byte(code)
+	if c.version == version5 {
+		e.properties(properties{}, func(p *encoder) {
+			if assignedClientID != "" {
+				p.byte(propAssignedClientID)
+				p.string(assignedClientID)
+			}
+			p.byte(propMaximumQoS)
+			p.byte(1)
+			p.byte(propSharedSubAvailable)
+			p.byte(0)
+			p.byte(propMaximumPacketSize)
+			p.uint32(_maxPacketSize)
+		})
+	}
+	return c.write(packetConnack, 0, e.b)
+}
+
+// end releases what the connection held once it is gone.
+func (c *conn) end() {
+	const op = "mqtt_app.conn.end"
+	log := c.log.With(slog.String("op", op))
+
+	c.cancel()
+	// unacked messages are redelivered on the next connection instead of waiting for their deadline
+	c.mu.Lock()
+	tokens := make([]string, 0, len(c.inflight))
+	for _, token := range c.inflight {
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	clear(c.inflight)
+	c.mu.Unlock()
+	for _, token := range tokens {
+		_ = c.app.funcs.Nack(token)
+	}
+
+	if w := c.will; w != nil {
+		c.app.publish(w.name, w.msg, w.qos, w.retain, w.empty)
+		log.Info("published will", slog.String("topic", w.name))
+	}
+	c.app.release(c)
+	log.Info("mqtt client disconnected")
+}
+
+// disconnect closes the connection, MQTT 5 clients are told why.
+func (c *conn) disconnect(reason byte) {
+	c.closeOnce.Do(func() {
+		if c.version == version5 && c.connected.Load() {
+			e := &encoder{}
+			e.byte(reason)
+			_ = c.write(packetDisconnect, 0, e.b)
+		}
+		_ = c.nc.Close()
+	})
+}
+
+func (c *conn) write(kind, flags byte, body []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.nc.SetWriteDeadline(time.Now().Add(_writeWait))
+	_, err := c.nc.Write(encodePacket(kind, flags, body))
+	return err
+}
+
+// message builds the broker message of an incoming MQTT publication.
+func (c *conn) message(name string, payload []byte, props properties) (broker.Message[any], error) {
+	topic, err := toTopic(name)
+	if err != nil {
+		return broker.Message[any]{}, fmt.Errorf("topic %q: %w", name, err)
+	}
+	msg := broker.Message[any]{
+		ID:            broker.NewID(),
+		Pattern:       topic,
+		ContentType:   props.contentType,
+		CorrelationID: string(props.correlationData),
+	}
+	if props.responseTopic != "" {
+		if msg.ReplyTo, err = toTopic(props.responseTopic); err != nil {
+			return msg, fmt.Errorf("response topic %q: %w", props.responseTopic, err)
+		}
+	}
+	for _, kv := range props.userProperties {
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		msg.Headers[kv[0]] = kv[1]
+	}
+	if err := msg.SetPayload(payload); err != nil {
+		return msg, err
+	}
+	return msg, nil
+}
+
+// publish hands an MQTT publication to the broker, keeping it when retained.
+func (a *App) publish(name string, msg broker.Message[any], qos byte, retain, empty bool) {
+	if retain {
+		a.retained.set(name, retainedMessage{msg: msg, qos: qos}, empty)
+	}
+	// toTopic validated the topic already
+	_, _ = a.funcs.Publish(msg)
+}
+
+func (c *conn) handlePublish(p packet) error {
+	const op = "mqtt_app.conn.handlePublish"
+	qos := (p.flags >> 1) & 0x03
+	if qos == 3 {
+		return fmt.Errorf("%w: invalid QoS", errMalformed)
+	}
+	d := &decoder{b: p.body}
+	name := d.string()
+	var id uint16
+	if qos > 0 {
+		id = d.uint16()
+	}
+	var props properties
+	if c.version == version5 {
+		props = d.properties()
+	}
+	payload := d.rest()
+	if d.err != nil {
+		return d.err
+	}
+	if props.topicAlias != 0 {
+		c.disconnect(reasonProtocolError)
+		return errors.New("topic aliases are not supported")
+	}
+
+	if qos == 2 {
+		c.mu.Lock()
+		duplicate := c.received[id]
+		c.received[id] = true
+		c.mu.Unlock()
+		if duplicate {
+			return c.ackPublish(qos, id, reasonSuccess)
+		}
+	}
+
+	msg, err := c.message(name, payload, props)
+	switch {
+	case errors.Is(err, errInvalidTopic):
+		c.disconnect(reasonTopicNameInvalid)
+		return err
+	case err != nil:
+		c.log.With(slog.String("op", op)).Warn("rejected message", slog.String("topic", name), logging.Err(err))
+		return c.ackPublish(qos, id, reasonPayloadFormatInvalid)
+	}
+	c.app.publish(name, msg, qos, p.flags&0x01 != 0, len(payload) == 0)
+	return c.ackPublish(qos, id, reasonSuccess)
+}
+
+// ackPublish answers an incoming publication with PUBACK for QoS 1 and PUBREC for QoS 2.
+func (c *conn) ackPublish(qos byte, id uint16, reason byte) error {
+	if qos == 0 {
+		return nil
+	}
+	e := &encoder{}
+	e.uint16(id)
+	if c.version == version5 && reason != reasonSuccess {
+		e.byte(reason)
+	}
+	if qos == 1 {
+		return c.write(packetPuback, 0, e.b)
+	}
+	return c.write(packetPubrec, 0, e.b)
+}
+
+func (c *conn) handlePubrel(p packet) error {
+	d := &decoder{b: p.body}
+	id := d.uint16()
+	if d.err != nil {
+		return d.err
+	}
+	c.mu.Lock()
+	delete(c.received, id)
+	c.mu.Unlock()
+	e := &encoder{}
+	e.uint16(id)
+	return c.write(packetPubcomp, 0, e.b)
+}
+
+func (c *conn) handlePuback(p packet) {
+	const op = "mqtt_app.conn.handlePuback"
+	d := &decoder{b: p.body}
+	id := d.uint16()
+	if d.err != nil {
+		return
+	}
+	c.mu.Lock()
+	token := c.inflight[id]
+	delete(c.inflight, id)
+	c.mu.Unlock()
+	if token == "" {
+		return
+	}
+	if err := c.app.funcs.Ack(token); err != nil {
+		// the ack deadline passed and the message is on its way again
+		c.log.With(slog.String("op", op)).Debug("late PUBACK", slog.Int("packet_id", int(id)), logging.Err(err))
+	}
+}
+
+func (c *conn) handleSubscribe(p packet) error {
+	d := &decoder{b: p.body}
+	id := d.uint16()
+	if c.version == version5 {
+		d.properties()
+	}
+	type request struct {
+		filter  string
+		options byte
+	}
+	var requests []request
+	for d.err == nil && len(d.b) > 0 {
+		requests = append(requests, request{filter: d.string(), options: d.byte()})
+	}
+	if d.err != nil || len(requests) == 0 {
+		return fmt.Errorf("%w: SUBSCRIBE without topic filters", errMalformed)
+	}
+
+	e := &encoder{}
+	e.uint16(id)
+	if c.version == version5 {
+		e.properties(properties{})
+	}
+	var starts []func()
+	for _, r := range requests {
+		_, existed := c.subscription(r.filter)
+		code, start := c.subscribe(r.filter, min(r.options&0x03, 1))
+		e.byte(code)
+		if start == nil {
+			continue
+		}
+		starts = append(starts, start)
+		// MQTT 5 clients may skip the retained messages, always or when resubscribing
+		retainHandling := (r.options >> 4) & 0x03
+		if retainHandling == 2 || (retainHandling == 1 && existed) {
+			continue
+		}
+		filter, qos := r.filter, code
+		starts = append(starts, func() { c.sendRetained(filter, qos) })
+	}
+	if err := c.write(packetSuback, 0, e.b); err != nil {
+		return err
+	}
+	for _, start := range starts {
+		start()
+	}
+	return nil
+}
+
+func (c *conn) subscription(filter string) (context.CancelFunc, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cancel, ok := c.subs[filter]
+	return cancel, ok
+}
+
+// subscribe consumes the broker subscriptions of the topic filter, replacing an
+// existing one. It returns the SUBACK code and, on success, the func starting the
+// deliveries once the SUBACK is sent.
+func (c *conn) subscribe(filter string, qos byte) (byte, func()) {
+	const op = "mqtt_app.conn.subscribe"
+	failure := func(reason byte) (byte, func()) {
+		if c.version == version5 {
+			return reason, nil
+		}
+		return subackFailure, nil
+	}
+	if strings.HasPrefix(filter, "$share/") {
+		return failure(reasonSharedSubsNotSupported)
+	}
+	patterns, err := toPatterns(filter)
+	if err != nil {
+		return failure(reasonTopicFilterInvalid)
+	}
+	if cancel, ok := c.subscription(filter); ok {
+		cancel()
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	deliveries := make([]<-chan broker.Delivery[any], 0, len(patterns))
+	for _, pattern := range patterns {
+		ch, err := c.consume(ctx, pattern, qos)
+		if err != nil {
+			cancel()
+			c.log.With(slog.String("op", op)).Warn("failed to subscribe", slog.String("filter", filter), logging.Err(err))
+			return failure(reasonUnspecifiedError)
+		}
+		deliveries = append(deliveries, ch)
+	}
+	c.mu.Lock()
+	c.subs[filter] = cancel
+	c.mu.Unlock()
+	c.app.remember(c.clientID, filter, qos)
+
+	return qos, func() {
+		for _, ch := range deliveries {
+			go c.forward(ch, qos)
+		}
+	}
+}
+
+// consume attaches to the broker subscription of the pattern, a connection that was
+// taken over may hold it for a moment.
+func (c *conn) consume(ctx context.Context, pattern string, qos byte) (<-chan broker.Delivery[any], error) {
+	sub := broker.Subscription{ID: subscriptionID(c.clientID, pattern), TopicName: pattern, Protocol: Protocol}
+	opts := broker.ConsumeOptions{MaxInFlight: broker.DefaultMaxInFlight, AutoAck: qos == 0}
+	if c.receiveMaximum > 0 {
+		opts.MaxInFlight = min(opts.MaxInFlight, c.receiveMaximum)
+	}
+	for i := 0; ; i++ {
+		ch, err := c.app.funcs.Consume(ctx, sub, opts)
+		if !errors.Is(err, broker.ErrConsumerAttached) || i == _attachRetries {
+			return ch, err
+		}
+		time.Sleep(_attachRetryDelay)
+	}
+}
+
+// forward sends the deliveries of a subscription to the client.
+func (c *conn) forward(deliveries <-chan broker.Delivery[any], qos byte) {
+	const op = "mqtt_app.conn.forward"
+	for d := range deliveries {
+		if c.ctx.Err() != nil {
+			if d.AckToken != "" {
+				_ = c.app.funcs.Nack(d.AckToken)
+			}
+			continue
+		}
+		if err := c.send(d.Message, qos, d.AckToken, d.Attempt > 1, false); err != nil {
+			if d.AckToken != "" {
+				_ = c.app.funcs.Nack(d.AckToken)
+			}
+			c.log.With(slog.String("op", op)).Warn("failed to send message", slog.String("message", d.Message.ID), logging.Err(err))
+			c.disconnect(reasonUnspecifiedError)
+		}
+	}
+}
+
+func (c *conn) sendRetained(filter string, qos byte) {
+	const op = "mqtt_app.conn.sendRetained"
+	for _, m := range c.app.retained.matching(filter) {
+		if err := c.send(m.msg, min(qos, m.qos), "", false, true); err != nil {
+			c.log.With(slog.String("op", op)).Warn("failed to send retained message", slog.String("message", m.msg.ID), logging.Err(err))
+			return
+		}
+	}
+}
+
+// send writes a PUBLISH of the message, QoS 1 messages are acked with token once
+// the client answers with PUBACK.
+func (c *conn) send(msg broker.Message[any], qos byte, token string, dup, retain bool) error {
+	payload, _, err := msg.Payload()
+	if err != nil {
+		return err
+	}
+	e := &encoder{}
+	e.string(fromTopic(msg.Pattern))
+	var id uint16
+	if qos > 0 {
+		id = c.packetID(token)
+		e.uint16(id)
+	}
+	if c.version == version5 {
+		e.properties(messageProperties(msg))
+	}
+	e.b = append(e.b, payload...)
+
+	flags := qos << 1
+	if dup {
+		flags |= 0x08
+	}
+	if retain {
+		flags |= 0x01
+	}
+	if err := c.write(packetPublish, flags, e.b); err != nil {
+		if qos > 0 {
+			c.mu.Lock()
+			delete(c.inflight, id)
+			c.mu.Unlock()
+		}
+		return err
+	}
+	return nil
+}
+
+// packetID returns an unused packet ID for an outgoing QoS 1 message.
+func (c *conn) packetID(token string) uint16 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for range 1 << 16 {
+		c.nextID++
+		if c.nextID == 0 {
+			continue
+		}
+		if _, used := c.inflight[c.nextID]; !used {
+			break
+		}
+	}
+	c.inflight[c.nextID] = token
+	return c.nextID
+}
+
+// messageProperties maps the message attributes onto MQTT 5 properties.
+func messageProperties(msg broker.Message[any]) properties {
+	props := properties{
+		contentType:     msg.ContentType,
+		responseTopic:   fromTopic(msg.ReplyTo),
+		correlationData: []byte(msg.CorrelationID),
+	}
+	keys := make([]string, 0, len(msg.Headers))
+	for k := range msg.Headers {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		props.userProperties = append(props.userProperties, [2]string{k, msg.Headers[k]})
+	}
+	return props
+}
+
+func (c *conn) handleUnsubscribe(p packet) error {
+	d := &decoder{b: p.body}
+	id := d.uint16()
+	if c.version == version5 {
+		d.properties()
+	}
+	var filters []string
+	for d.err == nil && len(d.b) > 0 {
+		filters = append(filters, d.string())
+	}
+	if d.err != nil || len(filters) == 0 {
+		return fmt.Errorf("%w: UNSUBSCRIBE without topic filters", errMalformed)
+	}
+
+	e := &encoder{}
+	e.uint16(id)
+	if c.version == version5 {
+		e.properties(properties{})
+	}
+	for _, filter := range filters {
+		c.mu.Lock()
+		cancel, ok := c.subs[filter]
+		delete(c.subs, filter)
+		c.mu.Unlock()
+		if ok {
+			cancel()
+		}
+		c.app.forget(c.clientID, filter)
+		removed := c.app.unsubscribe(c.clientID, filter)
+		if c.version == version5 {
+			if ok || removed {
+				e.byte(reasonSuccess)
+			} else {
+				e.byte(reasonNoSubscriptionExisted)
+			}
+		}
+	}
+	return c.write(packetUnsuback, 0, e.b)
+}
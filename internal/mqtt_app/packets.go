@@ -0,0 +1,320 @@
+package mqtt_app
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Control packet types.
+const (
+	packetConnect     = 1
+	packetConnack     = 2
+	packetPublish     = 3
+	packetPuback      = 4
+	packetPubrec      = 5
+	packetPubrel      = 6
+	packetPubcomp     = 7
+	packetSubscribe   = 8
+	packetSuback      = 9
+	packetUnsubscribe = 10
+	packetUnsuback    = 11
+	packetPingreq     = 12
+	packetPingresp    = 13
+	packetDisconnect  = 14
+)
+
+// Protocol levels of the CONNECT packet.
+const (
+	version311 = 4
+	version5   = 5
+)
+
+// Property identifiers of MQTT 5 used by the listener.
+const (
+	propPayloadFormat      = 0x01
+	propMessageExpiry      = 0x02
+	propContentType        = 0x03
+	propResponseTopic      = 0x08
+	propCorrelationData    = 0x09
+	propSubscriptionID     = 0x0B
+	propSessionExpiry      = 0x11
+	propAssignedClientID   = 0x12
+	propServerKeepAlive    = 0x13
+	propAuthMethod         = 0x15
+	propAuthData           = 0x16
+	propRequestProblemInfo = 0x17
+	propWillDelay          = 0x18
+	propRequestRespInfo    = 0x19
+	propResponseInfo       = 0x1A
+	propServerReference    = 0x1C
+	propReasonString       = 0x1F
+	propReceiveMaximum     = 0x21
+	propTopicAliasMaximum  = 0x22
+	propTopicAlias         = 0x23
+	propMaximumQoS         = 0x24
+	propRetainAvailable    = 0x25
+	propUserProperty       = 0x26
+	propMaximumPacketSize  = 0x27
+	propWildcardSubAvail   = 0x28
+	propSubIDAvailable     = 0x29
+	propSharedSubAvailable = 0x2A
+)
+
+var errMalformed = errors.New("malformed packet")
+
+// packet is a control packet with its fixed header split in type and flags.
+type packet struct {
+	kind  byte
+	flags byte
+	body  []byte
+}
+
+// properties holds the MQTT 5 properties the listener understands, others are skipped.
+type properties struct {
+	contentType     string
+	responseTopic   string
+	correlationData []byte
+	sessionExpiry   uint32
+	receiveMaximum  uint16
+	topicAlias      uint16
+	userProperties  [][2]string
+}
+
+func readPacket(r *bufio.Reader, maxSize int) (packet, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return packet{}, err
+	}
+	size, err := readVarint(r)
+	if err != nil {
+		return packet{}, err
+	}
+	if size > maxSize {
+		return packet{}, fmt.Errorf("%w: %d bytes exceed the maximum packet size", errMalformed, size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return packet{}, err
+	}
+	return packet{kind: header >> 4, flags: header & 0x0F, body: body}, nil
+}
+
+func readVarint(r io.ByteReader) (int, error) {
+	value, shift := 0, 0
+	for i := 0; i < 4; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		value |= int(b&0x7F) << shift
+		if b&0x80 == 0 {
+			return value, nil
+		}
+		shift += 7
+	}
+	return 0, fmt.Errorf("%w: variable byte integer too long", errMalformed)
+}
+
+// decoder reads the fields of a packet body, the first error sticks.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) fail() {
+	if d.err == nil {
+		d.err = errMalformed
+	}
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.b) < 1 {
+		d.fail()
+		return 0
+	}
+	v := d.b[0]
+	d.b = d.b[1:]
+	return v
+}
+
+func (d *decoder) uint16() uint16 {
+	if d.err != nil || len(d.b) < 2 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint16(d.b)
+	d.b = d.b[2:]
+	return v
+}
+
+func (d *decoder) uint32() uint32 {
+	if d.err != nil || len(d.b) < 4 {
+		d.fail()
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
+
+func (d *decoder) varint() int {
+	if d.err != nil {
+		return 0
+	}
+	r := &byteSliceReader{b: d.b}
+	v, err := readVarint(r)
+	if err != nil {
+		d.fail()
+		return 0
+	}
+	d.b = r.b
+	return v
+}
+
+func (d *decoder) binary() []byte {
+	n := int(d.uint16())
+	if d.err != nil || len(d.b) < n {
+		d.fail()
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	return string(d.binary())
+}
+
+func (d *decoder) rest() []byte {
+	v := d.b
+	d.b = nil
+	return v
+}
+
+func (d *decoder) properties() properties {
+	var props properties
+	n := d.varint()
+	if d.err != nil || len(d.b) < n {
+		d.fail()
+		return props
+	}
+	pd := &decoder{b: d.b[:n]}
+	d.b = d.b[n:]
+	for len(pd.b) > 0 && pd.err == nil {
+		switch id := pd.byte(); id {
+		case propContentType:
+			props.contentType = pd.string()
+		case propResponseTopic:
+			props.responseTopic = pd.string()
+		case propCorrelationData:
+			props.correlationData = pd.binary()
+		case propSessionExpiry:
+			props.sessionExpiry = pd.uint32()
+		case propReceiveMaximum:
+			props.receiveMaximum = pd.uint16()
+		case propTopicAlias:
+			props.topicAlias = pd.uint16()
+		case propUserProperty:
+			props.userProperties = append(props.userProperties, [2]string{pd.string(), pd.string()})
+		case propPayloadFormat, propRequestProblemInfo, propRequestRespInfo, propMaximumQoS,
+			propRetainAvailable, propWildcardSubAvail, propSubIDAvailable, propSharedSubAvailable:
+			pd.byte()
+		case propServerKeepAlive, propTopicAliasMaximum:
+			pd.uint16()
+		case propMessageExpiry, propWillDelay, propMaximumPacketSize:
+			pd.uint32()
+		case propSubscriptionID:
+			pd.varint()
+		case propAssignedClientID, propAuthMethod, propResponseInfo, propServerReference, propReasonString:
+			pd.string()
+		case propAuthData:
+			pd.binary()
+		default:
+			pd.fail()
+		}
+	}
+	if pd.err != nil {
+		d.err = pd.err
+	}
+	return props
+}
+
+type byteSliceReader struct{ b []byte }
+
+func (r *byteSliceReader) ReadByte() (byte, error) {
+	if len(r.b) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	v := r.b[0]
+	r.b = r.b[1:]
+	return v, nil
+}
+
+// encoder builds a packet body.
+type encoder struct{ b []byte }
+
+func (e *encoder) byte(v byte) { e.b = append(e.b, v) }
+
+func (e *encoder) uint16(v uint16) { e.b = binary.BigEndian.AppendUint16(e.b, v) }
+
+func (e *encoder) uint32(v uint32) { e.b = binary.BigEndian.AppendUint32(e.b, v) }
+
+func (e *encoder) binary(v []byte) {
+	e.uint16(uint16(len(v)))
+	e.b = append(e.b, v...)
+}
+
+func (e *encoder) string(v string) { e.binary([]byte(v)) }
+
+// properties writes the MQTT 5 properties of outgoing packets.
+func (e *encoder) properties(props properties, extra ...func(*encoder)) {
+	p := &encoder{}
+	if props.contentType != "" {
+		p.byte(propContentType)
+		p.string(props.contentType)
+	}
+	if props.responseTopic != "" {
+		p.byte(propResponseTopic)
+		p.string(props.responseTopic)
+	}
+	if len(props.correlationData) > 0 {
+		p.byte(propCorrelationData)
+		p.binary(props.correlationData)
+	}
+	for _, kv := range props.userProperties {
+		p.byte(propUserProperty)
+		p.string(kv[0])
+		p.string(kv[1])
+	}
+	for _, f := range extra {
+		f(p)
+	}
+	e.b = appendVarint(e.b, len(p.b))
+	e.b = append(e.b, p.b...)
+}
+
+func appendVarint(b []byte, v int) []byte {
+	for {
+		digit := byte(v % 128)
+		v /= 128
+		if v > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if v == 0 {
+			return b
+		}
+	}
+}
+
+// encodePacket adds the fixed header to the body.
+func encodePacket(kind, flags byte, body []byte) []byte {
+	b := make([]byte, 0, len(body)+5)
+	b = append(b, kind<<4|flags&0x0F)
+	b = appendVarint(b, len(body))
+	return append(b, body...)
+}
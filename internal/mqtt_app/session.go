@@ -0,0 +1,146 @@
+package mqtt_app
+
+import (
+	"errors"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"log/slog"
+	"maps"
+	"time"
+)
+
+// _sessionNeverExpires keeps a session until the client starts clean.
+const _sessionNeverExpires = 0xFFFFFFFF
+
+// session is the state of a client kept between its connections, its
+// subscriptions live in the broker under subscriptionID.
+type session struct {
+	// filters maps the subscribed topic filters to their granted QoS
+	filters map[string]byte
+	expiry  *time.Timer
+}
+
+// subscriptionID names the broker subscription of a client for one pattern.
+func subscriptionID(clientID, pattern string) string {
+	return Protocol + ":" + clientID + ":" + pattern
+}
+
+// attach makes c the connection of its client, taking over the previous one, and
+// returns whether a session was present together with its topic filters.
+func (a *App) attach(c *conn, cleanStart bool) (bool, map[string]byte) {
+	a.mu.Lock()
+	old := a.clients[c.clientID]
+	a.clients[c.clientID] = c
+	a.mu.Unlock()
+	if old != nil {
+		old.disconnect(reasonSessionTakenOver)
+		<-old.closed
+	}
+
+	a.mu.Lock()
+	s := a.sessions[c.clientID]
+	var dropped *session
+	if s != nil && cleanStart {
+		dropped, s = s, nil
+	}
+	present := s != nil
+	if s == nil {
+		s = &session{filters: make(map[string]byte)}
+		a.sessions[c.clientID] = s
+	}
+	if s.expiry != nil {
+		s.expiry.Stop()
+		s.expiry = nil
+	}
+	filters := maps.Clone(s.filters)
+	c.connected.Store(true)
+	a.mu.Unlock()
+
+	if dropped != nil {
+		a.dropSession(c.clientID, dropped)
+	}
+	return present, filters
+}
+
+// release ends the connection of a client, its session is dropped right away or
+// when it expires.
+func (a *App) release(c *conn) {
+	a.mu.Lock()
+	if a.clients[c.clientID] == c {
+		delete(a.clients, c.clientID)
+	}
+	s := a.sessions[c.clientID]
+	var dropped *session
+	switch {
+	case s == nil:
+	case c.sessionExpiry == 0:
+		delete(a.sessions, c.clientID)
+		dropped = s
+	case c.sessionExpiry != _sessionNeverExpires:
+		s.expiry = time.AfterFunc(time.Duration(c.sessionExpiry)*time.Second, func() { a.expire(c.clientID, s) })
+	}
+	a.mu.Unlock()
+
+	if dropped != nil {
+		a.dropSession(c.clientID, dropped)
+	}
+}
+
+func (a *App) expire(clientID string, s *session) {
+	a.mu.Lock()
+	expired := a.sessions[clientID] == s && a.clients[clientID] == nil
+	if expired {
+		delete(a.sessions, clientID)
+	}
+	a.mu.Unlock()
+
+	if expired {
+		a.dropSession(clientID, s)
+	}
+}
+
+// remember adds the topic filter to the session of the client.
+func (a *App) remember(clientID, filter string, qos byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s := a.sessions[clientID]; s != nil {
+		s.filters[filter] = qos
+	}
+}
+
+// forget removes the topic filter from the session of the client.
+func (a *App) forget(clientID, filter string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if s := a.sessions[clientID]; s != nil {
+		delete(s.filters, filter)
+	}
+}
+
+func (a *App) dropSession(clientID string, s *session) {
+	for filter := range s.filters {
+		a.unsubscribe(clientID, filter)
+	}
+}
+
+// unsubscribe removes the broker subscriptions of a topic filter, it reports whether
+// there were any.
+func (a *App) unsubscribe(clientID, filter string) bool {
+	const op = "mqtt_app.App.unsubscribe"
+	patterns, err := toPatterns(filter)
+	if err != nil {
+		return false
+	}
+	removed := false
+	for _, pattern := range patterns {
+		err := a.funcs.Unsubscribe(subscriptionID(clientID, pattern))
+		switch {
+		case err == nil:
+			removed = true
+		case !errors.Is(err, broker.ErrNotFound):
+			a.log.With(slog.String("op", op)).Warn("failed to unsubscribe", slog.String("client", clientID),
+				slog.String("filter", filter), logging.Err(err))
+		}
+	}
+	return removed
+}
@@ -0,0 +1,127 @@
+package mqtt_app
+
+import (
+	"errors"
+	"github.com/ivanbulyk/vortexq/broker"
+	"strings"
+	"sync"
+)
+
+const (
+	mqttSeparator    = "/"
+	mqttWildcardOne  = "+"
+	mqttWildcardRest = "#"
+)
+
+var errInvalidTopic = errors.New("invalid topic")
+
+// toTopic translates an MQTT topic name into a VortexQ topic, levels like *
+// that are wildcards in VortexQ aren't names. A . would split a level in
+// VortexQ, so names containing it are refused rather than mapped lossily.
+func toTopic(name string) (string, error) {
+	if strings.ContainsAny(name, mqttWildcardOne+mqttWildcardRest+broker.TopicSeparator) {
+		return "", errInvalidTopic
+	}
+	topic := strings.ReplaceAll(name, mqttSeparator, broker.TopicSeparator)
+	if broker.ValidateTopicName(topic) != nil {
+		return "", errInvalidTopic
+	}
+	return topic, nil
+}
+
+// fromTopic translates a VortexQ topic back into an MQTT topic name.
+func fromTopic(topic string) string {
+	return strings.ReplaceAll(topic, broker.TopicSeparator, mqttSeparator)
+}
+
+// toPatterns translates an MQTT topic filter into the VortexQ patterns it covers. A
+// trailing # also matches its parent level, which a VortexQ > doesn't.
+func toPatterns(filter string) ([]string, error) {
+	if filter == "" {
+		return nil, errInvalidTopic
+	}
+	levels := strings.Split(filter, mqttSeparator)
+	for i, level := range levels {
+		switch {
+		case level == mqttWildcardOne:
+			levels[i] = broker.WildcardOne
+		case level == mqttWildcardRest:
+			if i != len(levels)-1 {
+				return nil, errInvalidTopic
+			}
+			levels[i] = broker.WildcardRest
+		case strings.ContainsAny(level, mqttWildcardOne+mqttWildcardRest+broker.TopicSeparator):
+			return nil, errInvalidTopic
+		}
+	}
+	patterns := []string{strings.Join(levels, broker.TopicSeparator)}
+	if len(levels) > 1 && levels[len(levels)-1] == broker.WildcardRest {
+		patterns = append(patterns, strings.Join(levels[:len(levels)-1], broker.TopicSeparator))
+	}
+	for _, pattern := range patterns {
+		if broker.IsTopicPattern(pattern) {
+			if err := broker.ValidateTopicPattern(pattern); err != nil {
+				return nil, errInvalidTopic
+			}
+		}
+	}
+	return patterns, nil
+}
+
+// matchFilter reports whether the MQTT topic name matches the topic filter.
+// Wildcards at the first level don't match topics starting with $.
+func matchFilter(filter, name string) bool {
+	if strings.HasPrefix(name, "$") && (strings.HasPrefix(filter, mqttWildcardOne) || strings.HasPrefix(filter, mqttWildcardRest)) {
+		return false
+	}
+	filterLevels := strings.Split(filter, mqttSeparator)
+	nameLevels := strings.Split(name, mqttSeparator)
+	for i, level := range filterLevels {
+		if level == mqttWildcardRest {
+			return true
+		}
+		if i >= len(nameLevels) || (level != mqttWildcardOne && level != nameLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(nameLevels)
+}
+
+// retainedMessage is the last retained message of a topic.
+type retainedMessage struct {
+	msg broker.Message[any]
+	qos byte
+}
+
+// retainedStore keeps the retained message of every MQTT topic name.
+type retainedStore struct {
+	mu       sync.RWMutex
+	messages map[string]retainedMessage
+}
+
+// set stores the retained message of the topic, an empty payload removes it.
+func (s *retainedStore) set(name string, m retainedMessage, empty bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if empty {
+		delete(s.messages, name)
+		return
+	}
+	if s.messages == nil {
+		s.messages = make(map[string]retainedMessage)
+	}
+	s.messages[name] = m
+}
+
+// matching returns the retained messages whose topic matches the filter.
+func (s *retainedStore) matching(filter string) []retainedMessage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var matched []retainedMessage
+	for name, m := range s.messages {
+		if matchFilter(filter, name) {
+			matched = append(matched, m)
+		}
+	}
+	return matched
+}
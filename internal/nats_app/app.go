@@ -0,0 +1,61 @@
+package nats_app
+
+import (
+	"context"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Protocol marks the subscriptions consumed over NATS.
+const Protocol = "nats"
+
+type App struct {
+	log    *slog.Logger
+	funcs  broker.VortexQFuncs
+	server *tcpserver.Server
+
+	// id identifies the server in INFO
+	id string
+	// pingInterval is how often the server pings idle clients
+	pingInterval time.Duration
+
+	mu     sync.Mutex
+	queues map[string]*queue
+	// clients counts the connections for their ids
+	clients atomic.Uint64
+}
+
+// New creates new NATS app listening on addr, subjects map onto broker topics.
+func New(log *slog.Logger, funcs broker.VortexQFuncs, addr string) *App {
+	a := &App{
+		log:          log,
+		funcs:        funcs,
+		id:           broker.NewID(),
+		pingInterval: _pingInterval,
+		queues:       make(map[string]*queue),
+	}
+	a.server = tcpserver.New(log, Protocol, addr, a.handle)
+	return a
+}
+
+// MustRun runs NATS server and panics if any error occurs.
+func (a *App) MustRun() {
+	if err := a.server.Run(); err != nil {
+		panic(err)
+	}
+}
+
+// Ready is closed once the server accepts connections.
+func (a *App) Ready() <-chan struct{} {
+	return a.server.Ready()
+}
+
+// Stop closes the listener and the client connections, waiting for them to end
+// until timeoutCtx is done.
+func (a *App) Stop(timeoutCtx context.Context) error {
+	return a.server.Stop(timeoutCtx)
+}
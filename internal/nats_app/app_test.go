@@ -0,0 +1,245 @@
+package nats_app
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver/tcpservertest"
+	"github.com/nats-io/nats.go"
+)
+
+// startApp serves NATS on a loopback port, swirls the broker and returns its URL
+func startApp(t *testing.T, pingInterval time.Duration) (*broker.VortexQ[any], string) {
+	t.Helper()
+	vq := broker.NewVortexQ[any]()
+	vq.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	app := New(vq.Logger, vq, "127.0.0.1:0")
+	app.pingInterval = pingInterval
+
+	addr := tcpservertest.Start(t, vq, app.server.Serve, app.Stop)
+	return vq, "nats://" + addr
+}
+
+func connect(t *testing.T, url string) *nats.Conn {
+	t.Helper()
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatalf("connect error: %v", err)
+	}
+	t.Cleanup(nc.Close)
+	return nc
+}
+
+// Test wildcard subscriptions receive messages with headers from NATS and VortexQ publishers
+func TestPublishSubscribe(t *testing.T) {
+	vq, url := startApp(t, _pingInterval)
+	nc := connect(t, url)
+
+	sub, err := nc.SubscribeSync("orders.*")
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	all, _ := nc.SubscribeSync("orders.>")
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+
+	if err := nc.Publish("orders.created", []byte("plain")); err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	err = nc.PublishMsg(&nats.Msg{
+		Subject: "orders.created",
+		Header:  nats.Header{"Content-Type": []string{"application/json"}, "Order": []string{"7"}},
+		Data:    []byte(`{"n":7}`),
+	})
+	if err != nil {
+		t.Fatalf("publish error: %v", err)
+	}
+	if err := nc.Flush(); err != nil {
+		t.Fatalf("flush error: %v", err)
+	}
+	vq.Publish(broker.Message[any]{ID: "m3", Pattern: "orders.eu.shipped", Data: "from vortexq"})
+
+	msg, err := sub.NextMsg(2 * time.Second)
+	if err != nil || msg.Subject != "orders.created" || string(msg.Data) != "plain" || msg.Header != nil {
+		t.Fatalf("first message = %+v, %v; want the plain one", msg, err)
+	}
+	msg, err = sub.NextMsg(2 * time.Second)
+	if err != nil || string(msg.Data) != `{"n":7}` || msg.Header.Get("Content-Type") != "application/json" || msg.Header.Get("Order") != "7" {
+		t.Fatalf("second message = %+v, %v; want the JSON one with headers", msg, err)
+	}
+	if stored := vq.Messages("orders.created"); len(stored) != 2 || stored[1].ContentType != "application/json" || stored[1].Headers["Order"] != "7" {
+		t.Errorf("stored messages = %+v; want the content type and header", stored)
+	}
+	// topics are swirled independently, so only the order within a topic holds
+	subjects := map[string]int{}
+	for range 3 {
+		msg, err := all.NextMsg(2 * time.Second)
+		if err != nil {
+			t.Fatalf("> subscription error: %v", err)
+		}
+		subjects[msg.Subject]++
+	}
+	if !reflect.DeepEqual(subjects, map[string]int{"orders.created": 2, "orders.eu.shipped": 1}) {
+		t.Errorf("> subscription got %v; want both subjects", subjects)
+	}
+	if msg, err := sub.NextMsg(100 * time.Millisecond); err == nil {
+		t.Errorf("* subscription got %s; want nothing", msg.Subject)
+	}
+}
+
+// Test queue group members share the messages while other subscriptions get all
+func TestQueueGroup(t *testing.T) {
+	_, url := startApp(t, _pingInterval)
+	counts := make(chan string, 100)
+	for _, name := range []string{"a", "b"} {
+		nc := connect(t, url)
+		if _, err := nc.QueueSubscribe("jobs", "workers", func(*nats.Msg) { counts <- name }); err != nil {
+			t.Fatalf("queue subscribe error: %v", err)
+		}
+		_ = nc.Flush()
+	}
+	nc := connect(t, url)
+	plain, _ := nc.SubscribeSync("jobs")
+	_ = nc.Flush()
+
+	for i := range 10 {
+		_ = nc.Publish("jobs", fmt.Append(nil, i))
+	}
+	got := map[string]int{}
+	for range 10 {
+		select {
+		case name := <-counts:
+			got[name]++
+		case <-time.After(2 * time.Second):
+			t.Fatalf("queue group got %v; want 10 messages", got)
+		}
+	}
+	if got["a"] != 5 || got["b"] != 5 {
+		t.Errorf("queue group split = %v; want 5 each", got)
+	}
+	select {
+	case name := <-counts:
+		t.Errorf("member %s got an extra message", name)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for range 10 {
+		if _, err := plain.NextMsg(2 * time.Second); err != nil {
+			t.Fatalf("plain subscription error: %v", err)
+		}
+	}
+}
+
+// Test requests are answered through inbox subjects and fail fast without responders
+func TestRequestReply(t *testing.T) {
+	vq, url := startApp(t, _pingInterval)
+	responder := connect(t, url)
+	_, err := responder.Subscribe("svc.echo", func(m *nats.Msg) { _ = m.Respond(append([]byte("echo: "), m.Data...)) })
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	_ = responder.Flush()
+
+	requester := connect(t, url)
+	resp, err := requester.Request("svc.echo", []byte("hi"), 2*time.Second)
+	if err != nil || string(resp.Data) != "echo: hi" {
+		t.Fatalf("request = %v, %v; want the echo", resp, err)
+	}
+	start := time.Now()
+	if _, err := requester.Request("svc.nobody", []byte("hi"), 2*time.Second); !errors.Is(err, nats.ErrNoResponders) {
+		t.Errorf("request without responders error = %v; want ErrNoResponders", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Error("request without responders waited for the timeout")
+	}
+
+	// the inboxes are dropped once the replies were delivered
+	deadline := time.Now().Add(2 * time.Second)
+	for inboxes(vq) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := inboxes(vq); n > 0 {
+		t.Errorf("%d inbox topics retained after the replies", n)
+	}
+}
+
+func inboxes(vq *broker.VortexQ[any]) int {
+	n := 0
+	for _, topic := range vq.ListTopics() {
+		if strings.HasPrefix(topic.Name, "_INBOX.") {
+			n++
+		}
+	}
+	return n
+}
+
+// Test verbose acknowledgements, errors, UNSUB with a maximum and stale connections
+func TestProtocol(t *testing.T) {
+	_, url := startApp(t, 50*time.Millisecond)
+	conn, err := net.Dial("tcp", strings.TrimPrefix(url, "nats://"))
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	expect := func(want string) {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatalf("read error: %v; want %q", err, want)
+			}
+			// the server pings in the background
+			if line == "PING\r\n" {
+				_, _ = conn.Write([]byte("PONG\r\n"))
+				continue
+			}
+			if !strings.HasPrefix(line, want) {
+				t.Fatalf("got %q; want %q", line, want)
+			}
+			return
+		}
+	}
+	send := func(s string) {
+		t.Helper()
+		if _, err := conn.Write([]byte(s)); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+
+	expect("INFO {")
+	send("CONNECT {\"verbose\":true}\r\n")
+	expect("+OK")
+	send("PUB a.* 1\r\nx\r\n")
+	expect("-ERR 'Invalid Publish Subject'")
+	send("SUB a 1\r\nUNSUB 1 2\r\n")
+	expect("+OK")
+	expect("+OK")
+	send("PUB a 1\r\nx\r\nPUB a 1\r\ny\r\nPUB a 1\r\nz\r\n")
+	for range 3 {
+		expect("+OK")
+	}
+	expect("MSG a 1 1")
+	expect("x")
+	expect("MSG a 1 1")
+	expect("y")
+	send("PING\r\n")
+	expect("PONG")
+
+	// unanswered pings end the connection
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	out, _ := io.ReadAll(r)
+	if !strings.HasSuffix(string(out), "-ERR 'Stale Connection'\r\n") {
+		t.Errorf("connection ended with %q; want a stale connection error", out)
+	}
+}
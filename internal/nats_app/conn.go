@@ -0,0 +1,565 @@
+package nats_app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"io"
+	"log/slog"
+	"maps"
+	"net"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	_pingInterval   = 2 * time.Minute
+	_maxPingsOut    = 2
+	_writeWait      = 10 * time.Second
+	_maxPayload     = 1 << 20
+	_maxControlLine = 4096
+
+	serverVersion = "2.10.0"
+	headerVersion = "NATS/1.0"
+	// contentTypeHeader carries the content type of a message
+	contentTypeHeader = "Content-Type"
+)
+
+// natsError is answered with -ERR, fatal ones close the connection.
+type natsError struct {
+	message string
+	fatal   bool
+}
+
+func (e *natsError) Error() string { return e.message }
+
+var (
+	errUnknownOperation = &natsError{message: "Unknown Protocol Operation", fatal: true}
+	errControlLine      = &natsError{message: "Maximum Control Line Exceeded", fatal: true}
+	errMaxPayload       = &natsError{message: "Maximum Payload Violation", fatal: true}
+	errStale            = &natsError{message: "Stale Connection", fatal: true}
+	errPublishSubject   = &natsError{message: "Invalid Publish Subject"}
+	errSubject          = &natsError{message: "Invalid Subject"}
+)
+
+// serverInfo is sent with INFO when a client connects.
+type serverInfo struct {
+	ServerID   string `json:"server_id"`
+	ServerName string `json:"server_name"`
+	Version    string `json:"version"`
+	Proto      int    `json:"proto"`
+	Go         string `json:"go"`
+	Host       string `json:"host"`
+	Port       int    `json:"port"`
+	Headers    bool   `json:"headers"`
+	MaxPayload int    `json:"max_payload"`
+	ClientID   uint64 `json:"client_id"`
+	ClientIP   string `json:"client_ip,omitempty"`
+}
+
+// connectOptions are the options of CONNECT the server acts on.
+type connectOptions struct {
+	Verbose      bool  `json:"verbose"`
+	Headers      bool  `json:"headers"`
+	Echo         *bool `json:"echo"`
+	NoResponders bool  `json:"no_responders"`
+}
+
+// conn is a client connection, its subscriptions end with it.
+type conn struct {
+	app *App
+	nc  net.Conn
+	r   *bufio.Reader
+	log *slog.Logger
+	id  uint64
+	// source marks the messages the connection published, to not echo them
+	source string
+
+	ctx      context.Context
+	cancel   context.CancelFunc
+	writeMu  sync.Mutex
+	pingsOut atomic.Int32
+
+	mu      sync.Mutex
+	options connectOptions
+	subs    map[string]*subscription
+}
+
+// subscription is a SUB of the connection.
+type subscription struct {
+	sid     string
+	subject string
+	queue   string
+	// cancel ends the consumer of subscriptions outside a queue group
+	cancel context.CancelFunc
+	// max is the number of messages after which the subscription ends, 0 for no limit
+	max       int
+	delivered int
+}
+
+func (a *App) handle(nc net.Conn) {
+	const op = "nats_app.App.handle"
+
+	c := &conn{
+		app:  a,
+		id:   a.clients.Add(1),
+		nc:   nc,
+		r:    bufio.NewReaderSize(nc, _maxControlLine),
+		log:  a.log.With(slog.String("remote", nc.RemoteAddr().String())),
+		subs: make(map[string]*subscription),
+	}
+	c.options.Echo = new(bool)
+	*c.options.Echo = true
+	c.ctx, c.cancel = context.WithCancel(a.server.Context())
+	defer c.cancel()
+	defer nc.Close()
+	defer c.end()
+	c.source = "/nats/" + a.id + "/" + strconv.FormatUint(c.id, 10)
+
+	if err := c.info(); err != nil {
+		return
+	}
+	go c.ping()
+	err := c.serve()
+	var ne *natsError
+	if errors.As(err, &ne) {
+		_ = c.writeError(ne)
+	}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		c.log.With(slog.String("op", op)).Warn("nats connection failed", logging.Err(err))
+	}
+}
+
+func (c *conn) info() error {
+	host, port, _ := net.SplitHostPort(c.nc.LocalAddr().String())
+	clientIP, _, _ := net.SplitHostPort(c.nc.RemoteAddr().String())
+	p, _ := strconv.Atoi(port)
+	b, err := json.Marshal(serverInfo{
+		ServerID: c.app.id, ServerName: "vortexq", Version: serverVersion, Proto: 1, Go: runtime.Version(),
+		Host: host, Port: p, Headers: true, MaxPayload: _maxPayload, ClientID: c.id, ClientIP: clientIP,
+	})
+	if err != nil {
+		return err
+	}
+	return c.write(fmt.Appendf(nil, "INFO %s\r\n", b))
+}
+
+// ping pings the client every ping interval and closes the connection once
+// too many pings went unanswered.
+func (c *conn) ping() {
+	ticker := time.NewTicker(c.app.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.ctx.Done():
+			return
+		case <-ticker.C:
+			if c.pingsOut.Add(1) > _maxPingsOut {
+				_ = c.writeError(errStale)
+				_ = c.nc.Close()
+				return
+			}
+			if err := c.write([]byte("PING\r\n")); err != nil {
+				_ = c.nc.Close()
+				return
+			}
+		}
+	}
+}
+
+// serve runs the operations of the client until it disconnects.
+func (c *conn) serve() error {
+	for {
+		line, err := c.r.ReadSlice('\n')
+		if errors.Is(err, bufio.ErrBufferFull) {
+			return errControlLine
+		}
+		if err != nil {
+			return err
+		}
+		args := strings.Fields(string(line))
+		if len(args) == 0 {
+			continue
+		}
+
+		var opErr error
+		op := strings.ToUpper(args[0])
+		switch op {
+		case "PING":
+			opErr = c.write([]byte("PONG\r\n"))
+		case "PONG":
+			c.pingsOut.Store(0)
+		case "CONNECT":
+			opErr = c.connect(strings.TrimSpace(string(line))[len(args[0]):])
+		case "PUB":
+			opErr = c.publish(args[1:], false)
+		case "HPUB":
+			opErr = c.publish(args[1:], true)
+		case "SUB":
+			opErr = c.subscribe(args[1:])
+		case "UNSUB":
+			opErr = c.unsubscribe(args[1:])
+		default:
+			return errUnknownOperation
+		}
+
+		var ne *natsError
+		switch {
+		case errors.As(opErr, &ne) && !ne.fatal:
+			if err := c.writeError(ne); err != nil {
+				return err
+			}
+		case opErr != nil:
+			return opErr
+		case c.verbose() && op != "PING" && op != "PONG":
+			if err := c.write([]byte("+OK\r\n")); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *conn) verbose() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.options.Verbose
+}
+
+func (c *conn) write(b []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.nc.SetWriteDeadline(time.Now().Add(_writeWait))
+	_, err := c.nc.Write(b)
+	return err
+}
+
+func (c *conn) writeError(e *natsError) error {
+	return c.write(fmt.Appendf(nil, "-ERR '%s'\r\n", e.message))
+}
+
+func (c *conn) connect(arg string) error {
+	var opts connectOptions
+	if err := json.Unmarshal([]byte(arg), &opts); err != nil {
+		return &natsError{message: "Parser Error", fatal: true}
+	}
+	if opts.Echo == nil {
+		opts.Echo = new(bool)
+		*opts.Echo = true
+	}
+	c.mu.Lock()
+	c.options = opts
+	c.mu.Unlock()
+	return nil
+}
+
+// readPayload reads the payload of size bytes following PUB and HPUB.
+func (c *conn) readPayload(size string) ([]byte, error) {
+	n, err := strconv.Atoi(size)
+	switch {
+	case err != nil || n < 0:
+		return nil, errUnknownOperation
+	case n > _maxPayload:
+		return nil, errMaxPayload
+	}
+	b := make([]byte, n+2)
+	if _, err := io.ReadFull(c.r, b); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(b, []byte("\r\n")) {
+		return nil, errUnknownOperation
+	}
+	return b[:n], nil
+}
+
+// publish handles PUB subject [reply-to] size and HPUB subject [reply-to] header-size size.
+func (c *conn) publish(args []string, headers bool) error {
+	want := 2
+	if headers {
+		want = 3
+	}
+	if len(args) != want && len(args) != want+1 {
+		return errUnknownOperation
+	}
+	subject, reply := args[0], ""
+	if len(args) == want+1 {
+		reply = args[1]
+	}
+	payload, err := c.readPayload(args[len(args)-1])
+	if err != nil {
+		return err
+	}
+	// wildcards are checked before the no responders answer
+	if !validSubject(subject) || broker.ValidateTopicName(subject) != nil || (reply != "" && !validSubject(reply)) {
+		return errPublishSubject
+	}
+
+	msg := broker.Message[any]{ID: broker.NewID(), Pattern: subject, ReplyTo: reply, Source: c.source}
+	if headers {
+		n, err := strconv.Atoi(args[len(args)-2])
+		if err != nil || n < 0 || n > len(payload) {
+			return errUnknownOperation
+		}
+		if err := parseHeaders(payload[:n], &msg); err != nil {
+			return err
+		}
+		payload = payload[n:]
+	}
+	if err := msg.SetPayload(payload); err != nil {
+		return &natsError{message: "Invalid Payload: " + err.Error()}
+	}
+	if reply != "" && c.noResponders() && !c.hasResponders(subject) {
+		return c.answerNoResponders(reply)
+	}
+	if _, err := c.app.funcs.Publish(msg); err != nil {
+		return errPublishSubject
+	}
+	return nil
+}
+
+func (c *conn) noResponders() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.options.NoResponders && c.options.Headers
+}
+
+// hasResponders reports whether any subscription could receive a request to subject.
+func (c *conn) hasResponders(subject string) bool {
+	for _, sub := range c.app.funcs.ListSubscriptions() {
+		if broker.MatchTopic(sub.TopicName, subject) {
+			return true
+		}
+	}
+	return false
+}
+
+// answerNoResponders sends the 503 status to the subscriptions of the requester
+// waiting for the reply, like a NATS server does for requests nobody listens to.
+func (c *conn) answerNoResponders(reply string) error {
+	c.mu.Lock()
+	var sids []string
+	for sid, sub := range c.subs {
+		if broker.MatchTopic(sub.subject, reply) {
+			sids = append(sids, sid)
+		}
+	}
+	c.mu.Unlock()
+	status := headerVersion + " 503\r\n\r\n"
+	for _, sid := range sids {
+		if err := c.write(fmt.Appendf(nil, "HMSG %s %s %d %d\r\n%s\r\n", reply, sid, len(status), len(status), status)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseHeaders reads the header block of HPUB into msg, the first value of a
+// header wins.
+func parseHeaders(b []byte, msg *broker.Message[any]) error {
+	lines := strings.Split(strings.TrimSuffix(string(b), "\r\n\r\n"), "\r\n")
+	if !strings.HasPrefix(lines[0], headerVersion) {
+		return &natsError{message: "Invalid Headers", fatal: true}
+	}
+	for _, line := range lines[1:] {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if strings.EqualFold(key, contentTypeHeader) {
+			if msg.ContentType == "" {
+				msg.ContentType = value
+			}
+			continue
+		}
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		if _, ok := msg.Headers[key]; !ok {
+			msg.Headers[key] = value
+		}
+	}
+	return nil
+}
+
+// validSubject checks subjects have no empty tokens and '>' comes last.
+func validSubject(subject string) bool {
+	return subject != "" && broker.ValidateTopicPattern(subject) == nil
+}
+
+// subscribe handles SUB subject [queue group] sid.
+func (c *conn) subscribe(args []string) error {
+	const op = "nats_app.conn.subscribe"
+
+	if len(args) != 2 && len(args) != 3 {
+		return errUnknownOperation
+	}
+	sub := &subscription{subject: args[0], sid: args[len(args)-1]}
+	if len(args) == 3 {
+		sub.queue = args[1]
+	}
+	if !validSubject(sub.subject) {
+		return errSubject
+	}
+	c.mu.Lock()
+	_, exists := c.subs[sub.sid]
+	if !exists {
+		c.subs[sub.sid] = sub
+	}
+	c.mu.Unlock()
+	if exists {
+		return nil
+	}
+
+	if sub.queue != "" {
+		err := c.app.join(c, sub)
+		if err != nil {
+			c.mu.Lock()
+			delete(c.subs, sub.sid)
+			c.mu.Unlock()
+			c.log.With(slog.String("op", op)).Warn("failed to join queue group", slog.String("subject", sub.subject), logging.Err(err))
+			return errSubject
+		}
+		return nil
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	deliveries, err := c.app.funcs.Consume(ctx, broker.Subscription{TopicName: sub.subject, Protocol: Protocol}, broker.ConsumeOptions{AutoAck: true})
+	if err != nil {
+		cancel()
+		c.mu.Lock()
+		delete(c.subs, sub.sid)
+		c.mu.Unlock()
+		c.log.With(slog.String("op", op)).Warn("failed to subscribe", slog.String("subject", sub.subject), logging.Err(err))
+		return errSubject
+	}
+	sub.cancel = cancel
+	go func() {
+		for d := range deliveries {
+			c.deliver(sub, d.Message)
+		}
+	}()
+	return nil
+}
+
+// unsubscribe handles UNSUB sid [max], with max the subscription ends after
+// that many messages in total.
+func (c *conn) unsubscribe(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errUnknownOperation
+	}
+	limit := 0
+	if len(args) == 2 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 0 {
+			return errUnknownOperation
+		}
+		limit = n
+	}
+
+	c.mu.Lock()
+	sub, ok := c.subs[args[0]]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	if limit > sub.delivered {
+		sub.max = limit
+		c.mu.Unlock()
+		return nil
+	}
+	delete(c.subs, sub.sid)
+	c.mu.Unlock()
+	c.release(sub)
+	return nil
+}
+
+// release ends the consumer or the queue group membership of a subscription.
+func (c *conn) release(sub *subscription) {
+	if sub.queue != "" {
+		c.app.leave(c, sub)
+		return
+	}
+	if sub.cancel != nil {
+		sub.cancel()
+	}
+}
+
+// end releases the subscriptions of a closed connection.
+func (c *conn) end() {
+	c.mu.Lock()
+	subs := c.subs
+	c.subs = make(map[string]*subscription)
+	c.mu.Unlock()
+	for _, sub := range subs {
+		c.release(sub)
+	}
+}
+
+// deliver sends msg as MSG or HMSG, it reports false when the subscription
+// doesn't take it, so that a queue group can hand it to another member.
+func (c *conn) deliver(sub *subscription, msg broker.Message[any]) bool {
+	const op = "nats_app.conn.deliver"
+
+	c.mu.Lock()
+	echo, headers := *c.options.Echo, c.options.Headers
+	if c.subs[sub.sid] != sub || (!echo && msg.Source == c.source) {
+		c.mu.Unlock()
+		return false
+	}
+	sub.delivered++
+	last := sub.max > 0 && sub.delivered >= sub.max
+	if last {
+		delete(c.subs, sub.sid)
+	}
+	c.mu.Unlock()
+	if last {
+		defer c.release(sub)
+	}
+
+	payload, _, err := msg.Payload()
+	if err != nil {
+		c.log.With(slog.String("op", op)).Warn("can't encode message", slog.String("message", msg.ID), logging.Err(err))
+		return true
+	}
+	reply := ""
+	if msg.ReplyTo != "" {
+		reply = msg.ReplyTo + " "
+	}
+	var b []byte
+	if hdr := encodeHeaders(msg); headers && hdr != nil {
+		b = fmt.Appendf(nil, "HMSG %s %s %s%d %d\r\n", msg.Pattern, sub.sid, reply, len(hdr), len(hdr)+len(payload))
+		b = append(b, hdr...)
+	} else {
+		b = fmt.Appendf(nil, "MSG %s %s %s%d\r\n", msg.Pattern, sub.sid, reply, len(payload))
+	}
+	b = append(append(b, payload...), "\r\n"...)
+	if err := c.write(b); err != nil {
+		_ = c.nc.Close()
+	}
+	return true
+}
+
+// encodeHeaders returns the header block of a message, nil when it has no
+// headers and no content type of its own.
+func encodeHeaders(msg broker.Message[any]) []byte {
+	if len(msg.Headers) == 0 && msg.ContentType == "" {
+		return nil
+	}
+	b := []byte(headerVersion + "\r\n")
+	if msg.ContentType != "" {
+		b = fmt.Appendf(b, "%s: %s\r\n", contentTypeHeader, msg.ContentType)
+	}
+	for _, k := range slices.Sorted(maps.Keys(msg.Headers)) {
+		b = fmt.Appendf(b, "%s: %s\r\n", k, msg.Headers[k])
+	}
+	return append(b, "\r\n"...)
+}
@@ -0,0 +1,80 @@
+package nats_app
+
+import (
+	"context"
+	"github.com/ivanbulyk/vortexq/broker"
+	"slices"
+)
+
+// queue is a queue group, it consumes its subject once and hands every message
+// to one of its members in turn.
+type queue struct {
+	key     string
+	cancel  context.CancelFunc
+	members []member
+	next    int
+}
+
+type member struct {
+	c   *conn
+	sub *subscription
+}
+
+func queueKey(subject, group string) string {
+	return subject + " " + group
+}
+
+// join adds the subscription to its queue group, the first member starts the consumer.
+func (a *App) join(c *conn, sub *subscription) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := queueKey(sub.subject, sub.queue)
+	if q, ok := a.queues[key]; ok {
+		q.members = append(q.members, member{c: c, sub: sub})
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(a.server.Context())
+	deliveries, err := a.funcs.Consume(ctx, broker.Subscription{TopicName: sub.subject, Protocol: Protocol}, broker.ConsumeOptions{AutoAck: true})
+	if err != nil {
+		cancel()
+		return err
+	}
+	q := &queue{key: key, cancel: cancel, members: []member{{c: c, sub: sub}}}
+	a.queues[key] = q
+	go a.dispatch(q, deliveries)
+	return nil
+}
+
+// leave removes the subscription from its queue group, the last member stops the consumer.
+func (a *App) leave(c *conn, sub *subscription) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	q, ok := a.queues[queueKey(sub.subject, sub.queue)]
+	if !ok {
+		return
+	}
+	q.members = slices.DeleteFunc(q.members, func(m member) bool { return m.c == c && m.sub == sub })
+	if len(q.members) == 0 {
+		q.cancel()
+		delete(a.queues, q.key)
+	}
+}
+
+// dispatch hands each message to the next member taking it, messages no member
+// takes are dropped like NATS does.
+func (a *App) dispatch(q *queue, deliveries <-chan broker.Delivery[any]) {
+	for d := range deliveries {
+		a.mu.Lock()
+		members := slices.Clone(q.members)
+		start := q.next
+		q.next++
+		a.mu.Unlock()
+		for i := range members {
+			m := members[(start+i)%len(members)]
+			if m.c.deliver(m.sub, d.Message) {
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package resp_app
+
+import (
+	"context"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver"
+	"log/slog"
+	"sync"
+)
+
+// Protocol marks the subscriptions consumed over RESP.
+const Protocol = "resp"
+
+type App struct {
+	log    *slog.Logger
+	funcs  broker.VortexQFuncs
+	server *tcpserver.Server
+
+	mu     sync.Mutex
+	groups map[string]*group
+}
+
+// New creates new RESP app listening on addr, it maps Redis pub/sub and streams onto the broker.
+func New(log *slog.Logger, funcs broker.VortexQFuncs, addr string) *App {
+	a := &App{
+		log:    log,
+		funcs:  funcs,
+		groups: make(map[string]*group),
+	}
+	a.server = tcpserver.New(log, Protocol, addr, a.handle)
+	return a
+}
+
+// MustRun runs RESP server and panics if any error occurs.
+func (a *App) MustRun() {
+	if err := a.server.Run(); err != nil {
+		panic(err)
+	}
+}
+
+// Ready is closed once the server accepts connections.
+func (a *App) Ready() <-chan struct{} {
+	return a.server.Ready()
+}
+
+// Stop closes the listener and the client connections, waiting for them to end
+// until timeoutCtx is done.
+func (a *App) Stop(timeoutCtx context.Context) error {
+	return a.server.Stop(timeoutCtx)
+}
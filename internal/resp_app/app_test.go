@@ -0,0 +1,239 @@
+package resp_app
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver/tcpservertest"
+	"github.com/redis/go-redis/v9"
+)
+
+// startApp serves the RESP app on a loopback port, swirls the broker and returns a client
+func startApp(t *testing.T) (*broker.VortexQ[any], *redis.Client, string) {
+	t.Helper()
+	vq := broker.NewVortexQ[any]()
+	app := New(slog.Default(), vq, "127.0.0.1:0")
+
+	addr := tcpservertest.Start(t, vq, app.server.Serve, app.Stop)
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	t.Cleanup(func() { _ = client.Close() })
+	return vq, client, addr
+}
+
+// Test Redis glob patterns
+func TestGlob(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"news.*", "news.sport.football", true},
+		{"news.*", "weather.today", false},
+		{"h?llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{"*", "", true},
+		{"a*b*c", "abxbyc", true},
+		{"a*b*c", "abxbyd", false},
+		{"h[el", "h[el", true},
+		// one backtrack point, this took exponential time
+		{"a*a*a*a*a*a*a*a*a*a*a*a*b", strings.Repeat("a", 64), false},
+	} {
+		if got := globMatch(tc.pattern, tc.name); got != tc.want {
+			t.Errorf("globMatch(%q, %q) = %v; want %v", tc.pattern, tc.name, got, tc.want)
+		}
+	}
+	for pattern, want := range map[string]string{
+		"news.*":       "news.>",
+		"news.sp*.x":   "news.>",
+		"*":            ">",
+		"orders.eu":    "orders.eu",
+		"orders.*.eu?": "orders.>",
+	} {
+		if got := globTopic(pattern); got != want {
+			t.Errorf("globTopic(%q) = %q; want %q", pattern, got, want)
+		}
+	}
+}
+
+// Test PUBLISH reaches SUBSCRIBE and PSUBSCRIBE clients
+func TestPubSub(t *testing.T) {
+	vq, client, _ := startApp(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if pong, err := client.Ping(ctx).Result(); err != nil || pong != "PONG" {
+		t.Fatalf("PING = %q, %v; want PONG", pong, err)
+	}
+
+	pubsub := client.Subscribe(ctx, "orders.created")
+	defer pubsub.Close()
+	if _, err := pubsub.Receive(ctx); err != nil {
+		t.Fatalf("SUBSCRIBE error: %v", err)
+	}
+	ppubsub := client.PSubscribe(ctx, "orders.*")
+	defer ppubsub.Close()
+	if _, err := ppubsub.Receive(ctx); err != nil {
+		t.Fatalf("PSUBSCRIBE error: %v", err)
+	}
+
+	receivers, err := client.Publish(ctx, "orders.created", "o-1").Result()
+	if err != nil || receivers != 2 {
+		t.Fatalf("PUBLISH = %d, %v; want 2 receivers", receivers, err)
+	}
+	msg, err := pubsub.ReceiveMessage(ctx)
+	if err != nil || msg.Channel != "orders.created" || msg.Payload != "o-1" {
+		t.Fatalf("SUBSCRIBE received %+v, %v; want o-1 on orders.created", msg, err)
+	}
+
+	// messages published to the broker reach pattern subscribers, other channels don't match
+	vq.Publish(broker.Message[any]{ID: "m1", Pattern: "invoices.created", Data: "i-1"})
+	vq.Publish(broker.Message[any]{ID: "m2", Pattern: "orders.eu.shipped", Data: map[string]any{"id": "o-1"}})
+	for _, want := range []string{"o-1", `{"id":"o-1"}`} {
+		msg, err := ppubsub.ReceiveMessage(ctx)
+		if err != nil || msg.Pattern != "orders.*" || msg.Payload != want {
+			t.Fatalf("PSUBSCRIBE received %+v, %v; want %s", msg, err, want)
+		}
+	}
+}
+
+// Test the subscribed state of a connection and inline commands
+func TestSubscribedState(t *testing.T) {
+	_, _, addr := startApp(t)
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	expect := func(command string, want ...string) {
+		t.Helper()
+		if _, err := nc.Write([]byte(command + "\r\n")); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+		for _, line := range want {
+			got, err := r.ReadString('\n')
+			if err != nil || strings.TrimSuffix(got, "\r\n") != line {
+				t.Fatalf("%s replied %q, %v; want %q", command, got, err, line)
+			}
+		}
+	}
+
+	expect("PING", "+PONG")
+	expect("SUBSCRIBE a", "*3", "$9", "subscribe", "$1", "a", ":1")
+	expect("XLEN a", "-ERR unknown command 'XLEN', with args beginning with: 'a' ")
+	expect("ECHO x", "-ERR Can't execute 'echo': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context")
+	expect("PING", "*2", "$4", "pong", "$0", "")
+	expect("UNSUBSCRIBE", "*3", "$11", "unsubscribe", "$1", "a", ":0")
+	expect("ECHO x", "$1", "x")
+	expect("QUIT", "+OK")
+}
+
+// Test stream entries are added and read with XADD and XREAD
+func TestStreams(t *testing.T) {
+	vq, client, _ := startApp(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	id, err := client.XAdd(ctx, &redis.XAddArgs{Stream: "events", Values: []string{"kind", "signup", "user", "u1"}}).Result()
+	if err != nil || id != "1-0" {
+		t.Fatalf("XADD = %q, %v; want 1-0", id, err)
+	}
+	if msgs := vq.Messages("events"); len(msgs) != 1 || msgs[0].Data.(map[string]any)["user"] != "u1" {
+		t.Fatalf("topic events holds %+v; want the fields as data", msgs)
+	}
+	vq.Publish(broker.Message[any]{ID: "m2", Pattern: "events", Data: "raw"})
+
+	streams, err := client.XRead(ctx, &redis.XReadArgs{Streams: []string{"events", "0"}}).Result()
+	if err != nil || len(streams) != 1 || len(streams[0].Messages) != 2 {
+		t.Fatalf("XREAD = %+v, %v; want 2 entries", streams, err)
+	}
+	first, second := streams[0].Messages[0], streams[0].Messages[1]
+	if first.ID != "1-0" || first.Values["kind"] != "signup" || second.ID != "2-0" || second.Values["data"] != `"raw"` {
+		t.Errorf("XREAD entries = %+v; want the fields and the payload as data", streams[0].Messages)
+	}
+
+	// a blocked XREAD returns with the next entry
+	done := make(chan []redis.XStream, 1)
+	go func() {
+		streams, _ := client.XRead(ctx, &redis.XReadArgs{Streams: []string{"events", "$"}, Block: 2 * time.Second}).Result()
+		done <- streams
+	}()
+	time.Sleep(100 * time.Millisecond)
+	client.XAdd(ctx, &redis.XAddArgs{Stream: "events", Values: map[string]any{"kind": "login"}})
+	if streams := <-done; len(streams) != 1 || len(streams[0].Messages) != 1 || streams[0].Messages[0].ID != "3-0" {
+		t.Errorf("blocked XREAD = %+v; want entry 3-0", streams)
+	}
+	if _, err := client.XRead(ctx, &redis.XReadArgs{Streams: []string{"events", "3-0"}, Block: 50 * time.Millisecond}).Result(); err != redis.Nil {
+		t.Errorf("XREAD timeout error = %v; want nil reply", err)
+	}
+}
+
+// Test consumer groups share the entries of a stream until acked
+func TestConsumerGroups(t *testing.T) {
+	_, client, _ := startApp(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := client.XGroupCreate(ctx, "jobs", "workers", "0").Err(); err == nil || !strings.Contains(err.Error(), "MKSTREAM") {
+		t.Fatalf("XGROUP CREATE without stream error = %v; want MKSTREAM hint", err)
+	}
+	for _, job := range []string{"j1", "j2", "j3"} {
+		client.XAdd(ctx, &redis.XAddArgs{Stream: "jobs", Values: []string{"job", job}})
+	}
+	if err := client.XGroupCreate(ctx, "jobs", "workers", "0").Err(); err != nil {
+		t.Fatalf("XGROUP CREATE error: %v", err)
+	}
+	if err := client.XGroupCreate(ctx, "jobs", "workers", "0").Err(); err == nil || !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		t.Fatalf("second XGROUP CREATE error = %v; want BUSYGROUP", err)
+	}
+	if err := client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "nobody", Consumer: "c", Streams: []string{"jobs", ">"}}).Err(); err == nil || !strings.HasPrefix(err.Error(), "NOGROUP") {
+		t.Fatalf("XREADGROUP of a missing group error = %v; want NOGROUP", err)
+	}
+
+	read := func(consumer string, count int64) []redis.XMessage {
+		t.Helper()
+		streams, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group: "workers", Consumer: consumer, Streams: []string{"jobs", ">"}, Count: count, Block: time.Second,
+		}).Result()
+		if err != nil || len(streams) != 1 {
+			t.Fatalf("XREADGROUP = %+v, %v; want entries", streams, err)
+		}
+		return streams[0].Messages
+	}
+	var jobs []string
+	a := read("a", 1)
+	b := read("b", 2)
+	for _, m := range slices.Concat(a, b) {
+		jobs = append(jobs, m.Values["job"].(string))
+	}
+	if len(a) != 1 || len(b) != 2 || !slices.Equal(jobs, []string{"j1", "j2", "j3"}) {
+		t.Fatalf("consumers read %v and %v; want j1 and j2, j3", a, b)
+	}
+
+	// the history of a consumer lists its pending entries
+	pending, err := client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "workers", Consumer: "b", Streams: []string{"jobs", "0"}}).Result()
+	if err != nil || len(pending[0].Messages) != 2 || pending[0].Messages[0].ID != "2-0" {
+		t.Fatalf("pending of b = %+v, %v; want 2-0 and 3-0", pending, err)
+	}
+	if n, err := client.XAck(ctx, "jobs", "workers", "2-0", "3-0", "9-0").Result(); err != nil || n != 2 {
+		t.Fatalf("XACK = %d, %v; want 2", n, err)
+	}
+	pending, _ = client.XReadGroup(ctx, &redis.XReadGroupArgs{Group: "workers", Consumer: "b", Streams: []string{"jobs", "0"}}).Result()
+	if len(pending[0].Messages) != 0 {
+		t.Errorf("pending of b after XACK = %+v; want none", pending[0].Messages)
+	}
+
+	if n, err := client.XGroupDestroy(ctx, "jobs", "workers").Result(); err != nil || n != 1 {
+		t.Errorf("XGROUP DESTROY = %d, %v; want 1", n, err)
+	}
+}
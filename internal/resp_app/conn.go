@@ -0,0 +1,452 @@
+package resp_app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const _writeWait = 10 * time.Second
+
+var errQuit = errors.New("client quit")
+
+// command is a RESP command, minArgs counts the arguments after the command name.
+type command struct {
+	minArgs int
+	run     func(c *conn, args []string) *reply
+	// pubsub commands are the only ones allowed while subscribed
+	pubsub bool
+}
+
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"PING":         {minArgs: 0, run: (*conn).ping, pubsub: true},
+		"ECHO":         {minArgs: 1, run: (*conn).echo},
+		"QUIT":         {minArgs: 0, run: (*conn).quit, pubsub: true},
+		"HELLO":        {minArgs: 0, run: (*conn).hello},
+		"SELECT":       {minArgs: 1, run: (*conn).selectDB},
+		"CLIENT":       {minArgs: 1, run: (*conn).client},
+		"COMMAND":      {minArgs: 0, run: (*conn).commandDocs},
+		"PUBLISH":      {minArgs: 2, run: (*conn).publish},
+		"SUBSCRIBE":    {minArgs: 1, run: (*conn).subscribe, pubsub: true},
+		"PSUBSCRIBE":   {minArgs: 1, run: (*conn).psubscribe, pubsub: true},
+		"UNSUBSCRIBE":  {minArgs: 0, run: (*conn).unsubscribe, pubsub: true},
+		"PUNSUBSCRIBE": {minArgs: 0, run: (*conn).punsubscribe, pubsub: true},
+		"XADD":         {minArgs: 4, run: (*conn).xadd},
+		"XREAD":        {minArgs: 3, run: (*conn).xread},
+		"XREADGROUP":   {minArgs: 6, run: (*conn).xreadgroup},
+		"XACK":         {minArgs: 3, run: (*conn).xack},
+		"XGROUP":       {minArgs: 1, run: (*conn).xgroup},
+	}
+}
+
+// conn is a client connection, its pub/sub subscriptions end with it.
+type conn struct {
+	app *App
+	nc  net.Conn
+	r   *bufio.Reader
+	log *slog.Logger
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	channels map[string]context.CancelFunc
+	patterns map[string]context.CancelFunc
+}
+
+func (a *App) handle(nc net.Conn) {
+	const op = "resp_app.App.handle"
+
+	c := &conn{
+		app:      a,
+		nc:       nc,
+		r:        bufio.NewReader(nc),
+		log:      a.log.With(slog.String("remote", nc.RemoteAddr().String())),
+		channels: make(map[string]context.CancelFunc),
+		patterns: make(map[string]context.CancelFunc),
+	}
+	c.ctx, c.cancel = context.WithCancel(a.server.Context())
+	defer c.cancel()
+	defer nc.Close()
+
+	err := c.serve()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, errQuit) {
+		c.log.With(slog.String("op", op)).Warn("resp connection failed", logging.Err(err))
+	}
+}
+
+// serve runs the commands of the client until it quits.
+func (c *conn) serve() error {
+	for {
+		args, err := readCommand(c.r)
+		if errors.Is(err, errProtocol) {
+			_ = c.write(new(reply).error("ERR Protocol error: " + strings.TrimPrefix(err.Error(), errProtocol.Error()+": ")))
+			return err
+		}
+		if err != nil {
+			return err
+		}
+		if len(args) == 0 {
+			continue
+		}
+
+		name := strings.ToUpper(args[0])
+		cmd, ok := commands[name]
+		var r *reply
+		switch {
+		case !ok:
+			r = new(reply).error(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", args[0], quoteArgs(args[1:])))
+		case len(args)-1 < cmd.minArgs:
+			r = new(reply).error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		case c.subscribed() && !cmd.pubsub:
+			r = new(reply).error(fmt.Sprintf("ERR Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING / QUIT are allowed in this context", strings.ToLower(name)))
+		default:
+			r = cmd.run(c, args[1:])
+		}
+		if r != nil {
+			if err := c.write(r); err != nil {
+				return err
+			}
+		}
+		if name == "QUIT" {
+			return errQuit
+		}
+	}
+}
+
+func quoteArgs(args []string) string {
+	var sb strings.Builder
+	for _, arg := range args {
+		fmt.Fprintf(&sb, "'%s' ", arg)
+	}
+	return sb.String()
+}
+
+func (c *conn) write(r *reply) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.nc.SetWriteDeadline(time.Now().Add(_writeWait))
+	_, err := c.nc.Write(r.b)
+	return err
+}
+
+func (c *conn) subscribed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.channels)+len(c.patterns) > 0
+}
+
+func (c *conn) ping(args []string) *reply {
+	if c.subscribed() {
+		msg := ""
+		if len(args) > 0 {
+			msg = args[0]
+		}
+		return new(reply).bulks("pong", msg)
+	}
+	if len(args) > 0 {
+		return new(reply).bulk(args[0])
+	}
+	return new(reply).simple("PONG")
+}
+
+func (c *conn) echo(args []string) *reply {
+	return new(reply).bulk(args[0])
+}
+
+func (c *conn) quit([]string) *reply {
+	return new(reply).simple("OK")
+}
+
+// hello answers in RESP2, clients asking for RESP3 fall back to it.
+func (c *conn) hello(args []string) *reply {
+	if len(args) > 0 && args[0] != "2" {
+		return new(reply).error("NOPROTO unsupported protocol version")
+	}
+	r := new(reply).array(14)
+	r.bulk("server").bulk("vortexq")
+	r.bulk("version").bulk("7.0.0")
+	r.bulk("proto").integer(2)
+	r.bulk("id").integer(0)
+	r.bulk("mode").bulk("standalone")
+	r.bulk("role").bulk("master")
+	r.bulk("modules").array(0)
+	return r
+}
+
+// selectDB accepts the only database there is.
+func (c *conn) selectDB(args []string) *reply {
+	if args[0] != "0" {
+		return new(reply).error("ERR DB index is out of range")
+	}
+	return new(reply).simple("OK")
+}
+
+// client accepts the connection names and library infos clients send.
+func (c *conn) client(args []string) *reply {
+	switch strings.ToUpper(args[0]) {
+	case "SETNAME", "SETINFO":
+		return new(reply).simple("OK")
+	default:
+		return new(reply).error(fmt.Sprintf("ERR unknown subcommand '%s'.", args[0]))
+	}
+}
+
+// commandDocs gives redis-cli no command docs, it works without.
+func (c *conn) commandDocs([]string) *reply {
+	return new(reply).array(0)
+}
+
+func (c *conn) publish(args []string) *reply {
+	channel, payload := args[0], args[1]
+	msg := broker.Message[any]{ID: broker.NewID(), Pattern: channel}
+	if err := msg.SetPayload([]byte(payload)); err != nil {
+		return new(reply).error("ERR " + err.Error())
+	}
+	// the receivers are counted before publishing, like Redis counts the clients it sent to
+	receivers := 0
+	for _, sub := range c.app.funcs.ListSubscriptions() {
+		if broker.MatchTopic(sub.TopicName, channel) {
+			receivers++
+		}
+	}
+	if _, err := c.app.funcs.Publish(msg); err != nil {
+		return new(reply).error("ERR " + err.Error())
+	}
+	return new(reply).integer(int64(receivers))
+}
+
+func (c *conn) subscribe(args []string) *reply {
+	for _, channel := range args {
+		// channel names are literal, those looking like VortexQ patterns are matched exactly
+		topic, match := channel, func(string) bool { return true }
+		if broker.IsTopicPattern(channel) {
+			topic, match = broker.WildcardRest, func(name string) bool { return name == channel }
+		}
+		c.listen("subscribe", c.channels, channel, topic, match)
+	}
+	return nil
+}
+
+func (c *conn) psubscribe(args []string) *reply {
+	for _, pattern := range args {
+		c.listen("psubscribe", c.patterns, pattern, globTopic(pattern), func(name string) bool {
+			return globMatch(pattern, name)
+		})
+	}
+	return nil
+}
+
+// listen consumes topic for a channel or pattern subscription and forwards the
+// messages accepted by match.
+func (c *conn) listen(kind string, set map[string]context.CancelFunc, name, topic string, match func(string) bool) {
+	const op = "resp_app.conn.listen"
+
+	c.mu.Lock()
+	_, exists := set[name]
+	c.mu.Unlock()
+	var deliveries <-chan broker.Delivery[any]
+	if !exists {
+		ctx, cancel := context.WithCancel(c.ctx)
+		ch, err := c.app.funcs.Consume(ctx, broker.Subscription{TopicName: topic, Protocol: Protocol}, broker.ConsumeOptions{AutoAck: true})
+		if err != nil {
+			cancel()
+			c.log.With(slog.String("op", op)).Warn("failed to subscribe", slog.String(kind, name), logging.Err(err))
+			_ = c.write(new(reply).error("ERR " + err.Error()))
+			return
+		}
+		deliveries = ch
+		c.mu.Lock()
+		set[name] = cancel
+		c.mu.Unlock()
+	}
+
+	_ = c.write(new(reply).array(3).bulk(kind).bulk(name).integer(int64(c.count())))
+	if deliveries != nil {
+		go c.forward(deliveries, kind == "psubscribe", name, match)
+	}
+}
+
+func (c *conn) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.channels) + len(c.patterns)
+}
+
+// forward sends the messages of a subscription as pub/sub pushes.
+func (c *conn) forward(deliveries <-chan broker.Delivery[any], pattern bool, name string, match func(string) bool) {
+	const op = "resp_app.conn.forward"
+
+	for d := range deliveries {
+		channel := d.Message.Pattern
+		if !match(channel) {
+			continue
+		}
+		payload, _, err := d.Message.Payload()
+		if err != nil {
+			c.log.With(slog.String("op", op)).Warn("can't encode message", slog.String("message", d.Message.ID), logging.Err(err))
+			continue
+		}
+		r := new(reply)
+		if pattern {
+			r.array(4).bulk("pmessage").bulk(name)
+		} else {
+			r.array(3).bulk("message")
+		}
+		r.bulk(channel).bulk(string(payload))
+		if err := c.write(r); err != nil {
+			_ = c.nc.Close()
+		}
+	}
+}
+
+func (c *conn) unsubscribe(args []string) *reply {
+	return c.unlisten("unsubscribe", c.channels, args)
+}
+
+func (c *conn) punsubscribe(args []string) *reply {
+	return c.unlisten("punsubscribe", c.patterns, args)
+}
+
+// unlisten ends the named subscriptions, or all of the kind when none is named.
+func (c *conn) unlisten(kind string, set map[string]context.CancelFunc, names []string) *reply {
+	if len(names) == 0 {
+		c.mu.Lock()
+		for name := range set {
+			names = append(names, name)
+		}
+		c.mu.Unlock()
+		slices.Sort(names)
+	}
+	if len(names) == 0 {
+		return new(reply).array(3).bulk(kind).null().integer(int64(c.count()))
+	}
+
+	r := new(reply)
+	for _, name := range names {
+		c.mu.Lock()
+		cancel, ok := set[name]
+		delete(set, name)
+		c.mu.Unlock()
+		if ok {
+			cancel()
+		}
+		r.array(3).bulk(kind).bulk(name).integer(int64(c.count()))
+	}
+	return r
+}
+
+// globTopic returns the VortexQ topic or pattern covering what a Redis glob pattern
+// matches: its literal leading levels followed by >.
+func globTopic(pattern string) string {
+	levels := strings.Split(pattern, broker.TopicSeparator)
+	for i, level := range levels {
+		if strings.ContainsAny(level, `*?[\`) || level == broker.WildcardRest {
+			if i == 0 {
+				return broker.WildcardRest
+			}
+			return strings.Join(levels[:i], broker.TopicSeparator) + broker.TopicSeparator + broker.WildcardRest
+		}
+	}
+	if broker.IsTopicPattern(pattern) {
+		return broker.WildcardRest
+	}
+	return pattern
+}
+
+// globMatch matches name against a Redis glob pattern with *, ?, [...] and \ escapes.
+// Every other element matches one byte, so only the last * is ever backtracked to
+// and patterns with many stars can't take exponential time.
+func globMatch(pattern, name string) bool {
+	p, n := 0, 0
+	// star is the last * seen and resume the name position it matched up to
+	star, resume := -1, 0
+	for n < len(name) {
+		if p < len(pattern) && pattern[p] == '*' {
+			star, resume = p, n
+			p++
+			continue
+		}
+		if width, ok := matchOne(pattern[p:], name[n]); ok {
+			p, n = p+width, n+1
+			continue
+		}
+		if star < 0 {
+			return false
+		}
+		// the star takes one more byte
+		resume++
+		p, n = star+1, resume
+	}
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
+
+// matchOne matches b against the element pattern starts with, it returns the
+// length of the element.
+func matchOne(pattern string, b byte) (int, bool) {
+	if len(pattern) == 0 {
+		return 0, false
+	}
+	switch pattern[0] {
+	case '?':
+		return 1, true
+	case '[':
+		matched, rest, ok := matchClass(pattern[1:], b)
+		if !ok {
+			// an unterminated class matches [ literally
+			return 1, b == '['
+		}
+		return len(pattern) - len(rest), matched
+	case '\\':
+		if len(pattern) > 1 {
+			return 2, pattern[1] == b
+		}
+	}
+	return 1, pattern[0] == b
+}
+
+// matchClass matches b against the class that starts after [, it returns the pattern
+// after the closing ] and false when there is none.
+func matchClass(class string, b byte) (bool, string, bool) {
+	negate := len(class) > 0 && class[0] == '^'
+	if negate {
+		class = class[1:]
+	}
+	matched := false
+	for i := 0; i < len(class); i++ {
+		switch {
+		case class[i] == ']':
+			return matched != negate, class[i+1:], true
+		case class[i] == '\\' && i+1 < len(class):
+			i++
+			matched = matched || class[i] == b
+		case i+2 < len(class) && class[i+1] == '-' && class[i+2] != ']':
+			lo, hi := class[i], class[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (b >= lo && b <= hi)
+			i += 2
+		default:
+			matched = matched || class[i] == b
+		}
+	}
+	return false, "", false
+}
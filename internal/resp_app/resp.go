@@ -0,0 +1,131 @@
+package resp_app
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	_maxArgs     = 1 << 16
+	_maxBulkSize = 1 << 20
+	_maxInline   = 64 << 10
+)
+
+var errProtocol = errors.New("protocol error")
+
+// readCommand reads a command sent as an array of bulk strings, or inline as a
+// line of words as typed into telnet.
+func readCommand(r *bufio.Reader) ([]string, error) {
+	b, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	if b[0] != '*' {
+		line, err := readLine(r, _maxInline)
+		if err != nil {
+			return nil, err
+		}
+		return strings.Fields(line), nil
+	}
+
+	line, err := readLine(r, _maxInline)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > _maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	args := make([]string, 0, max(n, 0))
+	for range n {
+		line, err := readLine(r, _maxInline)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > _maxBulkSize {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string without CRLF", errProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func readLine(r *bufio.Reader, maxSize int) (string, error) {
+	var line []byte
+	for {
+		chunk, isPrefix, err := r.ReadLine()
+		if err != nil {
+			return "", err
+		}
+		line = append(line, chunk...)
+		if len(line) > maxSize {
+			return "", fmt.Errorf("%w: too big inline request", errProtocol)
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+// reply builds RESP2 replies.
+type reply struct{ b []byte }
+
+func (r *reply) simple(s string) *reply {
+	r.b = append(append(append(r.b, '+'), s...), "\r\n"...)
+	return r
+}
+
+func (r *reply) error(s string) *reply {
+	r.b = append(append(append(r.b, '-'), s...), "\r\n"...)
+	return r
+}
+
+func (r *reply) integer(n int64) *reply {
+	r.b = append(strconv.AppendInt(append(r.b, ':'), n, 10), "\r\n"...)
+	return r
+}
+
+func (r *reply) bulk(s string) *reply {
+	r.b = append(strconv.AppendInt(append(r.b, '$'), int64(len(s)), 10), "\r\n"...)
+	r.b = append(append(r.b, s...), "\r\n"...)
+	return r
+}
+
+func (r *reply) null() *reply {
+	r.b = append(r.b, "$-1\r\n"...)
+	return r
+}
+
+func (r *reply) nullArray() *reply {
+	r.b = append(r.b, "*-1\r\n"...)
+	return r
+}
+
+// array starts an array of n elements, they are added with the following calls.
+func (r *reply) array(n int) *reply {
+	r.b = append(strconv.AppendInt(append(r.b, '*'), int64(n), 10), "\r\n"...)
+	return r
+}
+
+func (r *reply) bulks(values ...string) *reply {
+	r.array(len(values))
+	for _, v := range values {
+		r.bulk(v)
+	}
+	return r
+}
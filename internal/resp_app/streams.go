@@ -0,0 +1,480 @@
+package resp_app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// _pollInterval is how often blocked XREAD and XREADGROUP calls look for new entries.
+const _pollInterval = 20 * time.Millisecond
+
+var errNoGroup = errors.New("no such consumer group")
+
+// group is a consumer group of a stream, its consumers share one broker subscription.
+type group struct {
+	deliveries <-chan broker.Delivery[any]
+	cancel     context.CancelFunc
+
+	mu sync.Mutex
+	// pending maps the offsets of the entries read and not acked yet
+	pending map[int64]pendingEntry
+}
+
+type pendingEntry struct {
+	token    string
+	consumer string
+	msg      broker.Message[any]
+}
+
+// groupSubscriptionID names the broker subscription of a consumer group.
+func groupSubscriptionID(key, name string) string {
+	return Protocol + ":" + key + ":" + name
+}
+
+// entryID turns a topic offset into a stream entry ID, offsets start at 0 while the
+// smallest entry ID is 1-0.
+func entryID(offset int64) string {
+	return strconv.FormatInt(offset+1, 10) + "-0"
+}
+
+// parseEntryID returns the offset following the entry ID, where a read after it starts.
+func parseEntryID(id string) (int64, error) {
+	ms, seq, _ := strings.Cut(id, "-")
+	next, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil || next < 0 {
+		return 0, errors.New("ERR Invalid stream ID specified as stream command argument")
+	}
+	if seq != "" {
+		if _, err := strconv.ParseUint(seq, 10, 64); err != nil {
+			return 0, errors.New("ERR Invalid stream ID specified as stream command argument")
+		}
+	}
+	return next, nil
+}
+
+// entryFields returns the fields of a message, the keys of a JSON object or its
+// payload as the data field.
+func entryFields(msg broker.Message[any]) []string {
+	if data, ok := msg.Data.(map[string]any); ok && len(data) > 0 {
+		keys := make([]string, 0, len(data))
+		for k := range data {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		fields := make([]string, 0, 2*len(keys))
+		for _, k := range keys {
+			value, ok := data[k].(string)
+			if !ok {
+				b, _ := json.Marshal(data[k])
+				value = string(b)
+			}
+			fields = append(fields, k, value)
+		}
+		return fields
+	}
+	payload, _, _ := msg.Payload()
+	return []string{"data", string(payload)}
+}
+
+func (r *reply) entries(msgs []broker.Message[any]) *reply {
+	r.array(len(msgs))
+	for _, msg := range msgs {
+		r.array(2).bulk(entryID(msg.Offset)).bulks(entryFields(msg)...)
+	}
+	return r
+}
+
+// readOptions are the COUNT, BLOCK and NOACK options followed by STREAMS keys and IDs.
+type readOptions struct {
+	count int
+	// block is how long to wait for entries, negative without BLOCK and 0 for ever
+	block time.Duration
+	noAck bool
+	keys  []string
+	ids   []string
+}
+
+func parseReadOptions(args []string, group bool) (readOptions, error) {
+	opts := readOptions{block: -1}
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COUNT", "BLOCK":
+			if i+1 == len(args) {
+				return opts, errors.New("ERR syntax error")
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				return opts, errors.New("ERR value is not an integer or out of range")
+			}
+			if strings.ToUpper(args[i]) == "COUNT" {
+				opts.count = n
+			} else {
+				opts.block = time.Duration(n) * time.Millisecond
+			}
+			i++
+		case "NOACK":
+			if !group {
+				return opts, errors.New("ERR syntax error")
+			}
+			opts.noAck = true
+		case "STREAMS":
+			rest := args[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return opts, errors.New("ERR Unbalanced 'xread' list of streams: for each stream key an ID or '$' must be specified.")
+			}
+			opts.keys, opts.ids = rest[:len(rest)/2], rest[len(rest)/2:]
+			return opts, nil
+		default:
+			return opts, errors.New("ERR syntax error")
+		}
+	}
+	return opts, errors.New("ERR syntax error")
+}
+
+// wait polls read until it reports entries or the BLOCK timeout passes.
+func (c *conn) wait(block time.Duration, read func() bool) bool {
+	if read() {
+		return true
+	}
+	if block < 0 {
+		return false
+	}
+	var timeout <-chan time.Time
+	if block > 0 {
+		timer := time.NewTimer(block)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	ticker := time.NewTicker(_pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if read() {
+				return true
+			}
+		case <-timeout:
+			return false
+		case <-c.ctx.Done():
+			return false
+		}
+	}
+}
+
+// xadd publishes the fields as a JSON object, retention replaces MAXLEN and MINID.
+func (c *conn) xadd(args []string) *reply {
+	key, args := args[0], args[1:]
+	noMkStream := false
+options:
+	for len(args) > 0 {
+		switch strings.ToUpper(args[0]) {
+		case "NOMKSTREAM":
+			noMkStream = true
+			args = args[1:]
+		case "MAXLEN", "MINID":
+			args = args[1:]
+			if len(args) > 0 && (args[0] == "=" || args[0] == "~") {
+				args = args[1:]
+			}
+			if len(args) == 0 {
+				return new(reply).error("ERR syntax error")
+			}
+			args = args[1:]
+			if len(args) > 1 && strings.ToUpper(args[0]) == "LIMIT" {
+				args = args[2:]
+			}
+		default:
+			break options
+		}
+	}
+	if len(args) < 3 || len(args)%2 != 1 {
+		return new(reply).error("ERR wrong number of arguments for 'xadd' command")
+	}
+	if args[0] != "*" {
+		return new(reply).error("ERR only auto-generated IDs (*) are supported")
+	}
+	if noMkStream {
+		if _, _, err := c.app.funcs.ReadTopic(key, math.MaxInt64, 0); errors.Is(err, broker.ErrNotFound) {
+			return new(reply).null()
+		}
+	}
+
+	data := make(map[string]any, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		data[args[i]] = args[i+1]
+	}
+	offset, err := c.app.funcs.Publish(broker.Message[any]{ID: broker.NewID(), Pattern: key, Data: data})
+	if err != nil {
+		return new(reply).error("ERR " + err.Error())
+	}
+	return new(reply).bulk(entryID(offset))
+}
+
+func (c *conn) xread(args []string) *reply {
+	opts, err := parseReadOptions(args, false)
+	if err != nil {
+		return new(reply).error(err.Error())
+	}
+	offsets := make([]int64, len(opts.keys))
+	for i, id := range opts.ids {
+		if id == "$" {
+			// a stream that doesn't exist yet is read from its first entry
+			_, offsets[i], _ = c.app.funcs.ReadTopic(opts.keys[i], math.MaxInt64, 0)
+			continue
+		}
+		if offsets[i], err = parseEntryID(id); err != nil {
+			return new(reply).error(err.Error())
+		}
+	}
+
+	var r *reply
+	found := c.wait(opts.block, func() bool {
+		var keys []string
+		var results [][]broker.Message[any]
+		for i, key := range opts.keys {
+			msgs, _, err := c.app.funcs.ReadTopic(key, offsets[i], opts.count)
+			if err == nil && len(msgs) > 0 {
+				keys = append(keys, key)
+				results = append(results, msgs)
+			}
+		}
+		if len(keys) == 0 {
+			return false
+		}
+		r = new(reply).array(len(keys))
+		for i, key := range keys {
+			r.array(2).bulk(key).entries(results[i])
+		}
+		return true
+	})
+	if !found {
+		return new(reply).nullArray()
+	}
+	return r
+}
+
+func (c *conn) xreadgroup(args []string) *reply {
+	if strings.ToUpper(args[0]) != "GROUP" {
+		return new(reply).error("ERR syntax error")
+	}
+	name, consumer := args[1], args[2]
+	opts, err := parseReadOptions(args[3:], true)
+	if err != nil {
+		return new(reply).error(err.Error())
+	}
+	groups := make([]*group, len(opts.keys))
+	history := false
+	for i, key := range opts.keys {
+		if groups[i], err = c.app.group(key, name); err != nil {
+			if errors.Is(err, errNoGroup) {
+				return new(reply).error(fmt.Sprintf("NOGROUP No such key '%s' or consumer group '%s' in XREADGROUP with GROUP option", key, name))
+			}
+			return new(reply).error("ERR " + err.Error())
+		}
+		if opts.ids[i] != ">" {
+			history = true
+		}
+	}
+
+	// an ID other than > reads the pending entries of the consumer, it never blocks
+	if history {
+		r := new(reply).array(len(opts.keys))
+		for i, key := range opts.keys {
+			msgs := []broker.Message[any]{}
+			if opts.ids[i] == ">" {
+				msgs = groups[i].take(c.app.funcs, consumer, opts.count, opts.noAck)
+			} else {
+				after, err := parseEntryID(opts.ids[i])
+				if err != nil {
+					return new(reply).error(err.Error())
+				}
+				msgs = groups[i].pendingOf(consumer, after, opts.count)
+			}
+			r.array(2).bulk(key).entries(msgs)
+		}
+		return r
+	}
+
+	var r *reply
+	found := c.wait(opts.block, func() bool {
+		var keys []string
+		var results [][]broker.Message[any]
+		for i, key := range opts.keys {
+			if msgs := groups[i].take(c.app.funcs, consumer, opts.count, opts.noAck); len(msgs) > 0 {
+				keys = append(keys, key)
+				results = append(results, msgs)
+			}
+		}
+		if len(keys) == 0 {
+			return false
+		}
+		r = new(reply).array(len(keys))
+		for i, key := range keys {
+			r.array(2).bulk(key).entries(results[i])
+		}
+		return true
+	})
+	if !found {
+		return new(reply).nullArray()
+	}
+	return r
+}
+
+func (c *conn) xack(args []string) *reply {
+	key, name := args[0], args[1]
+	g, err := c.app.group(key, name)
+	if errors.Is(err, errNoGroup) {
+		return new(reply).integer(0)
+	}
+	if err != nil {
+		return new(reply).error("ERR " + err.Error())
+	}
+	acked := 0
+	for _, id := range args[2:] {
+		next, err := parseEntryID(id)
+		if err != nil {
+			return new(reply).error(err.Error())
+		}
+		if g.ack(c.app.funcs, next-1) {
+			acked++
+		}
+	}
+	return new(reply).integer(int64(acked))
+}
+
+func (c *conn) xgroup(args []string) *reply {
+	switch strings.ToUpper(args[0]) {
+	case "CREATE":
+		if len(args) < 4 {
+			return new(reply).error("ERR wrong number of arguments for 'xgroup|create' command")
+		}
+		key, name, id := args[1], args[2], args[3]
+		mkStream := len(args) > 4 && strings.ToUpper(args[4]) == "MKSTREAM"
+		if !mkStream {
+			if _, _, err := c.app.funcs.ReadTopic(key, math.MaxInt64, 0); errors.Is(err, broker.ErrNotFound) {
+				return new(reply).error("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+			}
+		}
+		sub := broker.Subscription{ID: groupSubscriptionID(key, name), TopicName: key, Protocol: Protocol}
+		if id != "$" {
+			next, err := parseEntryID(id)
+			if err != nil {
+				return new(reply).error(err.Error())
+			}
+			sub.Start = &broker.StartPosition{From: broker.StartOffset, Offset: next}
+		}
+		if _, ok := c.app.funcs.FindSubscription(sub.ID); ok {
+			return new(reply).error("BUSYGROUP Consumer Group name already exists")
+		}
+		if err := c.app.funcs.Subscribe(sub); err != nil {
+			return new(reply).error("ERR " + err.Error())
+		}
+		return new(reply).simple("OK")
+	case "DESTROY":
+		if len(args) != 3 {
+			return new(reply).error("ERR wrong number of arguments for 'xgroup|destroy' command")
+		}
+		if c.app.dropGroup(args[1], args[2]) {
+			return new(reply).integer(1)
+		}
+		return new(reply).integer(0)
+	default:
+		return new(reply).error(fmt.Sprintf("ERR unknown subcommand '%s'. Try XGROUP HELP.", args[0]))
+	}
+}
+
+// group returns the consumer group of a stream, attaching to its subscription on first use.
+func (a *App) group(key, name string) (*group, error) {
+	id := groupSubscriptionID(key, name)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if g, ok := a.groups[id]; ok {
+		return g, nil
+	}
+	sub, ok := a.funcs.FindSubscription(id)
+	if !ok || sub.TopicName != key {
+		return nil, errNoGroup
+	}
+	ctx, cancel := context.WithCancel(a.server.Context())
+	deliveries, err := a.funcs.Consume(ctx, broker.Subscription{ID: id, TopicName: key, Protocol: Protocol}, broker.ConsumeOptions{})
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	g := &group{deliveries: deliveries, cancel: cancel, pending: make(map[int64]pendingEntry)}
+	a.groups[id] = g
+	return g, nil
+}
+
+// dropGroup removes the consumer group and its subscription, it reports whether it existed.
+func (a *App) dropGroup(key, name string) bool {
+	id := groupSubscriptionID(key, name)
+	a.mu.Lock()
+	if g, ok := a.groups[id]; ok {
+		g.cancel()
+		delete(a.groups, id)
+	}
+	a.mu.Unlock()
+	return a.funcs.Unsubscribe(id) == nil
+}
+
+// take hands the entries delivered to the group to one consumer, up to count when
+// positive. They are pending until acked unless noAck is set.
+func (g *group) take(funcs broker.VortexQFuncs, consumer string, count int, noAck bool) []broker.Message[any] {
+	var msgs []broker.Message[any]
+	for count <= 0 || len(msgs) < count {
+		select {
+		case d, ok := <-g.deliveries:
+			if !ok {
+				return msgs
+			}
+			if noAck {
+				_ = funcs.Ack(d.AckToken)
+			} else {
+				// a redelivered entry replaces the one whose ack deadline passed
+				g.mu.Lock()
+				g.pending[d.Message.Offset] = pendingEntry{token: d.AckToken, consumer: consumer, msg: d.Message}
+				g.mu.Unlock()
+			}
+			msgs = append(msgs, d.Message)
+		default:
+			return msgs
+		}
+	}
+	return msgs
+}
+
+// pendingOf returns the pending entries of a consumer from offset on.
+func (g *group) pendingOf(consumer string, offset int64, count int) []broker.Message[any] {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	msgs := []broker.Message[any]{}
+	for off, e := range g.pending {
+		if e.consumer == consumer && off >= offset {
+			msgs = append(msgs, e.msg)
+		}
+	}
+	slices.SortFunc(msgs, func(a, b broker.Message[any]) int { return int(a.Offset - b.Offset) })
+	if count > 0 && len(msgs) > count {
+		msgs = msgs[:count]
+	}
+	return msgs
+}
+
+// ack settles the pending entry at offset, it reports false when there was none.
+func (g *group) ack(funcs broker.VortexQFuncs, offset int64) bool {
+	g.mu.Lock()
+	e, ok := g.pending[offset]
+	delete(g.pending, offset)
+	g.mu.Unlock()
+	return ok && funcs.Ack(e.token) == nil
+}
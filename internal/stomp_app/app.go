@@ -0,0 +1,50 @@
+package stomp_app
+
+import (
+	"context"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver"
+	"log/slog"
+	"time"
+)
+
+// Protocol marks the subscriptions consumed over STOMP.
+const Protocol = "stomp"
+
+type App struct {
+	log    *slog.Logger
+	funcs  broker.VortexQFuncs
+	server *tcpserver.Server
+
+	// heartBeat is the interval the server sends and wants heart-beats at
+	heartBeat time.Duration
+}
+
+// New creates new STOMP app listening on addr, destinations map onto broker topics.
+func New(log *slog.Logger, funcs broker.VortexQFuncs, addr string) *App {
+	a := &App{
+		log:       log,
+		funcs:     funcs,
+		heartBeat: _heartBeat,
+	}
+	a.server = tcpserver.New(log, Protocol, addr, a.handle)
+	return a
+}
+
+// MustRun runs STOMP server and panics if any error occurs.
+func (a *App) MustRun() {
+	if err := a.server.Run(); err != nil {
+		panic(err)
+	}
+}
+
+// Ready is closed once the server accepts connections.
+func (a *App) Ready() <-chan struct{} {
+	return a.server.Ready()
+}
+
+// Stop closes the listener and the client connections, waiting for them to end
+// until timeoutCtx is done.
+func (a *App) Stop(timeoutCtx context.Context) error {
+	return a.server.Stop(timeoutCtx)
+}
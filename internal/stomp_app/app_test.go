@@ -0,0 +1,217 @@
+package stomp_app
+
+import (
+	"bufio"
+	"bytes"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-stomp/stomp/v3"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver/tcpservertest"
+)
+
+// startApp serves the STOMP app on a loopback port, swirls the broker and returns its address
+func startApp(t *testing.T, heartBeat time.Duration) (*broker.VortexQ[any], string) {
+	t.Helper()
+	vq := broker.NewVortexQ[any]()
+	app := New(slog.Default(), vq, "127.0.0.1:0")
+	app.heartBeat = heartBeat
+
+	addr := tcpservertest.Start(t, vq, app.server.Serve, app.Stop)
+	return vq, addr
+}
+
+func dial(t *testing.T, addr string) *stomp.Conn {
+	t.Helper()
+	client, err := stomp.Dial("tcp", addr, stomp.ConnOpt.HeartBeat(0, 0))
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	t.Cleanup(func() { _ = client.Disconnect() })
+	return client
+}
+
+func receive(t *testing.T, sub *stomp.Subscription) *stomp.Message {
+	t.Helper()
+	select {
+	case msg := <-sub.C:
+		if msg.Err != nil {
+			t.Fatalf("receive error: %v", msg.Err)
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no message on %s", sub.Destination())
+		return nil
+	}
+}
+
+// Test frames keep their escaped headers and bodies with NULs
+func TestFrame(t *testing.T) {
+	f := &frame{command: frameSend, body: []byte("a\x00b")}
+	f.set("destination", "/topic/a:b\nc").set("content-length", "3")
+	got, err := readFrame(bufio.NewReader(bytes.NewReader(append([]byte("\n\r\n"), f.encode(version12)...))), version12)
+	if err != nil {
+		t.Fatalf("readFrame error: %v", err)
+	}
+	if got.command != frameSend || got.header("destination") != "/topic/a:b\nc" || string(got.body) != "a\x00b" {
+		t.Errorf("readFrame = %+v; want the encoded frame", got)
+	}
+	for _, raw := range []string{"SEND\ndestination\n\n\x00", "SEND\ncontent-length:9\n\nabc\x00", "SEND\n\nabc"} {
+		if _, err := readFrame(bufio.NewReader(strings.NewReader(raw)), version12); err == nil {
+			t.Errorf("readFrame(%q) succeeded; want an error", raw)
+		}
+	}
+}
+
+// Test SEND reaches subscriptions on topics and patterns
+func TestSendSubscribe(t *testing.T) {
+	vq, addr := startApp(t, 0)
+	client := dial(t, addr)
+	if client.Version() != stomp.V12 {
+		t.Errorf("version = %s; want 1.2", client.Version())
+	}
+
+	exact, err := client.Subscribe("/topic/orders.created", stomp.AckAuto)
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	pattern, err := client.Subscribe("/queue/orders.*", stomp.AckAuto)
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+
+	err = client.Send("/topic/orders.created", "text/plain", []byte("o-1"), stomp.SendOpt.Receipt, stomp.SendOpt.Header("region", "eu"))
+	if err != nil {
+		t.Fatalf("send error: %v", err)
+	}
+	if msgs := vq.Messages("orders.created"); len(msgs) != 1 || msgs[0].Headers["region"] != "eu" {
+		t.Fatalf("topic holds %+v; want the message with its headers", msgs)
+	}
+	for _, sub := range []*stomp.Subscription{exact, pattern} {
+		msg := receive(t, sub)
+		if string(msg.Body) != "o-1" || msg.ContentType != "text/plain" || msg.Header.Get("region") != "eu" {
+			t.Errorf("received %s %q with %v; want o-1", msg.ContentType, msg.Body, msg.Header)
+		}
+	}
+
+	// messages published to the broker keep the prefix of the subscription
+	vq.Publish(broker.Message[any]{ID: "m2", Pattern: "orders.shipped", Data: map[string]any{"id": "o-1"}})
+	msg := receive(t, pattern)
+	if msg.Destination != "/queue/orders.shipped" || string(msg.Body) != `{"id":"o-1"}` || msg.Header.Get("message-id") != "m2" {
+		t.Errorf("received %s %q; want the shipped order", msg.Destination, msg.Body)
+	}
+
+	// the server closes the connection after the ERROR frame, so the client can't disconnect gracefully
+	other, err := stomp.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer other.MustDisconnect()
+	if err := other.Send("/topic/orders.*", "text/plain", []byte("x"), stomp.SendOpt.Receipt); err == nil {
+		t.Error("send to a pattern succeeded; want an error")
+	}
+}
+
+// Test client acks are cumulative and client-individual acks settle one message
+func TestAckModes(t *testing.T) {
+	vq, addr := startApp(t, 0)
+	for _, tc := range []struct {
+		mode      stomp.AckMode
+		topic     string
+		delivered []string
+	}{
+		// acking m2 acks m1 too, which frees room for m3 and m4
+		{stomp.AckClient, "client", []string{"m3", "m4"}},
+		// m1 stays in flight
+		{stomp.AckClientIndividual, "individual", []string{"m3"}},
+	} {
+		client := dial(t, addr)
+		sub, err := client.Subscribe(tc.topic, tc.mode, stomp.SubscribeOpt.Header("prefetch-count", "2"))
+		if err != nil {
+			t.Fatalf("subscribe error: %v", err)
+		}
+		// wait for the consumer before publishing
+		time.Sleep(50 * time.Millisecond)
+		for _, id := range []string{"m1", "m2", "m3", "m4"} {
+			vq.Publish(broker.Message[any]{ID: id, Pattern: tc.topic, Data: id})
+		}
+		receive(t, sub)
+		if err := client.Ack(receive(t, sub)); err != nil {
+			t.Fatalf("ack error: %v", err)
+		}
+		for _, want := range tc.delivered {
+			if msg := receive(t, sub); msg.Header.Get("message-id") != want {
+				t.Errorf("%s: received %s; want %s", tc.topic, msg.Header.Get("message-id"), want)
+			}
+		}
+		select {
+		case msg := <-sub.C:
+			t.Errorf("%s: received %s; want no more messages in flight", tc.topic, msg.Header.Get("message-id"))
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Test receipts, heart-beats and errors on the wire
+func TestProtocol(t *testing.T) {
+	_, addr := startApp(t, 50*time.Millisecond)
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+	write := func(raw string) {
+		t.Helper()
+		if _, err := nc.Write([]byte(raw + "\x00")); err != nil {
+			t.Fatalf("write error: %v", err)
+		}
+	}
+	read := func() frame {
+		t.Helper()
+		_ = nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+		f, err := readFrame(r, version12)
+		if err != nil {
+			t.Fatalf("read error: %v", err)
+		}
+		return f
+	}
+
+	write("CONNECT\naccept-version:1.1,1.2\nheart-beat:0,20\n\n")
+	if f := read(); f.command != frameConnected || f.header("version") != version12 || f.header("heart-beat") != "50,50" {
+		t.Fatalf("connect replied %+v; want CONNECTED 1.2 with heart-beats", f)
+	}
+	// the server sends heart-beats at the slower interval
+	_ = nc.SetReadDeadline(time.Now().Add(time.Second))
+	if b, err := r.ReadByte(); err != nil || b != '\n' {
+		t.Fatalf("heart-beat = %q, %v; want EOL", b, err)
+	}
+
+	write("SUBSCRIBE\nid:0\ndestination:/topic/a\nreceipt:r1\n\n")
+	if f := read(); f.command != frameReceipt || f.header("receipt-id") != "r1" {
+		t.Fatalf("subscribe replied %+v; want RECEIPT r1", f)
+	}
+	write("ACK\nid:unknown\nreceipt:r2\n\n")
+	if f := read(); f.command != frameError || f.header("receipt-id") != "r2" {
+		t.Fatalf("ack replied %+v; want ERROR", f)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Error("connection open after ERROR; want it closed")
+	}
+
+	// a client without a common version is refused
+	nc2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer nc2.Close()
+	_, _ = nc2.Write([]byte("CONNECT\naccept-version:2.0\n\n\x00"))
+	_ = nc2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if f, err := readFrame(bufio.NewReader(nc2), version10); err != nil || f.command != frameError || f.header("version") == "" {
+		t.Errorf("connect replied %+v, %v; want ERROR with the versions", f, err)
+	}
+}
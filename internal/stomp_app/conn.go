@@ -0,0 +1,536 @@
+package stomp_app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"io"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	version10 = "1.0"
+	version11 = "1.1"
+	version12 = "1.2"
+
+	_heartBeat      = 10 * time.Second
+	_connectTimeout = 10 * time.Second
+	_writeWait      = 10 * time.Second
+)
+
+// Ack modes of SUBSCRIBE.
+const (
+	ackAuto             = "auto"
+	ackClient           = "client"
+	ackClientIndividual = "client-individual"
+)
+
+// Destination prefixes clients commonly use, they are stripped to get the topic.
+const (
+	prefixTopic = "/topic/"
+	prefixQueue = "/queue/"
+)
+
+var errNoVersion = errors.New("no common protocol version")
+
+// reservedHeaders are set by the server on MESSAGE frames or belong to SEND itself.
+var reservedHeaders = map[string]bool{
+	"destination": true, "message-id": true, "subscription": true, "ack": true, "receipt": true,
+	"content-type": true, "content-length": true, "transaction": true, "reply-to": true, "correlation-id": true,
+}
+
+// conn is a client connection, its subscriptions end with it.
+type conn struct {
+	app *App
+	nc  net.Conn
+	r   *bufio.Reader
+	log *slog.Logger
+
+	version string
+	// readTimeout is how long the client may stay silent, zero without heart-beats
+	readTimeout time.Duration
+
+	ctx     context.Context
+	cancel  context.CancelFunc
+	writeMu sync.Mutex
+
+	mu   sync.Mutex
+	subs map[string]*subscription
+}
+
+// subscription is a SUBSCRIBE of the connection.
+type subscription struct {
+	id         string
+	prefix     string
+	ackMode    string
+	cancel     context.CancelFunc
+	deliveries <-chan broker.Delivery[any]
+	// pending holds the unacked messages in the order they were sent
+	pending []pendingMessage
+}
+
+type pendingMessage struct {
+	token     string
+	messageID string
+}
+
+// stompError is answered with an ERROR frame, then the connection is closed.
+type stompError struct {
+	message string
+	detail  string
+}
+
+func (e *stompError) Error() string {
+	if e.detail == "" {
+		return e.message
+	}
+	return e.message + ": " + e.detail
+}
+
+func errorf(message, format string, args ...any) *stompError {
+	return &stompError{message: message, detail: fmt.Sprintf(format, args...)}
+}
+
+// deadlineReader extends the read deadline before every read while heart-beats are expected.
+type deadlineReader struct{ c *conn }
+
+func (r deadlineReader) Read(p []byte) (int, error) {
+	if r.c.readTimeout > 0 {
+		_ = r.c.nc.SetReadDeadline(time.Now().Add(r.c.readTimeout))
+	}
+	return r.c.nc.Read(p)
+}
+
+func (a *App) handle(nc net.Conn) {
+	const op = "stomp_app.App.handle"
+
+	c := &conn{
+		app:     a,
+		nc:      nc,
+		log:     a.log.With(slog.String("remote", nc.RemoteAddr().String())),
+		version: version10,
+		subs:    make(map[string]*subscription),
+	}
+	c.r = bufio.NewReader(deadlineReader{c})
+	c.ctx, c.cancel = context.WithCancel(a.server.Context())
+	defer c.end()
+	defer nc.Close()
+
+	err := c.serve()
+	if errors.Is(err, errFrame) {
+		err = &stompError{message: err.Error()}
+	}
+	var se *stompError
+	if errors.As(err, &se) {
+		_ = c.write(c.errorFrame(se, ""))
+	}
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		c.log.With(slog.String("op", op)).Warn("stomp connection failed", logging.Err(err))
+	}
+}
+
+// serve runs the frames of the client until it disconnects.
+func (c *conn) serve() error {
+	_ = c.nc.SetReadDeadline(time.Now().Add(_connectTimeout))
+	f, err := readFrame(c.r, c.version)
+	if err != nil {
+		return err
+	}
+	if f.command != frameConnect && f.command != frameStomp {
+		return errorf("not connected", "expected CONNECT, got %s", f.command)
+	}
+	if err := c.connect(f); err != nil {
+		return err
+	}
+
+	for {
+		f, err := readFrame(c.r, c.version)
+		if err != nil {
+			return err
+		}
+
+		switch f.command {
+		case frameSend:
+			err = c.send(f)
+		case frameSubscribe:
+			err = c.subscribe(f)
+		case frameUnsubscribe:
+			err = c.unsubscribe(f)
+		case frameAck, frameNack:
+			err = c.settle(f)
+		case frameDisconnect:
+			c.receipt(f)
+			return nil
+		case frameBegin, frameCommit, frameAbort:
+			err = &stompError{message: "transactions are not supported"}
+		default:
+			err = errorf("unknown command", "%s", f.command)
+		}
+		if err != nil {
+			var se *stompError
+			if errors.As(err, &se) {
+				_ = c.write(c.errorFrame(se, f.header("receipt")))
+				return nil
+			}
+			return err
+		}
+		c.receipt(f)
+	}
+}
+
+func (c *conn) connect(f frame) error {
+	const op = "stomp_app.conn.connect"
+
+	// the highest version both sides speak, a client without accept-version speaks 1.0
+	accepted := strings.Split(f.header("accept-version"), ",")
+	if f.header("accept-version") == "" {
+		accepted = []string{version10}
+	}
+	c.version = ""
+	for _, v := range []string{version12, version11, version10} {
+		if slices.Contains(accepted, v) {
+			c.version = v
+			break
+		}
+	}
+	if c.version == "" {
+		c.version = version10
+		supported := strings.Join([]string{version10, version11, version12}, ",")
+		f := &frame{command: frameError, body: []byte("supported protocol versions are " + supported)}
+		f.set("version", supported).set("content-type", "text/plain").set("message", "unsupported protocol version")
+		_ = c.write(f)
+		return fmt.Errorf("%s: %w", op, errNoVersion)
+	}
+
+	// heart-beats are sent and expected at the slower of both intervals, login is checked in front of the broker
+	var cx, cy int
+	if hb := f.header("heart-beat"); hb != "" {
+		x, y, _ := strings.Cut(hb, ",")
+		var errX, errY error
+		cx, errX = strconv.Atoi(strings.TrimSpace(x))
+		cy, errY = strconv.Atoi(strings.TrimSpace(y))
+		if errX != nil || errY != nil || cx < 0 || cy < 0 {
+			return errorf("invalid heart-beat header", "%q", hb)
+		}
+	}
+	server := int(c.app.heartBeat / time.Millisecond)
+	if cx > 0 && server > 0 {
+		// allow for the client being late
+		c.readTimeout = 2 * time.Duration(max(cx, server)) * time.Millisecond
+	}
+	_ = c.nc.SetReadDeadline(time.Time{})
+
+	connected := &frame{command: frameConnected}
+	connected.set("version", c.version).
+		set("heart-beat", fmt.Sprintf("%d,%d", server, server)).
+		set("server", "vortexq").
+		set("session", broker.NewID())
+	if err := c.write(connected); err != nil {
+		return err
+	}
+	if cy > 0 && server > 0 {
+		go c.heartBeats(time.Duration(max(cy, server)) * time.Millisecond)
+	}
+	c.log.With(slog.String("op", op)).Info("stomp client connected", slog.String("version", c.version))
+	return nil
+}
+
+func (c *conn) heartBeats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.writeMu.Lock()
+			_ = c.nc.SetWriteDeadline(time.Now().Add(_writeWait))
+			_, err := c.nc.Write([]byte{'\n'})
+			c.writeMu.Unlock()
+			if err != nil {
+				return
+			}
+		case <-c.ctx.Done():
+			return
+		}
+	}
+}
+
+func (c *conn) write(f *frame) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = c.nc.SetWriteDeadline(time.Now().Add(_writeWait))
+	_, err := c.nc.Write(f.encode(c.version))
+	return err
+}
+
+func (c *conn) errorFrame(se *stompError, receipt string) *frame {
+	f := &frame{command: frameError, body: []byte(se.detail)}
+	f.set("message", se.message)
+	if receipt != "" {
+		f.set("receipt-id", receipt)
+	}
+	if se.detail != "" {
+		f.set("content-type", "text/plain")
+	}
+	return f
+}
+
+// receipt confirms a processed frame that asked for it.
+func (c *conn) receipt(f frame) {
+	if id := f.header("receipt"); id != "" {
+		_ = c.write((&frame{command: frameReceipt}).set("receipt-id", id))
+	}
+}
+
+// toTopic strips the /topic/ or /queue/ prefix of a destination.
+func toTopic(destination string) (prefix, topic string) {
+	for _, p := range []string{prefixTopic, prefixQueue} {
+		if strings.HasPrefix(destination, p) {
+			return p, destination[len(p):]
+		}
+	}
+	return "", destination
+}
+
+func (c *conn) send(f frame) error {
+	destination := f.header("destination")
+	if destination == "" {
+		return &stompError{message: "destination header is required"}
+	}
+	_, topic := toTopic(destination)
+	msg := broker.Message[any]{
+		ID:            broker.NewID(),
+		Pattern:       topic,
+		ContentType:   f.header("content-type"),
+		CorrelationID: f.header("correlation-id"),
+	}
+	if replyTo := f.header("reply-to"); replyTo != "" {
+		_, msg.ReplyTo = toTopic(replyTo)
+	}
+	for _, h := range f.headers {
+		if reservedHeaders[h[0]] {
+			continue
+		}
+		if msg.Headers == nil {
+			msg.Headers = make(map[string]string)
+		}
+		if _, ok := msg.Headers[h[0]]; !ok {
+			msg.Headers[h[0]] = h[1]
+		}
+	}
+	if err := msg.SetPayload(f.body); err != nil {
+		return errorf("invalid body", "%v", err)
+	}
+	if _, err := c.app.funcs.Publish(msg); err != nil {
+		return errorf("invalid destination", "%v", err)
+	}
+	return nil
+}
+
+func (c *conn) subscribe(f frame) error {
+	const op = "stomp_app.conn.subscribe"
+
+	destination := f.header("destination")
+	prefix, topic := toTopic(destination)
+	if topic == "" {
+		return &stompError{message: "destination header is required"}
+	}
+	id := f.header("id")
+	if id == "" {
+		if c.version != version10 {
+			return &stompError{message: "id header is required"}
+		}
+		id = destination
+	}
+	ackMode := f.header("ack")
+	switch ackMode {
+	case "":
+		ackMode = ackAuto
+	case ackAuto, ackClient, ackClientIndividual:
+	default:
+		return errorf("invalid ack header", "%q", ackMode)
+	}
+	opts := broker.ConsumeOptions{AutoAck: ackMode == ackAuto}
+	if prefetch := f.header("prefetch-count"); prefetch != "" {
+		n, err := strconv.Atoi(prefetch)
+		if err != nil || n <= 0 {
+			return errorf("invalid prefetch-count header", "%q", prefetch)
+		}
+		opts.MaxInFlight = n
+	}
+
+	c.mu.Lock()
+	_, exists := c.subs[id]
+	c.mu.Unlock()
+	if exists {
+		return errorf("duplicate subscription", "id %q is already subscribed", id)
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	deliveries, err := c.app.funcs.Consume(ctx, broker.Subscription{TopicName: topic, Protocol: Protocol}, opts)
+	if err != nil {
+		cancel()
+		c.log.With(slog.String("op", op)).Warn("failed to subscribe", slog.String("destination", destination), logging.Err(err))
+		return errorf("invalid subscription", "%v", err)
+	}
+	sub := &subscription{id: id, prefix: prefix, ackMode: ackMode, cancel: cancel, deliveries: deliveries}
+	c.mu.Lock()
+	c.subs[id] = sub
+	c.mu.Unlock()
+	go c.forward(sub)
+	return nil
+}
+
+// forward sends the deliveries of a subscription as MESSAGE frames.
+func (c *conn) forward(sub *subscription) {
+	const op = "stomp_app.conn.forward"
+
+	for d := range sub.deliveries {
+		msg := d.Message
+		body, contentType, err := msg.Payload()
+		if err != nil {
+			c.log.With(slog.String("op", op)).Warn("can't encode message", slog.String("message", msg.ID), logging.Err(err))
+			if d.AckToken != "" {
+				_ = c.app.funcs.Nack(d.AckToken)
+			}
+			continue
+		}
+		f := &frame{command: frameMessage, body: body}
+		f.set("destination", sub.prefix+msg.Pattern).
+			set("message-id", msg.ID).
+			set("subscription", sub.id)
+		if d.AckToken != "" {
+			c.mu.Lock()
+			if c.subs[sub.id] != sub {
+				// unsubscribed or disconnected, the pending messages were abandoned already
+				c.mu.Unlock()
+				_ = c.app.funcs.Nack(d.AckToken)
+				continue
+			}
+			sub.pending = append(sub.pending, pendingMessage{token: d.AckToken, messageID: msg.ID})
+			c.mu.Unlock()
+			if c.version == version12 {
+				f.set("ack", d.AckToken)
+			}
+		}
+		if contentType != "" {
+			f.set("content-type", contentType)
+		}
+		f.set("content-length", strconv.Itoa(len(body)))
+		if msg.ReplyTo != "" {
+			f.set("reply-to", sub.prefix+msg.ReplyTo)
+		}
+		if msg.CorrelationID != "" {
+			f.set("correlation-id", msg.CorrelationID)
+		}
+		keys := make([]string, 0, len(msg.Headers))
+		for k := range msg.Headers {
+			if !reservedHeaders[k] {
+				keys = append(keys, k)
+			}
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			f.set(k, msg.Headers[k])
+		}
+		if err := c.write(f); err != nil {
+			_ = c.nc.Close()
+		}
+	}
+}
+
+func (c *conn) unsubscribe(f frame) error {
+	id := f.header("id")
+	if id == "" && c.version == version10 {
+		id = f.header("destination")
+	}
+	c.mu.Lock()
+	sub, ok := c.subs[id]
+	delete(c.subs, id)
+	c.mu.Unlock()
+	if !ok {
+		return errorf("unknown subscription", "id %q is not subscribed", id)
+	}
+	sub.cancel()
+	c.abandon(sub)
+	return nil
+}
+
+// settle acks or nacks a message, in client mode together with the ones before it.
+func (c *conn) settle(f frame) error {
+	// STOMP 1.2 acks the ack header of the MESSAGE, before it its message-id
+	id, byToken := f.header("id"), true
+	if c.version != version12 {
+		id, byToken = f.header("message-id"), false
+	}
+	if id == "" {
+		return errorf("missing header", "%s requires the id of the message", f.command)
+	}
+
+	c.mu.Lock()
+	var settled []pendingMessage
+	for _, sub := range c.subs {
+		i := slices.IndexFunc(sub.pending, func(p pendingMessage) bool {
+			return (byToken && p.token == id) || (!byToken && p.messageID == id)
+		})
+		if i < 0 {
+			continue
+		}
+		if sub.ackMode == ackClient {
+			settled = slices.Clone(sub.pending[:i+1])
+			sub.pending = slices.Delete(sub.pending, 0, i+1)
+		} else {
+			settled = []pendingMessage{sub.pending[i]}
+			sub.pending = slices.Delete(sub.pending, i, i+1)
+		}
+		break
+	}
+	c.mu.Unlock()
+	if settled == nil {
+		return errorf("unknown message", "%s of %q which is not pending", f.command, id)
+	}
+
+	settle := c.app.funcs.Ack
+	if f.command == frameNack {
+		settle = c.app.funcs.Nack
+	}
+	for _, p := range settled {
+		// a message whose ack deadline passed was redelivered already
+		_ = settle(p.token)
+	}
+	return nil
+}
+
+// abandon nacks the pending messages of a subscription, so that they are redelivered
+// without waiting for their ack deadline.
+func (c *conn) abandon(sub *subscription) {
+	c.mu.Lock()
+	pending := sub.pending
+	sub.pending = nil
+	c.mu.Unlock()
+	for _, p := range pending {
+		_ = c.app.funcs.Nack(p.token)
+	}
+}
+
+// end releases the subscriptions once the connection is gone.
+func (c *conn) end() {
+	c.cancel()
+	c.mu.Lock()
+	subs := make([]*subscription, 0, len(c.subs))
+	for _, sub := range c.subs {
+		subs = append(subs, sub)
+	}
+	c.subs = make(map[string]*subscription)
+	c.mu.Unlock()
+	for _, sub := range subs {
+		c.abandon(sub)
+	}
+}
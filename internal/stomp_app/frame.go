@@ -0,0 +1,175 @@
+package stomp_app
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Frame commands.
+const (
+	frameConnect     = "CONNECT"
+	frameStomp       = "STOMP"
+	frameConnected   = "CONNECTED"
+	frameSend        = "SEND"
+	frameSubscribe   = "SUBSCRIBE"
+	frameUnsubscribe = "UNSUBSCRIBE"
+	frameAck         = "ACK"
+	frameNack        = "NACK"
+	frameBegin       = "BEGIN"
+	frameCommit      = "COMMIT"
+	frameAbort       = "ABORT"
+	frameDisconnect  = "DISCONNECT"
+	frameMessage     = "MESSAGE"
+	frameReceipt     = "RECEIPT"
+	frameError       = "ERROR"
+)
+
+const (
+	_maxFrameSize  = 1 << 20
+	_maxLineLength = 64 << 10
+	_maxHeaders    = 1000
+)
+
+var errFrame = errors.New("malformed frame")
+
+// frame is a STOMP frame, headers keep their order and the first of a name wins.
+type frame struct {
+	command string
+	headers [][2]string
+	body    []byte
+}
+
+func (f *frame) header(name string) string {
+	for _, h := range f.headers {
+		if h[0] == name {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+func (f *frame) set(name, value string) *frame {
+	f.headers = append(f.headers, [2]string{name, value})
+	return f
+}
+
+// escaped reports whether the headers of the frame are escaped, which STOMP 1.1
+// introduced for all frames but CONNECT and CONNECTED.
+func escaped(version, command string) bool {
+	return version != version10 && command != frameConnect && command != frameStomp && command != frameConnected
+}
+
+var (
+	headerEscaper   = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+	headerUnescaper = strings.NewReplacer(`\\`, `\`, `\r`, "\r", `\n`, "\n", `\c`, ":")
+)
+
+// readFrame reads the next frame, skipping the heart-beats before it.
+func readFrame(r *bufio.Reader, version string) (frame, error) {
+	var f frame
+	for f.command == "" {
+		line, err := readLine(r)
+		if err != nil {
+			return f, err
+		}
+		f.command = line
+	}
+
+	for {
+		line, err := readLine(r)
+		if err != nil {
+			return f, err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return f, fmt.Errorf("%w: header %q without colon", errFrame, line)
+		}
+		if escaped(version, f.command) {
+			name, value = headerUnescaper.Replace(name), headerUnescaper.Replace(value)
+		}
+		if len(f.headers) == _maxHeaders {
+			return f, fmt.Errorf("%w: too many headers", errFrame)
+		}
+		f.set(name, value)
+	}
+
+	if cl := f.header("content-length"); cl != "" {
+		n, err := strconv.Atoi(cl)
+		if err != nil || n < 0 || n > _maxFrameSize {
+			return f, fmt.Errorf("%w: invalid content-length %q", errFrame, cl)
+		}
+		f.body = make([]byte, n+1)
+		if _, err := io.ReadFull(r, f.body); err != nil {
+			return f, err
+		}
+		if f.body[n] != 0 {
+			return f, fmt.Errorf("%w: body not terminated by NULL", errFrame)
+		}
+		f.body = f.body[:n]
+		return f, nil
+	}
+
+	for {
+		chunk, err := r.ReadSlice(0)
+		if len(f.body)+len(chunk) > _maxFrameSize+1 {
+			return f, fmt.Errorf("%w: body too large", errFrame)
+		}
+		f.body = append(f.body, chunk...)
+		if err == nil {
+			f.body = f.body[:len(f.body)-1]
+			return f, nil
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return f, err
+		}
+	}
+}
+
+// readLine reads a line ended by LF or CRLF.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > _maxLineLength {
+			return "", fmt.Errorf("%w: line too long", errFrame)
+		}
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, bufio.ErrBufferFull) {
+			return "", err
+		}
+	}
+	line = bytes.TrimSuffix(line[:len(line)-1], []byte("\r"))
+	return string(line), nil
+}
+
+func (f *frame) encode(version string) []byte {
+	var b bytes.Buffer
+	b.WriteString(f.command)
+	b.WriteByte('\n')
+	escape := escaped(version, f.command)
+	for _, h := range f.headers {
+		name, value := h[0], h[1]
+		if escape {
+			name, value = headerEscaper.Replace(name), headerEscaper.Replace(value)
+		}
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(value)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.Write(f.body)
+	b.WriteByte(0)
+	return b.Bytes()
+}
@@ -0,0 +1,19 @@
+// Package systemd implements the socket activation and readiness notification
+// protocols of systemd without depending on libsystemd.
+package systemd
+
+// ListenFDsStart is the first file descriptor passed by socket activation.
+const ListenFDsStart = 3
+
+const (
+	envListenPID     = "LISTEN_PID"
+	envListenFDs     = "LISTEN_FDS"
+	envListenFDNames = "LISTEN_FDNAMES"
+	envNotifySocket  = "NOTIFY_SOCKET"
+)
+
+// Notification states understood by the service manager.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+)
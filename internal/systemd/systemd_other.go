@@ -0,0 +1,15 @@
+//go:build !unix
+
+package systemd
+
+import "net"
+
+// Listeners returns no listeners, socket activation needs a Unix system.
+func Listeners() ([]net.Listener, error) {
+	return nil, nil
+}
+
+// Notify reports false, the process never runs under systemd here.
+func Notify(state string) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,101 @@
+//go:build unix
+
+package systemd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// Test inherited descriptors become listeners that accept connections
+func TestFileListeners(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer func() { _ = lis.Close() }()
+	f, err := lis.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatalf("file error: %v", err)
+	}
+	defer func() { _ = f.Close() }()
+	// the listener closes its own duplicate of the descriptor
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatalf("dup error: %v", err)
+	}
+
+	listeners, err := FileListeners(fd, 1, []string{"http"})
+	if err != nil || len(listeners) != 1 {
+		t.Fatalf("FileListeners = %v, %v; want one listener", listeners, err)
+	}
+	defer func() { _ = listeners[0].Close() }()
+	if got, want := listeners[0].Addr().String(), lis.Addr().String(); got != want {
+		t.Errorf("listener address = %s; want %s", got, want)
+	}
+	go func() {
+		if conn, err := net.Dial("tcp", lis.Addr().String()); err == nil {
+			_ = conn.Close()
+		}
+	}()
+	conn, err := listeners[0].Accept()
+	if err != nil {
+		t.Fatalf("accept error: %v", err)
+	}
+	_ = conn.Close()
+}
+
+// Test the activation variables of another process are ignored and always unset
+func TestListenersOtherProcess(t *testing.T) {
+	t.Setenv(envListenPID, strconv.Itoa(os.Getpid()+1))
+	t.Setenv(envListenFDs, "1")
+	listeners, err := Listeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("Listeners = %v, %v; want none", listeners, err)
+	}
+	if _, ok := os.LookupEnv(envListenFDs); ok {
+		t.Errorf("%s still set", envListenFDs)
+	}
+
+	t.Setenv(envListenPID, strconv.Itoa(os.Getpid()))
+	t.Setenv(envListenFDs, "x")
+	if _, err := Listeners(); err == nil {
+		t.Error("Listeners with a malformed count succeeded; want an error")
+	}
+}
+
+// Test states are sent as datagrams to the notify socket
+func TestNotify(t *testing.T) {
+	t.Setenv(envNotifySocket, "")
+	if sent, err := Notify(Ready); sent || err != nil {
+		t.Errorf("Notify without socket = %v, %v; want false, nil", sent, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	t.Setenv(envNotifySocket, path)
+
+	if sent, err := Notify(Ready); !sent || err != nil {
+		t.Fatalf("Notify = %v, %v; want true, nil", sent, err)
+	}
+	buf := make([]byte, 64)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != Ready {
+		t.Errorf("received %q, %v; want %q", buf[:n], err, Ready)
+	}
+
+	t.Setenv(envNotifySocket, "relative.sock")
+	if _, err := Notify(Ready); err == nil {
+		t.Error("Notify to a relative path succeeded; want an error")
+	}
+}
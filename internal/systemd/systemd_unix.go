@@ -0,0 +1,94 @@
+//go:build unix
+
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Listeners returns the listening sockets passed by systemd socket activation,
+// in the order of the socket unit, or none when the process wasn't activated.
+// It unsets the activation variables so child processes don't pick them up.
+func Listeners() ([]net.Listener, error) {
+	const op = "systemd.Listeners"
+
+	pid, n := os.Getenv(envListenPID), os.Getenv(envListenFDs)
+	defer func() {
+		_ = os.Unsetenv(envListenPID)
+		_ = os.Unsetenv(envListenFDs)
+		_ = os.Unsetenv(envListenFDNames)
+	}()
+	if pid == "" || n == "" {
+		return nil, nil
+	}
+	if pid != strconv.Itoa(os.Getpid()) {
+		// the variables were meant for another process
+		return nil, nil
+	}
+	count, err := strconv.Atoi(n)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("%s: invalid %s %q", op, envListenFDs, n)
+	}
+
+	names := strings.Split(os.Getenv(envListenFDNames), ":")
+	listeners, err := FileListeners(ListenFDsStart, count, names)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return listeners, nil
+}
+
+// FileListeners turns the count file descriptors from start on into listeners,
+// names label the files in the order of the descriptors.
+func FileListeners(start, count int, names []string) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, count)
+	for fd := start; fd < start+count; fd++ {
+		syscall.CloseOnExec(fd)
+		name := "LISTEN_FD_" + strconv.Itoa(fd)
+		if i := fd - start; i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		lis, err := net.FileListener(f)
+		// the listener holds a duplicate of the descriptor
+		_ = f.Close()
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, fmt.Errorf("file descriptor %d (%s): %w", fd, name, err)
+		}
+		listeners = append(listeners, lis)
+	}
+	return listeners, nil
+}
+
+// Notify sends the state to the service manager, it reports false when the
+// process doesn't run under one.
+func Notify(state string) (bool, error) {
+	const op = "systemd.Notify"
+
+	addr := os.Getenv(envNotifySocket)
+	if addr == "" {
+		return false, nil
+	}
+	// net maps the leading @ of abstract namespace sockets itself
+	if addr[0] != '@' && addr[0] != '/' {
+		return false, fmt.Errorf("%s: unsupported notify socket %q", op, addr)
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	defer func() { _ = conn.Close() }()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, fmt.Errorf("%s: %w", op, err)
+	}
+	return true, nil
+}
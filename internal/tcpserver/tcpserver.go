@@ -0,0 +1,185 @@
+// Package tcpserver runs the accept loop and the graceful stop the protocol
+// listeners share, each protocol only serves its connections.
+package tcpserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/internal/handoff"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+// Server accepts connections on a TCP address and serves each with its handler
+// in a goroutine of its own.
+type Server struct {
+	log    *slog.Logger
+	name   string
+	addr   string
+	handle func(net.Conn)
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	listener net.Listener
+	open     map[net.Conn]struct{}
+	closed   bool
+
+	conns sync.WaitGroup
+
+	ready     chan struct{}
+	readyOnce sync.Once
+}
+
+// New creates a server listening on addr, name labels its log records.
+func New(log *slog.Logger, name, addr string, handle func(net.Conn)) *Server {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Server{
+		log:    log,
+		name:   name,
+		addr:   addr,
+		handle: handle,
+		ctx:    ctx,
+		cancel: cancel,
+		open:   make(map[net.Conn]struct{}),
+		ready:  make(chan struct{}),
+	}
+}
+
+// Context is canceled once the server stops accepting connections.
+func (s *Server) Context() context.Context {
+	return s.ctx
+}
+
+// Ready is closed once the server accepts connections.
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Run listens on the server address and serves it.
+func (s *Server) Run() error {
+	const op = "tcpserver.Server.Run"
+
+	lis, err := handoff.Listen("tcp", s.addr)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return s.Serve(lis)
+}
+
+// Serve accepts connections on lis until the server stops.
+func (s *Server) Serve(lis net.Listener) error {
+	const op = "tcpserver.Server.Serve"
+	log := s.log.With(slog.String("op", op))
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		_ = lis.Close()
+		return nil
+	}
+	s.listener = lis
+	s.mu.Unlock()
+
+	log.Info(s.name+" server listening at ", slog.String("addr", lis.Addr().String()))
+	s.readyOnce.Do(func() { close(s.ready) })
+	for {
+		nc, err := lis.Accept()
+		if err != nil {
+			if s.ctx.Err() != nil {
+				return nil
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+			log.Error("failed to run "+s.name+" server: \n", logging.Err(err))
+			return fmt.Errorf("%s: %w", op, err)
+		}
+		s.conns.Add(1)
+		go func() {
+			defer s.conns.Done()
+			s.serveConn(nc)
+		}()
+	}
+}
+
+// Handle serves a connection accepted elsewhere, such as a WebSocket, like
+// the accepted ones and returns once it ends.
+func (s *Server) Handle(nc net.Conn) {
+	s.conns.Add(1)
+	defer s.conns.Done()
+	s.serveConn(nc)
+}
+
+func (s *Server) serveConn(nc net.Conn) {
+	if !s.track(nc) {
+		_ = nc.Close()
+		return
+	}
+	defer s.untrack(nc)
+	s.handle(nc)
+}
+
+// StopAccepting closes the listener and cancels Context, the open connections
+// are served on until Stop.
+func (s *Server) StopAccepting() {
+	s.cancel()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.listener != nil {
+		_ = s.listener.Close()
+	}
+}
+
+// Stop closes the listener and the open connections, waiting for their
+// handlers to return until timeoutCtx is done.
+func (s *Server) Stop(timeoutCtx context.Context) error {
+	const op = "tcpserver.Server.Stop"
+
+	s.log.With(slog.String("op", op)).
+		Info(s.name + " server shutdown")
+
+	s.StopAccepting()
+	s.mu.Lock()
+	for nc := range s.open {
+		_ = nc.Close()
+	}
+	s.mu.Unlock()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return nil
+	case <-timeoutCtx.Done():
+		return fmt.Errorf("%s: %w", op, timeoutCtx.Err())
+	}
+}
+
+// track registers a new connection, it reports false once the server is stopped.
+func (s *Server) track(nc net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.open[nc] = struct{}{}
+	return true
+}
+
+func (s *Server) untrack(nc net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.open, nc)
+}
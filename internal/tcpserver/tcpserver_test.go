@@ -0,0 +1,59 @@
+package tcpserver
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+// Test Stop closes the open connections and waits for their handlers
+func TestStop(t *testing.T) {
+	handled := make(chan struct{})
+	returned := make(chan struct{})
+	s := New(slog.New(slog.NewTextHandler(io.Discard, nil)), "test", "127.0.0.1:0", func(nc net.Conn) {
+		close(handled)
+		// the handler ends once Stop closes the connection
+		_, _ = io.Copy(io.Discard, nc)
+		close(returned)
+	})
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen error: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(lis) }()
+
+	conn, err := net.Dial("tcp", lis.Addr().String())
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer func() { _ = conn.Close() }()
+	select {
+	case <-handled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("connection not handled")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := s.Stop(ctx); err != nil {
+		t.Fatalf("Stop error: %v", err)
+	}
+	select {
+	case <-returned:
+	default:
+		t.Error("Stop returned before the handler")
+	}
+	if err := <-served; err != nil {
+		t.Errorf("Serve error = %v; want nil after Stop", err)
+	}
+	if s.Context().Err() == nil {
+		t.Error("context not canceled after Stop")
+	}
+	if _, err := net.DialTimeout("tcp", lis.Addr().String(), time.Second); err == nil {
+		t.Error("dial after Stop succeeded; want the listener closed")
+	}
+}
@@ -0,0 +1,35 @@
+// Package tcpservertest starts protocol listeners for tests.
+package tcpservertest
+
+import (
+	"context"
+	"github.com/ivanbulyk/vortexq/broker"
+	"net"
+	"testing"
+	"time"
+)
+
+// Start serves on a loopback listener and swirls the broker every millisecond
+// until the test ends, then stops the server. It returns the listener address.
+func Start(tb testing.TB, vq *broker.VortexQ[any], serve func(net.Listener) error, stop func(context.Context) error) string {
+	tb.Helper()
+
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listen error: %v", err)
+	}
+	go func() { _ = serve(lis) }()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		for ctx.Err() == nil {
+			_ = vq.Swirl()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	tb.Cleanup(func() {
+		cancel()
+		_ = stop(context.Background())
+	})
+	return lis.Addr().String()
+}
@@ -0,0 +1,256 @@
+package urlpolicy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// ErrForbidden is returned when an address is rejected by the policy.
+var ErrForbidden = errors.New("address is not allowed")
+
+const _lookupTimeout = 5 * time.Second
+
+// Config describes which webhook destinations are acceptable.
+type Config struct {
+	// AllowedSchemes lists accepted URL schemes, e.g. "http", "https".
+	AllowedSchemes []string
+	// AllowedHosts lists host names (".example.com" matches subdomains) or CIDRs.
+	// When non-empty, only matching destinations are accepted.
+	AllowedHosts []string
+	// DeniedHosts lists host names or CIDRs that are always rejected.
+	DeniedHosts []string
+	// AllowPrivate disables blocking of loopback, private and link-local ranges.
+	AllowPrivate bool
+}
+
+// Policy validates subscriber addresses and guards outgoing connections.
+// A nil *Policy accepts every address.
+type Policy struct {
+	schemes      map[string]struct{}
+	allowedHosts []string
+	allowedNets  []*net.IPNet
+	deniedHosts  []string
+	deniedNets   []*net.IPNet
+	allowPrivate bool
+	resolver     *net.Resolver
+	transport    *http.Transport
+}
+
+// privateNets holds ranges that are not covered by the net.IP helpers.
+var privateNets = mustParseCIDRs(
+	"0.0.0.0/8",     // "this" network
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"64:ff9b::/96",  // NAT64, may embed private IPv4
+)
+
+// New creates a Policy from the given config.
+func New(cfg Config) (*Policy, error) {
+	const op = "urlpolicy.New"
+
+	p := &Policy{
+		schemes:      make(map[string]struct{}, len(cfg.AllowedSchemes)),
+		allowPrivate: cfg.AllowPrivate,
+		resolver:     net.DefaultResolver,
+	}
+	for _, s := range cfg.AllowedSchemes {
+		p.schemes[strings.ToLower(strings.TrimSpace(s))] = struct{}{}
+	}
+	var err error
+	if p.allowedHosts, p.allowedNets, err = splitHosts(cfg.AllowedHosts); err != nil {
+		return nil, fmt.Errorf("%s: allowed hosts: %w", op, err)
+	}
+	if p.deniedHosts, p.deniedNets, err = splitHosts(cfg.DeniedHosts); err != nil {
+		return nil, fmt.Errorf("%s: denied hosts: %w", op, err)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would resolve the destination on our behalf and bypass the checks
+	transport.Proxy = nil
+	transport.DialContext = p.dialContext
+	p.transport = transport
+
+	return p, nil
+}
+
+// Validate checks the URL against the policy, resolving its host so that
+// every address it currently points to is verified.
+func (p *Policy) Validate(ctx context.Context, rawURL string) error {
+	if p == nil {
+		return nil
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("%w: invalid url: %v", ErrForbidden, err)
+	}
+	if _, ok := p.schemes[strings.ToLower(u.Scheme)]; !ok {
+		return fmt.Errorf("%w: scheme %q is not allowed", ErrForbidden, u.Scheme)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("%w: url has no host", ErrForbidden)
+	}
+
+	ips, err := p.resolve(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, ip := range ips {
+		if err := p.checkIP(host, ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Transport returns an http.RoundTripper that re-checks every address at
+// dial time, which defeats DNS rebinding between validation and delivery.
+func (p *Policy) Transport() http.RoundTripper {
+	if p == nil {
+		return http.DefaultTransport
+	}
+	return p.transport
+}
+
+func (p *Policy) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := p.resolve(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var dialer net.Dialer
+	var lastErr error
+	for _, ip := range ips {
+		if err := p.checkIP(host, ip); err != nil {
+			return nil, err
+		}
+		// dial the checked address itself so a second lookup can't swap it
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+	}
+	return nil, lastErr
+}
+
+func (p *Policy) resolve(ctx context.Context, host string) ([]net.IP, error) {
+	if matchHost(p.deniedHosts, host) {
+		return nil, fmt.Errorf("%w: host %q is denied", ErrForbidden, host)
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, _lookupTimeout)
+	defer cancel()
+	addrs, err := p.resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, fmt.Errorf("%w: can't resolve host %q: %v", ErrForbidden, host, err)
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+func (p *Policy) checkIP(host string, ip net.IP) error {
+	if containsIP(p.deniedNets, ip) {
+		return fmt.Errorf("%w: address %s of %q is denied", ErrForbidden, ip, host)
+	}
+	// explicitly allowed ranges win over the private range block
+	if containsIP(p.allowedNets, ip) {
+		return nil
+	}
+	if (len(p.allowedHosts) > 0 || len(p.allowedNets) > 0) && !matchHost(p.allowedHosts, host) {
+		return fmt.Errorf("%w: host %q is not in the allow list", ErrForbidden, host)
+	}
+	if !p.allowPrivate && isPrivate(ip) {
+		return fmt.Errorf("%w: address %s of %q is in a private range", ErrForbidden, ip, host)
+	}
+	return nil
+}
+
+func matchHost(patterns []string, host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, ".") {
+			if strings.HasSuffix(host, pattern) || host == pattern[1:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+func isPrivate(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		containsIP(privateNets, ip)
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func splitHosts(entries []string) ([]string, []*net.IPNet, error) {
+	var hosts []string
+	var nets []*net.IPNet
+	for _, e := range entries {
+		e = strings.ToLower(strings.TrimSpace(e))
+		if e == "" {
+			continue
+		}
+		if strings.Contains(e, "/") {
+			_, n, err := net.ParseCIDR(e)
+			if err != nil {
+				return nil, nil, err
+			}
+			nets = append(nets, n)
+			continue
+		}
+		if ip := net.ParseIP(e); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		hosts = append(hosts, strings.TrimSuffix(e, "."))
+	}
+	return hosts, nets, nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
@@ -0,0 +1,97 @@
+package urlpolicy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func mustNew(t *testing.T, cfg Config) *Policy {
+	t.Helper()
+	p, err := New(cfg)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	return p
+}
+
+// Test Validate applies scheme, host list and private range rules
+func TestValidate(t *testing.T) {
+	defaults := Config{AllowedSchemes: []string{"http", "https"}}
+	tests := []struct {
+		name    string
+		cfg     Config
+		url     string
+		allowed bool
+	}{
+		{"public ip", defaults, "https://8.8.8.8/hook", true},
+		{"bad scheme", defaults, "ftp://8.8.8.8/hook", false},
+		{"no host", defaults, "http:///hook", false},
+		{"not a url", defaults, "a", false},
+		{"loopback", defaults, "http://127.0.0.1:8080/", false},
+		{"localhost", defaults, "http://localhost:8080/", false},
+		{"metadata", defaults, "http://169.254.169.254/latest/meta-data", false},
+		{"private", defaults, "http://10.1.2.3/", false},
+		{"ipv6 loopback", defaults, "http://[::1]/", false},
+		{"cgnat", defaults, "http://100.64.0.1/", false},
+		{"private allowed", Config{AllowedSchemes: []string{"http"}, AllowPrivate: true}, "http://10.1.2.3/", true},
+		{"denied cidr", Config{AllowedSchemes: []string{"http"}, DeniedHosts: []string{"8.8.0.0/16"}}, "http://8.8.8.8/", false},
+		{"denied host", Config{AllowedSchemes: []string{"http"}, DeniedHosts: []string{".example.com"}}, "http://api.example.com/", false},
+		{"allowed cidr beats private", Config{AllowedSchemes: []string{"http"}, AllowedHosts: []string{"10.0.0.0/8"}}, "http://10.1.2.3/", true},
+		{"outside allow list", Config{AllowedSchemes: []string{"http"}, AllowedHosts: []string{"10.0.0.0/8"}}, "http://8.8.8.8/", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := mustNew(t, tt.cfg).Validate(context.Background(), tt.url)
+			if tt.allowed && err != nil {
+				t.Errorf("Validate(%q) = %v; want nil", tt.url, err)
+			}
+			if !tt.allowed && !errors.Is(err, ErrForbidden) {
+				t.Errorf("Validate(%q) = %v; want ErrForbidden", tt.url, err)
+			}
+		})
+	}
+}
+
+// Test a nil policy accepts anything
+func TestNilPolicy(t *testing.T) {
+	var p *Policy
+	if err := p.Validate(context.Background(), "a"); err != nil {
+		t.Errorf("nil Validate() = %v; want nil", err)
+	}
+	if p.Transport() != http.DefaultTransport {
+		t.Error("nil Transport() should be http.DefaultTransport")
+	}
+}
+
+// Test the transport refuses to dial blocked addresses
+func TestTransportBlocksAtDial(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	blocked := &http.Client{Transport: mustNew(t, Config{AllowedSchemes: []string{"http"}}).Transport()}
+	if _, err := blocked.Get(server.URL); !errors.Is(err, ErrForbidden) {
+		t.Errorf("blocked Get() error = %v; want ErrForbidden", err)
+	}
+
+	allowed := &http.Client{Transport: mustNew(t, Config{AllowedSchemes: []string{"http"}, AllowPrivate: true}).Transport()}
+	resp, err := allowed.Get(server.URL)
+	if err != nil {
+		t.Fatalf("allowed Get() error = %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("allowed Get() status = %d; want %d", resp.StatusCode, http.StatusOK)
+	}
+}
+
+// Test New rejects malformed CIDRs
+func TestNewInvalidCIDR(t *testing.T) {
+	if _, err := New(Config{DeniedHosts: []string{"10.0.0.0/99"}}); err == nil {
+		t.Error("expected error for invalid CIDR")
+	}
+}
@@ -0,0 +1,389 @@
+package wire_app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/http_app/routes"
+	"github.com/ivanbulyk/vortexq/internal/tcpserver/tcpservertest"
+	"github.com/ivanbulyk/vortexq/wire"
+)
+
+// startApp serves the native protocol on a loopback port, swirls the broker and returns its address
+func startApp(tb testing.TB) (*broker.VortexQ[any], string) {
+	tb.Helper()
+	vq := broker.NewVortexQ[any]()
+	vq.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	app := New(vq.Logger, vq, "127.0.0.1:0")
+
+	addr := tcpservertest.Start(tb, vq, app.server.Serve, app.Stop)
+	return vq, addr
+}
+
+func dial(tb testing.TB, addr string) *wire.Client {
+	tb.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	client, err := wire.Dial(ctx, addr)
+	if err != nil {
+		tb.Fatalf("dial error: %v", err)
+	}
+	tb.Cleanup(func() { _ = client.Close() })
+	return client
+}
+
+// Test pipelined publishes are confirmed and consumed with acks
+func TestPublishSubscribe(t *testing.T) {
+	vq, addr := startApp(t)
+	client := dial(t, addr)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if client.Version() != wire.Version1 {
+		t.Errorf("version = %d; want %d", client.Version(), wire.Version1)
+	}
+
+	sub, err := client.Subscribe(ctx, "orders.*", wire.SubscribeOptions{})
+	if err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	if _, err := client.Subscribe(ctx, "orders.>.x", wire.SubscribeOptions{}); err == nil {
+		t.Error("subscribe to an invalid pattern succeeded; want an error")
+	}
+
+	published, err := client.Publish(ctx, broker.Message[any]{Pattern: "orders.created", Data: []byte(`{"n":0}`), ContentType: "application/json"})
+	if err != nil || published.ID == "" || published.Offset != 0 {
+		t.Fatalf("publish = %+v, %v; want offset 0 with an ID", published, err)
+	}
+	var wg sync.WaitGroup
+	for i := 1; i <= 9; i++ {
+		wg.Add(1)
+		err := client.PublishAsync(broker.Message[any]{ID: fmt.Sprint("m", i), Pattern: "orders.created", Data: i}, func(p wire.Published, err error) {
+			defer wg.Done()
+			if err != nil || p.ID != fmt.Sprint("m", i) {
+				t.Errorf("publish of m%d = %+v, %v", i, p, err)
+			}
+		})
+		if err != nil {
+			t.Fatalf("publish error: %v", err)
+		}
+	}
+	wg.Wait()
+	if _, err := client.Publish(ctx, broker.Message[any]{Pattern: "orders.*"}); err == nil {
+		t.Error("publish to a pattern succeeded; want an error")
+	}
+	if n := len(vq.Messages("orders.created")); n != 10 {
+		t.Fatalf("topic holds %d messages; want 10", n)
+	}
+
+	var tokens []string
+	for i := range 10 {
+		d, err := sub.Receive(ctx)
+		if err != nil {
+			t.Fatalf("receive error: %v", err)
+		}
+		if i == 0 && (d.Message.ContentType != "application/json" || d.Message.Data.(map[string]any)["n"] != float64(0)) {
+			t.Errorf("first delivery = %+v; want the JSON message", d.Message)
+		}
+		if d.AckToken == "" || d.Attempt != 1 {
+			t.Errorf("delivery %d = %+v; want an ack token", i, d)
+		}
+		tokens = append(tokens, d.AckToken)
+	}
+	if err := client.Ack(tokens...); err != nil {
+		t.Fatalf("ack error: %v", err)
+	}
+	if err := sub.Close(ctx); err != nil {
+		t.Fatalf("close error: %v", err)
+	}
+	if _, err := sub.Receive(ctx); !errors.Is(err, wire.ErrClosed) {
+		t.Errorf("receive after close error = %v; want ErrClosed", err)
+	}
+}
+
+// Test a durable subscription is consumed by one client at a time
+func TestDurableSubscription(t *testing.T) {
+	vq, addr := startApp(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	first := dial(t, addr)
+	if _, err := first.Subscribe(ctx, "jobs", wire.SubscribeOptions{SubscriptionID: "workers"}); err != nil {
+		t.Fatalf("subscribe error: %v", err)
+	}
+	var we *wire.Error
+	if _, err := dial(t, addr).Subscribe(ctx, "jobs", wire.SubscribeOptions{SubscriptionID: "workers"}); !errors.As(err, &we) || we.Code != wire.CodeConflict {
+		t.Fatalf("second consumer error = %v; want conflict", err)
+	}
+	if _, ok := vq.FindSubscription("workers"); !ok {
+		t.Error("durable subscription missing")
+	}
+}
+
+// writeRaw writes encoded frames to the connection
+func writeRaw(t *testing.T, nc net.Conn, b []byte) {
+	t.Helper()
+	if _, err := nc.Write(b); err != nil {
+		t.Fatalf("write error: %v", err)
+	}
+}
+
+func readRaw(t *testing.T, nc net.Conn, r *bufio.Reader) wire.Frame {
+	t.Helper()
+	_ = nc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	f, err := wire.ReadFrame(r, wire.DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatalf("read error: %v", err)
+	}
+	return f
+}
+
+// Test deliveries stop when the credit is used and batched acks make room in flight
+func TestFlowControl(t *testing.T) {
+	vq, addr := startApp(t)
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial error: %v", err)
+	}
+	defer nc.Close()
+	r := bufio.NewReader(nc)
+
+	writeRaw(t, nc, (&wire.Hello{MinVersion: wire.Version1, MaxVersion: 9}).Append(nil))
+	var welcome wire.Welcome
+	if f := readRaw(t, nc, r); f.Type != wire.FrameWelcome || welcome.Decode(f.Body) != nil || welcome.Version != wire.Version1 {
+		t.Fatalf("hello answered by %#x; want welcome with version 1", f.Type)
+	}
+	writeRaw(t, nc, (&wire.Subscribe{Seq: 1, Topic: "metrics", Credit: 2, MaxInFlight: 3}).Append(nil))
+	var subscribed wire.Subscribed
+	if f := readRaw(t, nc, r); subscribed.Decode(f.Body) != nil || subscribed.Seq != 1 {
+		t.Fatalf("subscribe answered by %#x; want subscribed", f.Type)
+	}
+	for i := range 6 {
+		vq.Publish(broker.Message[any]{ID: fmt.Sprint("m", i), Pattern: "metrics", Data: i})
+	}
+
+	var tokens []string
+	expect := func(n int) {
+		t.Helper()
+		for range n {
+			var d wire.Delivery
+			if f := readRaw(t, nc, r); f.Type != wire.FrameDelivery || d.Decode(f.Body) != nil || d.Stream != subscribed.Stream {
+				t.Fatalf("got frame %#x; want a delivery", f.Type)
+			}
+			tokens = append(tokens, d.AckToken)
+		}
+		_ = nc.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if f, err := wire.ReadFrame(r, wire.DefaultMaxFrameSize); err == nil {
+			t.Fatalf("got frame %#x; want none after %d deliveries", f.Type, len(tokens))
+		}
+	}
+	// two credits, then three in flight
+	expect(2)
+	writeRaw(t, nc, (&wire.Credit{Stream: subscribed.Stream, Credit: 10}).Append(nil))
+	expect(1)
+	writeRaw(t, nc, (&wire.Settle{Tokens: tokens}).Append(nil))
+	expect(3)
+}
+
+// Test versions and checksums are checked
+func TestProtocolErrors(t *testing.T) {
+	_, addr := startApp(t)
+	for _, tc := range []struct {
+		name string
+		raw  []byte
+		want wire.ErrorCode
+	}{
+		{"version", (&wire.Hello{MinVersion: 2, MaxVersion: 3}).Append(nil), wire.CodeUnsupportedVersion},
+		{"magic", []byte("GET / HTTP/1.1\r\n\r\n"), wire.CodeProtocol},
+		{"checksum", func() []byte {
+			b := (&wire.Hello{MinVersion: 1, MaxVersion: 1}).Append(nil)
+			b = (&wire.Credit{Stream: 1, Credit: 1}).Append(b)
+			b[len(b)-1] ^= 0xff
+			return b
+		}(), wire.CodeProtocol},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			nc, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("dial error: %v", err)
+			}
+			defer nc.Close()
+			r := bufio.NewReader(nc)
+			writeRaw(t, nc, tc.raw)
+			f := readRaw(t, nc, r)
+			if f.Type == wire.FrameWelcome {
+				f = readRaw(t, nc, r)
+			}
+			var e wire.Error
+			if f.Type != wire.FrameError || e.Decode(f.Body) != nil || e.Code != tc.want {
+				t.Fatalf("got frame %#x %+v; want error %s", f.Type, e, tc.want)
+			}
+			if _, err := r.ReadByte(); err == nil {
+				t.Error("connection open after the error; want it closed")
+			}
+		})
+	}
+}
+
+var benchPayload = bytes.Repeat([]byte("x"), 256)
+
+// Benchmark publishing over the native protocol against POST /publish
+func BenchmarkPublish(b *testing.B) {
+	b.Run("wire", func(b *testing.B) {
+		_, addr := startApp(b)
+		client := dial(b, addr)
+		ctx := context.Background()
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, err := client.Publish(ctx, broker.Message[any]{Pattern: "telemetry", Data: benchPayload, ContentType: "application/octet-stream"}); err != nil {
+				b.Fatalf("publish error: %v", err)
+			}
+		}
+	})
+
+	b.Run("wire-pipelined", func(b *testing.B) {
+		_, addr := startApp(b)
+		client := dial(b, addr)
+		var wg sync.WaitGroup
+		b.ReportAllocs()
+		for b.Loop() {
+			wg.Add(1)
+			err := client.PublishAsync(broker.Message[any]{Pattern: "telemetry", Data: benchPayload, ContentType: "application/octet-stream"}, func(_ wire.Published, err error) {
+				if err != nil {
+					b.Errorf("publish error: %v", err)
+				}
+				wg.Done()
+			})
+			if err != nil {
+				b.Fatalf("publish error: %v", err)
+			}
+		}
+		wg.Wait()
+	})
+
+	b.Run("http", func(b *testing.B) {
+		vq := broker.NewVortexQ[any]()
+		vq.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		url := startHTTP(b, vq)
+
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := postPublish(url); err != nil {
+				b.Fatalf("publish error: %v", err)
+			}
+		}
+	})
+}
+
+// Benchmark consuming over the native protocol against webhook deliveries of
+// messages published with POST /publish, from publish until the consumer got it
+func BenchmarkConsume(b *testing.B) {
+	b.Run("wire", func(b *testing.B) {
+		_, addr := startApp(b)
+		client := dial(b, addr)
+		ctx := context.Background()
+		sub, err := client.Subscribe(ctx, "telemetry", wire.SubscribeOptions{AutoAck: true})
+		if err != nil {
+			b.Fatalf("subscribe error: %v", err)
+		}
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		go func() {
+			for range b.N {
+				if err := client.PublishAsync(broker.Message[any]{Pattern: "telemetry", Data: benchPayload, ContentType: "application/octet-stream"}, nil); err != nil {
+					b.Errorf("publish error: %v", err)
+					return
+				}
+			}
+		}()
+		for range b.N {
+			if _, err := sub.Receive(ctx); err != nil {
+				b.Fatalf("receive error: %v", err)
+			}
+		}
+	})
+
+	b.Run("http", func(b *testing.B) {
+		received := make(chan struct{}, 1024)
+		subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(io.Discard, r.Body)
+			received <- struct{}{}
+		}))
+		defer subscriber.Close()
+
+		vq := broker.NewVortexQ[any]()
+		vq.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+		if err := vq.Subscribe(broker.Subscription{ID: "bench", SubscriberAddress: subscriber.URL, TopicName: "telemetry"}); err != nil {
+			b.Fatalf("subscribe error: %v", err)
+		}
+		url := startHTTP(b, vq)
+		ctx, cancel := context.WithCancel(context.Background())
+		swirled := make(chan struct{})
+		go func() {
+			defer close(swirled)
+			for ctx.Err() == nil {
+				_ = vq.Swirl()
+				time.Sleep(time.Millisecond)
+			}
+		}()
+		defer func() {
+			cancel()
+			<-swirled
+		}()
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		go func() {
+			for range b.N {
+				if err := postPublish(url); err != nil {
+					b.Errorf("publish error: %v", err)
+					return
+				}
+			}
+		}()
+		for range b.N {
+			<-received
+		}
+	})
+}
+
+// startHTTP serves POST /publish of vq until the test ends, it returns the server URL
+func startHTTP(tb testing.TB, vq *broker.VortexQ[any]) string {
+	tb.Helper()
+	gin.SetMode(gin.TestMode)
+	h := routes.NewVortexQHandler(vq)
+	h.Logger = vq.Logger
+	router := gin.New()
+	router.POST("/publish", h.PublishHandler)
+	server := httptest.NewServer(router)
+	tb.Cleanup(server.Close)
+	return server.URL
+}
+
+// postPublish publishes benchPayload to telemetry with POST /publish
+func postPublish(url string) error {
+	body := fmt.Appendf(nil, `{"pattern":"telemetry","data":%q}`, benchPayload)
+	resp, err := http.Post(url+"/publish", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("publish status = %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package wire_app
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"github.com/ivanbulyk/vortexq/internal/logging"
+	"github.com/ivanbulyk/vortexq/wire"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	_handshakeTimeout = 10 * time.Second
+	_writeWait        = 10 * time.Second
+	_writeQueue       = 256
+	_maxFrameSize     = wire.DefaultMaxFrameSize
+)
+
+// conn is a client connection, its streams end with it.
+type conn struct {
+	app *App
+	nc  net.Conn
+	log *slog.Logger
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	// out queues the encoded frames for writeLoop, written is closed once it returned
+	out     chan []byte
+	written chan struct{}
+
+	mu         sync.Mutex
+	nextStream uint32
+	streams    map[uint32]*stream
+}
+
+// stream is a subscription consumed by the connection.
+type stream struct {
+	id     uint32
+	cancel context.CancelFunc
+	// done is closed once forward returned
+	done chan struct{}
+
+	mu     sync.Mutex
+	credit uint32
+	// granted wakes forward when credit was added
+	granted chan struct{}
+}
+
+func (a *App) handle(nc net.Conn) {
+	const op = "wire_app.App.handle"
+
+	c := &conn{
+		app:     a,
+		nc:      nc,
+		log:     a.log.With(slog.String("remote", nc.RemoteAddr().String())),
+		out:     make(chan []byte, _writeQueue),
+		written: make(chan struct{}),
+		streams: make(map[uint32]*stream),
+	}
+	c.ctx, c.cancel = context.WithCancel(a.server.Context())
+	defer c.cancel()
+	defer nc.Close()
+
+	r := bufio.NewReaderSize(nc, 64<<10)
+	if err := c.handshake(r); err != nil {
+		c.log.With(slog.String("op", op)).Warn("wire handshake failed", logging.Err(err))
+		return
+	}
+	go c.writeLoop()
+
+	err := c.serve(r)
+	var we *wire.Error
+	switch {
+	case errors.As(err, &we):
+		c.reply(we.Append(nil))
+	case isProtocolError(err):
+		c.reply((&wire.Error{Code: wire.CodeProtocol, Message: err.Error()}).Append(nil))
+	}
+	c.end()
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		c.log.With(slog.String("op", op)).Warn("wire connection failed", logging.Err(err))
+	}
+}
+
+// handshake answers the Hello of the client with the highest version both speak.
+func (c *conn) handshake(r *bufio.Reader) error {
+	_ = c.nc.SetDeadline(time.Now().Add(_handshakeTimeout))
+	defer func() { _ = c.nc.SetDeadline(time.Time{}) }()
+
+	var hello wire.Hello
+	f, err := wire.ReadFrame(r, _maxFrameSize)
+	switch {
+	case err != nil:
+	case f.Type != wire.FrameHello:
+		err = fmt.Errorf("%w: expected hello, got %#x", wire.ErrMalformed, f.Type)
+	default:
+		err = hello.Decode(f.Body)
+	}
+	if err != nil {
+		if isProtocolError(err) {
+			_, _ = c.nc.Write((&wire.Error{Code: wire.CodeProtocol, Message: err.Error()}).Append(nil))
+		}
+		return err
+	}
+	version := min(hello.MaxVersion, wire.MaxVersion)
+	if version < hello.MinVersion || version < wire.Version1 {
+		e := &wire.Error{Code: wire.CodeUnsupportedVersion,
+			Message: fmt.Sprintf("versions %d to %d are supported", wire.Version1, wire.MaxVersion)}
+		_, _ = c.nc.Write(e.Append(nil))
+		return e
+	}
+	welcome := wire.Welcome{Version: version, MaxFrameSize: _maxFrameSize}
+	_, err = c.nc.Write(welcome.Append(nil))
+	return err
+}
+
+// isProtocolError reports whether err is answered with CodeProtocol.
+func isProtocolError(err error) bool {
+	return errors.Is(err, wire.ErrMalformed) || errors.Is(err, wire.ErrChecksum) || errors.Is(err, wire.ErrFrameTooLarge)
+}
+
+// serve runs the frames of the client until it disconnects.
+func (c *conn) serve(r *bufio.Reader) error {
+	for {
+		f, err := wire.ReadFrame(r, _maxFrameSize)
+		if err != nil {
+			return err
+		}
+		switch f.Type {
+		case wire.FramePublish:
+			err = c.publish(f)
+		case wire.FrameSubscribe:
+			err = c.subscribe(f)
+		case wire.FrameUnsubscribe:
+			err = c.unsubscribe(f)
+		case wire.FrameCredit:
+			err = c.grant(f)
+		case wire.FrameAck, wire.FrameNack:
+			err = c.settle(f)
+		default:
+			err = &wire.Error{Code: wire.CodeProtocol, Message: fmt.Sprintf("unexpected frame %#x", f.Type)}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// writeLoop writes the queued frames until out is closed, a failed write cancels
+// the connection so that nobody waits to queue more.
+func (c *conn) writeLoop() {
+	defer close(c.written)
+	w := bufio.NewWriterSize(c.nc, 64<<10)
+	for b := range c.out {
+		_ = c.nc.SetWriteDeadline(time.Now().Add(_writeWait))
+		_, err := w.Write(b)
+		// write what is queued before flushing, so that pipelined replies share packets
+		if err == nil && len(c.out) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			c.cancel()
+			_ = c.nc.Close()
+			return
+		}
+	}
+}
+
+// reply queues a frame, it blocks while the client doesn't read its replies.
+func (c *conn) reply(b []byte) bool {
+	select {
+	case c.out <- b:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// failure answers the request seq with err, broker errors map onto error codes.
+func failure(seq uint64, err error) []byte {
+	code := wire.CodeInternal
+	switch {
+	case errors.Is(err, broker.ErrNotFound):
+		code = wire.CodeNotFound
+	case errors.Is(err, broker.ErrConsumerAttached):
+		code = wire.CodeConflict
+	case errors.Is(err, broker.ErrInvalidSubscription), errors.Is(err, broker.ErrInvalidTopic):
+		code = wire.CodeInvalid
+	}
+	return (&wire.Error{Seq: seq, Code: code, Message: err.Error()}).Append(nil)
+}
+
+func (c *conn) publish(f wire.Frame) error {
+	const op = "wire_app.conn.publish"
+
+	var p wire.Publish
+	if err := p.Decode(f.Body); err != nil {
+		return err
+	}
+	msg := p.Message
+	if msg.ID == "" {
+		msg.ID = broker.NewID()
+	}
+	msg.Offset = 0
+	offset, err := c.app.funcs.Publish(msg)
+	if err != nil {
+		c.reply(failure(p.Seq, err))
+		return nil
+	}
+	if p.NoReply {
+		return nil
+	}
+	published := wire.Published{Seq: p.Seq, ID: msg.ID, Offset: offset}
+	if !c.reply(published.Append(nil)) {
+		c.log.With(slog.String("op", op)).Debug("connection ended before the reply", slog.String("message", msg.ID))
+	}
+	return nil
+}
+
+func (c *conn) subscribe(f wire.Frame) error {
+	const op = "wire_app.conn.subscribe"
+
+	var s wire.Subscribe
+	if err := s.Decode(f.Body); err != nil {
+		return err
+	}
+	if s.Topic == "" {
+		c.reply((&wire.Error{Seq: s.Seq, Code: wire.CodeInvalid, Message: "topic is required"}).Append(nil))
+		return nil
+	}
+	if s.Credit == 0 {
+		c.reply((&wire.Error{Seq: s.Seq, Code: wire.CodeInvalid, Message: "credit is required"}).Append(nil))
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(c.ctx)
+	deliveries, err := c.app.funcs.Consume(ctx,
+		broker.Subscription{ID: s.SubscriptionID, TopicName: s.Topic, Protocol: Protocol},
+		broker.ConsumeOptions{MaxInFlight: int(s.MaxInFlight), AutoAck: s.AutoAck})
+	if err != nil {
+		cancel()
+		c.log.With(slog.String("op", op)).Warn("failed to subscribe", slog.String("topic", s.Topic), logging.Err(err))
+		c.reply(failure(s.Seq, err))
+		return nil
+	}
+
+	c.mu.Lock()
+	c.nextStream++
+	st := &stream{
+		id:      c.nextStream,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+		credit:  s.Credit,
+		granted: make(chan struct{}, 1),
+	}
+	c.streams[st.id] = st
+	c.mu.Unlock()
+
+	// Subscribed is queued before the first delivery of the stream
+	c.reply((&wire.Subscribed{Seq: s.Seq, Stream: st.id}).Append(nil))
+	go c.forward(ctx, st, deliveries)
+	return nil
+}
+
+// forward sends the deliveries of a stream while the client has credit for them.
+func (c *conn) forward(ctx context.Context, st *stream, deliveries <-chan broker.Delivery[any]) {
+	const op = "wire_app.conn.forward"
+	defer close(st.done)
+
+	for {
+		if !st.take(ctx) {
+			return
+		}
+		var d broker.Delivery[any]
+		select {
+		case delivery, ok := <-deliveries:
+			if !ok {
+				return
+			}
+			d = delivery
+		case <-ctx.Done():
+			return
+		}
+		dl := wire.Delivery{Stream: st.id, Attempt: uint16(min(d.Attempt, 1<<16-1)), AckToken: d.AckToken, Message: d.Message}
+		b, err := dl.Append(nil)
+		if err != nil {
+			c.log.With(slog.String("op", op)).Warn("can't encode message", slog.String("message", d.Message.ID), logging.Err(err))
+			if d.AckToken != "" {
+				_ = c.app.funcs.Nack(d.AckToken)
+			}
+			st.give(1)
+			continue
+		}
+		if !c.reply(b) {
+			if d.AckToken != "" {
+				_ = c.app.funcs.Nack(d.AckToken)
+			}
+			return
+		}
+	}
+}
+
+// take uses one credit, waiting for the client to grant it.
+func (st *stream) take(ctx context.Context) bool {
+	for {
+		st.mu.Lock()
+		if st.credit > 0 {
+			st.credit--
+			st.mu.Unlock()
+			return true
+		}
+		st.mu.Unlock()
+		select {
+		case <-st.granted:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (st *stream) give(n uint32) {
+	st.mu.Lock()
+	st.credit = uint32(min(uint64(st.credit)+uint64(n), 1<<32-1))
+	st.mu.Unlock()
+	select {
+	case st.granted <- struct{}{}:
+	default:
+	}
+}
+
+func (c *conn) grant(f wire.Frame) error {
+	var cr wire.Credit
+	if err := cr.Decode(f.Body); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	st, ok := c.streams[cr.Stream]
+	c.mu.Unlock()
+	// credit may cross the Unsubscribed of its stream
+	if ok {
+		st.give(cr.Credit)
+	}
+	return nil
+}
+
+func (c *conn) unsubscribe(f wire.Frame) error {
+	var u wire.Unsubscribe
+	if err := u.Decode(f.Body); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	st, ok := c.streams[u.Stream]
+	delete(c.streams, u.Stream)
+	c.mu.Unlock()
+	if !ok {
+		c.reply((&wire.Error{Seq: u.Seq, Code: wire.CodeNotFound, Message: fmt.Sprintf("stream %d not found", u.Stream)}).Append(nil))
+		return nil
+	}
+	st.cancel()
+	// no delivery of the stream follows Unsubscribed
+	<-st.done
+	c.reply((&wire.Unsubscribed{Seq: u.Seq}).Append(nil))
+	return nil
+}
+
+// settle acks or nacks a batch of deliveries, tokens that were settled already are skipped.
+func (c *conn) settle(f wire.Frame) error {
+	var s wire.Settle
+	if err := s.Decode(f.Type, f.Body); err != nil {
+		return err
+	}
+	settle := c.app.funcs.Ack
+	if s.Nack {
+		settle = c.app.funcs.Nack
+	}
+	for _, token := range s.Tokens {
+		_ = settle(token)
+	}
+	return nil
+}
+
+// end stops the streams and waits for the queued frames to be written.
+func (c *conn) end() {
+	c.mu.Lock()
+	streams := c.streams
+	c.streams = make(map[uint32]*stream)
+	c.mu.Unlock()
+	for _, st := range streams {
+		st.cancel()
+		<-st.done
+	}
+	// nothing queues frames anymore
+	close(c.out)
+	<-c.written
+}
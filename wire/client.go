@@ -0,0 +1,509 @@
+package wire
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCredit is the credit of a subscription unless SubscribeOptions sets it
+	DefaultCredit = 256
+
+	// maxSettleTokens bounds the tokens of one Ack or Nack frame
+	maxSettleTokens = 4096
+	_writeQueue     = 256
+)
+
+// ErrClosed is returned once the client is closed.
+var ErrClosed = errors.New("wire: client closed")
+
+// Client is a connection to the native protocol listener, it is safe for
+// concurrent use and pipelines the requests of all goroutines.
+type Client struct {
+	nc      net.Conn
+	version uint8
+	// maxFrameSize is the limit announced by the server
+	maxFrameSize int
+
+	out  chan []byte
+	done chan struct{}
+	err  error
+	once sync.Once
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]func(Frame, error)
+	streams map[uint32]*Subscription
+}
+
+// Dial connects to addr and negotiates the protocol version.
+func Dial(ctx context.Context, addr string) (*Client, error) {
+	const op = "wire.Dial"
+
+	var dialer net.Dialer
+	nc, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = nc.SetDeadline(deadline)
+	}
+	r := bufio.NewReader(nc)
+	welcome, err := handshake(nc, r)
+	if err != nil {
+		_ = nc.Close()
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	_ = nc.SetDeadline(time.Time{})
+
+	c := &Client{
+		nc:           nc,
+		version:      welcome.Version,
+		maxFrameSize: int(welcome.MaxFrameSize),
+		out:          make(chan []byte, _writeQueue),
+		done:         make(chan struct{}),
+		pending:      make(map[uint64]func(Frame, error)),
+		streams:      make(map[uint32]*Subscription),
+	}
+	go c.readLoop(r)
+	go c.writeLoop()
+	return c, nil
+}
+
+func handshake(nc net.Conn, r *bufio.Reader) (Welcome, error) {
+	hello := Hello{MinVersion: Version1, MaxVersion: MaxVersion}
+	if _, err := nc.Write(hello.Append(nil)); err != nil {
+		return Welcome{}, err
+	}
+	f, err := ReadFrame(r, DefaultMaxFrameSize)
+	if err != nil {
+		return Welcome{}, err
+	}
+	var welcome Welcome
+	switch f.Type {
+	case FrameWelcome:
+		err = welcome.Decode(f.Body)
+	case FrameError:
+		e := &Error{}
+		if err = e.Decode(f.Body); err == nil {
+			err = e
+		}
+	default:
+		err = fmt.Errorf("%w: unexpected frame %#x", ErrMalformed, f.Type)
+	}
+	return welcome, err
+}
+
+// Version is the negotiated protocol version.
+func (c *Client) Version() uint8 {
+	return c.version
+}
+
+// Close closes the connection, pending requests fail with ErrClosed.
+func (c *Client) Close() error {
+	c.fail(ErrClosed)
+	return nil
+}
+
+// fail ends the connection with err, the first error wins.
+func (c *Client) fail(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		_ = c.nc.Close()
+
+		c.mu.Lock()
+		pending, streams := c.pending, c.streams
+		c.pending, c.streams = nil, nil
+		c.mu.Unlock()
+		for _, callback := range pending {
+			callback(Frame{}, err)
+		}
+		for _, s := range streams {
+			close(s.ch)
+		}
+	})
+}
+
+func (c *Client) writeLoop() {
+	w := bufio.NewWriterSize(c.nc, 64<<10)
+	for {
+		select {
+		case b := <-c.out:
+			if _, err := w.Write(b); err != nil {
+				c.fail(err)
+				return
+			}
+			// write what is queued before flushing, so that pipelined frames share packets
+			if len(c.out) == 0 {
+				if err := w.Flush(); err != nil {
+					c.fail(err)
+					return
+				}
+			}
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *Client) send(b []byte) error {
+	if len(b) > c.maxFrameSize {
+		return fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, len(b))
+	}
+	select {
+	case c.out <- b:
+		return nil
+	case <-c.done:
+		return c.err
+	}
+}
+
+func (c *Client) readLoop(r *bufio.Reader) {
+	for {
+		f, err := ReadFrame(r, DefaultMaxFrameSize)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if err := c.dispatch(f); err != nil {
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// dispatch hands a frame to the request or the stream it belongs to.
+func (c *Client) dispatch(f Frame) error {
+	var seq uint64
+	switch f.Type {
+	case FrameDelivery:
+		var d Delivery
+		if err := d.Decode(f.Body); err != nil {
+			return err
+		}
+		// the lock keeps Close from closing the channel during the send, which never blocks
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		s, ok := c.streams[d.Stream]
+		if !ok {
+			// the stream was unsubscribed while the delivery was sent
+			return nil
+		}
+		select {
+		case s.ch <- d:
+			return nil
+		default:
+			return fmt.Errorf("%w: delivery beyond the granted credit", ErrMalformed)
+		}
+	case FramePublished:
+		var p Published
+		if err := p.Decode(f.Body); err != nil {
+			return err
+		}
+		seq = p.Seq
+	case FrameSubscribed:
+		var s Subscribed
+		if err := s.Decode(f.Body); err != nil {
+			return err
+		}
+		seq = s.Seq
+	case FrameUnsubscribed:
+		var u Unsubscribed
+		if err := u.Decode(f.Body); err != nil {
+			return err
+		}
+		seq = u.Seq
+	case FrameError:
+		e := &Error{}
+		if err := e.Decode(f.Body); err != nil {
+			return err
+		}
+		if e.Seq == 0 {
+			return e
+		}
+		seq = e.Seq
+	default:
+		return fmt.Errorf("%w: unexpected frame %#x", ErrMalformed, f.Type)
+	}
+
+	c.mu.Lock()
+	callback, ok := c.pending[seq]
+	delete(c.pending, seq)
+	c.mu.Unlock()
+	if ok {
+		callback(f, nil)
+	}
+	return nil
+}
+
+// request registers callback for the reply of the frame built by build.
+func (c *Client) request(build func(seq uint64) ([]byte, error), callback func(Frame, error)) error {
+	c.mu.Lock()
+	c.seq++
+	seq := c.seq
+	c.mu.Unlock()
+	b, err := build(seq)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.pending == nil {
+		c.mu.Unlock()
+		return c.err
+	}
+	if callback != nil {
+		c.pending[seq] = callback
+	}
+	c.mu.Unlock()
+
+	if err := c.send(b); err != nil {
+		c.mu.Lock()
+		delete(c.pending, seq)
+		c.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// call sends a request and waits for its reply.
+func (c *Client) call(ctx context.Context, build func(seq uint64) ([]byte, error)) (Frame, error) {
+	replies := make(chan Frame, 1)
+	errs := make(chan error, 1)
+	err := c.request(build, func(f Frame, err error) {
+		if err != nil {
+			errs <- err
+			return
+		}
+		replies <- f
+	})
+	if err != nil {
+		return Frame{}, err
+	}
+	select {
+	case f := <-replies:
+		if f.Type == FrameError {
+			e := &Error{}
+			if err := e.Decode(f.Body); err != nil {
+				return Frame{}, err
+			}
+			return Frame{}, e
+		}
+		return f, nil
+	case err := <-errs:
+		return Frame{}, err
+	case <-ctx.Done():
+		return Frame{}, ctx.Err()
+	}
+}
+
+// Publish publishes msg and waits for the server to confirm it, concurrent calls are pipelined.
+func (c *Client) Publish(ctx context.Context, msg broker.Message[any]) (Published, error) {
+	const op = "wire.Client.Publish"
+
+	f, err := c.call(ctx, func(seq uint64) ([]byte, error) {
+		p := Publish{Seq: seq, Message: msg}
+		return p.Append(nil)
+	})
+	if err != nil {
+		return Published{}, fmt.Errorf("%s: %w", op, err)
+	}
+	var published Published
+	if err := published.Decode(f.Body); err != nil {
+		return Published{}, fmt.Errorf("%s: %w", op, err)
+	}
+	return published, nil
+}
+
+// PublishAsync publishes msg without waiting, done is called from the reading
+// goroutine once the server confirmed the message and must not block. Without done
+// the server doesn't confirm the message.
+func (c *Client) PublishAsync(msg broker.Message[any], done func(Published, error)) error {
+	const op = "wire.Client.PublishAsync"
+
+	var callback func(Frame, error)
+	if done != nil {
+		callback = func(f Frame, err error) {
+			var published Published
+			switch {
+			case err != nil:
+			case f.Type == FrameError:
+				e := &Error{}
+				if err = e.Decode(f.Body); err == nil {
+					err = e
+				}
+			default:
+				err = published.Decode(f.Body)
+			}
+			done(published, err)
+		}
+	}
+	err := c.request(func(seq uint64) ([]byte, error) {
+		p := Publish{Seq: seq, NoReply: done == nil, Message: msg}
+		return p.Append(nil)
+	}, callback)
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
+
+// Ack settles deliveries by their ack tokens, many tokens are sent in one frame.
+func (c *Client) Ack(tokens ...string) error {
+	return c.settle(false, tokens)
+}
+
+// Nack hands deliveries back to the broker to be retried.
+func (c *Client) Nack(tokens ...string) error {
+	return c.settle(true, tokens)
+}
+
+func (c *Client) settle(nack bool, tokens []string) error {
+	for len(tokens) > 0 {
+		n := min(len(tokens), maxSettleTokens)
+		s := Settle{Nack: nack, Tokens: tokens[:n]}
+		if err := c.send(s.Append(nil)); err != nil {
+			return err
+		}
+		tokens = tokens[n:]
+	}
+	return nil
+}
+
+// SubscribeOptions configures a subscription stream.
+type SubscribeOptions struct {
+	// SubscriptionID names a durable subscription, without it the subscription ends with the stream
+	SubscriptionID string
+	// AutoAck settles deliveries once they are sent
+	AutoAck bool
+	// Credit is the number of deliveries the server sends ahead of Receive, DefaultCredit if zero
+	Credit uint32
+	// MaxInFlight bounds the unacked deliveries, the broker default if zero
+	MaxInFlight uint32
+}
+
+// Subscription receives the deliveries of a stream.
+type Subscription struct {
+	c      *Client
+	stream uint32
+	credit uint32
+	ch     chan Delivery
+
+	mu sync.Mutex
+	// consumed counts the deliveries received since credit was last granted
+	consumed uint32
+}
+
+// Subscribe consumes topic, which may be a pattern.
+func (c *Client) Subscribe(ctx context.Context, topic string, opts SubscribeOptions) (*Subscription, error) {
+	const op = "wire.Client.Subscribe"
+
+	if opts.Credit == 0 {
+		opts.Credit = DefaultCredit
+	}
+	// the stream is registered together with the reply, before its first delivery is read
+	s := &Subscription{c: c, credit: opts.Credit, ch: make(chan Delivery, opts.Credit)}
+	replies := make(chan error, 1)
+	err := c.request(func(seq uint64) ([]byte, error) {
+		sub := Subscribe{Seq: seq, SubscriptionID: opts.SubscriptionID, Topic: topic,
+			AutoAck: opts.AutoAck, Credit: opts.Credit, MaxInFlight: opts.MaxInFlight}
+		return sub.Append(nil), nil
+	}, func(f Frame, err error) {
+		if err == nil {
+			err = s.register(f)
+		}
+		replies <- err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	select {
+	case err = <-replies:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	return s, nil
+}
+
+// register adds the stream confirmed by f, it runs on the reading goroutine.
+func (s *Subscription) register(f Frame) error {
+	if f.Type == FrameError {
+		e := &Error{}
+		if err := e.Decode(f.Body); err != nil {
+			return err
+		}
+		return e
+	}
+	var subscribed Subscribed
+	if err := subscribed.Decode(f.Body); err != nil {
+		return err
+	}
+	s.stream = subscribed.Stream
+	s.c.mu.Lock()
+	defer s.c.mu.Unlock()
+	if s.c.streams == nil {
+		return s.c.err
+	}
+	s.c.streams[s.stream] = s
+	return nil
+}
+
+// Receive returns the next delivery, it grants the server more credit once half
+// of it was used.
+func (s *Subscription) Receive(ctx context.Context) (Delivery, error) {
+	select {
+	case d, ok := <-s.ch:
+		if !ok {
+			if s.c.err != nil {
+				return Delivery{}, s.c.err
+			}
+			return Delivery{}, ErrClosed
+		}
+		s.mu.Lock()
+		s.consumed++
+		grant := uint32(0)
+		if s.consumed >= max(s.credit/2, 1) {
+			grant, s.consumed = s.consumed, 0
+		}
+		s.mu.Unlock()
+		if grant > 0 {
+			credit := Credit{Stream: s.stream, Credit: grant}
+			if err := s.c.send(credit.Append(nil)); err != nil {
+				return d, err
+			}
+		}
+		return d, nil
+	case <-ctx.Done():
+		return Delivery{}, ctx.Err()
+	}
+}
+
+// Close ends the stream, deliveries not acked yet are retried after their ack deadline.
+func (s *Subscription) Close(ctx context.Context) error {
+	const op = "wire.Subscription.Close"
+
+	_, err := s.c.call(ctx, func(seq uint64) ([]byte, error) {
+		u := Unsubscribe{Seq: seq, Stream: s.stream}
+		return u.Append(nil), nil
+	})
+	s.c.mu.Lock()
+	if s.c.streams != nil && s.c.streams[s.stream] == s {
+		delete(s.c.streams, s.stream)
+		close(s.ch)
+	}
+	s.c.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("%s: %w", op, err)
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package wire
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/ivanbulyk/vortexq/broker"
+	"math"
+	"slices"
+	"time"
+)
+
+// Hello opens a connection with the versions the client speaks.
+type Hello struct {
+	MinVersion uint8
+	MaxVersion uint8
+}
+
+func (h *Hello) Append(dst []byte) []byte {
+	dst, start := begin(dst, FrameHello)
+	dst = append(dst, magic[:]...)
+	dst = append(dst, h.MinVersion, h.MaxVersion)
+	return end(dst, start)
+}
+
+func (h *Hello) Decode(body []byte) error {
+	d := decoder{b: body}
+	if m := d.take(len(magic)); d.err == nil && [4]byte(m) != magic {
+		return fmt.Errorf("%w: not a VortexQ hello", ErrMalformed)
+	}
+	h.MinVersion = d.uint8()
+	h.MaxVersion = d.uint8()
+	return d.finish()
+}
+
+// Welcome accepts a connection with the negotiated version.
+type Welcome struct {
+	Version      uint8
+	MaxFrameSize uint32
+}
+
+func (w *Welcome) Append(dst []byte) []byte {
+	dst, start := begin(dst, FrameWelcome)
+	dst = append(dst, w.Version)
+	dst = binary.BigEndian.AppendUint32(dst, w.MaxFrameSize)
+	return end(dst, start)
+}
+
+func (w *Welcome) Decode(body []byte) error {
+	d := decoder{b: body}
+	w.Version = d.uint8()
+	w.MaxFrameSize = d.uint32()
+	return d.finish()
+}
+
+// Publish publishes a message, it is confirmed by Published unless NoReply is set.
+type Publish struct {
+	Seq     uint64
+	NoReply bool
+	Message broker.Message[any]
+}
+
+func (p *Publish) Append(dst []byte) ([]byte, error) {
+	dst, start := begin(dst, FramePublish)
+	dst = binary.BigEndian.AppendUint64(dst, p.Seq)
+	dst = appendBool(dst, p.NoReply)
+	dst, err := appendMessage(dst, p.Message)
+	if err != nil {
+		return dst[:start], err
+	}
+	return end(dst, start), nil
+}
+
+func (p *Publish) Decode(body []byte) error {
+	d := decoder{b: body}
+	p.Seq = d.uint64()
+	p.NoReply = d.bool()
+	p.Message = d.message()
+	return d.finish()
+}
+
+// Published confirms a Publish with the ID and offset of the message.
+type Published struct {
+	Seq    uint64
+	ID     string
+	Offset int64
+}
+
+func (p *Published) Append(dst []byte) []byte {
+	dst, start := begin(dst, FramePublished)
+	dst = binary.BigEndian.AppendUint64(dst, p.Seq)
+	dst = appendString(dst, p.ID)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(p.Offset))
+	return end(dst, start)
+}
+
+func (p *Published) Decode(body []byte) error {
+	d := decoder{b: body}
+	p.Seq = d.uint64()
+	p.ID = d.string()
+	p.Offset = int64(d.uint64())
+	return d.finish()
+}
+
+// Subscribe consumes a topic or pattern, an empty SubscriptionID subscribes for
+// the lifetime of the stream. Credit is the number of deliveries the server may
+// send before the client grants more.
+type Subscribe struct {
+	Seq            uint64
+	SubscriptionID string
+	Topic          string
+	AutoAck        bool
+	Credit         uint32
+	MaxInFlight    uint32
+}
+
+func (s *Subscribe) Append(dst []byte) []byte {
+	dst, start := begin(dst, FrameSubscribe)
+	dst = binary.BigEndian.AppendUint64(dst, s.Seq)
+	dst = appendString(dst, s.SubscriptionID)
+	dst = appendString(dst, s.Topic)
+	dst = appendBool(dst, s.AutoAck)
+	dst = binary.BigEndian.AppendUint32(dst, s.Credit)
+	dst = binary.BigEndian.AppendUint32(dst, s.MaxInFlight)
+	return end(dst, start)
+}
+
+func (s *Subscribe) Decode(body []byte) error {
+	d := decoder{b: body}
+	s.Seq = d.uint64()
+	s.SubscriptionID = d.string()
+	s.Topic = d.string()
+	s.AutoAck = d.bool()
+	s.Credit = d.uint32()
+	s.MaxInFlight = d.uint32()
+	return d.finish()
+}
+
+// Subscribed confirms a Subscribe with the stream its deliveries are sent on.
+type Subscribed struct {
+	Seq    uint64
+	Stream uint32
+}
+
+func (s *Subscribed) Append(dst []byte) []byte {
+	dst, start := begin(dst, FrameSubscribed)
+	dst = binary.BigEndian.AppendUint64(dst, s.Seq)
+	dst = binary.BigEndian.AppendUint32(dst, s.Stream)
+	return end(dst, start)
+}
+
+func (s *Subscribed) Decode(body []byte) error {
+	d := decoder{b: body}
+	s.Seq = d.uint64()
+	s.Stream = d.uint32()
+	return d.finish()
+}
+
+// Unsubscribe ends a stream, it is confirmed by Unsubscribed which is the last
+// frame of the stream.
+type Unsubscribe struct {
+	Seq    uint64
+	Stream uint32
+}
+
+func (u *Unsubscribe) Append(dst []byte) []byte {
+	dst, start := begin(dst, FrameUnsubscribe)
+	dst = binary.BigEndian.AppendUint64(dst, u.Seq)
+	dst = binary.BigEndian.AppendUint32(dst, u.Stream)
+	return end(dst, start)
+}
+
+func (u *Unsubscribe) Decode(body []byte) error {
+	d := decoder{b: body}
+	u.Seq = d.uint64()
+	u.Stream = d.uint32()
+	return d.finish()
+}
+
+// Unsubscribed confirms an Unsubscribe.
+type Unsubscribed struct {
+	Seq uint64
+}
+
+func (u *Unsubscribed) Append(dst []byte) []byte {
+	dst, start := begin(dst, FrameUnsubscribed)
+	dst = binary.BigEndian.AppendUint64(dst, u.Seq)
+	return end(dst, start)
+}
+
+func (u *Unsubscribed) Decode(body []byte) error {
+	d := decoder{b: body}
+	u.Seq = d.uint64()
+	return d.finish()
+}
+
+// Credit allows the server to send more deliveries on a stream.
+type Credit struct {
+	Stream uint32
+	Credit uint32
+}
+
+func (c *Credit) Append(dst []byte) []byte {
+	dst, start := begin(dst, FrameCredit)
+	dst = binary.BigEndian.AppendUint32(dst, c.Stream)
+	dst = binary.BigEndian.AppendUint32(dst, c.Credit)
+	return end(dst, start)
+}
+
+func (c *Credit) Decode(body []byte) error {
+	d := decoder{b: body}
+	c.Stream = d.uint32()
+	c.Credit = d.uint32()
+	return d.finish()
+}
+
+// Delivery is a message sent on a stream, AckToken is empty when auto acked.
+type Delivery struct {
+	Stream   uint32
+	Attempt  uint16
+	AckToken string
+	Message  broker.Message[any]
+}
+
+func (dl *Delivery) Append(dst []byte) ([]byte, error) {
+	dst, start := begin(dst, FrameDelivery)
+	dst = binary.BigEndian.AppendUint32(dst, dl.Stream)
+	dst = binary.BigEndian.AppendUint16(dst, dl.Attempt)
+	dst = appendString(dst, dl.AckToken)
+	dst, err := appendMessage(dst, dl.Message)
+	if err != nil {
+		return dst[:start], err
+	}
+	return end(dst, start), nil
+}
+
+func (dl *Delivery) Decode(body []byte) error {
+	d := decoder{b: body}
+	dl.Stream = d.uint32()
+	dl.Attempt = d.uint16()
+	dl.AckToken = d.string()
+	dl.Message = d.message()
+	return d.finish()
+}
+
+// Settle acks or nacks deliveries in one frame, there is no reply.
+type Settle struct {
+	Nack   bool
+	Tokens []string
+}
+
+func (s *Settle) Append(dst []byte) []byte {
+	t := FrameAck
+	if s.Nack {
+		t = FrameNack
+	}
+	dst, start := begin(dst, t)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(s.Tokens)))
+	for _, token := range s.Tokens {
+		dst = appendString(dst, token)
+	}
+	return end(dst, start)
+}
+
+// Decode reads the tokens of an Ack or Nack frame.
+func (s *Settle) Decode(t FrameType, body []byte) error {
+	d := decoder{b: body}
+	s.Nack = t == FrameNack
+	n := d.uint32()
+	// every token takes at least its length
+	if int(n) > len(d.b)/2 {
+		return fmt.Errorf("%w: %d tokens", ErrMalformed, n)
+	}
+	s.Tokens = make([]string, n)
+	for i := range s.Tokens {
+		s.Tokens[i] = d.string()
+	}
+	return d.finish()
+}
+
+// Messages are encoded field by field, strings and data with their length.
+func appendMessage(dst []byte, msg broker.Message[any]) ([]byte, error) {
+	data, contentType := []byte(nil), msg.ContentType
+	if msg.Data != nil {
+		var err error
+		if data, contentType, err = msg.Payload(); err != nil {
+			return dst, err
+		}
+	}
+	if len(msg.Headers) > math.MaxUint16 {
+		return dst, fmt.Errorf("%w: %d headers", ErrFrameTooLarge, len(msg.Headers))
+	}
+	dst = appendString(dst, msg.ID)
+	dst = appendString(dst, msg.Pattern)
+	dst = appendString(dst, contentType)
+	dst = appendString(dst, msg.Source)
+	dst = appendString(dst, msg.Type)
+	dst = appendString(dst, msg.CorrelationID)
+	dst = appendString(dst, msg.ReplyTo)
+	var unixNano int64
+	if !msg.Time.IsZero() {
+		unixNano = msg.Time.UnixNano()
+	}
+	dst = binary.BigEndian.AppendUint64(dst, uint64(unixNano))
+	dst = binary.BigEndian.AppendUint64(dst, uint64(msg.Offset))
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(msg.Headers)))
+	keys := make([]string, 0, len(msg.Headers))
+	for k := range msg.Headers {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		dst = appendString(dst, k)
+		dst = appendString(dst, msg.Headers[k])
+	}
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(data)))
+	return append(dst, data...), nil
+}
+
+func (d *decoder) message() broker.Message[any] {
+	msg := broker.Message[any]{
+		ID:            d.string(),
+		Pattern:       d.string(),
+		ContentType:   d.string(),
+		Source:        d.string(),
+		Type:          d.string(),
+		CorrelationID: d.string(),
+		ReplyTo:       d.string(),
+	}
+	if unixNano := int64(d.uint64()); unixNano != 0 {
+		msg.Time = time.Unix(0, unixNano).UTC()
+	}
+	msg.Offset = int64(d.uint64())
+	if n := int(d.uint16()); n > 0 {
+		msg.Headers = make(map[string]string, n)
+		for range n {
+			k := d.string()
+			msg.Headers[k] = d.string()
+		}
+	}
+	data := d.take(int(d.uint32()))
+	if d.err == nil {
+		if err := msg.SetPayload(data); err != nil {
+			d.err = fmt.Errorf("%w: message data: %v", ErrMalformed, err)
+		}
+	}
+	return msg
+}
+
+func appendBool(dst []byte, v bool) []byte {
+	if v {
+		return append(dst, 1)
+	}
+	return append(dst, 0)
+}
+
+func appendString(dst []byte, s string) []byte {
+	if len(s) > math.MaxUint16 {
+		s = s[:math.MaxUint16]
+	}
+	dst = binary.BigEndian.AppendUint16(dst, uint16(len(s)))
+	return append(dst, s...)
+}
+
+// decoder reads the fields of a body, the first error sticks.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.b) {
+		d.err = fmt.Errorf("%w: truncated body", ErrMalformed)
+		return nil
+	}
+	v := d.b[:n]
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) uint8() uint8 {
+	if b := d.take(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (d *decoder) bool() bool { return d.uint8() != 0 }
+
+func (d *decoder) uint16() uint16 {
+	if b := d.take(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint32() uint32 {
+	if b := d.take(4); b != nil {
+		return binary.BigEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (d *decoder) uint64() uint64 {
+	if b := d.take(8); b != nil {
+		return binary.BigEndian.Uint64(b)
+	}
+	return 0
+}
+
+func (d *decoder) string() string {
+	return string(d.take(int(d.uint16())))
+}
+
+// finish reports the first error or trailing bytes.
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.b) > 0 {
+		d.err = fmt.Errorf("%w: %d trailing bytes", ErrMalformed, len(d.b))
+	}
+	return d.err
+}
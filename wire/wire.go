@@ -0,0 +1,170 @@
+// Package wire is the native binary protocol of VortexQ over TCP.
+//
+// Every frame is length-prefixed and checksummed:
+//
+//	length uint32   big endian, the size of type, body and crc
+//	type   uint8
+//	body   []byte
+//	crc    uint32   CRC-32C of type and body
+//
+// A connection starts with a Hello of the client answered by a Welcome carrying the
+// negotiated version. Publish and Subscribe carry a sequence number that is echoed in
+// their reply, so clients may pipeline them. Deliveries of a subscription are sent
+// while the client granted credit for them, acks and nacks settle many deliveries at once.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// FrameType tells how the body of a frame is encoded.
+type FrameType uint8
+
+const (
+	FrameHello        FrameType = 0x01
+	FrameWelcome      FrameType = 0x02
+	FramePublish      FrameType = 0x10
+	FramePublished    FrameType = 0x11
+	FrameSubscribe    FrameType = 0x20
+	FrameSubscribed   FrameType = 0x21
+	FrameUnsubscribe  FrameType = 0x22
+	FrameUnsubscribed FrameType = 0x23
+	FrameCredit       FrameType = 0x24
+	FrameDelivery     FrameType = 0x30
+	FrameAck          FrameType = 0x31
+	FrameNack         FrameType = 0x32
+	FrameError        FrameType = 0x7f
+)
+
+const (
+	// Version1 is the first version of the protocol
+	Version1 uint8 = 1
+	// MaxVersion is the newest version this package speaks
+	MaxVersion = Version1
+
+	// DefaultMaxFrameSize bounds the frames a peer accepts unless it announces another limit
+	DefaultMaxFrameSize = 16 << 20
+
+	// headerSize is the length and the type, trailerSize the crc
+	headerSize  = 5
+	trailerSize = 4
+)
+
+// magic opens the Hello so that other protocols are refused early.
+var magic = [4]byte{'V', 'Q', 'W', 'P'}
+
+var (
+	// ErrMalformed is returned for frames whose body doesn't decode
+	ErrMalformed = errors.New("malformed frame")
+	// ErrChecksum is returned for frames whose crc doesn't match
+	ErrChecksum = errors.New("frame checksum mismatch")
+	// ErrFrameTooLarge is returned for frames above the size limit
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// Frame is a frame as read from the connection.
+type Frame struct {
+	Type FrameType
+	Body []byte
+}
+
+// ReadFrame reads the next frame, r should be buffered.
+func ReadFrame(r io.Reader, maxSize int) (Frame, error) {
+	var header [headerSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return Frame{}, err
+	}
+	length := int(binary.BigEndian.Uint32(header[:4]))
+	if length < 1+trailerSize {
+		return Frame{}, fmt.Errorf("%w: length %d", ErrMalformed, length)
+	}
+	if length > maxSize {
+		return Frame{}, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	}
+	rest := make([]byte, length-1)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return Frame{}, err
+	}
+	body, sum := rest[:len(rest)-trailerSize], binary.BigEndian.Uint32(rest[len(rest)-trailerSize:])
+	crc := crc32.Update(crc32.Checksum(header[4:], castagnoli), castagnoli, body)
+	if crc != sum {
+		return Frame{}, ErrChecksum
+	}
+	return Frame{Type: FrameType(header[4]), Body: body}, nil
+}
+
+// begin appends the header of a frame, its length is filled in by end.
+func begin(dst []byte, t FrameType) ([]byte, int) {
+	start := len(dst)
+	return append(dst, 0, 0, 0, 0, byte(t)), start
+}
+
+func end(dst []byte, start int) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, crc32.Checksum(dst[start+4:], castagnoli))
+	binary.BigEndian.PutUint32(dst[start:], uint32(len(dst)-start-4))
+	return dst
+}
+
+// ErrorCode classifies the failure reported by an Error frame.
+type ErrorCode uint16
+
+const (
+	CodeProtocol ErrorCode = iota + 1
+	CodeUnsupportedVersion
+	CodeInvalid
+	CodeNotFound
+	CodeConflict
+	CodeInternal
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeProtocol:
+		return "protocol error"
+	case CodeUnsupportedVersion:
+		return "unsupported version"
+	case CodeInvalid:
+		return "invalid request"
+	case CodeNotFound:
+		return "not found"
+	case CodeConflict:
+		return "conflict"
+	case CodeInternal:
+		return "internal error"
+	}
+	return fmt.Sprintf("error %d", uint16(c))
+}
+
+// Error fails the request with the sequence number Seq, a zero Seq fails the
+// connection which is closed afterwards.
+type Error struct {
+	Seq     uint64
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("wire: %s: %s", e.Code, e.Message)
+}
+
+func (e *Error) Append(dst []byte) []byte {
+	dst, start := begin(dst, FrameError)
+	dst = binary.BigEndian.AppendUint64(dst, e.Seq)
+	dst = binary.BigEndian.AppendUint16(dst, uint16(e.Code))
+	dst = appendString(dst, e.Message)
+	return end(dst, start)
+}
+
+func (e *Error) Decode(body []byte) error {
+	d := decoder{b: body}
+	e.Seq = d.uint64()
+	e.Code = ErrorCode(d.uint16())
+	e.Message = d.string()
+	return d.finish()
+}
@@ -0,0 +1,81 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ivanbulyk/vortexq/broker"
+)
+
+func read(t *testing.T, b []byte) Frame {
+	t.Helper()
+	f, err := ReadFrame(bufio.NewReader(bytes.NewReader(b)), DefaultMaxFrameSize)
+	if err != nil {
+		t.Fatalf("ReadFrame error: %v", err)
+	}
+	return f
+}
+
+// Test frames decode into what was encoded
+func TestFrames(t *testing.T) {
+	msg := broker.Message[any]{
+		ID: "m1", Pattern: "orders.created", Data: map[string]any{"n": float64(1)}, ContentType: "application/json",
+		Source: "/shop", Type: "order", Time: time.Unix(1700000000, 5).UTC(), Offset: 7,
+		Headers: map[string]string{"b": "2", "a": "1"}, CorrelationID: "c1", ReplyTo: "replies",
+	}
+	b, err := (&Publish{Seq: 3, NoReply: true, Message: msg}).Append(nil)
+	if err != nil {
+		t.Fatalf("Append error: %v", err)
+	}
+	var p Publish
+	if f := read(t, b); f.Type != FramePublish || p.Decode(f.Body) != nil {
+		t.Fatalf("frame %#x doesn't decode as publish", f.Type)
+	}
+	if p.Seq != 3 || !p.NoReply || !reflect.DeepEqual(p.Message, msg) {
+		t.Errorf("publish = %+v; want %+v", p, msg)
+	}
+
+	// raw payloads keep their bytes
+	b, _ = (&Delivery{Stream: 1, Attempt: 2, AckToken: "t", Message: broker.Message[any]{ID: "m2", Pattern: "bin", Data: []byte{0, 1}, ContentType: "application/octet-stream"}}).Append(nil)
+	var d Delivery
+	if err := d.Decode(read(t, b).Body); err != nil || d.AckToken != "t" || !reflect.DeepEqual(d.Message.Data, []byte{0, 1}) {
+		t.Errorf("delivery = %+v, %v; want the raw payload", d, err)
+	}
+
+	var s Settle
+	b = (&Settle{Nack: true, Tokens: []string{"t1", "t2"}}).Append(nil)
+	if f := read(t, b); s.Decode(f.Type, f.Body) != nil || !s.Nack || !reflect.DeepEqual(s.Tokens, []string{"t1", "t2"}) {
+		t.Errorf("settle = %+v; want a nack of t1 and t2", s)
+	}
+
+	var e Error
+	if err := e.Decode(read(t, (&Error{Seq: 9, Code: CodeConflict, Message: "taken"}).Append(nil)).Body); err != nil || e.Code != CodeConflict || e.Seq != 9 {
+		t.Errorf("error = %+v, %v; want conflict of request 9", e, err)
+	}
+}
+
+// Test corrupted, oversized and truncated frames are refused
+func TestReadFrameErrors(t *testing.T) {
+	valid := (&Credit{Stream: 1, Credit: 10}).Append(nil)
+
+	corrupted := bytes.Clone(valid)
+	corrupted[6] ^= 0xff
+	if _, err := ReadFrame(bytes.NewReader(corrupted), DefaultMaxFrameSize); !errors.Is(err, ErrChecksum) {
+		t.Errorf("corrupted frame error = %v; want ErrChecksum", err)
+	}
+	if _, err := ReadFrame(bytes.NewReader(valid), 4); !errors.Is(err, ErrFrameTooLarge) {
+		t.Errorf("oversized frame error = %v; want ErrFrameTooLarge", err)
+	}
+	var c Credit
+	if err := c.Decode(read(t, valid).Body[:5]); !errors.Is(err, ErrMalformed) {
+		t.Errorf("truncated body error = %v; want ErrMalformed", err)
+	}
+	var h Hello
+	if err := h.Decode([]byte("HTTP\x01\x01")); !errors.Is(err, ErrMalformed) {
+		t.Errorf("hello of another protocol error = %v; want ErrMalformed", err)
+	}
+}